@@ -0,0 +1,243 @@
+// keytool runs maintenance tasks against the HSM configured through the same
+// environment variables as the API server.
+//
+//	keytool backup -label <label> [-out <file>]
+//	keytool restore -in <file> [-token <token>]
+//	keytool reconcile [-clean]
+//	keytool seal-credentials -in <file> -out <file>
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	"open_custodial/pkg/config"
+	"open_custodial/pkg/eth_hsm"
+	"open_custodial/pkg/hsm"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	c := config.NewConfig()
+
+	// sealing credentials runs before the HSM is loaded, the credentials it
+	// logs in with may be the ones being sealed
+	if os.Args[1] == "seal-credentials" {
+		if err := sealCredentials(c, os.Args[2:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	kek, err := c.BackupKEK()
+	if err != nil {
+		fatal(err)
+	}
+
+	var opts []hsm.Option
+	if kek != nil {
+		opts = append(opts, hsm.WithKeyBackup(kek))
+	}
+
+	h, err := hsm.NewHSMFromConfig(c, opts...)
+	if err != nil {
+		fatal(err)
+	}
+
+	// an interrupt abandons the running HSM call instead of killing the
+	// process in the middle of it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch os.Args[1] {
+	case "backup":
+		err = backup(ctx, h, kek, os.Args[2:])
+	case "restore":
+		err = restore(ctx, h, kek, os.Args[2:])
+	case "reconcile":
+		err = reconcile(ctx, h, os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func backup(ctx context.Context, h hsm.HSM, kek []byte, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	label := fs.String("label", "", "label of the key to back up")
+	out := fs.String("out", "", "file to write the backup to, stdout if empty")
+	fs.Parse(args)
+
+	if *label == "" {
+		return errors.New("backup needs -label")
+	}
+
+	if kek == nil {
+		return fmt.Errorf("backup needs %s", config.KeyBackupKEK)
+	}
+
+	b, err := eth_hsm.BackupKey(ctx, h, *label, kek)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		w = f
+	}
+
+	return json.NewEncoder(w).Encode(b)
+}
+
+func restore(ctx context.Context, h hsm.HSM, kek []byte, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := fs.String("in", "", "file to read the backup from")
+	token := fs.String("token", "", "token to restore into, a new token named after the label if empty")
+	fs.Parse(args)
+
+	if *in == "" {
+		return errors.New("restore needs -in")
+	}
+
+	if kek == nil {
+		return fmt.Errorf("restore needs %s", config.KeyBackupKEK)
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	var b eth_hsm.Backup
+	if err := json.NewDecoder(f).Decode(&b); err != nil {
+		return err
+	}
+
+	if *token == "" {
+		*token = b.Label
+	}
+
+	addr, err := eth_hsm.RestoreKey(ctx, h, b, *token, kek)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %s as %s in token %s\n", addr.Hex(), b.Label, *token)
+	return nil
+}
+
+// reconcile lists tokens left behind by failed token creations. With -clean
+// they are wiped and marked as failed, so new tokens reuse them. Run it while
+// no keys are being created, tokens being set up look empty.
+func reconcile(ctx context.Context, h hsm.HSM, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	clean := fs.Bool("clean", false, "wipe orphaned tokens so they can be reused")
+	fs.Parse(args)
+
+	orphans, err := h.Orphans(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range orphans {
+		fmt.Printf("slot %d\t%s\t%s\n", o.SlotID, o.Label, o.Reason)
+
+		if !*clean || o.Reason == hsm.OrphanFailed {
+			continue
+		}
+
+		if err := h.DiscardSlot(ctx, o.Label); err != nil {
+			return fmt.Errorf("unable to clean token %s: %w", o.Label, err)
+		}
+
+		fmt.Printf("slot %d\tcleaned\n", o.SlotID)
+	}
+
+	return nil
+}
+
+// sealCredentials encrypts a JSON file of credentials, keyed like
+// {"cu": {"username": "...", "password": "..."}, "so": {...}}, or
+// "<backend>/cu" for backends, with the passphrase in
+// HSM_CREDENTIALS_PASSPHRASE_FILE
+func sealCredentials(c config.Config, args []string) error {
+	fs := flag.NewFlagSet("seal-credentials", flag.ExitOnError)
+	in := fs.String("in", "", "JSON file of the credentials to seal")
+	out := fs.String("out", "", "file to write the sealed credentials to")
+	fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		return errors.New("seal-credentials needs -in and -out")
+	}
+
+	passphrase, err := c.Passphrase()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	var plain map[string]struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(f).Decode(&plain); err != nil {
+		return fmt.Errorf("unable to read %s: %w", *in, err)
+	}
+
+	creds := make(map[string]config.Credential, len(plain))
+	for key, p := range plain {
+		creds[key] = config.Credential{Username: p.Username, Password: p.Password}
+	}
+
+	sealed, err := config.SealCredentials(creds, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(*out, sealed, 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("sealed %d credentials into %s\n", len(creds), *out)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: keytool backup -label <label> [-out <file>]")
+	fmt.Fprintln(os.Stderr, "       keytool restore -in <file> [-token <token>]")
+	fmt.Fprintln(os.Stderr, "       keytool reconcile [-clean]")
+	fmt.Fprintln(os.Stderr, "       keytool seal-credentials -in <file> -out <file>")
+	os.Exit(2)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
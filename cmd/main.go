@@ -3,28 +3,115 @@ package main
 import (
 	eth_http "open_custodial/module/eth/http"
 	eth_svc "open_custodial/module/eth/service"
+	hsm_http "open_custodial/module/hsm/http"
+	hsm_svc "open_custodial/module/hsm/service"
+	key_http "open_custodial/module/key/http"
+	key_svc "open_custodial/module/key/service"
 	validator_svc "open_custodial/module/validator/service"
 	"open_custodial/pkg/config"
+	eth "open_custodial/pkg/eth_hsm"
 	"open_custodial/pkg/hsm"
+	hsm_repo "open_custodial/pkg/hsm/repository"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
 	c := config.NewConfig()
-	h, err := hsm.NewHSM(c.HSMLibPath, c.CU_USERNAME, c.CU_PASSWORD, c.SO_PASSWORD)
+	kek, err := c.BackupKEK()
 	if err != nil {
 		panic(err)
 	}
 
+	refresh, err := c.IndexRefreshInterval()
+	if err != nil {
+		panic(err)
+	}
+
+	healthCheck, err := c.HealthCheckInterval()
+	if err != nil {
+		panic(err)
+	}
+
+	confirm, err := c.DestroyRequiresConfirmation()
+	if err != nil {
+		panic(err)
+	}
+
+	waitingPeriod, err := c.DestroyWaitingPeriodDuration()
+	if err != nil {
+		panic(err)
+	}
+
+	legacySOPin, err := c.LegacySOPinAllowed()
+	if err != nil {
+		panic(err)
+	}
+
+	var opts []hsm.Option
+	if kek != nil {
+		opts = append(opts, hsm.WithKeyBackup(kek))
+	}
+
+	if refresh > 0 {
+		opts = append(opts, hsm.WithIndexRefresh(refresh))
+	}
+
+	if healthCheck > 0 {
+		opts = append(opts, hsm.WithHealthCheck(healthCheck))
+	}
+
+	if legacySOPin {
+		opts = append(opts, hsm.WithLegacySOPin())
+	}
+
+	for _, op := range hsm.Operations {
+		timeout, err := c.OperationTimeout(string(op))
+		if err != nil {
+			panic(err)
+		}
+
+		if timeout > 0 {
+			opts = append(opts, hsm.WithTimeout(op, timeout))
+		}
+	}
+
+	h, err := hsm.NewHSMFromConfig(c, opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	ethOpts := []eth_svc.Option{eth_svc.WithDestroyPolicy(eth.DestroyPolicy{
+		RequireConfirmation: confirm,
+		WaitingPeriod:       waitingPeriod,
+	})}
+	var keyOpts []key_svc.Option
+
+	if c.KeyRepoPath != "" {
+		repo, err := hsm_repo.NewBoltRepo(c.KeyRepoPath)
+		if err != nil {
+			panic(err)
+		}
+
+		defer repo.Close()
+		ethOpts = append(ethOpts, eth_svc.WithRepo(repo))
+		keyOpts = append(keyOpts, key_svc.WithRepo(repo))
+	}
+
 	validatorSvc := validator_svc.NewValidatorService()
-	ethSvc := eth_svc.NewETHService(h, validatorSvc)
+	ethSvc := eth_svc.NewETHService(h, validatorSvc, ethOpts...)
 	handler := eth_http.NewHandler(ethSvc)
+	keySvc := key_svc.NewKeyService(h, validatorSvc, keyOpts...)
+	keyHandler := key_http.NewHandler(keySvc)
+	hsmHandler := hsm_http.NewHandler(hsm_svc.NewHSMService(h))
 
 	g := gin.Default()
+	g.GET("/debug/vars", hsm_http.SignatureVars)
 	v1 := g.Group("/v1")
 
 	handler.Setup(v1)
+	keyHandler.Setup(v1)
+	hsmHandler.Setup(v1)
 
 	g.Run()
 }
@@ -1,28 +1,107 @@
 package eth_http
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
+	eth_svc "open_custodial/module/eth/service"
 	eth "open_custodial/pkg/eth_hsm"
+	"open_custodial/pkg/hsm"
+	hsm_repo "open_custodial/pkg/hsm/repository"
+	"regexp"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/gin-gonic/gin"
 )
 
 type SignTxForm struct {
+	// Type is the EIP-2718 transaction type, 0 for legacy, 1 for access list
+	// and 2 for dynamic fee transactions
+	Type     uint8          `json:"type"`
 	Nonce    uint64         `json:"nonce"`
 	To       common.Address `json:"to"`
 	Amount   *big.Int       `json:"amount"`
 	GasLimit uint64         `json:"gasLimit"`
 	GasPrice *big.Int       `json:"gasPrice"`
-	Data     []byte         `json:"data"`
-	ChainID  *big.Int       `json:"chaindID"`
-	Label    string         `json:"label"`
+	// MaxFeePerGas and MaxPriorityFeePerGas replace GasPrice in dynamic fee
+	// transactions
+	MaxFeePerGas         *big.Int `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *big.Int `json:"maxPriorityFeePerGas"`
+	Data                 []byte   `json:"data"`
+	ChainID              *big.Int `json:"chaindID"`
+	Label                string   `json:"label"`
+	// AccessList is the EIP-2930 access list of typed transactions
+	AccessList []accessTupleForm `json:"accessList"`
 }
 
+type accessTupleForm struct {
+	Address     string   `json:"address"`
+	StorageKeys []string `json:"storageKeys"`
+}
+
+var (
+	addressPattern    = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+	storageKeyPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{64}$`)
+)
+
 func newSignTxForm(c *gin.Context) (f SignTxForm, err error) {
-	err = c.BindJSON(&f)
-	return f, err
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	for i, tuple := range f.AccessList {
+		if !addressPattern.MatchString(tuple.Address) {
+			return f, fmt.Errorf("accessList[%d].address must be a 0x prefixed 20 byte hex address", i)
+		}
+
+		for j, key := range tuple.StorageKeys {
+			if !storageKeyPattern.MatchString(key) {
+				return f, fmt.Errorf("accessList[%d].storageKeys[%d] must be a 0x prefixed 32 byte hex value", i, j)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+func (f SignTxForm) accessList() types.AccessList {
+	if len(f.AccessList) == 0 {
+		return nil
+	}
+
+	list := make(types.AccessList, 0, len(f.AccessList))
+	for _, tuple := range f.AccessList {
+		keys := make([]common.Hash, 0, len(tuple.StorageKeys))
+		for _, key := range tuple.StorageKeys {
+			keys = append(keys, common.HexToHash(key))
+		}
+
+		list = append(list, types.AccessTuple{
+			Address:     common.HexToAddress(tuple.Address),
+			StorageKeys: keys,
+		})
+	}
+
+	return list
+}
+
+func (f SignTxForm) params() eth.TxParams {
+	return eth.TxParams{
+		Type:       f.Type,
+		ChainID:    f.ChainID,
+		Nonce:      f.Nonce,
+		To:         f.To,
+		Value:      f.Amount,
+		Gas:        f.GasLimit,
+		GasPrice:   f.GasPrice,
+		GasTipCap:  f.MaxPriorityFeePerGas,
+		GasFeeCap:  f.MaxFeePerGas,
+		Data:       f.Data,
+		AccessList: f.accessList(),
+	}
 }
 
 type SignTxResp struct {
@@ -37,3 +116,271 @@ func NewSignTxResp(tx *types.Transaction) (f SignTxResp, err error) {
 	f.SerializedTransaction = b
 	return f, nil
 }
+
+type signMessageForm struct {
+	Label string `json:"label"`
+	// Message is signed as UTF-8 text, Data as raw bytes. Exactly one of
+	// them is set.
+	Message string        `json:"message"`
+	Data    hexutil.Bytes `json:"data"`
+}
+
+func newSignMessageForm(c *gin.Context) (f signMessageForm, err error) {
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	if f.Label == "" {
+		return f, errors.New("label is required")
+	}
+
+	if (f.Message == "") == (len(f.Data) == 0) {
+		return f, errors.New("exactly one of message and data is required")
+	}
+
+	return f, nil
+}
+
+func (f signMessageForm) message() []byte {
+	if f.Message != "" {
+		return []byte(f.Message)
+	}
+
+	return f.Data
+}
+
+// SignMessageResp holds the 65 byte [R || S || V] signature, V is 27 or 28
+type SignMessageResp struct {
+	Signature hexutil.Bytes `json:"signature"`
+}
+
+type signTypedDataForm struct {
+	Label   string   `json:"label"`
+	ChainID *big.Int `json:"chainId"`
+	// TypedData is the EIP-712 document, it has to be bound to ChainID
+	TypedData json.RawMessage `json:"typedData"`
+
+	typedData eth.TypedData
+}
+
+func newSignTypedDataForm(c *gin.Context) (f signTypedDataForm, err error) {
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	if f.Label == "" {
+		return f, errors.New("label is required")
+	}
+
+	if f.ChainID == nil {
+		return f, errors.New("chainId is required")
+	}
+
+	if len(f.TypedData) == 0 {
+		return f, errors.New("typedData is required")
+	}
+
+	f.typedData, err = eth.ParseTypedData(f.TypedData)
+	return f, err
+}
+
+// verifyForm takes a signed rawTransaction, or a signature with the message,
+// data or typedData it was made over
+type verifyForm struct {
+	RawTransaction hexutil.Bytes   `json:"rawTransaction"`
+	Message        string          `json:"message"`
+	Data           hexutil.Bytes   `json:"data"`
+	TypedData      json.RawMessage `json:"typedData"`
+	Signature      hexutil.Bytes   `json:"signature"`
+
+	typedData *eth.TypedData
+}
+
+func newVerifyForm(c *gin.Context) (f verifyForm, err error) {
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	if string(f.TypedData) == "null" {
+		f.TypedData = nil
+	}
+
+	payloads := 0
+	for _, set := range []bool{len(f.RawTransaction) > 0, f.Message != "", len(f.Data) > 0, len(f.TypedData) > 0} {
+		if set {
+			payloads++
+		}
+	}
+
+	if payloads != 1 {
+		return f, errors.New("exactly one of rawTransaction, message, data and typedData is required")
+	}
+
+	if len(f.RawTransaction) > 0 {
+		if len(f.Signature) > 0 {
+			return f, errors.New("signature is part of rawTransaction")
+		}
+
+		return f, nil
+	}
+
+	if len(f.Signature) == 0 {
+		return f, errors.New("signature is required")
+	}
+
+	if len(f.TypedData) > 0 {
+		td, err := eth.ParseTypedData(f.TypedData)
+		if err != nil {
+			return f, err
+		}
+
+		f.typedData = &td
+	}
+
+	return f, nil
+}
+
+func (f verifyForm) message() []byte {
+	if f.Message != "" {
+		return []byte(f.Message)
+	}
+
+	return f.Data
+}
+
+type wrappingKeyForm struct {
+	Token string `json:"token"`
+	// Create initializes the token when it does not exist, as token-per-key
+	// imports need
+	Create bool `json:"create"`
+}
+
+func newWrappingKeyForm(c *gin.Context) (f wrappingKeyForm, err error) {
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	if f.Token == "" {
+		return f, errors.New("token is required")
+	}
+
+	return f, nil
+}
+
+type importAddressForm struct {
+	Label  string     `json:"label"`
+	Layout eth.Layout `json:"layout"`
+	// Token receives the key with the shared-token layout. With
+	// token-per-key the key goes to the token labeled Label, which has to be
+	// created first by requesting its wrapping key.
+	Token           string            `json:"token"`
+	Mechanism       hsm.WrapMechanism `json:"mechanism"`
+	KEKLabel        string            `json:"kekLabel"`
+	WrappedKey      []byte            `json:"wrappedKey"`
+	ExpectedAddress common.Address    `json:"expectedAddress"`
+	Creator         string            `json:"creator"`
+	Tags            []string          `json:"tags"`
+}
+
+func newImportAddressForm(c *gin.Context) (f importAddressForm, err error) {
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	if f.Label == "" {
+		return f, errors.New("label is required")
+	}
+
+	if f.Layout == "" {
+		f.Layout = eth.LayoutTokenPerKey
+	}
+
+	switch f.Layout {
+	case eth.LayoutTokenPerKey:
+		f.Token = f.Label
+	case eth.LayoutSharedToken:
+		if f.Token == "" {
+			return f, errors.New("token is required for the shared-token layout")
+		}
+	default:
+		return f, errors.New("unknown layout " + string(f.Layout))
+	}
+
+	if !f.Mechanism.Valid() {
+		return f, errors.New("unknown wrap mechanism " + string(f.Mechanism))
+	}
+
+	if len(f.WrappedKey) == 0 {
+		return f, errors.New("wrappedKey is required")
+	}
+
+	if f.ExpectedAddress == (common.Address{}) {
+		return f, errors.New("expectedAddress is required")
+	}
+
+	return f, nil
+}
+
+func (f importAddressForm) wrappedKey() eth.WrappedKey {
+	return eth.WrappedKey{Mechanism: f.Mechanism, KEK: f.KEKLabel, Key: f.WrappedKey}
+}
+
+func (f importAddressForm) metadata() eth_svc.Metadata {
+	return eth_svc.Metadata{Creator: f.Creator, Tags: f.Tags}
+}
+
+func (f createAddressForm) metadata() eth_svc.Metadata {
+	return eth_svc.Metadata{Creator: f.Creator, Tags: f.Tags}
+}
+
+type listAddressesForm struct {
+	State hsm_repo.State
+	Tag   string
+}
+
+func newListAddressesForm(c *gin.Context) (f listAddressesForm, err error) {
+	f.State = hsm_repo.State(c.Query("state"))
+	f.Tag = c.Query("tag")
+
+	switch f.State {
+	case "", hsm_repo.StateActive, hsm_repo.StateRetired, hsm_repo.StateDestroyed:
+	default:
+		return f, errors.New("unknown state " + string(f.State))
+	}
+
+	return f, nil
+}
+
+func (f listAddressesForm) filter() hsm_repo.Filter {
+	return hsm_repo.Filter{State: f.State, Tag: f.Tag}
+}
+
+type retireAddressForm struct {
+	Label string `json:"label"`
+}
+
+func newRetireAddressForm(c *gin.Context) (f retireAddressForm, err error) {
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	if f.Label == "" {
+		return f, errors.New("label is required")
+	}
+
+	return f, nil
+}
+
+type destroyAddressForm struct {
+	// ConfirmAddress repeats the EIP-55 checksummed address of the key
+	ConfirmAddress string `json:"confirmAddress"`
+}
+
+func newDestroyAddressForm(c *gin.Context) (f destroyAddressForm, err error) {
+	if c.Request.ContentLength == 0 {
+		return f, nil
+	}
+
+	err = c.BindJSON(&f)
+	return f, err
+}
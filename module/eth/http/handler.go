@@ -1,12 +1,14 @@
 package eth_http
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	eth_svc "open_custodial/module/eth/service"
 	"open_custodial/pkg/_err"
 	"open_custodial/pkg/_http"
+	eth "open_custodial/pkg/eth_hsm"
 
-	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/gin-gonic/gin"
 )
 
@@ -15,7 +17,12 @@ type Handler struct {
 }
 
 type createAddressForm struct {
-	Label string `json:"label"`
+	Label  string     `json:"label"`
+	Layout eth.Layout `json:"layout"`
+	Token  string     `json:"token"`
+	// Creator and Tags are recorded in the key repository
+	Creator string   `json:"creator"`
+	Tags    []string `json:"tags"`
 }
 
 func NewHandler(s eth_svc.ETHService) *Handler {
@@ -24,14 +31,37 @@ func NewHandler(s eth_svc.ETHService) *Handler {
 
 func (h *Handler) Setup(r *gin.RouterGroup) {
 	r.POST("/address", h.createAddress)
+	r.GET("/address", h.listAddresses)
+	r.POST("/address/import/key", h.getWrappingKey)
+	r.POST("/address/import", h.importAddress)
+	r.POST("/address/retire", h.retireAddress)
 	r.GET("/address/:label", h.getAddress)
+	r.DELETE("/address/:label", h.destroyAddress)
 	r.GET("/slotaddress/:slotID", h.getSlotAddress)
 	r.POST("/sign", h.signTransaction)
+	r.POST("/sign/message", h.signMessage)
+	r.POST("/sign/typed-data", h.signTypedData)
+	r.POST("/verify", h.verify)
 }
 
 func newCreateAddressForm(c *gin.Context) (f createAddressForm, err error) {
-	err = c.BindJSON(&f)
-	return f, err
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	if f.Layout == "" {
+		f.Layout = eth.LayoutTokenPerKey
+	}
+
+	if !f.Layout.Valid() {
+		return f, fmt.Errorf("unknown layout %s", f.Layout)
+	}
+
+	if f.Layout == eth.LayoutSharedToken && f.Token == "" {
+		return f, errors.New("token is required for the shared-token layout")
+	}
+
+	return f, nil
 }
 
 func (h *Handler) createAddress(c *gin.Context) {
@@ -42,8 +72,12 @@ func (h *Handler) createAddress(c *gin.Context) {
 		return
 	}
 
-	addr, err := h.service.CreateAddress(f.Label)
+	addr, err := h.service.CreateAddress(c.Request.Context(), f.Label, f.Layout, f.Token, f.metadata())
 	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
 		switch e := err.(type) {
 		case _err.DuplicateLabel:
 			_http.ErrorResponse(c, e, http.StatusBadRequest)
@@ -57,18 +91,146 @@ func (h *Handler) createAddress(c *gin.Context) {
 	c.JSON(http.StatusOK, addr)
 }
 
+func (h *Handler) getWrappingKey(c *gin.Context) {
+	f, err := newWrappingKeyForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.service.GetWrappingKey(c.Request.Context(), f.Token, f.Create)
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		switch e := err.(type) {
+		case _err.TokenNotFound:
+			_http.ErrorResponse(c, e, http.StatusNotFound)
+		default:
+			_http.UnknownError(c, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, key)
+}
+
+func (h *Handler) importAddress(c *gin.Context) {
+	f, err := newImportAddressForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	addr, err := h.service.ImportAddress(c.Request.Context(), f.Label, f.Token, f.wrappedKey(), f.ExpectedAddress, f.metadata())
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		switch e := err.(type) {
+		case _err.DuplicateLabel, _err.AddressMismatch:
+			_http.ErrorResponse(c, e, http.StatusBadRequest)
+			return
+		default:
+			_http.ErrorResponse(c, _err.NewError(err, "unable to import key"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, addr)
+}
+
+func (h *Handler) retireAddress(c *gin.Context) {
+	f, err := newRetireAddressForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	addr, err := h.service.RetireAddress(c.Request.Context(), f.Label)
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		_http.ErrorResponse(c, _err.NewError(err, "unable to retire address"), http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusOK, addr)
+}
+
+func (h *Handler) destroyAddress(c *gin.Context) {
+	f, err := newDestroyAddressForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	addr, err := h.service.DestroyAddress(c.Request.Context(), _http.GetParamLabel(c), f.ConfirmAddress)
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		switch e := err.(type) {
+		case _err.DestroyRefused:
+			_http.ErrorResponse(c, e, http.StatusConflict)
+			return
+		default:
+			_http.ErrorResponse(c, _err.NewError(err, "unable to destroy address"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, addr)
+}
+
 func (h *Handler) getAddress(c *gin.Context) {
 	label := _http.GetParamLabel(c)
-	addr, err := h.service.GetAddressByLabel(label)
+	addr, err := h.service.GetAddressByLabel(c.Request.Context(), label)
 	if err != nil {
-		c.Status(http.StatusBadRequest)
-		return
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		switch e := err.(type) {
+		case _err.KeyDestroyed:
+			_http.ErrorResponse(c, e, http.StatusGone)
+			return
+		default:
+			c.Status(http.StatusBadRequest)
+			return
+		}
 	}
 
 	c.JSON(http.StatusOK, addr)
 
 }
 
+func (h *Handler) listAddresses(c *gin.Context) {
+	f, err := newListAddressesForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	keys, err := h.service.ListAddresses(c.Request.Context(), f.filter())
+	if err != nil {
+		if errors.Is(err, eth_svc.ErrNoRepo) {
+			_http.ErrorResponse(c, _err.NewError(err, "unable to list addresses"), http.StatusNotImplemented)
+			return
+		}
+
+		_http.UnknownError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
 func (h *Handler) getSlotAddress(c *gin.Context) {
 	slotID, err := _http.GetParamSlotID(c)
 	if err != nil {
@@ -76,8 +238,12 @@ func (h *Handler) getSlotAddress(c *gin.Context) {
 		return
 	}
 
-	addr, err := h.service.GetSlotAddress(uint(slotID))
+	addr, err := h.service.GetSlotAddress(c.Request.Context(), uint(slotID))
 	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
 		_http.ErrorResponse(c, _err.NewError(err, "unable to get address by slot"), http.StatusBadRequest)
 		return
 	}
@@ -93,12 +259,20 @@ func (h *Handler) signTransaction(c *gin.Context) {
 		return
 	}
 
-	tx := types.NewTransaction(f.Nonce, f.To, f.Amount, f.GasLimit, f.GasPrice, f.Data)
-
-	tx, err = h.service.SignTransaction(tx, f.ChainID, f.Label)
+	tx, err := h.service.SignTransaction(c.Request.Context(), f.params(), f.Label)
 	if err != nil {
-		_http.ErrorResponse(c, _err.NewError(err, "unable to sign transaction"), http.StatusBadRequest)
-		return
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		switch e := err.(type) {
+		case _err.InvalidTransaction:
+			_http.ErrorResponse(c, e, http.StatusBadRequest)
+			return
+		default:
+			_http.ErrorResponse(c, _err.NewError(err, "unable to sign transaction"), http.StatusBadRequest)
+			return
+		}
 	}
 
 	resp, err := NewSignTxResp(tx)
@@ -109,3 +283,80 @@ func (h *Handler) signTransaction(c *gin.Context) {
 
 	c.JSON(http.StatusOK, resp)
 }
+
+func (h *Handler) signMessage(c *gin.Context) {
+	f, err := newSignMessageForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	sig, err := h.service.SignPersonalMessage(c.Request.Context(), f.Label, f.message())
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		_http.ErrorResponse(c, _err.NewError(err, "unable to sign message"), http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusOK, SignMessageResp{Signature: sig})
+}
+
+func (h *Handler) signTypedData(c *gin.Context) {
+	f, err := newSignTypedDataForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	sig, err := h.service.SignTypedData(c.Request.Context(), f.Label, f.typedData, f.ChainID)
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		switch e := err.(type) {
+		case _err.InvalidTypedData:
+			_http.ErrorResponse(c, e, http.StatusBadRequest)
+			return
+		default:
+			_http.ErrorResponse(c, _err.NewError(err, "unable to sign typed data"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, SignMessageResp{Signature: sig})
+}
+
+func (h *Handler) verify(c *gin.Context) {
+	f, err := newVerifyForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	var v eth_svc.Verification
+	ctx := c.Request.Context()
+	switch {
+	case len(f.RawTransaction) > 0:
+		v, err = h.service.VerifyTransaction(ctx, f.RawTransaction)
+	case f.typedData != nil:
+		v, err = h.service.VerifyTypedData(ctx, *f.typedData, f.Signature)
+	default:
+		v, err = h.service.VerifyMessage(ctx, f.message(), f.Signature)
+	}
+	if err != nil {
+		switch e := err.(type) {
+		case _err.InvalidSignature, _err.InvalidTypedData:
+			_http.ErrorResponse(c, e, http.StatusBadRequest)
+			return
+		default:
+			_http.UnknownError(c, e, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, v)
+}
@@ -0,0 +1,711 @@
+package eth_http
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	eth_svc "open_custodial/module/eth/service"
+	validator_svc "open_custodial/module/validator/service"
+	eth "open_custodial/pkg/eth_hsm"
+	"open_custodial/pkg/hsm"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+	hsm_repo "open_custodial/pkg/hsm/repository"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/suite"
+)
+
+type HandlerSuite struct {
+	suite.Suite
+	hsm    *hsm_mem.HSM
+	router *gin.Engine
+}
+
+func TestHandlerSuite(t *testing.T) {
+	suite.Run(t, new(HandlerSuite))
+}
+
+func (s *HandlerSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+
+	s.hsm = hsm_mem.New()
+	svc := eth_svc.NewETHService(s.hsm, validator_svc.NewValidatorService())
+
+	s.router = gin.New()
+	NewHandler(svc).Setup(s.router.Group("/v1"))
+}
+
+func (s *HandlerSuite) do(method, path string, body interface{}) *httptest.ResponseRecorder {
+	var b bytes.Buffer
+	if body != nil {
+		s.NoError(json.NewEncoder(&b).Encode(body))
+	}
+
+	req := httptest.NewRequest(method, path, &b)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func (s *HandlerSuite) TestCreateAndGetAddress() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_address"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+	s.Equal("handler_address", created.Label)
+
+	w = s.do(http.MethodGet, "/v1/address/handler_address", nil)
+	s.Equal(http.StatusOK, w.Code)
+
+	var found eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &found))
+	s.Equal(created.Addr, found.Addr)
+	s.Zero(s.hsm.OpenSessions())
+}
+
+func (s *HandlerSuite) TestCreateAddressSharedToken() {
+	form := createAddressForm{Label: "handler_shared", Layout: eth.LayoutSharedToken}
+	w := s.do(http.MethodPost, "/v1/address", form)
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	form.Token = "handler_shared_token"
+	w = s.do(http.MethodPost, "/v1/address", form)
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/address", form)
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	w = s.do(http.MethodGet, "/v1/address/handler_shared", nil)
+	s.Equal(http.StatusOK, w.Code)
+}
+
+func (s *HandlerSuite) TestImportAddress() {
+	w := s.do(http.MethodPost, "/v1/address/import/key", wrappingKeyForm{Token: "handler_import"})
+	s.Equal(http.StatusNotFound, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/address/import/key", wrappingKeyForm{Token: "handler_import", Create: true})
+	s.Equal(http.StatusOK, w.Code)
+
+	var wrapping eth_svc.WrappingKey
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &wrapping))
+
+	block, _ := pem.Decode([]byte(wrapping.PublicKey))
+	s.NotNil(block)
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	s.NoError(err)
+
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+
+	der, err := hsm.MarshalPKCS8Secp256k1(key)
+	s.NoError(err)
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub.(*rsa.PublicKey), der, nil)
+	s.NoError(err)
+
+	form := importAddressForm{
+		Label:           "handler_import",
+		Mechanism:       hsm.WrapRSAOAEP,
+		WrappedKey:      wrapped,
+		ExpectedAddress: common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+	}
+
+	w = s.do(http.MethodPost, "/v1/address/import", form)
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	form.ExpectedAddress = crypto.PubkeyToAddress(key.PublicKey)
+	w = s.do(http.MethodPost, "/v1/address/import", form)
+	s.Equal(http.StatusOK, w.Code)
+
+	var imported eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &imported))
+	s.Equal(form.ExpectedAddress, imported.Addr)
+	s.Zero(s.hsm.OpenSessions())
+}
+
+func (s *HandlerSuite) TestSignTransaction() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_sign"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+
+	form := SignTxForm{
+		Nonce:    1,
+		To:       common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+		Amount:   big.NewInt(1000),
+		GasLimit: 21000,
+		GasPrice: big.NewInt(100),
+		ChainID:  big.NewInt(3),
+		Label:    "handler_sign",
+	}
+
+	// high s values from the token are normalized before they reach the
+	// transaction
+	for _, mode := range []hsm_mem.SignatureMode{hsm_mem.SignatureAlwaysLowS, hsm_mem.SignatureAlwaysHighS} {
+		s.hsm.SetSignatureMode(mode)
+
+		w = s.do(http.MethodPost, "/v1/sign", form)
+		s.Equal(http.StatusOK, w.Code)
+
+		var resp SignTxResp
+		s.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+
+		tx := new(types.Transaction)
+		s.NoError(tx.UnmarshalBinary(resp.SerializedTransaction))
+
+		sender, err := types.Sender(types.NewLondonSigner(big.NewInt(3)), tx)
+		s.NoError(err)
+		s.Equal(created.Addr, sender)
+	}
+}
+
+func (s *HandlerSuite) TestSignDynamicFeeTransaction() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_sign_dynamic"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+
+	form := SignTxForm{
+		Type:                 types.DynamicFeeTxType,
+		Nonce:                1,
+		To:                   common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+		Amount:               big.NewInt(1000),
+		GasLimit:             21000,
+		MaxFeePerGas:         big.NewInt(100),
+		MaxPriorityFeePerGas: big.NewInt(2),
+		ChainID:              big.NewInt(3),
+		Label:                "handler_sign_dynamic",
+	}
+
+	w = s.do(http.MethodPost, "/v1/sign", form)
+	s.Equal(http.StatusOK, w.Code)
+
+	var resp SignTxResp
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Equal(byte(types.DynamicFeeTxType), resp.SerializedTransaction[0])
+
+	tx := new(types.Transaction)
+	s.NoError(tx.UnmarshalBinary(resp.SerializedTransaction))
+	s.Equal(big.NewInt(100), tx.GasFeeCap())
+
+	sender, err := types.Sender(types.NewLondonSigner(big.NewInt(3)), tx)
+	s.NoError(err)
+	s.Equal(created.Addr, sender)
+
+	form.MaxPriorityFeePerGas = big.NewInt(101)
+	w = s.do(http.MethodPost, "/v1/sign", form)
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Contains(w.Body.String(), "maxPriorityFeePerGas is above maxFeePerGas")
+}
+
+func (s *HandlerSuite) TestSignAccessListTransaction() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_sign_access_list"})
+	s.Equal(http.StatusOK, w.Code)
+
+	form := SignTxForm{
+		Type:     types.AccessListTxType,
+		Nonce:    1,
+		To:       common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+		Amount:   big.NewInt(1000),
+		GasLimit: 50000,
+		GasPrice: big.NewInt(100),
+		ChainID:  big.NewInt(3),
+		Label:    "handler_sign_access_list",
+		AccessList: []accessTupleForm{{
+			Address:     "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+			StorageKeys: []string{"0x0000000000000000000000000000000000000000000000000000000000000001"},
+		}},
+	}
+
+	w = s.do(http.MethodPost, "/v1/sign", form)
+	s.Equal(http.StatusOK, w.Code)
+
+	var resp SignTxResp
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+
+	tx := new(types.Transaction)
+	s.NoError(tx.UnmarshalBinary(resp.SerializedTransaction))
+	s.Equal(uint8(types.AccessListTxType), tx.Type())
+	s.Equal(types.AccessList{{
+		Address:     common.HexToAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"),
+		StorageKeys: []common.Hash{common.HexToHash("0x01")},
+	}}, tx.AccessList())
+
+	form.AccessList[0].StorageKeys = []string{"0x01"}
+	w = s.do(http.MethodPost, "/v1/sign", form)
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	form.AccessList[0] = accessTupleForm{Address: "5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"}
+	w = s.do(http.MethodPost, "/v1/sign", form)
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	form.AccessList[0] = accessTupleForm{Address: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"}
+	form.Type = types.LegacyTxType
+	w = s.do(http.MethodPost, "/v1/sign", form)
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlerSuite) TestSignMessage() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_sign_message"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+
+	w = s.do(http.MethodPost, "/v1/sign/message", signMessageForm{Label: "handler_sign_message", Message: "hello"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var resp SignMessageResp
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+	s.Len(resp.Signature, 65)
+
+	sig := append([]byte{}, resp.Signature...)
+	sig[64] -= 27
+	pub, err := crypto.SigToPub(eth.PersonalMessageHash([]byte("hello")), sig)
+	s.NoError(err)
+	s.Equal(created.Addr, crypto.PubkeyToAddress(*pub))
+
+	w = s.do(http.MethodPost, "/v1/sign/message", signMessageForm{Label: "handler_sign_message", Data: []byte{0x01, 0x02}})
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/sign/message", signMessageForm{Label: "handler_sign_message", Message: "hello", Data: []byte{0x01}})
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/sign/message", signMessageForm{Message: "hello"})
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Zero(s.hsm.OpenSessions())
+}
+
+// typedDataValidator records the typed data it is asked to validate
+type typedDataValidator struct {
+	validator_svc.ValidatorService
+	seen []apitypes.TypedData
+}
+
+func (v *typedDataValidator) ValidateSignTypedData(ctx context.Context, data apitypes.TypedData) error {
+	v.seen = append(v.seen, data)
+	return nil
+}
+
+func (s *HandlerSuite) TestSignTypedData() {
+	v := &typedDataValidator{ValidatorService: validator_svc.NewValidatorService()}
+	s.router = gin.New()
+	NewHandler(eth_svc.NewETHService(s.hsm, v)).Setup(s.router.Group("/v1"))
+
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_sign_typed"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+
+	doc := json.RawMessage(`{
+		"types": {
+			"EIP712Domain": [{"name": "name", "type": "string"}, {"name": "chainId", "type": "uint256"}],
+			"Vote": [{"name": "proposal", "type": "uint256"}, {"name": "support", "type": "bool"}]
+		},
+		"primaryType": "Vote",
+		"domain": {"name": "Governor", "chainId": 3},
+		"message": {"proposal": "42", "support": true}
+	}`)
+
+	w = s.do(http.MethodPost, "/v1/sign/typed-data", signTypedDataForm{Label: "handler_sign_typed", ChainID: big.NewInt(3), TypedData: doc})
+	s.Equal(http.StatusOK, w.Code)
+
+	var resp SignMessageResp
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+
+	td, err := eth.ParseTypedData(doc)
+	s.NoError(err)
+	hash, _, err := eth.TypedDataHash(td)
+	s.NoError(err)
+
+	sig := append([]byte{}, resp.Signature...)
+	sig[64] -= 27
+	pub, err := crypto.SigToPub(hash, sig)
+	s.NoError(err)
+	s.Equal(created.Addr, crypto.PubkeyToAddress(*pub))
+
+	s.Len(v.seen, 1)
+	s.Equal("Vote", v.seen[0].PrimaryType)
+	s.Equal("42", v.seen[0].Message["proposal"])
+
+	w = s.do(http.MethodPost, "/v1/sign/typed-data", signTypedDataForm{Label: "handler_sign_typed", ChainID: big.NewInt(1), TypedData: doc})
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Contains(w.Body.String(), "does not match chainId")
+	s.Len(v.seen, 1)
+
+	w = s.do(http.MethodPost, "/v1/sign/typed-data", signTypedDataForm{Label: "handler_sign_typed", ChainID: big.NewInt(3), TypedData: json.RawMessage(`{"types": {}}`)})
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlerSuite) TestSignTransactionHSMFailure() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_sign_fail"})
+	s.Equal(http.StatusOK, w.Code)
+
+	s.hsm.Fail(hsm_mem.OpSign, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), 0)
+
+	form := SignTxForm{
+		To:       common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+		Amount:   big.NewInt(1000),
+		GasLimit: 21000,
+		GasPrice: big.NewInt(100),
+		ChainID:  big.NewInt(3),
+		Label:    "handler_sign_fail",
+	}
+
+	w = s.do(http.MethodPost, "/v1/sign", form)
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Zero(s.hsm.OpenSessions())
+}
+
+func (s *HandlerSuite) TestSignTransactionTimeout() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_sign_timeout"})
+	s.Equal(http.StatusOK, w.Code)
+
+	s.hsm.Stall(hsm_mem.OpSign, time.Minute)
+
+	form := SignTxForm{
+		To:       common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+		Amount:   big.NewInt(1000),
+		GasLimit: 21000,
+		GasPrice: big.NewInt(100),
+		ChainID:  big.NewInt(3),
+		Label:    "handler_sign_timeout",
+	}
+
+	var b bytes.Buffer
+	s.NoError(json.NewEncoder(&b).Encode(form))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/sign", &b).WithContext(ctx)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+
+	s.Equal(http.StatusGatewayTimeout, w.Code)
+	s.Zero(s.hsm.OpenSessions())
+}
+
+func (s *HandlerSuite) TestRetireAndDestroyAddress() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_destroy"})
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodDelete, "/v1/address/handler_destroy", nil)
+	s.Equal(http.StatusConflict, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/address/retire", retireAddressForm{Label: "handler_destroy"})
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodDelete, "/v1/address/handler_destroy", nil)
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodGet, "/v1/address/handler_destroy", nil)
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Zero(s.hsm.OpenSessions())
+}
+
+func (s *HandlerSuite) TestDestroyAddressConfirmation() {
+	svc := eth_svc.NewETHService(s.hsm, validator_svc.NewValidatorService(),
+		eth_svc.WithDestroyPolicy(eth.DestroyPolicy{RequireConfirmation: true}))
+	s.router = gin.New()
+	NewHandler(svc).Setup(s.router.Group("/v1"))
+
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_confirm"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+
+	w = s.do(http.MethodPost, "/v1/address/retire", retireAddressForm{Label: "handler_confirm"})
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodDelete, "/v1/address/handler_confirm", nil)
+	s.Equal(http.StatusConflict, w.Code)
+
+	w = s.do(http.MethodDelete, "/v1/address/handler_confirm", destroyAddressForm{ConfirmAddress: created.Addr.Hex()})
+	s.Equal(http.StatusOK, w.Code)
+}
+
+func (s *HandlerSuite) TestListAddresses() {
+	w := s.do(http.MethodGet, "/v1/address", nil)
+	s.Equal(http.StatusNotImplemented, w.Code)
+
+	dir := s.T().TempDir()
+	repo, err := hsm_repo.NewBoltRepo(filepath.Join(dir, "keys.db"))
+	s.NoError(err)
+	defer repo.Close()
+
+	svc := eth_svc.NewETHService(s.hsm, validator_svc.NewValidatorService(), eth_svc.WithRepo(repo))
+	s.router = gin.New()
+	NewHandler(svc).Setup(s.router.Group("/v1"))
+
+	w = s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_list", Creator: "alice", Tags: []string{"hot"}})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+
+	w = s.do(http.MethodPost, "/v1/address/retire", retireAddressForm{Label: "handler_list"})
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodGet, "/v1/address?state=retired&tag=hot", nil)
+	s.Equal(http.StatusOK, w.Code)
+
+	var keys []hsm_repo.Key
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &keys))
+	s.Len(keys, 1)
+	s.Equal(created.Addr.Hex(), keys[0].Address)
+	s.Equal("alice", keys[0].Creator)
+	s.Equal(hsm.CurveSecp256k1, keys[0].Curve)
+
+	w = s.do(http.MethodGet, "/v1/address?state=active", nil)
+	s.Equal(http.StatusOK, w.Code)
+	s.JSONEq("[]", w.Body.String())
+
+	w = s.do(http.MethodGet, "/v1/address?state=unknown", nil)
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	// the repository remembers destroyed keys
+	w = s.do(http.MethodDelete, "/v1/address/handler_list", nil)
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodGet, "/v1/address/handler_list", nil)
+	s.Equal(http.StatusGone, w.Code)
+}
+
+func (s *HandlerSuite) TestGetAddressFromRepo() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_repo"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+
+	repo, err := hsm_repo.NewBoltRepo(filepath.Join(s.T().TempDir(), "keys.db"))
+	s.NoError(err)
+	defer repo.Close()
+
+	svc := eth_svc.NewETHService(s.hsm, validator_svc.NewValidatorService(), eth_svc.WithRepo(repo))
+	s.router = gin.New()
+	NewHandler(svc).Setup(s.router.Group("/v1"))
+
+	// created before the repository, the first lookup records it
+	w = s.do(http.MethodGet, "/v1/address/handler_repo", nil)
+	s.Equal(http.StatusOK, w.Code)
+
+	k, err := repo.Get("handler_repo")
+	s.NoError(err)
+	s.Equal(created.Addr.Hex(), k.Address)
+
+	// a shared token label does not stand for a key, nothing is recorded
+	form := createAddressForm{Label: "handler_repo_shared", Layout: eth.LayoutSharedToken, Token: "handler_repo_token"}
+	w = s.do(http.MethodPost, "/v1/address", form)
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodGet, "/v1/address/handler_repo_token", nil)
+	s.NotEqual(http.StatusOK, w.Code)
+
+	_, err = repo.Get("handler_repo_token")
+	s.ErrorIs(err, hsm_repo.ErrNotFound)
+
+	s.hsm.Fail(hsm_mem.OpOpenSession, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), 0)
+	defer s.hsm.ClearFailures()
+
+	w = s.do(http.MethodGet, "/v1/address/handler_repo", nil)
+	s.Equal(http.StatusOK, w.Code)
+
+	var found eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &found))
+	s.Equal(created.Addr, found.Addr)
+}
+
+func (s *HandlerSuite) TestVerify() {
+	repo, err := hsm_repo.NewBoltRepo(filepath.Join(s.T().TempDir(), "keys.db"))
+	s.NoError(err)
+	defer repo.Close()
+
+	s.router = gin.New()
+	NewHandler(eth_svc.NewETHService(s.hsm, validator_svc.NewValidatorService(), eth_svc.WithRepo(repo))).Setup(s.router.Group("/v1"))
+
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_verify"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created eth_svc.Address
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+
+	w = s.do(http.MethodPost, "/v1/sign/message", signMessageForm{Label: "handler_verify", Message: "proof of reserves"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var signed SignMessageResp
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &signed))
+
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{Message: "proof of reserves", Signature: signed.Signature})
+	s.Equal(http.StatusOK, w.Code)
+
+	var v eth_svc.Verification
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &v))
+	s.Equal(created.Addr, v.Signer)
+	s.True(*v.Known)
+	s.Equal("handler_verify", v.Label)
+
+	// the same signature over another message recovers some other address
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{Message: "tampered", Signature: signed.Signature})
+	s.Equal(http.StatusOK, w.Code)
+
+	v = eth_svc.Verification{}
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &v))
+	s.NotEqual(created.Addr, v.Signer)
+	s.False(*v.Known)
+	s.Empty(v.Label)
+
+	form := SignTxForm{
+		Type:                 types.DynamicFeeTxType,
+		To:                   common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+		GasLimit:             21000,
+		MaxFeePerGas:         big.NewInt(100),
+		MaxPriorityFeePerGas: big.NewInt(2),
+		ChainID:              big.NewInt(3),
+		Label:                "handler_verify",
+	}
+
+	w = s.do(http.MethodPost, "/v1/sign", form)
+	s.Equal(http.StatusOK, w.Code)
+
+	var tx SignTxResp
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &tx))
+
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{RawTransaction: tx.SerializedTransaction})
+	s.Equal(http.StatusOK, w.Code)
+
+	v = eth_svc.Verification{}
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &v))
+	s.Equal(created.Addr, v.Signer)
+	s.Equal("handler_verify", v.Label)
+	s.NotNil(v.TxHash)
+
+	doc := json.RawMessage(`{
+		"types": {"EIP712Domain": [{"name": "chainId", "type": "uint256"}], "Login": [{"name": "nonce", "type": "uint256"}]},
+		"primaryType": "Login",
+		"domain": {"chainId": "3"},
+		"message": {"nonce": "7"}
+	}`)
+
+	w = s.do(http.MethodPost, "/v1/sign/typed-data", signTypedDataForm{Label: "handler_verify", ChainID: big.NewInt(3), TypedData: doc})
+	s.Equal(http.StatusOK, w.Code)
+
+	signed = SignMessageResp{}
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &signed))
+
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{TypedData: doc, Signature: signed.Signature})
+	s.Equal(http.StatusOK, w.Code)
+
+	v = eth_svc.Verification{}
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &v))
+	s.Equal("handler_verify", v.Label)
+
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{Message: "proof of reserves", Signature: signed.Signature[:64]})
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{Message: "proof of reserves", RawTransaction: tx.SerializedTransaction})
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{Message: "proof of reserves"})
+	s.Equal(http.StatusBadRequest, w.Code)
+}
+
+func (s *HandlerSuite) TestVerifyWithoutRepo() {
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+
+	sig, err := crypto.Sign(eth.PersonalMessageHash([]byte("hello")), key)
+	s.NoError(err)
+
+	w := s.do(http.MethodPost, "/v1/verify", verifyForm{Message: "hello", Signature: sig})
+	s.Equal(http.StatusOK, w.Code)
+
+	var v eth_svc.Verification
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &v))
+	s.Equal(crypto.PubkeyToAddress(key.PublicKey), v.Signer)
+	s.False(*v.Known)
+
+	// the hsm is asked when there is no key repository
+	w = s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_verify_hsm"})
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/sign/message", signMessageForm{Label: "handler_verify_hsm", Message: "hello"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var signed SignMessageResp
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &signed))
+
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{Message: "hello", Signature: signed.Signature})
+	s.Equal(http.StatusOK, w.Code)
+
+	v = eth_svc.Verification{}
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &v))
+	s.True(*v.Known)
+	s.Equal("handler_verify_hsm", v.Label)
+	s.Equal(hsm_repo.StateActive, v.State)
+	s.Zero(s.hsm.OpenSessions())
+
+	// when the hsm can not be read whether the signer is ours is unknown
+	s.hsm.Fail(hsm_mem.OpOpenSession, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), 0)
+	defer s.hsm.ClearFailures()
+
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{Message: "hello", Signature: sig})
+	s.Equal(http.StatusOK, w.Code)
+	s.NotContains(w.Body.String(), "known")
+}
+
+func (s *HandlerSuite) TestVerifyRecordsKeyFoundInHSM() {
+	w := s.do(http.MethodPost, "/v1/address", createAddressForm{Label: "handler_verify_record"})
+	s.Equal(http.StatusOK, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/sign/message", signMessageForm{Label: "handler_verify_record", Message: "hello"})
+	s.Equal(http.StatusOK, w.Code)
+
+	var signed SignMessageResp
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &signed))
+
+	repo, err := hsm_repo.NewBoltRepo(filepath.Join(s.T().TempDir(), "keys.db"))
+	s.NoError(err)
+	defer repo.Close()
+
+	svc := eth_svc.NewETHService(s.hsm, validator_svc.NewValidatorService(), eth_svc.WithRepo(repo))
+	s.router = gin.New()
+	NewHandler(svc).Setup(s.router.Group("/v1"))
+
+	// created before the repository, it is found in the hsm and recorded
+	w = s.do(http.MethodPost, "/v1/verify", verifyForm{Message: "hello", Signature: signed.Signature})
+	s.Equal(http.StatusOK, w.Code)
+
+	var v eth_svc.Verification
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &v))
+	s.True(*v.Known)
+	s.Equal("handler_verify_record", v.Label)
+
+	k, err := repo.GetByAddress(v.Signer.Hex())
+	s.NoError(err)
+	s.Equal("handler_verify_record", k.Label)
+}
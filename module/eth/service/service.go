@@ -1,10 +1,17 @@
 package eth_svc
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"open_custodial/pkg/hsm"
+	hsm_repo "open_custodial/pkg/hsm/repository"
 
 	validator_svc "open_custodial/module/validator/service"
+	"open_custodial/pkg/_err"
 	eth "open_custodial/pkg/eth_hsm"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -12,19 +19,57 @@ import (
 )
 
 type ETHService interface {
-	CreateAddress(label string) (a Address, err error)
-	GetAddressByLabel(label string) (a Address, err error)
-	GetSlotAddress(slotID uint) (a Address, err error)
-	SignTransaction(tx *types.Transaction, chainID *big.Int, label string) (*types.Transaction, error)
+	CreateAddress(ctx context.Context, label string, layout eth.Layout, token string, meta Metadata) (a Address, err error)
+	GetAddressByLabel(ctx context.Context, label string) (a Address, err error)
+	ListAddresses(ctx context.Context, f hsm_repo.Filter) ([]hsm_repo.Key, error)
+	GetSlotAddress(ctx context.Context, slotID uint) (a Address, err error)
+	SignTransaction(ctx context.Context, p eth.TxParams, label string) (*types.Transaction, error)
+	SignPersonalMessage(ctx context.Context, label string, msg []byte) ([]byte, error)
+	SignTypedData(ctx context.Context, label string, td eth.TypedData, chainID *big.Int) ([]byte, error)
+	VerifyTransaction(ctx context.Context, raw []byte) (v Verification, err error)
+	VerifyMessage(ctx context.Context, msg, signature []byte) (v Verification, err error)
+	VerifyTypedData(ctx context.Context, td eth.TypedData, signature []byte) (v Verification, err error)
+	GetWrappingKey(ctx context.Context, token string, create bool) (k WrappingKey, err error)
+	ImportAddress(ctx context.Context, label, token string, key eth.WrappedKey, expected common.Address, meta Metadata) (a Address, err error)
+	RetireAddress(ctx context.Context, label string) (a Address, err error)
+	DestroyAddress(ctx context.Context, label, confirmation string) (a Address, err error)
 }
 
 type service struct {
-	hsm       hsm.HSM
-	validator validator_svc.ValidatorService
+	hsm           hsm.HSM
+	validator     validator_svc.ValidatorService
+	destroyPolicy eth.DestroyPolicy
+	repo          hsm_repo.HSMRepo
 }
 
-func NewETHService(h hsm.HSM, v validator_svc.ValidatorService) ETHService {
-	return &service{hsm: h, validator: v}
+// ErrNoRepo is returned for listings when no key repository is configured
+var ErrNoRepo = errors.New("key repository is not configured")
+
+type Option func(*service)
+
+// WithDestroyPolicy sets the interlocks DestroyAddress enforces on top of
+// retirement
+func WithDestroyPolicy(p eth.DestroyPolicy) Option {
+	return func(s *service) {
+		s.destroyPolicy = p
+	}
+}
+
+// WithRepo keeps the metadata of keys in r, lookups are answered from it
+// without calling into the HSM
+func WithRepo(r hsm_repo.HSMRepo) Option {
+	return func(s *service) {
+		s.repo = r
+	}
+}
+
+func NewETHService(h hsm.HSM, v validator_svc.ValidatorService, opts ...Option) ETHService {
+	s := &service{hsm: h, validator: v}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
 type Address struct {
@@ -32,32 +77,141 @@ type Address struct {
 	Label string         `json:"label"`
 }
 
-func (s *service) CreateAddress(label string) (a Address, err error) {
-	if err := s.validator.ValidateCreateAddress(); err != nil {
+// Verification names the address that produced a signature and whether it
+// is one of ours
+type Verification struct {
+	Signer common.Address `json:"signer"`
+	// Known is left out when neither the key repository nor the HSM could be
+	// read, the signer is still correct
+	Known *bool          `json:"known,omitempty"`
+	Label string         `json:"label,omitempty"`
+	State hsm_repo.State `json:"state,omitempty"`
+	// TxHash is set for transactions
+	TxHash *common.Hash `json:"txHash,omitempty"`
+}
+
+// Metadata is recorded in the key repository for new addresses
+type Metadata struct {
+	Creator string
+	Tags    []string
+}
+
+type WrappingKey struct {
+	Token string `json:"token"`
+	// PublicKey is the PEM encoded RSA public key to wrap keys to
+	PublicKey string `json:"publicKey"`
+}
+
+// CreateAddress creates a new key labeled label. With LayoutSharedToken the
+// key is stored in the token labeled token, otherwise in a token of its own.
+func (s *service) CreateAddress(ctx context.Context, label string, layout eth.Layout, token string, meta Metadata) (a Address, err error) {
+	if err := s.validator.ValidateCreateAddress(ctx); err != nil {
 		return a, err
 	}
 
 	a.Label = label
-	a.Addr, err = eth.CreateAddress(s.hsm, label)
+	switch layout {
+	case eth.LayoutSharedToken:
+		a.Addr, err = eth.CreateAddressInToken(ctx, s.hsm, token, label)
+	default:
+		a.Addr, err = eth.CreateAddress(ctx, s.hsm, label)
+	}
 	if err != nil {
 		return a, err
 	}
 
+	s.record(ctx, label, a.Addr, hsm_repo.StateActive, meta)
 	return a, nil
 }
 
-func (s *service) GetAddressByLabel(label string) (a Address, err error) {
+// GetAddressByLabel answers from the key repository when it knows label.
+// Keys it does not know yet, created before it was configured, are looked
+// up in the HSM and recorded.
+func (s *service) GetAddressByLabel(ctx context.Context, label string) (a Address, err error) {
 	a.Label = label
-	a.Addr, err = eth.GetAddress(s.hsm, label)
+
+	if s.repo != nil {
+		k, err := s.repo.Get(label)
+		switch {
+		case err == nil && k.State == hsm_repo.StateDestroyed:
+			return a, _err.NewKeyDestroyedErr(label)
+		case err == nil:
+			a.Addr = common.HexToAddress(k.Address)
+			return a, nil
+		case !errors.Is(err, hsm_repo.ErrNotFound):
+			fmt.Println("eth_svc: unable to read key repository ", err)
+		}
+	}
+
+	if s.repo == nil {
+		a.Addr, err = eth.GetAddress(ctx, s.hsm, label)
+		return a, err
+	}
+
+	addr, retired, err := eth.AddressRetired(ctx, s.hsm, label)
 	if err != nil {
 		return a, err
 	}
 
+	a.Addr = addr
+	state := hsm_repo.StateActive
+	if retired {
+		state = hsm_repo.StateRetired
+	}
+
+	s.record(ctx, label, addr, state, Metadata{})
 	return a, nil
 }
 
-func (s *service) GetSlotAddress(slotID uint) (a Address, err error) {
-	a.Addr, err = eth.GetSlotAddress(s.hsm, slotID)
+// ListAddresses lists the addresses in the key repository matching f
+func (s *service) ListAddresses(ctx context.Context, f hsm_repo.Filter) ([]hsm_repo.Key, error) {
+	if s.repo == nil {
+		return nil, ErrNoRepo
+	}
+
+	f.Curve = hsm.CurveSecp256k1
+	return s.repo.List(f)
+}
+
+// record adds a key to the repository. The key already exists in the HSM, so
+// a failure is only logged, the key is recorded on its next lookup.
+func (s *service) record(ctx context.Context, label string, addr common.Address, state hsm_repo.State, meta Metadata) {
+	if s.repo == nil {
+		return
+	}
+
+	k, err := hsm_repo.Locate(ctx, s.hsm, label)
+	if err != nil {
+		fmt.Println("eth_svc: unable to locate key ", label, " ", err)
+		return
+	}
+
+	k.Address = addr.Hex()
+	k.Curve = hsm.CurveSecp256k1
+	k.State = state
+	k.Creator = meta.Creator
+	k.Tags = meta.Tags
+
+	if err := s.repo.Create(k); err != nil {
+		fmt.Println("eth_svc: unable to record key ", label, " ", err)
+	}
+}
+
+// setState moves a recorded key through its lifecycle, keys the repository
+// does not know are recorded on their next lookup
+func (s *service) setState(label string, state hsm_repo.State) {
+	if s.repo == nil {
+		return
+	}
+
+	err := s.repo.SetState(label, state)
+	if err != nil && !errors.Is(err, hsm_repo.ErrNotFound) {
+		fmt.Println("eth_svc: unable to update key ", label, " ", err)
+	}
+}
+
+func (s *service) GetSlotAddress(ctx context.Context, slotID uint) (a Address, err error) {
+	a.Addr, err = eth.GetSlotAddress(ctx, s.hsm, slotID)
 	if err != nil {
 		return a, err
 	}
@@ -65,9 +219,181 @@ func (s *service) GetSlotAddress(slotID uint) (a Address, err error) {
 	return a, nil
 }
 
-func (s *service) SignTransaction(tx *types.Transaction, chainID *big.Int, label string) (*types.Transaction, error) {
-	if err := s.validator.ValidateSign(); err != nil {
+// SignTransaction builds the transaction p describes and signs it with the
+// key labeled label. Invalid parameters are an InvalidTransaction error.
+func (s *service) SignTransaction(ctx context.Context, p eth.TxParams, label string) (*types.Transaction, error) {
+	tx, err := eth.NewTransaction(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.validator.ValidateSign(ctx); err != nil {
 		return nil, err
 	}
-	return eth.SignTransaction(s.hsm, tx, label, chainID)
+	return eth.SignTransaction(ctx, s.hsm, tx, label, p.ChainID)
+}
+
+// SignPersonalMessage signs msg with the EIP-191 prefix of personal_sign
+func (s *service) SignPersonalMessage(ctx context.Context, label string, msg []byte) ([]byte, error) {
+	if err := s.validator.ValidateSignMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	return eth.SignPersonalMessage(ctx, s.hsm, label, msg)
+}
+
+// SignTypedData signs an EIP-712 document whose domain is bound to chainID.
+// The validator sees the document before it is signed.
+func (s *service) SignTypedData(ctx context.Context, label string, td eth.TypedData, chainID *big.Int) ([]byte, error) {
+	if err := eth.CheckTypedDataChain(td, chainID); err != nil {
+		return nil, err
+	}
+
+	if err := s.validator.ValidateSignTypedData(ctx, td); err != nil {
+		return nil, err
+	}
+
+	return eth.SignTypedData(ctx, s.hsm, label, td, chainID)
+}
+
+// VerifyTransaction recovers the sender of a signed raw transaction
+func (s *service) VerifyTransaction(ctx context.Context, raw []byte) (v Verification, err error) {
+	tx, sender, err := eth.RecoverTransactionSender(raw)
+	if err != nil {
+		return v, err
+	}
+
+	v = s.identify(ctx, sender)
+	hash := tx.Hash()
+	v.TxHash = &hash
+	return v, nil
+}
+
+// VerifyMessage recovers the signer of a personal_sign signature over msg
+func (s *service) VerifyMessage(ctx context.Context, msg, signature []byte) (v Verification, err error) {
+	signer, err := eth.RecoverSigner(eth.PersonalMessageHash(msg), signature)
+	if err != nil {
+		return v, err
+	}
+
+	return s.identify(ctx, signer), nil
+}
+
+// VerifyTypedData recovers the signer of an eth_signTypedData_v4 signature
+func (s *service) VerifyTypedData(ctx context.Context, td eth.TypedData, signature []byte) (v Verification, err error) {
+	hash, _, err := eth.TypedDataHash(td)
+	if err != nil {
+		return v, err
+	}
+
+	signer, err := eth.RecoverSigner(hash, signature)
+	if err != nil {
+		return v, err
+	}
+
+	return s.identify(ctx, signer), nil
+}
+
+// identify looks the address up in the key repository, and in the HSM when
+// the repository does not know it. Keys found in the HSM are recorded. When
+// a lookup fails Known is left out, the recovered signer is still correct.
+func (s *service) identify(ctx context.Context, addr common.Address) Verification {
+	v := Verification{Signer: addr}
+	if s.repo != nil {
+		k, err := s.repo.GetByAddress(addr.Hex())
+		switch {
+		case err == nil:
+			known := true
+			v.Known = &known
+			v.Label = k.Label
+			v.State = k.State
+			return v
+		case !errors.Is(err, hsm_repo.ErrNotFound):
+			fmt.Println("eth_svc: unable to read key repository ", err)
+		}
+	}
+
+	label, retired, err := eth.FindAddress(ctx, s.hsm, addr)
+	switch {
+	case errors.Is(err, eth.ErrUnknownAddress):
+		known := false
+		v.Known = &known
+	case err != nil:
+		fmt.Println("eth_svc: unable to look the signer up in the hsm ", err)
+	default:
+		known := true
+		v.Known = &known
+		v.Label = label
+		v.State = hsm_repo.StateActive
+		if retired {
+			v.State = hsm_repo.StateRetired
+		}
+
+		s.record(ctx, label, addr, v.State, Metadata{})
+	}
+
+	return v
+}
+
+func (s *service) GetWrappingKey(ctx context.Context, token string, create bool) (k WrappingKey, err error) {
+	pub, err := eth.GetWrappingKey(ctx, s.hsm, token, create)
+	if err != nil {
+		return k, err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return k, err
+	}
+
+	k.Token = token
+	k.PublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	return k, nil
+}
+
+// ImportAddress imports a wrapped key into token under label. The import is
+// rejected unless the key controls expected.
+func (s *service) ImportAddress(ctx context.Context, label, token string, key eth.WrappedKey, expected common.Address, meta Metadata) (a Address, err error) {
+	if err := s.validator.ValidateCreateAddress(ctx); err != nil {
+		return a, err
+	}
+
+	a.Label = label
+	a.Addr, err = eth.ImportAddress(ctx, s.hsm, token, label, key, expected)
+	if err != nil {
+		return a, err
+	}
+
+	s.record(ctx, label, a.Addr, hsm_repo.StateActive, meta)
+	return a, nil
+}
+
+// RetireAddress stops the key labeled label from signing
+func (s *service) RetireAddress(ctx context.Context, label string) (a Address, err error) {
+	a.Label = label
+	a.Addr, err = eth.RetireAddress(ctx, s.hsm, label)
+	if err != nil {
+		return a, err
+	}
+
+	s.setState(label, hsm_repo.StateRetired)
+	return a, nil
+}
+
+// DestroyAddress destroys the retired key labeled label, confirmation is the
+// checksummed address when the destroy policy requires it
+func (s *service) DestroyAddress(ctx context.Context, label, confirmation string) (a Address, err error) {
+	if err := s.validator.ValidateDestroyAddress(ctx); err != nil {
+		return a, err
+	}
+
+	a.Label = label
+	a.Addr, err = eth.DestroyAddress(ctx, s.hsm, label, confirmation, s.destroyPolicy)
+	if err != nil {
+		return a, err
+	}
+
+	s.setState(label, hsm_repo.StateDestroyed)
+	return a, nil
 }
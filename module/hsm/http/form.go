@@ -0,0 +1,35 @@
+package hsm_http
+
+import (
+	"errors"
+	"fmt"
+	"open_custodial/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+type rotatePINForm struct {
+	Role     config.Role `json:"role"`
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+}
+
+func newRotatePINForm(c *gin.Context) (f rotatePINForm, err error) {
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	if f.Role != config.RoleCU && f.Role != config.RoleSO {
+		return f, fmt.Errorf("role must be %s or %s", config.RoleCU, config.RoleSO)
+	}
+
+	if f.Password == "" {
+		return f, errors.New("password is required")
+	}
+
+	return f, nil
+}
+
+func (f rotatePINForm) credential() config.Credential {
+	return config.Credential{Username: f.Username, Password: f.Password}
+}
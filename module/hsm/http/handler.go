@@ -0,0 +1,125 @@
+package hsm_http
+
+import (
+	"errors"
+	"net/http"
+	hsm_svc "open_custodial/module/hsm/service"
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/_http"
+	"open_custodial/pkg/hsm"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	service hsm_svc.HSMService
+}
+
+func NewHandler(s hsm_svc.HSMService) *Handler {
+	return &Handler{s}
+}
+
+func (h *Handler) Setup(r *gin.RouterGroup) {
+	r.POST("/hsm/index/refresh", h.refreshIndex)
+	r.GET("/hsm/health", h.health)
+	r.GET("/hsm/info", h.info)
+	r.POST("/hsm/pin/rotate", h.rotatePIN)
+	r.GET("/hsm/pin/rotation", h.pinRotation)
+}
+
+func (h *Handler) refreshIndex(c *gin.Context) {
+	report, err := h.service.RefreshIndex(c.Request.Context())
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		_http.UnknownError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// SignatureVars serves the ECDSA signature counters under their expvar
+// names. It replaces the expvar handler, which also publishes the command
+// line and memory statistics of the process.
+func SignatureVars(c *gin.Context) {
+	total, normalized := hsm.SignatureStats()
+	c.JSON(http.StatusOK, gin.H{
+		"hsm_ecdsa_signatures":            total,
+		"hsm_ecdsa_signatures_normalized": normalized,
+	})
+}
+
+// health answers 503 unless the module is connected, so load balancers stop
+// routing to an instance that is reconnecting
+func (h *Handler) health(c *gin.Context) {
+	status := h.service.Status()
+	if status.State != hsm.StateConnected {
+		c.JSON(http.StatusServiceUnavailable, status)
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// info answers with the report even when required mechanisms are missing,
+// its features list them
+func (h *Handler) info(c *gin.Context) {
+	report, err := h.service.Info(c.Request.Context())
+	var missing *hsm.MissingMechanismsError
+	if err != nil && !errors.As(err, &missing) {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		_http.UnknownError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// rotatePIN answers with the rotation report, whose state tells whether
+// tokens are left on the old PIN. Running it again resumes the rotation.
+func (h *Handler) rotatePIN(c *gin.Context) {
+	f, err := newRotatePINForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.service.RotatePIN(c.Request.Context(), f.Role, f.credential())
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		switch e := err.(type) {
+		case _err.RotationConflict:
+			_http.ErrorResponse(c, e, http.StatusConflict)
+			return
+		default:
+			if errors.Is(err, hsm.ErrNotConnected) {
+				_http.ErrorResponse(c, _err.NewError(err, "hsm is not connected"), http.StatusServiceUnavailable)
+				return
+			}
+
+			_http.UnknownError(c, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func (h *Handler) pinRotation(c *gin.Context) {
+	report, ok := h.service.PINRotation()
+	if !ok {
+		_http.ErrorResponse(c, _err.NewError(errors.New("no pin rotation"), "no pin rotation was started"), http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
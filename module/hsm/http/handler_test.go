@@ -0,0 +1,156 @@
+package hsm_http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	hsm_svc "open_custodial/module/hsm/service"
+	"open_custodial/pkg/hsm"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/suite"
+)
+
+type HandlerSuite struct {
+	suite.Suite
+	hsm    *hsm_mem.HSM
+	router *gin.Engine
+}
+
+func TestHandlerSuite(t *testing.T) {
+	suite.Run(t, new(HandlerSuite))
+}
+
+func (s *HandlerSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+
+	s.hsm = hsm_mem.New()
+	s.router = gin.New()
+	NewHandler(hsm_svc.NewHSMService(s.hsm)).Setup(s.router.Group("/v1"))
+}
+
+func (s *HandlerSuite) health() (int, hsm.ConnectionStatus) {
+	req := httptest.NewRequest(http.MethodGet, "/v1/hsm/health", nil)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+
+	var status hsm.ConnectionStatus
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &status))
+	return w.Code, status
+}
+
+func (s *HandlerSuite) TestHealth() {
+	code, status := s.health()
+	s.Equal(http.StatusOK, code)
+	s.Equal(hsm.StateConnected, status.State)
+
+	s.hsm.Disconnect(errors.New("device removed"))
+
+	code, status = s.health()
+	s.Equal(http.StatusServiceUnavailable, code)
+	s.Equal(hsm.StateDisconnected, status.State)
+	s.Equal("device removed", status.LastError)
+
+	s.hsm.Reconnect()
+
+	code, status = s.health()
+	s.Equal(http.StatusOK, code)
+	s.Equal(1, status.Reconnects)
+}
+
+func (s *HandlerSuite) TestInfo() {
+	req := httptest.NewRequest(http.MethodGet, "/v1/hsm/info", nil)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	s.Equal(http.StatusOK, w.Code)
+
+	var report hsm.InfoReport
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &report))
+	s.NotEmpty(report.Mechanisms)
+	s.Len(report.Tokens, 1)
+
+	for _, f := range report.Features {
+		s.True(f.Supported, f.Name)
+		s.Equal(f.Name == hsm.FeatureECDSA, f.Required, f.Name)
+	}
+}
+
+func (s *HandlerSuite) rotatePIN(body string) (int, hsm.PINRotation) {
+	req := httptest.NewRequest(http.MethodPost, "/v1/hsm/pin/rotate", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+
+	var report hsm.PINRotation
+	json.Unmarshal(w.Body.Bytes(), &report)
+	return w.Code, report
+}
+
+func (s *HandlerSuite) TestRotatePIN() {
+	for _, label := range []string{"rotate_first", "rotate_second"} {
+		_, err := s.hsm.NewSlot(context.Background(), label)
+		s.NoError(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/hsm/pin/rotation", nil)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	s.Equal(http.StatusNotFound, w.Code)
+
+	code, _ := s.rotatePIN(`{"role": "user", "password": "next"}`)
+	s.Equal(http.StatusBadRequest, code)
+
+	// the second token keeps the old PIN
+	s.hsm.Fail(hsm_mem.OpSetPIN, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), 1)
+
+	code, report := s.rotatePIN(`{"role": "cu", "username": "cu", "password": "next"}`)
+	s.Equal(http.StatusOK, code)
+	s.Equal(hsm.RotationIncomplete, report.State)
+	s.Equal([]string{"rotate_second"}, report.Rotated)
+	s.Contains(report.Failed, "rotate_first")
+
+	code, _ = s.rotatePIN(`{"role": "cu", "username": "cu", "password": "other"}`)
+	s.Equal(http.StatusConflict, code)
+
+	code, _ = s.rotatePIN(`{"role": "so", "password": "next"}`)
+	s.Equal(http.StatusConflict, code)
+
+	// resuming rotates the tokens that are left, including new ones
+	_, err := s.hsm.NewSlot(context.Background(), "rotate_third")
+	s.NoError(err)
+
+	code, report = s.rotatePIN(`{"role": "cu", "username": "cu", "password": "next"}`)
+	s.Equal(http.StatusOK, code)
+	s.Equal(hsm.RotationComplete, report.State)
+	s.Equal([]string{"rotate_first", "rotate_second", "rotate_third"}, report.Rotated)
+	s.Empty(report.Failed)
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/hsm/pin/rotation", nil)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	s.Equal(http.StatusOK, w.Code)
+	s.NotContains(w.Body.String(), "next")
+}
+
+func (s *HandlerSuite) TestSignatureVars() {
+	s.router.GET("/debug/vars", SignatureVars)
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	s.Equal(http.StatusOK, w.Code)
+
+	var vars map[string]json.RawMessage
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &vars))
+	s.Len(vars, 2)
+	s.Contains(vars, "hsm_ecdsa_signatures")
+	s.Contains(vars, "hsm_ecdsa_signatures_normalized")
+	s.NotContains(vars, "cmdline")
+	s.NotContains(vars, "memstats")
+}
@@ -0,0 +1,57 @@
+package hsm_svc
+
+import (
+	"context"
+	"errors"
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/config"
+	"open_custodial/pkg/hsm"
+)
+
+type HSMService interface {
+	RefreshIndex(ctx context.Context) (hsm.IndexReport, error)
+	Status() hsm.ConnectionStatus
+	Info(ctx context.Context) (hsm.InfoReport, error)
+	RotatePIN(ctx context.Context, role config.Role, next config.Credential) (hsm.PINRotation, error)
+	PINRotation() (hsm.PINRotation, bool)
+}
+
+type service struct {
+	hsm hsm.HSM
+}
+
+func NewHSMService(h hsm.HSM) HSMService {
+	return &service{hsm: h}
+}
+
+// RefreshIndex rescans the tokens, for when they were changed outside the
+// process and the next background refresh is too far away
+func (s *service) RefreshIndex(ctx context.Context) (hsm.IndexReport, error) {
+	return s.hsm.Refresh(ctx)
+}
+
+// Status reports whether the PKCS#11 module is connected
+func (s *service) Status() hsm.ConnectionStatus {
+	return s.hsm.Status()
+}
+
+// Info reports the mechanisms of the module and the capacity of its tokens
+func (s *service) Info(ctx context.Context) (hsm.InfoReport, error) {
+	return s.hsm.Info(ctx)
+}
+
+// RotatePIN changes the PIN of role on every token and switches the service
+// to next once all of them have it, see hsm.HSM.RotatePIN
+func (s *service) RotatePIN(ctx context.Context, role config.Role, next config.Credential) (hsm.PINRotation, error) {
+	report, err := s.hsm.RotatePIN(ctx, role, next)
+	if errors.Is(err, hsm.ErrRotationConflict) {
+		return report, _err.NewRotationConflictErr(err)
+	}
+
+	return report, err
+}
+
+// PINRotation reports the progress of the last PIN rotation
+func (s *service) PINRotation() (hsm.PINRotation, bool) {
+	return s.hsm.PINRotation()
+}
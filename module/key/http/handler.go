@@ -0,0 +1,88 @@
+package key_http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	key_svc "open_custodial/module/key/service"
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/_http"
+	"open_custodial/pkg/hsm"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	service key_svc.KeyService
+}
+
+type createKeyForm struct {
+	Label string    `json:"label"`
+	Curve hsm.Curve `json:"curve"`
+}
+
+func NewHandler(s key_svc.KeyService) *Handler {
+	return &Handler{s}
+}
+
+func (h *Handler) Setup(r *gin.RouterGroup) {
+	r.POST("/keys", h.createKey)
+	r.GET("/keys/:label", h.getKey)
+}
+
+func newCreateKeyForm(c *gin.Context) (f createKeyForm, err error) {
+	if err = c.BindJSON(&f); err != nil {
+		return f, err
+	}
+
+	if f.Label == "" {
+		return f, errors.New("label is required")
+	}
+
+	if !f.Curve.Valid() {
+		return f, fmt.Errorf("unknown curve %s, expected one of %v", f.Curve, hsm.Curves)
+	}
+
+	return f, nil
+}
+
+func (h *Handler) createKey(c *gin.Context) {
+	f, err := newCreateKeyForm(c)
+	if err != nil {
+		_http.ErrorResponse(c, _err.NewBadFormErr(err), http.StatusBadRequest)
+		return
+	}
+
+	k, err := h.service.CreateKey(c.Request.Context(), f.Label, f.Curve)
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		switch e := err.(type) {
+		case _err.DuplicateLabel:
+			_http.ErrorResponse(c, e, http.StatusBadRequest)
+			return
+		default:
+			_http.UnknownError(c, e, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, k)
+}
+
+func (h *Handler) getKey(c *gin.Context) {
+	label := _http.GetParamLabel(c)
+	k, err := h.service.GetKey(c.Request.Context(), label)
+	if err != nil {
+		if _http.ContextError(c, err) {
+			return
+		}
+
+		_http.ErrorResponse(c, _err.NewError(err, "unable to get key"), http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusOK, k)
+}
@@ -0,0 +1,87 @@
+package key_http
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	key_svc "open_custodial/module/key/service"
+	validator_svc "open_custodial/module/validator/service"
+	"open_custodial/pkg/hsm"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type HandlerSuite struct {
+	suite.Suite
+	hsm    *hsm_mem.HSM
+	router *gin.Engine
+}
+
+func TestHandlerSuite(t *testing.T) {
+	suite.Run(t, new(HandlerSuite))
+}
+
+func (s *HandlerSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+
+	s.hsm = hsm_mem.New()
+	svc := key_svc.NewKeyService(s.hsm, validator_svc.NewValidatorService())
+
+	s.router = gin.New()
+	NewHandler(svc).Setup(s.router.Group("/v1"))
+}
+
+func (s *HandlerSuite) do(method, path string, body interface{}) *httptest.ResponseRecorder {
+	var b bytes.Buffer
+	if body != nil {
+		s.NoError(json.NewEncoder(&b).Encode(body))
+	}
+
+	req := httptest.NewRequest(method, path, &b)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func (s *HandlerSuite) TestCreateAndGetKey() {
+	w := s.do(http.MethodPost, "/v1/keys", createKeyForm{Label: "handler_p256", Curve: hsm.CurveP256})
+	s.Equal(http.StatusOK, w.Code)
+
+	var created key_svc.Key
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+	s.Equal(hsm.CurveP256, created.Curve)
+
+	block, _ := pem.Decode([]byte(created.PublicKey))
+	s.NotNil(block)
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	s.NoError(err)
+	s.IsType(&ecdsa.PublicKey{}, pub)
+
+	w = s.do(http.MethodGet, "/v1/keys/handler_p256", nil)
+	s.Equal(http.StatusOK, w.Code)
+
+	var found key_svc.Key
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &found))
+	s.Equal(created, found)
+
+	w = s.do(http.MethodPost, "/v1/keys", createKeyForm{Label: "handler_p256", Curve: hsm.CurveEd25519})
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Zero(s.hsm.OpenSessions())
+}
+
+func (s *HandlerSuite) TestCreateKeyUnknownCurve() {
+	w := s.do(http.MethodPost, "/v1/keys", createKeyForm{Label: "handler_unknown", Curve: "secp384r1"})
+	s.Equal(http.StatusBadRequest, w.Code)
+
+	w = s.do(http.MethodPost, "/v1/keys", createKeyForm{Label: "handler_missing"})
+	s.Equal(http.StatusBadRequest, w.Code)
+}
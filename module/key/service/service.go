@@ -0,0 +1,102 @@
+package key_svc
+
+import (
+	"context"
+	"fmt"
+	validator_svc "open_custodial/module/validator/service"
+	"open_custodial/pkg/hsm"
+	hsm_repo "open_custodial/pkg/hsm/repository"
+	key "open_custodial/pkg/key_hsm"
+)
+
+type KeyService interface {
+	CreateKey(ctx context.Context, label string, curve hsm.Curve) (k Key, err error)
+	GetKey(ctx context.Context, label string) (k Key, err error)
+}
+
+type service struct {
+	hsm       hsm.HSM
+	validator validator_svc.ValidatorService
+	repo      hsm_repo.HSMRepo
+}
+
+type Option func(s *service)
+
+// WithRepo records the metadata of created keys in r
+func WithRepo(r hsm_repo.HSMRepo) Option {
+	return func(s *service) {
+		s.repo = r
+	}
+}
+
+func NewKeyService(h hsm.HSM, v validator_svc.ValidatorService, opts ...Option) KeyService {
+	s := &service{hsm: h, validator: v}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+type Key struct {
+	Label string    `json:"label"`
+	Curve hsm.Curve `json:"curve"`
+	// PublicKey is the PEM encoded SubjectPublicKeyInfo of the key
+	PublicKey string `json:"publicKey"`
+}
+
+// CreateKey creates a key pair on curve in a token of its own
+func (s *service) CreateKey(ctx context.Context, label string, curve hsm.Curve) (k Key, err error) {
+	if err := s.validator.ValidateCreateKey(ctx); err != nil {
+		return k, err
+	}
+
+	pub, err := key.CreateKey(ctx, s.hsm, label, curve)
+	if err != nil {
+		return k, err
+	}
+
+	s.record(ctx, label, curve)
+
+	k = Key{Label: label, Curve: curve}
+	k.PublicKey, err = key.MarshalPublicKeyPEM(pub)
+	if err != nil {
+		return k, err
+	}
+
+	return k, nil
+}
+
+func (s *service) GetKey(ctx context.Context, label string) (k Key, err error) {
+	curve, pub, err := key.GetPublicKey(ctx, s.hsm, label)
+	if err != nil {
+		return k, err
+	}
+
+	k = Key{Label: label, Curve: curve}
+	k.PublicKey, err = key.MarshalPublicKeyPEM(pub)
+	if err != nil {
+		return k, err
+	}
+
+	return k, nil
+}
+
+// record adds a created key to the repository, a failure is only logged as
+// the key already exists in the HSM
+func (s *service) record(ctx context.Context, label string, curve hsm.Curve) {
+	if s.repo == nil {
+		return
+	}
+
+	k, err := hsm_repo.Locate(ctx, s.hsm, label)
+	if err != nil {
+		fmt.Println("key_svc: unable to locate key ", label, " ", err)
+		return
+	}
+
+	k.Curve = curve
+	if err := s.repo.Create(k); err != nil {
+		fmt.Println("key_svc: unable to record key ", label, " ", err)
+	}
+}
@@ -1,8 +1,22 @@
 package validator_svc
 
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
 type ValidatorService interface {
-	ValidateSign() error
-	ValidateCreateAddress() error
+	ValidateSign(ctx context.Context) error
+	// ValidateSignMessage sees the message as the caller sent it, before the
+	// EIP-191 prefix is applied
+	ValidateSignMessage(ctx context.Context, msg []byte) error
+	// ValidateSignTypedData sees the decoded EIP-712 document, so policies
+	// can inspect the domain and message of permits, orders or votes
+	ValidateSignTypedData(ctx context.Context, data apitypes.TypedData) error
+	ValidateCreateAddress(ctx context.Context) error
+	ValidateCreateKey(ctx context.Context) error
+	ValidateDestroyAddress(ctx context.Context) error
 }
 
 type service struct {
@@ -13,11 +27,31 @@ func NewValidatorService() ValidatorService {
 }
 
 // TODO - find and invoke validator webhook
-func (s *service) ValidateSign() error {
+func (s *service) ValidateSign(ctx context.Context) error {
+	return nil
+}
+
+// TODO - find and invoke validator webhook
+func (s *service) ValidateSignMessage(ctx context.Context, msg []byte) error {
+	return nil
+}
+
+// TODO - find and invoke validator webhook
+func (s *service) ValidateSignTypedData(ctx context.Context, data apitypes.TypedData) error {
+	return nil
+}
+
+// TODO - find and invoke validator webhook
+func (s *service) ValidateCreateAddress(ctx context.Context) error {
+	return nil
+}
+
+// TODO - find and invoke validator webhook
+func (s *service) ValidateCreateKey(ctx context.Context) error {
 	return nil
 }
 
 // TODO - find and invoke validator webhook
-func (s *service) ValidateCreateAddress() error {
+func (s *service) ValidateDestroyAddress(ctx context.Context) error {
 	return nil
 }
@@ -49,3 +49,64 @@ type BadForm struct{ Err }
 func NewBadFormErr(e error) BadForm {
 	return BadForm{Err{error: e, Message: "invalid request form"}}
 }
+
+type AddressMismatch struct{ Err }
+
+func NewAddressMismatchErr(expected string) AddressMismatch {
+	message := fmt.Sprintf("imported key does not control address %s", expected)
+	return AddressMismatch{Err{error: errors.New(message), Message: message}}
+}
+
+type DestroyRefused struct{ Err }
+
+func NewDestroyRefusedErr(label, reason string) DestroyRefused {
+	message := fmt.Sprintf("refusing to destroy %s: %s", label, reason)
+	return DestroyRefused{Err{error: errors.New(message), Message: message}}
+}
+
+type KeyDestroyed struct{ Err }
+
+func NewKeyDestroyedErr(label string) KeyDestroyed {
+	message := fmt.Sprintf("key %s was destroyed", label)
+	return KeyDestroyed{Err{error: errors.New(message), Message: message}}
+}
+
+type TokenNotFound struct{ Err }
+
+func NewTokenNotFoundErr(token string) TokenNotFound {
+	message := fmt.Sprintf("token %s does not exist", token)
+	return TokenNotFound{Err{error: errors.New(message), Message: message}}
+}
+
+type Timeout struct{ Err }
+
+func NewTimeoutErr(e error) Timeout {
+	return Timeout{Err{error: e, Message: "the hsm did not answer in time"}}
+}
+
+type RotationConflict struct{ Err }
+
+func NewRotationConflictErr(e error) RotationConflict {
+	return RotationConflict{Err{error: e, Message: e.Error()}}
+}
+
+type InvalidTransaction struct{ Err }
+
+func NewInvalidTransactionErr(reason string) InvalidTransaction {
+	message := fmt.Sprintf("invalid transaction: %s", reason)
+	return InvalidTransaction{Err{error: errors.New(message), Message: message}}
+}
+
+type InvalidTypedData struct{ Err }
+
+func NewInvalidTypedDataErr(reason string) InvalidTypedData {
+	message := fmt.Sprintf("invalid typed data: %s", reason)
+	return InvalidTypedData{Err{error: errors.New(message), Message: message}}
+}
+
+type InvalidSignature struct{ Err }
+
+func NewInvalidSignatureErr(reason string) InvalidSignature {
+	message := fmt.Sprintf("invalid signature: %s", reason)
+	return InvalidSignature{Err{error: errors.New(message), Message: message}}
+}
@@ -1,7 +1,10 @@
 package _http
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -11,6 +14,10 @@ import (
 
 type HttpParam string
 
+// StatusClientClosedRequest is logged for requests whose client went away
+// before they were answered
+const StatusClientClosedRequest = 499
+
 const (
 	ParamLabel  HttpParam = "label"
 	ParamSlotID HttpParam = "slotID"
@@ -34,3 +41,19 @@ func UnknownError(c *gin.Context, err error, statusCode int) {
 		Details: err.Error(),
 	})
 }
+
+// ContextError answers requests that ended because their context did. A
+// deadline is reported as 504, a client that went away gets no body. It
+// reports whether err was such an error.
+func ContextError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		ErrorResponse(c, _err.NewTimeoutErr(err), http.StatusGatewayTimeout)
+		return true
+	case errors.Is(err, context.Canceled):
+		c.AbortWithStatus(StatusClientClosedRequest)
+		return true
+	default:
+		return false
+	}
+}
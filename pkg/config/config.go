@@ -1,28 +1,389 @@
 package config
 
-import "os"
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	HSMLibPath  string
 	CU_USERNAME string
 	CU_PASSWORD string
+	SO_USERNAME string
 	SO_PASSWORD string
+	// Credentials is where PINs are read from, one of the Credentials
+	// constants, the environment variables above when empty
+	Credentials string
+	// CredentialsDir holds the secret files of CredentialsFile, with a sub
+	// directory per backend
+	CredentialsDir string
+	// CredentialsSealedFile is the file of CredentialsSealed and
+	// CredentialsPassphraseFile the file its passphrase is read from at
+	// startup
+	CredentialsSealedFile     string
+	CredentialsPassphraseFile string
+	// CredentialsURL is the secret store of CredentialsHTTP, authenticated
+	// with the bearer token in CredentialsTokenFile. CredentialsTTL is how
+	// long fetched credentials are cached, as a time.Duration string.
+	CredentialsURL       string
+	CredentialsTokenFile string
+	CredentialsTTL       string
+	// KeyBackupKEK is the hex encoded AES key encryption key backups are
+	// wrapped with, empty unless backup mode is on
+	KeyBackupKEK string
+	// IndexRefresh is how often the token index is rebuilt, as a
+	// time.Duration string, empty to never refresh it in the background
+	IndexRefresh string
+	// DestroyConfirm is "true" when destroying an address requires its
+	// checksummed address as confirmation
+	DestroyConfirm string
+	// DestroyWaitingPeriod is how long an address has to be retired before
+	// it can be destroyed, as a time.Duration string
+	DestroyWaitingPeriod string
+	// LegacySOPin is "true" when SO logins may fall back to the crypto user
+	// PIN, which tokens created before the SO had a credential of its own
+	// have as SO PIN
+	LegacySOPin string
+	// RotationStateDir is where an incomplete PIN rotation is kept, sealed
+	// with the passphrase of CredentialsPassphraseFile, with a sub directory
+	// per backend. Empty keeps it in memory only.
+	RotationStateDir string
+	// HealthCheck is how often the PKCS#11 module is probed, as a
+	// time.Duration string, empty to only reconnect after failed requests
+	HealthCheck string
+	// Timeout bounds every call into the PKCS#11 module, as a time.Duration
+	// string, empty to only stop at the deadline of the request
+	Timeout string
+	// KeyRepoPath is the bbolt database key metadata is kept in, empty to
+	// answer every lookup from the HSM
+	KeyRepoPath string
+	// OperationTimeouts overrides Timeout per operation, keyed by the lower
+	// case operation name from HSM_TIMEOUT_<OPERATION>
+	OperationTimeouts map[string]string
+	// Backends lists the PKCS#11 modules of a multi backend setup, empty when
+	// only the module at HSMLibPath is used
+	Backends []BackendConfig
 }
 
+// BackendConfig is a named PKCS#11 module with its own credentials, read
+// from HSM_<NAME>_ prefixed variables
+type BackendConfig struct {
+	Name        string
+	HSMLibPath  string
+	CU_USERNAME string
+	CU_PASSWORD string
+	SO_USERNAME string
+	SO_PASSWORD string
+	// LabelPrefixes routes new tokens with a matching label to the backend
+	LabelPrefixes []string
+	// ReplicaOf names the backend this one holds copies of the keys of
+	ReplicaOf string
+}
+
+// Credentials sources
+const (
+	CredentialsEnv    = "env"
+	CredentialsFile   = "file"
+	CredentialsSealed = "sealed"
+	CredentialsHTTP   = "http"
+)
+
 type ENVKey string
 
 const (
-	KeyHSMLibPath ENVKey = "HSM_LIB_PATH"
-	KeyCUUsername ENVKey = "CU_USERNAME"
-	KeyCUPassword ENVKey = "CU_PASSWORD"
-	KeySOPassword ENVKey = "SO_PASSWORD"
+	KeyHSMLibPath           ENVKey = "HSM_LIB_PATH"
+	KeyCUUsername           ENVKey = "CU_USERNAME"
+	KeyCUPassword           ENVKey = "CU_PASSWORD"
+	KeySOUsername           ENVKey = "SO_USERNAME"
+	KeySOPassword           ENVKey = "SO_PASSWORD"
+	KeyCredentials          ENVKey = "HSM_CREDENTIALS"
+	KeyCredentialsDir       ENVKey = "HSM_CREDENTIALS_DIR"
+	KeyCredentialsFile      ENVKey = "HSM_CREDENTIALS_FILE"
+	KeyCredentialsPassFile  ENVKey = "HSM_CREDENTIALS_PASSPHRASE_FILE"
+	KeyCredentialsURL       ENVKey = "HSM_CREDENTIALS_URL"
+	KeyCredentialsTokenFile ENVKey = "HSM_CREDENTIALS_TOKEN_FILE"
+	KeyCredentialsTTL       ENVKey = "HSM_CREDENTIALS_TTL"
+	KeyBackupKEK            ENVKey = "KEY_BACKUP_KEK"
+	KeyIndexRefresh         ENVKey = "HSM_INDEX_REFRESH"
+	KeyDestroyConfirm       ENVKey = "DESTROY_REQUIRE_CONFIRMATION"
+	KeyDestroyWaitingPeriod ENVKey = "DESTROY_WAITING_PERIOD"
+	KeyHealthCheck          ENVKey = "HSM_HEALTH_CHECK"
+	KeyLegacySOPin          ENVKey = "HSM_LEGACY_SO_PIN"
+	KeyRotationStateDir     ENVKey = "HSM_ROTATION_STATE_DIR"
+	KeyRepoPath             ENVKey = "KEY_REPO_PATH"
+	// KeyTimeout is the default timeout, HSM_TIMEOUT_<OPERATION> sets the
+	// timeout of a single operation
+	KeyTimeout ENVKey = "HSM_TIMEOUT"
+	// KeyBackends is a comma separated list of backend names, every backend
+	// is configured with the variables below prefixed by HSM_<NAME>_
+	KeyBackends ENVKey = "HSM_BACKENDS"
+)
+
+const (
+	KeyBackendLibPath       ENVKey = "LIB_PATH"
+	KeyBackendLabelPrefixes ENVKey = "LABEL_PREFIXES"
+	KeyBackendReplicaOf     ENVKey = "REPLICA_OF"
 )
 
 func NewConfig() Config {
 	return Config{
-		HSMLibPath:  os.Getenv(string(KeyHSMLibPath)),
-		CU_USERNAME: os.Getenv(string(KeyCUUsername)),
-		CU_PASSWORD: os.Getenv(string(KeyCUPassword)),
-		SO_PASSWORD: os.Getenv(string(KeySOPassword)),
+		HSMLibPath:                os.Getenv(string(KeyHSMLibPath)),
+		CU_USERNAME:               os.Getenv(string(KeyCUUsername)),
+		CU_PASSWORD:               os.Getenv(string(KeyCUPassword)),
+		SO_USERNAME:               os.Getenv(string(KeySOUsername)),
+		SO_PASSWORD:               os.Getenv(string(KeySOPassword)),
+		Credentials:               os.Getenv(string(KeyCredentials)),
+		CredentialsDir:            os.Getenv(string(KeyCredentialsDir)),
+		CredentialsSealedFile:     os.Getenv(string(KeyCredentialsFile)),
+		CredentialsPassphraseFile: os.Getenv(string(KeyCredentialsPassFile)),
+		CredentialsURL:            os.Getenv(string(KeyCredentialsURL)),
+		CredentialsTokenFile:      os.Getenv(string(KeyCredentialsTokenFile)),
+		CredentialsTTL:            os.Getenv(string(KeyCredentialsTTL)),
+		KeyBackupKEK:              os.Getenv(string(KeyBackupKEK)),
+		IndexRefresh:              os.Getenv(string(KeyIndexRefresh)),
+		DestroyConfirm:            os.Getenv(string(KeyDestroyConfirm)),
+		DestroyWaitingPeriod:      os.Getenv(string(KeyDestroyWaitingPeriod)),
+		HealthCheck:               os.Getenv(string(KeyHealthCheck)),
+		LegacySOPin:               os.Getenv(string(KeyLegacySOPin)),
+		RotationStateDir:          os.Getenv(string(KeyRotationStateDir)),
+		Timeout:                   os.Getenv(string(KeyTimeout)),
+		KeyRepoPath:               os.Getenv(string(KeyRepoPath)),
+		OperationTimeouts:         newOperationTimeouts(os.Environ()),
+		Backends:                  newBackendConfigs(os.Getenv(string(KeyBackends))),
+	}
+}
+
+func newBackendConfigs(names string) []BackendConfig {
+	var backends []BackendConfig
+	for _, name := range splitList(names) {
+		env := func(key ENVKey) string {
+			return os.Getenv(fmt.Sprintf("HSM_%s_%s", strings.ToUpper(name), key))
+		}
+
+		backends = append(backends, BackendConfig{
+			Name:          name,
+			HSMLibPath:    env(KeyBackendLibPath),
+			CU_USERNAME:   env(KeyCUUsername),
+			CU_PASSWORD:   env(KeyCUPassword),
+			SO_USERNAME:   env(KeySOUsername),
+			SO_PASSWORD:   env(KeySOPassword),
+			LabelPrefixes: splitList(env(KeyBackendLabelPrefixes)),
+			ReplicaOf:     env(KeyBackendReplicaOf),
+		})
+	}
+
+	return backends
+}
+
+func newOperationTimeouts(environ []string) map[string]string {
+	prefix := string(KeyTimeout) + "_"
+	timeouts := make(map[string]string)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+
+		if i := strings.Index(kv, "="); i > len(prefix) {
+			timeouts[strings.ToLower(kv[len(prefix):i])] = kv[i+1:]
+		}
 	}
+
+	return timeouts
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// BackupKEK decodes KeyBackupKEK, it returns nil when backup mode is off
+func (c Config) BackupKEK() ([]byte, error) {
+	if c.KeyBackupKEK == "" {
+		return nil, nil
+	}
+
+	return hex.DecodeString(c.KeyBackupKEK)
+}
+
+// IndexRefreshInterval parses IndexRefresh, it returns zero when background
+// refresh is off
+func (c Config) IndexRefreshInterval() (time.Duration, error) {
+	if c.IndexRefresh == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(c.IndexRefresh)
+}
+
+// DestroyRequiresConfirmation parses DestroyConfirm, it is off when unset
+func (c Config) DestroyRequiresConfirmation() (bool, error) {
+	if c.DestroyConfirm == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(c.DestroyConfirm)
+}
+
+// LegacySOPinAllowed parses LegacySOPin, it is off when unset
+func (c Config) LegacySOPinAllowed() (bool, error) {
+	if c.LegacySOPin == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(c.LegacySOPin)
+}
+
+// RotationStatePath is the file the PIN rotation of backend is kept in,
+// empty when RotationStateDir is not set
+func (c Config) RotationStatePath(backend string) string {
+	if c.RotationStateDir == "" {
+		return ""
+	}
+
+	return filepath.Join(c.RotationStateDir, backend, "rotation.sealed")
+}
+
+// DestroyWaitingPeriodDuration parses DestroyWaitingPeriod, it returns zero
+// when there is no waiting period
+func (c Config) DestroyWaitingPeriodDuration() (time.Duration, error) {
+	if c.DestroyWaitingPeriod == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(c.DestroyWaitingPeriod)
+}
+
+// HealthCheckInterval parses HealthCheck, it returns zero when the module is
+// not probed
+func (c Config) HealthCheckInterval() (time.Duration, error) {
+	if c.HealthCheck == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(c.HealthCheck)
+}
+
+// OperationTimeout parses the timeout of op, falling back to Timeout. It
+// returns zero when calls of op are not bounded.
+func (c Config) OperationTimeout(op string) (time.Duration, error) {
+	timeout, ok := c.OperationTimeouts[op]
+	if !ok {
+		timeout = c.Timeout
+	}
+
+	if timeout == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(timeout)
+}
+
+// CredentialProvider returns the provider of the credentials of backend, or
+// of the module at HSMLibPath when backend is empty. Sealed credentials are
+// unsealed here, so a wrong passphrase stops the process at startup.
+func (c Config) CredentialProvider(backend string) (CredentialProvider, error) {
+	switch c.Credentials {
+	case "", CredentialsEnv:
+		if backend == "" {
+			return NewStaticProvider(
+				Credential{Username: c.CU_USERNAME, Password: c.CU_PASSWORD},
+				Credential{Username: c.SO_USERNAME, Password: c.SO_PASSWORD},
+			), nil
+		}
+
+		for _, b := range c.Backends {
+			if b.Name == backend {
+				return NewStaticProvider(
+					Credential{Username: b.CU_USERNAME, Password: b.CU_PASSWORD},
+					Credential{Username: b.SO_USERNAME, Password: b.SO_PASSWORD},
+				), nil
+			}
+		}
+
+		return nil, fmt.Errorf("unknown hsm backend %s", backend)
+	case CredentialsFile:
+		if c.CredentialsDir == "" {
+			return nil, fmt.Errorf("%s is required for %s credentials", KeyCredentialsDir, c.Credentials)
+		}
+
+		return NewFileProvider(filepath.Join(c.CredentialsDir, backend)), nil
+	case CredentialsSealed:
+		creds, err := c.unsealCredentials()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewSealedProvider(creds, backend), nil
+	case CredentialsHTTP:
+		if c.CredentialsURL == "" {
+			return nil, fmt.Errorf("%s is required for %s credentials", KeyCredentialsURL, c.Credentials)
+		}
+
+		var token string
+		if c.CredentialsTokenFile != "" {
+			t, err := readSecretFile(c.CredentialsTokenFile)
+			if err != nil {
+				return nil, err
+			}
+			token = t
+		}
+
+		var ttl time.Duration
+		if c.CredentialsTTL != "" {
+			d, err := time.ParseDuration(c.CredentialsTTL)
+			if err != nil {
+				return nil, err
+			}
+			ttl = d
+		}
+
+		return NewHTTPProvider(c.CredentialsURL, token, backend, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown credentials source %s", c.Credentials)
+	}
+}
+
+func (c Config) unsealCredentials() (map[string]Credential, error) {
+	if c.CredentialsSealedFile == "" || c.CredentialsPassphraseFile == "" {
+		return nil, fmt.Errorf("%s and %s are required for %s credentials", KeyCredentialsFile, KeyCredentialsPassFile, c.Credentials)
+	}
+
+	sealed, err := ioutil.ReadFile(c.CredentialsSealedFile)
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase, err := c.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	return UnsealCredentials(sealed, passphrase)
+}
+
+// Passphrase reads the passphrase of sealed credentials from
+// CredentialsPassphraseFile
+func (c Config) Passphrase() ([]byte, error) {
+	if c.CredentialsPassphraseFile == "" {
+		return nil, fmt.Errorf("%s is not set", KeyCredentialsPassFile)
+	}
+
+	passphrase, err := readSecretFile(c.CredentialsPassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(passphrase), nil
 }
@@ -0,0 +1,359 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Role is the PKCS#11 user a credential logs in as
+type Role string
+
+const (
+	// RoleCU is the crypto user that owns and uses the keys
+	RoleCU Role = "cu"
+	// RoleSO is the security officer that initializes tokens and their PINs
+	RoleSO Role = "so"
+)
+
+// Credential logs a role into a token. It never prints its password, so it
+// is safe to hand to fmt or a JSON encoder.
+type Credential struct {
+	Username string
+	Password string
+}
+
+// PIN is what C_Login expects, username:password when there is a username
+func (c Credential) PIN() string {
+	if c.Username == "" {
+		return c.Password
+	}
+
+	return fmt.Sprintf("%s:%s", c.Username, c.Password)
+}
+
+func (c Credential) String() string {
+	return fmt.Sprintf("%s:<redacted>", c.Username)
+}
+
+func (c Credential) GoString() string {
+	return c.String()
+}
+
+func (c Credential) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+// CredentialProvider hands out the credentials of one PKCS#11 module. It is
+// asked on every login, so secrets rotated at the source are picked up.
+type CredentialProvider interface {
+	Credential(role Role) (Credential, error)
+}
+
+// secret is the wire format of a credential in sealed files and secret
+// store responses
+type secret struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CredentialKey names the credential of role for backend in files and secret
+// stores, backend is empty for the module at HSM_LIB_PATH
+func CredentialKey(backend string, role Role) string {
+	if backend == "" {
+		return string(role)
+	}
+
+	return fmt.Sprintf("%s/%s", backend, role)
+}
+
+func missingCredential(role Role) error {
+	return fmt.Errorf("no %s credential configured", role)
+}
+
+type staticProvider map[Role]Credential
+
+// NewStaticProvider hands out fixed credentials, like the ones read from
+// environment variables
+func NewStaticProvider(cu, so Credential) CredentialProvider {
+	return staticProvider{RoleCU: cu, RoleSO: so}
+}
+
+func (p staticProvider) Credential(role Role) (Credential, error) {
+	c, ok := p[role]
+	if !ok || c.Password == "" {
+		return Credential{}, missingCredential(role)
+	}
+
+	return c, nil
+}
+
+type fileProvider struct {
+	dir string
+}
+
+// NewFileProvider reads <role>_username and <role>_password from dir, the
+// way Docker and Kubernetes mount secrets. The username file is optional.
+// Files are read on every call so secrets rotated in place are picked up.
+func NewFileProvider(dir string) CredentialProvider {
+	return fileProvider{dir}
+}
+
+func (p fileProvider) Credential(role Role) (Credential, error) {
+	password, err := readSecretFile(filepath.Join(p.dir, fmt.Sprintf("%s_password", role)))
+	if errors.Is(err, os.ErrNotExist) {
+		return Credential{}, missingCredential(role)
+	}
+	if err != nil {
+		return Credential{}, err
+	}
+
+	username, err := readSecretFile(filepath.Join(p.dir, fmt.Sprintf("%s_username", role)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Credential{}, err
+	}
+
+	return Credential{Username: username, Password: password}, nil
+}
+
+// readSecretFile reads a secret without the trailing newline editors and
+// echo leave behind
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+const sealedVersion = 1
+
+// scrypt parameters of sealed credential files
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+)
+
+// sealedFile is the on disk format of SealCredentials
+type sealedFile struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// SealCredentials encrypts creds, keyed by CredentialKey, with AES-256-GCM
+// under a key derived from passphrase with scrypt
+func SealCredentials(creds map[string]Credential, passphrase []byte) ([]byte, error) {
+	secrets := make(map[string]secret, len(creds))
+	for key, c := range creds {
+		secrets[key] = secret{c.Username, c.Password}
+	}
+
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	f := sealedFile{Version: sealedVersion, Salt: make([]byte, saltLen)}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := sealingKey(passphrase, f.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return nil, err
+	}
+
+	f.Ciphertext = aead.Seal(nil, f.Nonce, plaintext, nil)
+	return json.Marshal(f)
+}
+
+// UnsealCredentials decrypts a file written by SealCredentials
+func UnsealCredentials(sealed, passphrase []byte) (map[string]Credential, error) {
+	var f sealedFile
+	if err := json.Unmarshal(sealed, &f); err != nil {
+		return nil, fmt.Errorf("unable to read sealed credentials: %w", err)
+	}
+
+	if f.Version != sealedVersion {
+		return nil, fmt.Errorf("unsupported sealed credentials version %d", f.Version)
+	}
+
+	aead, err := sealingKey(passphrase, f.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(f.Nonce) != aead.NonceSize() {
+		return nil, errors.New("sealed credentials have an invalid nonce")
+	}
+
+	plaintext, err := aead.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("unable to unseal credentials, wrong passphrase or corrupted file")
+	}
+
+	var secrets map[string]secret
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, errors.New("sealed credentials are malformed")
+	}
+
+	creds := make(map[string]Credential, len(secrets))
+	for key, s := range secrets {
+		creds[key] = Credential{s.Username, s.Password}
+	}
+
+	return creds, nil
+}
+
+func sealingKey(passphrase, salt []byte) (cipher.AEAD, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase of sealed credentials is empty")
+	}
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type sealedProvider struct {
+	creds   map[string]Credential
+	backend string
+}
+
+// NewSealedProvider hands out the credentials of backend from unsealed
+// credentials, see UnsealCredentials
+func NewSealedProvider(creds map[string]Credential, backend string) CredentialProvider {
+	return sealedProvider{creds, backend}
+}
+
+func (p sealedProvider) Credential(role Role) (Credential, error) {
+	c, ok := p.creds[CredentialKey(p.backend, role)]
+	if !ok || c.Password == "" {
+		return Credential{}, missingCredential(role)
+	}
+
+	return c, nil
+}
+
+// defaultCredentialsTTL is how long credentials from a secret store are
+// cached
+const defaultCredentialsTTL = 5 * time.Minute
+
+type cachedCredential struct {
+	credential Credential
+	expires    time.Time
+}
+
+type httpProvider struct {
+	url     string
+	token   string
+	backend string
+	ttl     time.Duration
+	client  *http.Client
+
+	mu    sync.Mutex
+	cache map[Role]cachedCredential
+}
+
+// NewHTTPProvider fetches credentials from a secret store with
+// GET <url>/<CredentialKey> and a bearer token. The store answers with
+// {"username": "...", "password": "..."}. Credentials are cached for ttl.
+func NewHTTPProvider(url, token, backend string, ttl time.Duration) CredentialProvider {
+	if ttl <= 0 {
+		ttl = defaultCredentialsTTL
+	}
+
+	return &httpProvider{
+		url:     strings.TrimRight(url, "/"),
+		token:   token,
+		backend: backend,
+		ttl:     ttl,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		cache:   make(map[Role]cachedCredential),
+	}
+}
+
+func (p *httpProvider) Credential(role Role) (Credential, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if c, ok := p.cache[role]; ok && time.Now().Before(c.expires) {
+		return c.credential, nil
+	}
+
+	c, err := p.fetch(role)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	p.cache[role] = cachedCredential{c, time.Now().Add(p.ttl)}
+	return c, nil
+}
+
+func (p *httpProvider) fetch(role Role) (Credential, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s", p.url, CredentialKey(p.backend, role)), nil)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Credential{}, fmt.Errorf("unable to fetch %s credential: %w", role, err)
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return Credential{}, missingCredential(role)
+	case resp.StatusCode != http.StatusOK:
+		// the body is never part of the error, it may hold the secret
+		return Credential{}, fmt.Errorf("unable to fetch %s credential: secret store answered %d", role, resp.StatusCode)
+	}
+
+	var s secret
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return Credential{}, fmt.Errorf("unable to read %s credential from secret store", role)
+	}
+
+	if s.Password == "" {
+		return Credential{}, missingCredential(role)
+	}
+
+	return Credential{Username: s.Username, Password: s.Password}, nil
+}
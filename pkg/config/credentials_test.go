@@ -0,0 +1,177 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CredentialsSuite struct {
+	suite.Suite
+	dir string
+}
+
+func TestCredentialsSuite(t *testing.T) {
+	suite.Run(t, new(CredentialsSuite))
+}
+
+func (s *CredentialsSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "credentials")
+	s.NoError(err)
+	s.dir = dir
+}
+
+func (s *CredentialsSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *CredentialsSuite) write(name, content string) {
+	s.NoError(ioutil.WriteFile(filepath.Join(s.dir, name), []byte(content), 0600))
+}
+
+func (s *CredentialsSuite) TestRolesAreSeparate() {
+	p := NewStaticProvider(Credential{"cu", "cu_pass"}, Credential{"so", "so_pass"})
+
+	cu, err := p.Credential(RoleCU)
+	s.NoError(err)
+	s.Equal("cu:cu_pass", cu.PIN())
+
+	so, err := p.Credential(RoleSO)
+	s.NoError(err)
+	s.Equal("so:so_pass", so.PIN())
+
+	_, err = NewStaticProvider(Credential{"cu", "cu_pass"}, Credential{}).Credential(RoleSO)
+	s.Error(err)
+}
+
+func (s *CredentialsSuite) TestRedacted() {
+	c := Credential{"cu", "hunter2"}
+
+	for _, out := range []string{fmt.Sprint(c), fmt.Sprintf("%v %+v %#v", c, c, c)} {
+		s.NotContains(out, "hunter2")
+	}
+
+	b, err := json.Marshal(struct{ Credential Credential }{c})
+	s.NoError(err)
+	s.NotContains(string(b), "hunter2")
+}
+
+func (s *CredentialsSuite) TestFileProvider() {
+	s.write("cu_username", "cu\n")
+	s.write("cu_password", "cu_pass\n")
+	s.write("so_password", "so_pass")
+
+	p := NewFileProvider(s.dir)
+
+	cu, err := p.Credential(RoleCU)
+	s.NoError(err)
+	s.Equal(Credential{"cu", "cu_pass"}, cu)
+
+	so, err := p.Credential(RoleSO)
+	s.NoError(err)
+	s.Equal("so_pass", so.PIN())
+
+	// rotated in place
+	s.write("cu_password", "rotated")
+	cu, err = p.Credential(RoleCU)
+	s.NoError(err)
+	s.Equal("rotated", cu.Password)
+
+	_, err = NewFileProvider(filepath.Join(s.dir, "missing")).Credential(RoleCU)
+	s.Error(err)
+}
+
+func (s *CredentialsSuite) TestSealed() {
+	creds := map[string]Credential{
+		CredentialKey("", RoleCU):        {"cu", "cu_pass"},
+		CredentialKey("", RoleSO):        {"so", "so_pass"},
+		CredentialKey("replica", RoleCU): {"cu", "replica_pass"},
+	}
+
+	sealed, err := SealCredentials(creds, []byte("passphrase"))
+	s.NoError(err)
+	s.NotContains(string(sealed), "cu_pass")
+
+	_, err = UnsealCredentials(sealed, []byte("wrong"))
+	s.Error(err)
+
+	unsealed, err := UnsealCredentials(sealed, []byte("passphrase"))
+	s.NoError(err)
+	s.Equal(creds, unsealed)
+
+	cu, err := NewSealedProvider(unsealed, "replica").Credential(RoleCU)
+	s.NoError(err)
+	s.Equal("replica_pass", cu.Password)
+
+	_, err = NewSealedProvider(unsealed, "replica").Credential(RoleSO)
+	s.Error(err)
+}
+
+func (s *CredentialsSuite) TestSealedFromConfig() {
+	sealed, err := SealCredentials(map[string]Credential{"cu": {"cu", "cu_pass"}}, []byte("passphrase"))
+	s.NoError(err)
+	s.write("creds.sealed", string(sealed))
+	s.write("passphrase", "passphrase\n")
+
+	c := Config{
+		Credentials:               CredentialsSealed,
+		CredentialsSealedFile:     filepath.Join(s.dir, "creds.sealed"),
+		CredentialsPassphraseFile: filepath.Join(s.dir, "passphrase"),
+	}
+
+	p, err := c.CredentialProvider("")
+	s.NoError(err)
+
+	cu, err := p.Credential(RoleCU)
+	s.NoError(err)
+	s.Equal("cu_pass", cu.Password)
+
+	s.write("passphrase", "wrong")
+	_, err = c.CredentialProvider("")
+	s.Error(err)
+}
+
+func (s *CredentialsSuite) TestHTTPProvider() {
+	calls := 0
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"password": "leaked"}`))
+			return
+		}
+
+		if r.URL.Path != "/primary/cu" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(secret{"cu", "cu_pass"})
+	}))
+	defer store.Close()
+
+	p := NewHTTPProvider(store.URL+"/", "token", "primary", time.Minute)
+
+	for i := 0; i < 2; i++ {
+		cu, err := p.Credential(RoleCU)
+		s.NoError(err)
+		s.Equal(Credential{"cu", "cu_pass"}, cu)
+	}
+	s.Equal(1, calls)
+
+	_, err := p.Credential(RoleSO)
+	s.Error(err)
+
+	_, err = NewHTTPProvider(store.URL, "wrong", "primary", time.Minute).Credential(RoleCU)
+	s.Error(err)
+	s.False(strings.Contains(err.Error(), "leaked"))
+}
@@ -0,0 +1,162 @@
+package eth_hsm
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"open_custodial/pkg/hsm"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// BackupVersion is the version of the backup format written by BackupKey
+const BackupVersion = 1
+
+const backupCurve = "secp256k1"
+
+// Backup is an exported key. The key is wrapped under the backup key
+// encryption key, and the backup as a whole is authenticated with a MAC
+// derived from the same key, so neither the key nor its label and address
+// can be changed without restore noticing.
+type Backup struct {
+	Version    int               `json:"version"`
+	Label      string            `json:"label"`
+	Address    common.Address    `json:"address"`
+	Curve      string            `json:"curve"`
+	Mechanism  hsm.WrapMechanism `json:"mechanism"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	WrappedKey []byte            `json:"wrappedKey"`
+	MAC        []byte            `json:"mac"`
+}
+
+// BackupKey exports the key labeled label. The key must have been created
+// in backup mode, see hsm.WithKeyBackup, and kek must be the backup key
+// encryption key the HSM was configured with.
+func BackupKey(ctx context.Context, h hsm.HSM, label string, kek []byte) (b Backup, err error) {
+	loc, err := h.LocateKey(ctx, label)
+	if err != nil {
+		return b, err
+	}
+
+	sess, err := h.NewSlotSession(ctx, loc.Token)
+	if err != nil {
+		return b, err
+	}
+
+	defer h.EndSession(sess)
+
+	pubKeyBytes, privHandle, err := getSigningKeys(ctx, h, sess, loc.Key)
+	if err != nil {
+		return b, err
+	}
+
+	pub, err := crypto.UnmarshalPubkey(pubKeyBytes)
+	if err != nil {
+		return b, err
+	}
+
+	wrapped, err := h.WrapKeyECDSA_secp256k1(ctx, *sess, hsm.BackupKEKLabel, privHandle)
+	if err != nil {
+		return b, fmt.Errorf("unable to wrap key %s, only keys created in backup mode can be exported: %w", label, err)
+	}
+
+	b = Backup{
+		Version:    BackupVersion,
+		Label:      label,
+		Address:    crypto.PubkeyToAddress(*pub),
+		Curve:      backupCurve,
+		Mechanism:  hsm.WrapAESKeyWrapPad,
+		CreatedAt:  time.Now().UTC(),
+		WrappedKey: wrapped,
+	}
+	b.MAC = b.mac(kek)
+
+	return b, nil
+}
+
+// RestoreKey unwraps a backup into token under its original label and
+// checks the restored key derives the address the backup was taken from.
+// The token is initialized if it does not exist yet.
+func RestoreKey(ctx context.Context, h hsm.HSM, b Backup, token string, kek []byte) (addr common.Address, err error) {
+	if err := b.Verify(kek); err != nil {
+		return addr, err
+	}
+
+	if err := ensureToken(ctx, h, token); err != nil {
+		return addr, err
+	}
+
+	key := WrappedKey{Mechanism: b.Mechanism, KEK: hsm.BackupKEKLabel, Key: b.WrappedKey}
+	if _, err := ImportAddress(ctx, h, token, b.Label, key, b.Address); err != nil {
+		return addr, err
+	}
+
+	addr, err = GetAddress(ctx, h, b.Label)
+	if err != nil {
+		return addr, err
+	}
+
+	if addr != b.Address {
+		return addr, fmt.Errorf("restored key derives %s instead of %s", addr.Hex(), b.Address.Hex())
+	}
+
+	return addr, nil
+}
+
+// Verify checks the backup was written by a supported version and has not
+// been changed since.
+func (b Backup) Verify(kek []byte) error {
+	if b.Version != BackupVersion {
+		return fmt.Errorf("unsupported backup version %d", b.Version)
+	}
+
+	if b.Curve != backupCurve || b.Mechanism != hsm.WrapAESKeyWrapPad {
+		return fmt.Errorf("unsupported backup of a %s key wrapped with %s", b.Curve, b.Mechanism)
+	}
+
+	if !hmac.Equal(b.MAC, b.mac(kek)) {
+		return errors.New("backup failed the integrity check")
+	}
+
+	return nil
+}
+
+func (b Backup) mac(kek []byte) []byte {
+	// use a key derived from the key encryption key rather than the key itself
+	derive := hmac.New(sha256.New, kek)
+	derive.Write([]byte("open_custodial backup mac"))
+
+	m := hmac.New(sha256.New, derive.Sum(nil))
+	m.Write(b.authenticatedBytes())
+	return m.Sum(nil)
+}
+
+// authenticatedBytes length prefixes every field but the MAC so fields can
+// not be shifted into one another
+func (b Backup) authenticatedBytes() []byte {
+	var buf bytes.Buffer
+
+	fields := [][]byte{
+		[]byte(strconv.Itoa(b.Version)),
+		[]byte(b.Label),
+		b.Address.Bytes(),
+		[]byte(b.Curve),
+		[]byte(b.Mechanism),
+		[]byte(b.CreatedAt.UTC().Format(time.RFC3339Nano)),
+		b.WrappedKey,
+	}
+
+	for _, field := range fields {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,84 @@
+package eth_hsm
+
+import (
+	"context"
+	"crypto/rand"
+	"open_custodial/pkg/_err"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+)
+
+func (s *ETHSuite) TestBackupAndRestoreKey() {
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	s.NoError(err)
+
+	src := hsm_mem.New()
+	src.EnableKeyBackup(kek)
+
+	addr, err := CreateAddress(context.Background(), src, "test_backup")
+	s.NoError(err)
+
+	b, err := BackupKey(context.Background(), src, "test_backup", kek)
+	s.NoError(err)
+	s.Equal(addr, b.Address)
+
+	dst := hsm_mem.New()
+	dst.EnableKeyBackup(kek)
+
+	restored, err := RestoreKey(context.Background(), dst, b, "test_backup", kek)
+	s.NoError(err)
+	s.Equal(addr, restored)
+
+	found, err := GetAddress(context.Background(), dst, "test_backup")
+	s.NoError(err)
+	s.Equal(addr, found)
+
+	_, err = RestoreKey(context.Background(), dst, b, "test_backup", kek)
+	s.IsType(_err.DuplicateLabel{}, err)
+}
+
+func (s *ETHSuite) TestRestoreKeyTampered() {
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	s.NoError(err)
+
+	src := hsm_mem.New()
+	src.EnableKeyBackup(kek)
+
+	_, err = CreateAddress(context.Background(), src, "test_backup_tampered")
+	s.NoError(err)
+
+	b, err := BackupKey(context.Background(), src, "test_backup_tampered", kek)
+	s.NoError(err)
+
+	dst := hsm_mem.New()
+	dst.EnableKeyBackup(kek)
+
+	tampered := b
+	tampered.Label = "test_backup_other"
+	_, err = RestoreKey(context.Background(), dst, tampered, "test_backup_other", kek)
+	s.Error(err)
+
+	other := make([]byte, 32)
+	_, err = rand.Read(other)
+	s.NoError(err)
+
+	_, err = RestoreKey(context.Background(), dst, b, "test_backup_tampered", other)
+	s.Error(err)
+
+	_, err = GetAddress(context.Background(), dst, "test_backup_tampered")
+	s.Error(err)
+}
+
+func (s *ETHSuite) TestBackupKeyNotExtractable() {
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	s.NoError(err)
+
+	mem := hsm_mem.New()
+	_, err = CreateAddress(context.Background(), mem, "test_backup_locked")
+	s.NoError(err)
+
+	_, err = BackupKey(context.Background(), mem, "test_backup_locked", kek)
+	s.Error(err)
+}
@@ -0,0 +1,131 @@
+package eth_hsm
+
+import (
+	"context"
+	"fmt"
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/hsm"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/miekg/pkcs11"
+)
+
+// DestroyPolicy adds interlocks on top of the retirement every destruction
+// requires
+type DestroyPolicy struct {
+	// RequireConfirmation refuses destruction unless the caller repeats the
+	// EIP-55 checksummed address of the key
+	RequireConfirmation bool
+	// WaitingPeriod is how long a key has to be retired before it can be
+	// destroyed
+	WaitingPeriod time.Duration
+}
+
+// RetireAddress stops the key labeled label from signing, it is the first
+// step towards destroying it
+func RetireAddress(ctx context.Context, h hsm.HSM, label string) (addr common.Address, err error) {
+	loc, err := h.LocateKey(ctx, label)
+	if err != nil {
+		return addr, err
+	}
+
+	sess, err := h.NewSlotSession(ctx, loc.Token)
+	if err != nil {
+		return addr, err
+	}
+
+	defer h.EndSession(sess)
+
+	addr, err = sessionAddress(ctx, h, *sess, loc.Key)
+	if err != nil {
+		return addr, err
+	}
+
+	return addr, h.RetireKey(ctx, *sess, loc.Key)
+}
+
+// DestroyAddress destroys the retired key labeled label. confirmation is
+// checked against the checksummed address when the policy requires it. The
+// label stays reserved once the key is gone.
+func DestroyAddress(ctx context.Context, h hsm.HSM, label, confirmation string, policy DestroyPolicy) (addr common.Address, err error) {
+	loc, err := h.LocateKey(ctx, label)
+	if err != nil {
+		return addr, err
+	}
+
+	sess, err := h.NewSlotSession(ctx, loc.Token)
+	if err != nil {
+		return addr, err
+	}
+
+	defer h.EndSession(sess)
+
+	retiredAt, retired, err := h.KeyRetiredAt(ctx, *sess, loc.Key)
+	if err != nil {
+		return addr, err
+	}
+
+	if !retired {
+		return addr, _err.NewDestroyRefusedErr(label, "the address has not been retired")
+	}
+
+	addr, err = sessionAddress(ctx, h, *sess, loc.Key)
+	if err != nil {
+		return addr, err
+	}
+
+	if policy.RequireConfirmation && confirmation != addr.Hex() {
+		return addr, _err.NewDestroyRefusedErr(label, "confirmation does not match the checksummed address")
+	}
+
+	if at := retiredAt.Add(policy.WaitingPeriod); time.Now().Before(at) {
+		return addr, _err.NewDestroyRefusedErr(label, fmt.Sprintf("the waiting period ends at %s", at.UTC().Format(time.RFC3339)))
+	}
+
+	if err := h.DestroyKey(ctx, *sess, loc.Key); err != nil {
+		return addr, err
+	}
+
+	fmt.Println("destroy_address: destroyed key ", label, addr.Hex())
+	return addr, nil
+}
+
+func sessionAddress(ctx context.Context, h hsm.HSM, sess pkcs11.SessionHandle, key hsm.KeyID) (addr common.Address, err error) {
+	pubHandle, err := h.PublicKeyHandle(ctx, sess, key)
+	if err != nil {
+		return addr, err
+	}
+
+	pub, err := getPublicKey(ctx, h, sess, pubHandle)
+	if err != nil {
+		return addr, err
+	}
+
+	return crypto.PubkeyToAddress(pub), nil
+}
+
+// AddressRetired returns the address of the key labeled label and whether it
+// is retired
+func AddressRetired(ctx context.Context, h hsm.HSM, label string) (addr common.Address, retired bool, err error) {
+	loc, err := h.LocateKey(ctx, label)
+	if err != nil {
+		return addr, false, err
+	}
+
+	sess, err := h.NewReadOnlySlotSession(ctx, loc.Token)
+	if err != nil {
+		return addr, false, err
+	}
+
+	defer h.EndSession(sess)
+
+	addr, err = sessionAddress(ctx, h, *sess, loc.Key)
+	if err != nil {
+		return addr, false, err
+	}
+
+	_, retired, err = h.KeyRetiredAt(ctx, *sess, loc.Key)
+	return addr, retired, err
+}
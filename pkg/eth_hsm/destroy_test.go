@@ -0,0 +1,108 @@
+package eth_hsm
+
+import (
+	"context"
+	"math/big"
+	"open_custodial/pkg/_err"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func (s *ETHSuite) TestDestroyRequiresRetirement() {
+	addr, err := CreateAddress(context.Background(), s.hsm, "test_destroy_not_retired")
+	s.NoError(err)
+
+	_, err = DestroyAddress(context.Background(), s.hsm, "test_destroy_not_retired", addr.Hex(), DestroyPolicy{})
+	s.IsType(_err.DestroyRefused{}, err)
+
+	found, err := GetAddress(context.Background(), s.hsm, "test_destroy_not_retired")
+	s.NoError(err)
+	s.Equal(addr, found)
+}
+
+func (s *ETHSuite) TestRetiredAddressCanNotSign() {
+	addr, err := CreateAddress(context.Background(), s.hsm, "test_retire_sign")
+	s.NoError(err)
+
+	retired, err := RetireAddress(context.Background(), s.hsm, "test_retire_sign")
+	s.NoError(err)
+	s.Equal(addr, retired)
+
+	// retiring twice is a no-op
+	_, err = RetireAddress(context.Background(), s.hsm, "test_retire_sign")
+	s.NoError(err)
+
+	tx := types.NewTransaction(1, common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"), big.NewInt(1000), 100, big.NewInt(100), nil)
+	_, err = SignTransaction(context.Background(), s.hsm, tx, "test_retire_sign", big.NewInt(3))
+	s.Error(err)
+}
+
+func (s *ETHSuite) TestDestroyAddress() {
+	addr, err := CreateAddress(context.Background(), s.hsm, "test_destroy")
+	s.NoError(err)
+
+	_, err = RetireAddress(context.Background(), s.hsm, "test_destroy")
+	s.NoError(err)
+
+	policy := DestroyPolicy{RequireConfirmation: true}
+	_, err = DestroyAddress(context.Background(), s.hsm, "test_destroy", addr.Hex()[:10], policy)
+	s.IsType(_err.DestroyRefused{}, err)
+
+	// the confirmation has to carry the checksum
+	_, err = DestroyAddress(context.Background(), s.hsm, "test_destroy", "0x"+common.Bytes2Hex(addr.Bytes()), policy)
+	s.IsType(_err.DestroyRefused{}, err)
+
+	destroyed, err := DestroyAddress(context.Background(), s.hsm, "test_destroy", addr.Hex(), policy)
+	s.NoError(err)
+	s.Equal(addr, destroyed)
+
+	_, err = GetAddress(context.Background(), s.hsm, "test_destroy")
+	s.Error(err)
+
+	_, err = CreateAddress(context.Background(), s.hsm, "test_destroy")
+	s.Error(err)
+}
+
+func (s *ETHSuite) TestDestroyWaitingPeriod() {
+	mem := hsm_mem.New()
+	addr, err := CreateAddress(context.Background(), mem, "test_destroy_wait")
+	s.NoError(err)
+
+	_, err = RetireAddress(context.Background(), mem, "test_destroy_wait")
+	s.NoError(err)
+
+	_, err = DestroyAddress(context.Background(), mem, "test_destroy_wait", addr.Hex(), DestroyPolicy{WaitingPeriod: time.Hour})
+	s.IsType(_err.DestroyRefused{}, err)
+
+	_, err = GetAddress(context.Background(), mem, "test_destroy_wait")
+	s.NoError(err)
+	s.Zero(mem.OpenSessions())
+}
+
+func (s *ETHSuite) TestDestroyedSharedLabelIsNotReused() {
+	mem := hsm_mem.New()
+	addr, err := CreateAddressInToken(context.Background(), mem, "test_destroy_shared", "test_destroy_shared_key")
+	s.NoError(err)
+
+	_, err = RetireAddress(context.Background(), mem, "test_destroy_shared_key")
+	s.NoError(err)
+
+	_, err = DestroyAddress(context.Background(), mem, "test_destroy_shared_key", addr.Hex(), DestroyPolicy{})
+	s.NoError(err)
+
+	_, err = CreateAddressInToken(context.Background(), mem, "test_destroy_shared", "test_destroy_shared_key")
+	s.Error(err)
+
+	_, err = CreateAddressInToken(context.Background(), mem, "test_destroy_other", "test_destroy_shared_key")
+	s.Error(err)
+
+	// the token keeps the record of the destroyed key, it is not an orphan
+	orphans, err := mem.Orphans(context.Background())
+	s.NoError(err)
+	for _, orphan := range orphans {
+		s.NotEqual("test_destroy_shared", orphan.Label)
+	}
+}
@@ -2,9 +2,12 @@ package eth_hsm
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"math/big"
+	"open_custodial/pkg/_err"
 	"open_custodial/pkg/hsm"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -13,20 +16,20 @@ import (
 	"github.com/miekg/pkcs11"
 )
 
-func GetSlotAddress(h hsm.HSM, slotID uint) (addr common.Address, err error) {
-	sess, err := h.NewSession(slotID)
+func GetSlotAddress(ctx context.Context, h hsm.HSM, slotID uint) (addr common.Address, err error) {
+	sess, err := h.NewSession(ctx, slotID)
 	if err != nil {
 		return addr, err
 	}
 
 	defer h.EndSession(&sess)
 
-	pubHandle, err := h.PublicKeyHandle(sess)
+	pubHandle, err := h.PublicKeyHandle(ctx, sess, "")
 	if err != nil {
 		return addr, err
 	}
 
-	pub, err := h.GetPublicKey(sess, pubHandle)
+	pub, err := getPublicKey(ctx, h, sess, pubHandle)
 	if err != nil {
 		return addr, err
 	}
@@ -34,21 +37,26 @@ func GetSlotAddress(h hsm.HSM, slotID uint) (addr common.Address, err error) {
 	return crypto.PubkeyToAddress(pub), nil
 }
 
-func GetAddress(h hsm.HSM, name string) (addr common.Address, err error) {
+func GetAddress(ctx context.Context, h hsm.HSM, name string) (addr common.Address, err error) {
 
-	sess, err := h.NewSlotSession(name)
+	loc, err := h.LocateKey(ctx, name)
+	if err != nil {
+		return addr, err
+	}
+
+	sess, err := h.NewReadOnlySlotSession(ctx, loc.Token)
 	if err != nil {
 		return addr, err
 	}
 
 	defer h.EndSession(sess)
 
-	pubHandle, err := h.PublicKeyHandle(*sess)
+	pubHandle, err := h.PublicKeyHandle(ctx, *sess, loc.Key)
 	if err != nil {
 		return addr, err
 	}
 
-	pub, err := h.GetPublicKey(*sess, pubHandle)
+	pub, err := getPublicKey(ctx, h, *sess, pubHandle)
 	if err != nil {
 		return addr, err
 	}
@@ -56,25 +64,106 @@ func GetAddress(h hsm.HSM, name string) (addr common.Address, err error) {
 	return crypto.PubkeyToAddress(pub), nil
 }
 
-func CreateAddress(h hsm.HSM, name string) (addr common.Address, err error) {
-	_, err = h.NewSlot(name)
+// Layout decides where the key of a new address is stored
+type Layout string
+
+const (
+	// LayoutTokenPerKey initializes a new token, labeled after the address,
+	// for every key
+	LayoutTokenPerKey Layout = "token-per-key"
+	// LayoutSharedToken stores the key as one of many objects in a shared token
+	LayoutSharedToken Layout = "shared-token"
+)
+
+func (l Layout) Valid() bool {
+	return l == LayoutTokenPerKey || l == LayoutSharedToken
+}
+
+// CreateAddress creates a key labeled name in a token of its own
+func CreateAddress(ctx context.Context, h hsm.HSM, name string) (addr common.Address, err error) {
+	if _, err := h.LocateKey(ctx, name); err == nil {
+		return addr, _err.NewDuplicateLabelErr(name)
+	}
+
+	_, err = h.NewSlot(ctx, name)
+	if err != nil {
+		discardAbandoned(h, name, err)
+		return addr, err
+	}
+
+	addr, err = generateAddress(ctx, h, name, name)
 	if err != nil {
+		// do not leave an empty token behind under the label, even when ctx
+		// is what failed
+		if discardErr := h.DiscardSlot(context.Background(), name); discardErr != nil {
+			fmt.Println("create_address: failed to discard token ", discardErr)
+		}
+
 		return addr, err
 	}
 
-	sess, err := h.NewSlotSession(name)
+	return addr, nil
+}
+
+// discardAbandoned discards the token labeled name when its creation failed
+// with err because it timed out or was canceled. The module keeps creating
+// the token after the call is given up on, left alone it would hold the
+// label and a retry would fail as a duplicate. DiscardSlot waits for the
+// creation to finish.
+func discardAbandoned(h hsm.HSM, name string, err error) {
+	if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if err := h.DiscardSlot(context.Background(), name); err != nil {
+		fmt.Println("create_address: failed to discard abandoned token ", err)
+	}
+}
+
+// CreateAddressInToken creates a key labeled name inside the token labeled
+// token, initializing the token first if it does not exist yet.
+func CreateAddressInToken(ctx context.Context, h hsm.HSM, token, name string) (addr common.Address, err error) {
+	if _, err := h.LocateKey(ctx, name); err == nil {
+		return addr, _err.NewDuplicateLabelErr(name)
+	}
+
+	if err := ensureToken(ctx, h, token); err != nil {
+		return addr, err
+	}
+
+	return generateAddress(ctx, h, token, name)
+}
+
+// ensureToken initializes the token labeled token unless it exists
+func ensureToken(ctx context.Context, h hsm.HSM, token string) error {
+	if _, err := h.GetSlotID(ctx, token); err == nil {
+		return nil
+	}
+
+	if _, err := h.NewSlot(ctx, token); err != nil {
+		// another request may have created the token in the meantime
+		if _, lookupErr := h.GetSlotID(ctx, token); lookupErr != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func generateAddress(ctx context.Context, h hsm.HSM, token, name string) (addr common.Address, err error) {
+	sess, err := h.NewSlotSession(ctx, token)
 	if err != nil {
 		return addr, err
 	}
 
 	defer h.EndSession(sess)
 
-	pubHandle, _, err := h.GenerateKeyECDSA_secp256k1(*sess)
+	pubHandle, _, err := h.GenerateKeyECDSA_secp256k1(ctx, *sess, hsm.KeyID(name))
 	if err != nil {
 		return addr, err
 	}
 
-	pub, err := h.GetPublicKey(*sess, pubHandle)
+	pub, err := getPublicKey(ctx, h, *sess, pubHandle)
 	if err != nil {
 		return addr, err
 	}
@@ -82,76 +171,118 @@ func CreateAddress(h hsm.HSM, name string) (addr common.Address, err error) {
 	return crypto.PubkeyToAddress(pub), nil
 }
 
-func SignTransaction(h hsm.HSM, tx *types.Transaction, label string, chainID *big.Int) (*types.Transaction, error) {
+func SignTransaction(ctx context.Context, h hsm.HSM, tx *types.Transaction, label string, chainID *big.Int) (*types.Transaction, error) {
 	signer := types.NewLondonSigner(chainID)
-	message := signer.Hash(tx).Bytes()
 
-	sess, err := h.NewSlotSession(label)
+	verifiedSig, err := signHash(ctx, h, label, signer.Hash(tx).Bytes())
 	if err != nil {
 		return nil, err
 	}
 
-	defer h.EndSession(sess)
+	return tx.WithSignature(signer, verifiedSig)
+}
 
-	pubKeyBytes, privHandle, err := getSigningKeys(h, sess, label)
+// signHash signs a 32 byte hash with the key labeled label and returns the
+// 65 byte [R || S || V] signature, V being the recovery id 0 or 1
+func signHash(ctx context.Context, h hsm.HSM, label string, hash []byte) ([]byte, error) {
+	loc, err := h.LocateKey(ctx, label)
 	if err != nil {
 		return nil, err
 	}
 
-	signature, err := h.SignECDSA_secp256k1(message, *sess, privHandle)
+	sess, err := h.NewSlotSession(ctx, loc.Token)
 	if err != nil {
 		return nil, err
 	}
 
-	verifiedSig, err := VerifySignature(message, signature, pubKeyBytes)
+	defer h.EndSession(sess)
+
+	pubKeyBytes, privHandle, err := getSigningKeys(ctx, h, sess, loc.Key)
 	if err != nil {
 		return nil, err
 	}
 
-	return tx.WithSignature(signer, verifiedSig)
+	signature, err := h.SignECDSA_secp256k1(ctx, hash, *sess, privHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	return VerifySignature(hash, signature, pubKeyBytes)
 }
 
-func getSigningKeys(h hsm.HSM, sess *pkcs11.SessionHandle, label string) (b []byte, privKey pkcs11.ObjectHandle, err error) {
-	pubHandle, err := h.PublicKeyHandle(*sess)
+func getSigningKeys(ctx context.Context, h hsm.HSM, sess *pkcs11.SessionHandle, key hsm.KeyID) (b []byte, privKey pkcs11.ObjectHandle, err error) {
+	pubHandle, err := h.PublicKeyHandle(ctx, *sess, key)
 	if err != nil {
 		return b, privKey, err
 	}
 
-	if err := h.ReleaseHandle(*sess); err != nil {
+	if err := h.ReleaseHandle(ctx, *sess); err != nil {
 		return b, privKey, err
 	}
 
-	pubKey, err := h.GetPublicKey(*sess, pubHandle)
+	pubKey, err := getPublicKey(ctx, h, *sess, pubHandle)
 	if err != nil {
 		return b, privKey, err
 	}
 
-	privHandle, err := h.PrivateKeyHandle(*sess)
+	privHandle, err := h.PrivateKeyHandle(ctx, *sess, key)
 	if err != nil {
 		return b, privKey, err
 	}
 
-	if err := h.ReleaseHandle(*sess); err != nil {
+	if err := h.ReleaseHandle(ctx, *sess); err != nil {
 		return b, privKey, err
 	}
 
 	return crypto.FromECDSAPub(&pubKey), privHandle, nil
 }
 
-func RawTransaction(tx *types.Transaction) ([]byte, error) {
-	var b bytes.Buffer
+// getPublicKey reads a public key and makes sure it is on secp256k1, the
+// HSM also holds keys on other curves that must never be used as addresses
+func getPublicKey(ctx context.Context, h hsm.HSM, sess pkcs11.SessionHandle, pubHandle pkcs11.ObjectHandle) (pub ecdsa.PublicKey, err error) {
+	pub, err = h.GetPublicKey(ctx, sess, pubHandle)
+	if err != nil {
+		return pub, err
+	}
+
+	if pub.Curve.Params().P.Cmp(crypto.S256().Params().P) != 0 {
+		return pub, errors.New("key is not a secp256k1 key")
+	}
 
-	if err := tx.EncodeRLP(&b); err != nil {
+	return pub, nil
+}
+
+// RawTransaction encodes a signed transaction the way eth_sendRawTransaction
+// takes it, an RLP list for legacy transactions and the EIP-2718 envelope,
+// the type byte followed by the payload, for typed ones
+func RawTransaction(tx *types.Transaction) ([]byte, error) {
+	b, err := tx.MarshalBinary()
+	if err != nil {
 		return nil, fmt.Errorf("unable to encode signed transaction %v", err)
 	}
 
-	return b.Bytes(), nil
+	return b, nil
 }
 
+// VerifySignature turns an r || s or DER signature into the 65 byte
+// [R || S || V] format by finding the recovery id that recovers
+// expectedPublicKey. High s values are normalized first, which flips the
+// recovery id, so the id is always worked out on the low s signature.
+// Malformed signatures return an hsm.SignatureFormatError.
 func VerifySignature(message, signature, expectedPublicKey []byte) ([]byte, error) {
-	sig := append(signature, 0)
+	canonical, err := hsm.CanonicalSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	normalized, _, err := hsm.NormalizeS(canonical)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := append(normalized, 0)
 
-	err := recoverPublicKey(expectedPublicKey, message, sig)
+	err = recoverPublicKey(expectedPublicKey, message, sig)
 	if err == nil {
 		return sig, nil
 	}
@@ -1,13 +1,17 @@
 package eth_hsm
 
 import (
+	"context"
 	"math/big"
+	"open_custodial/pkg/_err"
 	"open_custodial/pkg/config"
 	"open_custodial/pkg/hsm"
+	hsm_mem "open_custodial/pkg/hsm/memory"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -22,26 +26,195 @@ func TestETHSuite(t *testing.T) {
 
 func (s *ETHSuite) SetupSuite() {
 	c := config.NewConfig()
-	h, err := hsm.NewHSM(c.HSMLibPath, c.CU_USERNAME, c.CU_PASSWORD, c.SO_PASSWORD)
+	if c.HSMLibPath == "" {
+		s.hsm = hsm_mem.New()
+		return
+	}
+
+	h, err := hsm.NewHSMFromConfig(c)
 	s.NoError(err)
 	s.hsm = h
 }
 
 // func (s *ETHSuite) TestCreateAddress() {
-// 	addr, err := CreateAddress(s.hsm, "test_create_address")
+// 	addr, err := CreateAddress(context.Background(), s.hsm, "test_create_address")
 // 	s.NoError(err)
 
-// 	found, err := GetAddress(s.hsm, "test_create_address")
+// 	found, err := GetAddress(context.Background(), s.hsm, "test_create_address")
 // 	s.NoError(err)
 
 // 	s.Equal(addr.Hex(), found.Hex())
 // }
 
 func (s *ETHSuite) TestSignTransaction() {
-	_, err := CreateAddress(s.hsm, "test_sign_transaction")
+	_, err := CreateAddress(context.Background(), s.hsm, "test_sign_transaction")
+	s.NoError(err)
+
+	tx := types.NewTransaction(1, common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"), big.NewInt(1000), 100, big.NewInt(100), nil)
+	_, err = SignTransaction(context.Background(), s.hsm, tx, "test_sign_transaction", big.NewInt(3))
+	s.NoError(err)
+}
+
+func (s *ETHSuite) TestSignDynamicFeeTransaction() {
+	addr, err := CreateAddress(context.Background(), s.hsm, "test_sign_dynamic_fee")
+	s.NoError(err)
+
+	tx, err := NewTransaction(TxParams{
+		Type:      types.DynamicFeeTxType,
+		ChainID:   big.NewInt(3),
+		Nonce:     1,
+		To:        common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+		Value:     big.NewInt(1000),
+		Gas:       21000,
+		GasTipCap: big.NewInt(2),
+		GasFeeCap: big.NewInt(100),
+	})
+	s.NoError(err)
+
+	signed, err := SignTransaction(context.Background(), s.hsm, tx, "test_sign_dynamic_fee", big.NewInt(3))
+	s.NoError(err)
+
+	raw, err := RawTransaction(signed)
+	s.NoError(err)
+	s.Equal(byte(types.DynamicFeeTxType), raw[0])
+
+	decoded := new(types.Transaction)
+	s.NoError(decoded.UnmarshalBinary(raw))
+	s.Equal(uint8(types.DynamicFeeTxType), decoded.Type())
+	s.Equal(big.NewInt(2), decoded.GasTipCap())
+	s.Equal(big.NewInt(100), decoded.GasFeeCap())
+
+	sender, err := types.Sender(types.NewLondonSigner(big.NewInt(3)), decoded)
+	s.NoError(err)
+	s.Equal(addr, sender)
+}
+
+func (s *ETHSuite) TestSignAccessListTransactions() {
+	addr, err := CreateAddress(context.Background(), s.hsm, "test_sign_access_list")
+	s.NoError(err)
+
+	list := types.AccessList{{
+		Address:     common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+		StorageKeys: []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02")},
+	}}
+
+	for _, p := range []TxParams{
+		{Type: types.AccessListTxType, GasPrice: big.NewInt(100)},
+		{Type: types.DynamicFeeTxType, GasTipCap: big.NewInt(2), GasFeeCap: big.NewInt(100)},
+	} {
+		p.ChainID = big.NewInt(3)
+		p.Nonce = 1
+		p.To = common.HexToAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+		p.Gas = 50000
+		p.AccessList = list
+
+		tx, err := NewTransaction(p)
+		s.NoError(err)
+
+		signed, err := SignTransaction(context.Background(), s.hsm, tx, "test_sign_access_list", big.NewInt(3))
+		s.NoError(err)
+
+		raw, err := RawTransaction(signed)
+		s.NoError(err)
+		s.Equal(p.Type, raw[0])
+
+		decoded := new(types.Transaction)
+		s.NoError(decoded.UnmarshalBinary(raw))
+		s.Equal(p.Type, decoded.Type())
+		s.Equal(list, decoded.AccessList())
+		s.Equal(signed.Hash(), decoded.Hash())
+
+		again, err := RawTransaction(decoded)
+		s.NoError(err)
+		s.Equal(raw, again)
+
+		sender, err := types.Sender(types.NewLondonSigner(big.NewInt(3)), decoded)
+		s.NoError(err)
+		s.Equal(addr, sender)
+	}
+
+	_, err = NewTransaction(TxParams{ChainID: big.NewInt(3), GasPrice: big.NewInt(100), AccessList: list})
+	s.IsType(_err.InvalidTransaction{}, err)
+}
+
+func (s *ETHSuite) TestNewTransactionInvalid() {
+	valid := TxParams{
+		Type:      types.DynamicFeeTxType,
+		ChainID:   big.NewInt(3),
+		Gas:       21000,
+		GasTipCap: big.NewInt(2),
+		GasFeeCap: big.NewInt(100),
+	}
+
+	_, err := NewTransaction(valid)
+	s.NoError(err)
+
+	for name, change := range map[string]func(p *TxParams){
+		"tip above fee cap":   func(p *TxParams) { p.GasTipCap = big.NewInt(101) },
+		"missing fee cap":     func(p *TxParams) { p.GasFeeCap = nil },
+		"negative tip":        func(p *TxParams) { p.GasTipCap = big.NewInt(-1) },
+		"gas price":           func(p *TxParams) { p.GasPrice = big.NewInt(1) },
+		"no gas":              func(p *TxParams) { p.Gas = 0 },
+		"no chain":            func(p *TxParams) { p.ChainID = nil },
+		"fee cap overflow":    func(p *TxParams) { p.GasFeeCap = new(big.Int).Lsh(big.NewInt(1), 256) },
+		"unknown type":        func(p *TxParams) { p.Type = 9 },
+		"legacy with fee cap": func(p *TxParams) { p.Type = types.LegacyTxType },
+	} {
+		p := valid
+		change(&p)
+
+		_, err := NewTransaction(p)
+		s.IsType(_err.InvalidTransaction{}, err, name)
+	}
+}
+
+func (s *ETHSuite) TestCreateAddressInToken() {
+	first, err := CreateAddressInToken(context.Background(), s.hsm, "test_shared_token", "test_shared_first")
+	s.NoError(err)
+
+	second, err := CreateAddressInToken(context.Background(), s.hsm, "test_shared_token", "test_shared_second")
 	s.NoError(err)
+	s.NotEqual(first, second)
+
+	found, err := GetAddress(context.Background(), s.hsm, "test_shared_second")
+	s.NoError(err)
+	s.Equal(second, found)
+
+	_, err = CreateAddressInToken(context.Background(), s.hsm, "test_shared_token", "test_shared_first")
+	s.IsType(_err.DuplicateLabel{}, err)
 
 	tx := types.NewTransaction(1, common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"), big.NewInt(1000), 100, big.NewInt(100), nil)
-	_, err = SignTransaction(s.hsm, tx, "test_sign_transaction", big.NewInt(3))
+	signed, err := SignTransaction(context.Background(), s.hsm, tx, "test_shared_first", big.NewInt(3))
 	s.NoError(err)
+
+	sender, err := types.Sender(types.NewLondonSigner(big.NewInt(3)), signed)
+	s.NoError(err)
+	s.Equal(first, sender)
+}
+
+func (s *ETHSuite) TestVerifySignatureHighS() {
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+
+	digest := crypto.Keccak256([]byte("verify"))
+	sig, err := crypto.Sign(digest, key)
+	s.NoError(err)
+
+	high := make([]byte, 64)
+	copy(high, sig[:64])
+	n := crypto.S256().Params().N
+	new(big.Int).Sub(n, new(big.Int).SetBytes(sig[32:64])).FillBytes(high[32:64])
+
+	verified, err := VerifySignature(digest, high, crypto.FromECDSAPub(&key.PublicKey))
+	s.NoError(err)
+	s.Equal(sig, verified)
+}
+
+func (s *ETHSuite) TestVerifySignatureMalformed() {
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+
+	digest := crypto.Keccak256([]byte("verify"))
+	_, err = VerifySignature(digest, make([]byte, 63), crypto.FromECDSAPub(&key.PublicKey))
+	s.IsType(hsm.SignatureFormatError{}, err)
 }
@@ -0,0 +1,127 @@
+package eth_hsm
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/hsm"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/miekg/pkcs11"
+)
+
+// WrappedKey is a PKCS#8 encoded secp256k1 private key wrapped for import
+type WrappedKey struct {
+	Mechanism hsm.WrapMechanism
+	// KEK is the label of the AES key encryption key, unused for RSA-OAEP
+	KEK string
+	Key []byte
+}
+
+// GetWrappingKey returns the RSA key callers wrap private keys to before
+// importing them into token. A token that does not exist is initialized
+// when create is set and is an error otherwise.
+func GetWrappingKey(ctx context.Context, h hsm.HSM, token string, create bool) (*rsa.PublicKey, error) {
+	if create {
+		if err := ensureToken(ctx, h, token); err != nil {
+			return nil, err
+		}
+	} else if _, err := h.GetSlotID(ctx, token); err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		return nil, _err.NewTokenNotFoundErr(token)
+	}
+
+	sess, err := h.NewSlotSession(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer h.EndSession(sess)
+
+	return h.WrappingPublicKey(ctx, *sess)
+}
+
+// ImportAddress unwraps key into token under the label name. The key is
+// only kept when it controls expected.
+func ImportAddress(ctx context.Context, h hsm.HSM, token, name string, key WrappedKey, expected common.Address) (addr common.Address, err error) {
+	sess, err := h.NewSlotSession(ctx, token)
+	if err != nil {
+		return addr, err
+	}
+
+	defer h.EndSession(sess)
+
+	if err := checkImportLabel(ctx, h, sess, token, name); err != nil {
+		return addr, err
+	}
+
+	privHandle, err := h.UnwrapKeyECDSA_secp256k1(ctx, *sess, key.Mechanism, hsm.KeyID(key.KEK), key.Key, hsm.KeyID(name))
+	if err != nil {
+		return addr, err
+	}
+
+	pub, err := recoverImportedKey(ctx, h, sess, privHandle, expected)
+	if err != nil {
+		// the key must not outlive a failed import, even when ctx is what
+		// failed
+		h.DestroyObject(context.Background(), *sess, privHandle)
+		return addr, err
+	}
+
+	if _, err := h.CreatePublicKeyECDSA_secp256k1(ctx, *sess, *pub, hsm.KeyID(name)); err != nil {
+		h.DestroyObject(context.Background(), *sess, privHandle)
+		return addr, err
+	}
+
+	return expected, nil
+}
+
+// checkImportLabel rejects labels that are taken. A token labeled name is
+// fine as long as it holds no key yet, which is the case for token-per-key
+// imports whose token was created by GetWrappingKey.
+func checkImportLabel(ctx context.Context, h hsm.HSM, sess *pkcs11.SessionHandle, token, name string) error {
+	loc, err := h.LocateKey(ctx, name)
+	if err != nil {
+		return nil
+	}
+
+	if loc.Key != "" || loc.Token != token {
+		return _err.NewDuplicateLabelErr(name)
+	}
+
+	if _, err := h.PublicKeyHandle(ctx, *sess, ""); err == nil {
+		return _err.NewDuplicateLabelErr(name)
+	}
+
+	return nil
+}
+
+// recoverImportedKey works out the public key of an imported private key,
+// which C_UnwrapKey does not create, by signing a random digest and
+// recovering the key that controls expected.
+func recoverImportedKey(ctx context.Context, h hsm.HSM, sess *pkcs11.SessionHandle, privHandle pkcs11.ObjectHandle, expected common.Address) (*ecdsa.PublicKey, error) {
+	digest := make([]byte, 32)
+	if _, err := rand.Read(digest); err != nil {
+		return nil, err
+	}
+
+	signature, err := h.SignECDSA_secp256k1(ctx, digest, *sess, privHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	for v := byte(0); v < 2; v++ {
+		pub, err := crypto.SigToPub(digest, append(signature, v))
+		if err == nil && crypto.PubkeyToAddress(*pub) == expected {
+			return pub, nil
+		}
+	}
+
+	return nil, _err.NewAddressMismatchErr(expected.Hex())
+}
@@ -0,0 +1,105 @@
+package eth_hsm
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/hsm"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func (s *ETHSuite) TestImportAddressRSA() {
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+	expected := crypto.PubkeyToAddress(key.PublicKey)
+
+	_, err = GetWrappingKey(context.Background(), s.hsm, "test_import_rsa", false)
+	s.IsType(_err.TokenNotFound{}, err)
+
+	_, err = s.hsm.GetSlotID(context.Background(), "test_import_rsa")
+	s.Error(err)
+
+	pub, err := GetWrappingKey(context.Background(), s.hsm, "test_import_rsa", true)
+	s.NoError(err)
+
+	again, err := GetWrappingKey(context.Background(), s.hsm, "test_import_rsa", false)
+	s.NoError(err)
+	s.Equal(pub, again)
+
+	der, err := hsm.MarshalPKCS8Secp256k1(key)
+	s.NoError(err)
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, der, nil)
+	s.NoError(err)
+
+	addr, err := ImportAddress(context.Background(), s.hsm, "test_import_rsa", "test_import_rsa", WrappedKey{Mechanism: hsm.WrapRSAOAEP, Key: wrapped}, expected)
+	s.NoError(err)
+	s.Equal(expected, addr)
+
+	found, err := GetAddress(context.Background(), s.hsm, "test_import_rsa")
+	s.NoError(err)
+	s.Equal(expected, found)
+
+	_, err = ImportAddress(context.Background(), s.hsm, "test_import_rsa", "test_import_rsa", WrappedKey{Mechanism: hsm.WrapRSAOAEP, Key: wrapped}, expected)
+	s.IsType(_err.DuplicateLabel{}, err)
+}
+
+func (s *ETHSuite) TestImportAddressMismatch() {
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+
+	other, err := crypto.GenerateKey()
+	s.NoError(err)
+
+	pub, err := GetWrappingKey(context.Background(), s.hsm, "test_import_shared", true)
+	s.NoError(err)
+
+	der, err := hsm.MarshalPKCS8Secp256k1(key)
+	s.NoError(err)
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, der, nil)
+	s.NoError(err)
+
+	_, err = ImportAddress(context.Background(), s.hsm, "test_import_shared", "test_import_mismatch", WrappedKey{Mechanism: hsm.WrapRSAOAEP, Key: wrapped}, crypto.PubkeyToAddress(other.PublicKey))
+	s.IsType(_err.AddressMismatch{}, err)
+
+	_, err = GetAddress(context.Background(), s.hsm, "test_import_mismatch")
+	s.Error(err)
+}
+
+func (s *ETHSuite) TestImportAddressAESKeyWrap() {
+	mem, ok := s.hsm.(*hsm_mem.HSM)
+	if !ok {
+		s.T().Skip("provisioning a key encryption key needs the in memory HSM")
+	}
+
+	_, err := mem.NewSlot(context.Background(), "test_import_aes")
+	s.NoError(err)
+
+	kek := make([]byte, 32)
+	_, err = rand.Read(kek)
+	s.NoError(err)
+	s.NoError(mem.CreateKEK("test_import_aes", "test_kek", kek))
+
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+	expected := crypto.PubkeyToAddress(key.PublicKey)
+
+	der, err := hsm.MarshalPKCS8Secp256k1(key)
+	s.NoError(err)
+
+	wrapped, err := hsm.AESKeyWrapPad(kek, der)
+	s.NoError(err)
+
+	addr, err := ImportAddress(context.Background(), s.hsm, "test_import_aes", "test_import_aes_key", WrappedKey{Mechanism: hsm.WrapAESKeyWrapPad, KEK: "test_kek", Key: wrapped}, expected)
+	s.NoError(err)
+	s.Equal(expected, addr)
+
+	found, err := GetAddress(context.Background(), s.hsm, "test_import_aes_key")
+	s.NoError(err)
+	s.Equal(expected, found)
+}
@@ -0,0 +1,29 @@
+package eth_hsm
+
+import (
+	"context"
+	"fmt"
+	"open_custodial/pkg/hsm"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// PersonalMessageHash is the EIP-191 version 0x45 hash of msg, what
+// personal_sign and eth_sign sign: the Keccak-256 of
+// "\x19Ethereum Signed Message:\n" + len(msg) + msg
+func PersonalMessageHash(msg []byte) []byte {
+	prefix := fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(msg))
+	return crypto.Keccak256([]byte(prefix), msg)
+}
+
+// SignPersonalMessage signs msg with the key labeled label as personal_sign
+// does and returns the 65 byte [R || S || V] signature with V 27 or 28
+func SignPersonalMessage(ctx context.Context, h hsm.HSM, label string, msg []byte) ([]byte, error) {
+	sig, err := signHash(ctx, h, label, PersonalMessageHash(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	sig[crypto.RecoveryIDOffset] += 27
+	return sig, nil
+}
@@ -0,0 +1,53 @@
+package eth_hsm
+
+import (
+	"context"
+	"open_custodial/pkg/hsm"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/suite"
+)
+
+type MessageSuite struct {
+	suite.Suite
+	hsm hsm.HSM
+}
+
+func TestMessageSuite(t *testing.T) {
+	suite.Run(t, new(MessageSuite))
+}
+
+func (s *MessageSuite) SetupTest() {
+	s.hsm = hsm_mem.New()
+}
+
+func (s *MessageSuite) TestPersonalMessageHash() {
+	for _, msg := range []string{"", "hello", "a message longer than ten bytes"} {
+		s.Equal(accounts.TextHash([]byte(msg)), PersonalMessageHash([]byte(msg)))
+	}
+}
+
+func (s *MessageSuite) TestSignPersonalMessage() {
+	addr, err := CreateAddress(context.Background(), s.hsm, "test_sign_message")
+	s.NoError(err)
+
+	for _, msg := range []string{"login nonce 1", "login nonce 2", "login nonce 3", "login nonce 4"} {
+		sig, err := SignPersonalMessage(context.Background(), s.hsm, "test_sign_message", []byte(msg))
+		s.NoError(err)
+		s.Len(sig, 65)
+		s.Contains([]byte{27, 28}, sig[64])
+
+		recoverable := append([]byte{}, sig...)
+		recoverable[64] -= 27
+
+		pub, err := crypto.SigToPub(PersonalMessageHash([]byte(msg)), recoverable)
+		s.NoError(err)
+		s.Equal(addr, crypto.PubkeyToAddress(*pub))
+	}
+
+	_, err = SignPersonalMessage(context.Background(), s.hsm, "unknown", []byte("hello"))
+	s.Error(err)
+}
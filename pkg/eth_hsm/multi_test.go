@@ -0,0 +1,144 @@
+package eth_hsm
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"open_custodial/pkg/hsm"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func (s *ETHSuite) TestMultiBackendRouting() {
+	primary, soft := hsm_mem.New(), hsm_mem.New()
+	h, err := hsm.NewMultiHSM(
+		hsm.Backend{Name: "primary", HSM: primary},
+		hsm.Backend{Name: "softhsm", HSM: soft, LabelPrefixes: []string{"test_"}},
+	)
+	s.NoError(err)
+
+	prod, err := CreateAddress(context.Background(), h, "prod_routed")
+	s.NoError(err)
+
+	test, err := CreateAddress(context.Background(), h, "test_routed")
+	s.NoError(err)
+
+	_, err = primary.GetSlotID(context.Background(), "prod_routed")
+	s.NoError(err)
+	_, err = soft.GetSlotID(context.Background(), "test_routed")
+	s.NoError(err)
+	_, err = primary.GetSlotID(context.Background(), "test_routed")
+	s.Error(err)
+
+	found, err := GetAddress(context.Background(), h, "test_routed")
+	s.NoError(err)
+	s.Equal(test, found)
+
+	// slot IDs of the two modules overlap, the multi backend keeps them apart
+	for label, addr := range map[string]common.Address{"prod_routed": prod, "test_routed": test} {
+		slotID, err := h.GetSlotID(context.Background(), label)
+		s.NoError(err)
+
+		found, err := GetSlotAddress(context.Background(), h, slotID)
+		s.NoError(err)
+		s.Equal(addr, found)
+	}
+
+	tx := types.NewTransaction(1, common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"), big.NewInt(1000), 100, big.NewInt(100), nil)
+	_, err = SignTransaction(context.Background(), h, tx, "test_routed", big.NewInt(3))
+	s.NoError(err)
+
+	_, err = CreateAddress(context.Background(), h, "test_routed")
+	s.Error(err)
+	s.Zero(primary.OpenSessions() + soft.OpenSessions())
+}
+
+func (s *ETHSuite) TestMultiBackendFailover() {
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	s.NoError(err)
+
+	primary, replica := hsm_mem.New(), hsm_mem.New()
+	primary.EnableKeyBackup(kek)
+	replica.EnableKeyBackup(kek)
+
+	h, err := hsm.NewMultiHSM(
+		hsm.Backend{Name: "primary", HSM: primary},
+		hsm.Backend{Name: "secondary", HSM: replica, ReplicaOf: "primary"},
+	)
+	s.NoError(err)
+
+	addr, err := CreateAddress(context.Background(), h, "replicated")
+	s.NoError(err)
+
+	b, err := BackupKey(context.Background(), primary, "replicated", kek)
+	s.NoError(err)
+	_, err = RestoreKey(context.Background(), replica, b, "replicated", kek)
+	s.NoError(err)
+
+	primary.Disconnect(errors.New("device removed"))
+
+	status := h.Status()
+	s.Equal(hsm.StateDisconnected, status.State)
+	s.Equal(hsm.StateConnected, status.Backends["secondary"].State)
+
+	// reads fail over to the replica
+	found, err := GetAddress(context.Background(), h, "replicated")
+	s.NoError(err)
+	s.Equal(addr, found)
+
+	// writes stay with the primary
+	tx := types.NewTransaction(1, common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"), big.NewInt(1000), 100, big.NewInt(100), nil)
+	_, err = SignTransaction(context.Background(), h, tx, "replicated", big.NewInt(3))
+	s.ErrorIs(err, hsm.ErrNotConnected)
+
+	primary.Reconnect()
+	_, err = SignTransaction(context.Background(), h, tx, "replicated", big.NewInt(3))
+	s.NoError(err)
+	s.Zero(primary.OpenSessions() + replica.OpenSessions())
+}
+
+func (s *ETHSuite) TestNewMultiHSMValidation() {
+	_, err := hsm.NewMultiHSM()
+	s.Error(err)
+
+	_, err = hsm.NewMultiHSM(hsm.Backend{Name: "a", HSM: hsm_mem.New()}, hsm.Backend{Name: "a", HSM: hsm_mem.New()})
+	s.Error(err)
+
+	_, err = hsm.NewMultiHSM(hsm.Backend{Name: "a", HSM: hsm_mem.New(), ReplicaOf: "b"})
+	s.Error(err)
+}
+
+func (s *ETHSuite) TestMultiBackendDestroyedLabel() {
+	primary, soft := hsm_mem.New(), hsm_mem.New()
+	h, err := hsm.NewMultiHSM(
+		hsm.Backend{Name: "primary", HSM: primary},
+		hsm.Backend{Name: "softhsm", HSM: soft, LabelPrefixes: []string{"test_"}},
+	)
+	s.NoError(err)
+
+	_, err = h.NewSlot(context.Background(), "prod_wallets")
+	s.NoError(err)
+	_, err = h.NewSlot(context.Background(), "test_wallets")
+	s.NoError(err)
+
+	addr, err := CreateAddressInToken(context.Background(), h, "prod_wallets", "wallet_destroyed")
+	s.NoError(err)
+
+	_, err = RetireAddress(context.Background(), h, "wallet_destroyed")
+	s.NoError(err)
+	_, err = DestroyAddress(context.Background(), h, "wallet_destroyed", addr.Hex(), DestroyPolicy{})
+	s.NoError(err)
+
+	// the label stays reserved on the backends that never held it
+	_, err = CreateAddressInToken(context.Background(), h, "test_wallets", "wallet_destroyed")
+	s.Error(err)
+
+	destroyed, err := h.KeyDestroyed(context.Background(), "wallet_destroyed")
+	s.NoError(err)
+	s.True(destroyed)
+	s.Zero(primary.OpenSessions() + soft.OpenSessions())
+}
@@ -0,0 +1,79 @@
+package eth_hsm
+
+import (
+	"context"
+	"open_custodial/pkg/hsm"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+
+	"github.com/miekg/pkcs11"
+)
+
+func (s *ETHSuite) TestCreateAddressRollsBackToken() {
+	mem := hsm_mem.New()
+	mem.Fail(hsm_mem.OpGenerateKeyPair, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), 1)
+
+	_, err := CreateAddress(context.Background(), mem, "test_rollback")
+	s.Error(err)
+
+	_, err = mem.GetSlotID(context.Background(), "test_rollback")
+	s.Error(err)
+
+	orphans, err := mem.Orphans(context.Background())
+	s.NoError(err)
+	s.Len(orphans, 1)
+	s.Equal(hsm.OrphanFailed, orphans[0].Reason)
+
+	// the label is free again
+	addr, err := CreateAddress(context.Background(), mem, "test_rollback")
+	s.NoError(err)
+
+	found, err := GetAddress(context.Background(), mem, "test_rollback")
+	s.NoError(err)
+	s.Equal(addr, found)
+	s.Zero(mem.OpenSessions())
+}
+
+func (s *ETHSuite) TestCreateAddressInitPINFailure() {
+	mem := hsm_mem.New()
+	mem.Fail(hsm_mem.OpInitPIN, pkcs11.Error(pkcs11.CKR_PIN_INVALID), 1)
+
+	_, err := CreateAddress(context.Background(), mem, "test_init_pin")
+	s.Error(err)
+
+	_, err = mem.GetSlotID(context.Background(), "test_init_pin")
+	s.Error(err)
+
+	orphans, err := mem.Orphans(context.Background())
+	s.NoError(err)
+	s.Len(orphans, 1)
+	s.Equal(hsm.OrphanFailed, orphans[0].Reason)
+}
+
+func (s *ETHSuite) TestConcurrentCreateAddress() {
+	mem := hsm_mem.New()
+
+	labels := []string{"test_concurrent_a", "test_concurrent_b", "test_concurrent_c", "test_concurrent_d"}
+	errs := make(chan error, len(labels))
+	for _, label := range labels {
+		go func(label string) {
+			_, err := CreateAddress(context.Background(), mem, label)
+			errs <- err
+		}(label)
+	}
+
+	slots := make(map[uint]bool)
+	for range labels {
+		s.NoError(<-errs)
+	}
+
+	for _, label := range labels {
+		slotID, err := mem.GetSlotID(context.Background(), label)
+		s.NoError(err)
+		s.False(slots[slotID])
+		slots[slotID] = true
+	}
+
+	orphans, err := mem.Orphans(context.Background())
+	s.NoError(err)
+	s.Empty(orphans)
+}
@@ -0,0 +1,71 @@
+package eth_hsm
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	hsm_mem "open_custodial/pkg/hsm/memory"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func (s *ETHSuite) TestSignTransactionTimeout() {
+	mem := hsm_mem.New()
+	_, err := CreateAddress(context.Background(), mem, "test_sign_timeout")
+	s.NoError(err)
+
+	mem.Stall(hsm_mem.OpSign, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	tx := types.NewTransaction(1, common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"), big.NewInt(1000), 100, big.NewInt(100), nil)
+	_, err = SignTransaction(ctx, mem, tx, "test_sign_timeout", big.NewInt(3))
+	s.ErrorIs(err, context.DeadlineExceeded)
+	s.Zero(mem.OpenSessions())
+
+	// the key is still usable once the module answers again
+	mem.ClearFailures()
+	_, err = SignTransaction(context.Background(), mem, tx, "test_sign_timeout", big.NewInt(3))
+	s.NoError(err)
+}
+
+func (s *ETHSuite) TestCreateAddressCanceled() {
+	mem := hsm_mem.New()
+	mem.Stall(hsm_mem.OpGenerateKeyPair, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := CreateAddress(ctx, mem, "test_create_canceled")
+	s.ErrorIs(err, context.Canceled)
+	s.Zero(mem.OpenSessions())
+
+	// the token was rolled back although ctx was done
+	_, err = mem.GetSlotID(context.Background(), "test_create_canceled")
+	s.Error(err)
+}
+
+func (s *ETHSuite) TestCreateAddressTokenTimeout() {
+	mem := hsm_mem.New()
+	mem.Stall(hsm_mem.OpInitToken, 200*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := CreateAddress(ctx, mem, "test_create_token_timeout")
+	s.ErrorIs(err, context.DeadlineExceeded)
+
+	// the token the module went on to create was discarded, a retry succeeds
+	_, err = mem.GetSlotID(context.Background(), "test_create_token_timeout")
+	s.Error(err)
+
+	mem.ClearFailures()
+	_, err = CreateAddress(context.Background(), mem, "test_create_token_timeout")
+	s.NoError(err)
+}
@@ -0,0 +1,153 @@
+package eth_hsm
+
+import (
+	"fmt"
+	"math/big"
+	"open_custodial/pkg/_err"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// TxParams describes a transaction to sign. Type is the EIP-2718 type,
+// legacy and access list (EIP-2930) transactions pay GasPrice and dynamic
+// fee (EIP-1559) transactions GasTipCap and GasFeeCap. Every type but legacy
+// takes an AccessList.
+type TxParams struct {
+	Type     uint8
+	ChainID  *big.Int
+	Nonce    uint64
+	To       common.Address
+	Value    *big.Int
+	Gas      uint64
+	GasPrice *big.Int
+	// GasTipCap is maxPriorityFeePerGas, GasFeeCap is maxFeePerGas
+	GasTipCap  *big.Int
+	GasFeeCap  *big.Int
+	Data       []byte
+	AccessList types.AccessList
+}
+
+// NewTransaction builds the transaction p describes. Fee fields that do not
+// belong to the type are refused rather than ignored, a client setting
+// maxFeePerGas on a legacy transaction most likely forgot the type.
+func NewTransaction(p TxParams) (*types.Transaction, error) {
+	if p.ChainID == nil || p.ChainID.Sign() <= 0 {
+		return nil, _err.NewInvalidTransactionErr("chainID must be positive")
+	}
+
+	if err := checkAmount("value", p.Value); err != nil {
+		return nil, err
+	}
+
+	switch p.Type {
+	case types.LegacyTxType:
+		return newLegacyTx(p)
+	case types.AccessListTxType:
+		return newAccessListTx(p)
+	case types.DynamicFeeTxType:
+		return newDynamicFeeTx(p)
+	}
+
+	return nil, _err.NewInvalidTransactionErr(fmt.Sprintf("unsupported transaction type %d", p.Type))
+}
+
+func newLegacyTx(p TxParams) (*types.Transaction, error) {
+	if len(p.AccessList) > 0 {
+		return nil, _err.NewInvalidTransactionErr("legacy transactions have no access list, use an access list or dynamic fee transaction")
+	}
+
+	if err := checkGasPrice(p); err != nil {
+		return nil, err
+	}
+
+	return types.NewTransaction(p.Nonce, p.To, p.Value, p.Gas, p.GasPrice, p.Data), nil
+}
+
+func newAccessListTx(p TxParams) (*types.Transaction, error) {
+	if err := checkGasPrice(p); err != nil {
+		return nil, err
+	}
+
+	if p.Gas == 0 {
+		return nil, _err.NewInvalidTransactionErr("gasLimit is required")
+	}
+
+	to := p.To
+	return types.NewTx(&types.AccessListTx{
+		ChainID:    p.ChainID,
+		Nonce:      p.Nonce,
+		GasPrice:   p.GasPrice,
+		Gas:        p.Gas,
+		To:         &to,
+		Value:      p.Value,
+		Data:       p.Data,
+		AccessList: p.AccessList,
+	}), nil
+}
+
+// checkGasPrice checks the fee of the types paying a gas price
+func checkGasPrice(p TxParams) error {
+	if p.GasTipCap != nil || p.GasFeeCap != nil {
+		return _err.NewInvalidTransactionErr("maxFeePerGas and maxPriorityFeePerGas need a dynamic fee transaction")
+	}
+
+	return checkAmount("gasPrice", p.GasPrice)
+}
+
+func newDynamicFeeTx(p TxParams) (*types.Transaction, error) {
+	if p.GasPrice != nil {
+		return nil, _err.NewInvalidTransactionErr("gasPrice is for legacy transactions, set maxFeePerGas and maxPriorityFeePerGas")
+	}
+
+	if p.GasFeeCap == nil || p.GasTipCap == nil {
+		return nil, _err.NewInvalidTransactionErr("maxFeePerGas and maxPriorityFeePerGas are required")
+	}
+
+	if err := checkAmount("maxFeePerGas", p.GasFeeCap); err != nil {
+		return nil, err
+	}
+
+	if err := checkAmount("maxPriorityFeePerGas", p.GasTipCap); err != nil {
+		return nil, err
+	}
+
+	if p.GasTipCap.Cmp(p.GasFeeCap) > 0 {
+		return nil, _err.NewInvalidTransactionErr("maxPriorityFeePerGas is above maxFeePerGas")
+	}
+
+	if p.Gas == 0 {
+		return nil, _err.NewInvalidTransactionErr("gasLimit is required")
+	}
+
+	to := p.To
+	return types.NewTx(&types.DynamicFeeTx{
+		ChainID:    p.ChainID,
+		Nonce:      p.Nonce,
+		GasTipCap:  p.GasTipCap,
+		GasFeeCap:  p.GasFeeCap,
+		Gas:        p.Gas,
+		To:         &to,
+		Value:      p.Value,
+		Data:       p.Data,
+		AccessList: p.AccessList,
+	}), nil
+}
+
+// checkAmount refuses negative amounts and amounts that do not fit the 256
+// bits the protocol has for them. Missing amounts are zero.
+func checkAmount(name string, v *big.Int) error {
+	if v == nil {
+		return nil
+	}
+
+	if v.Sign() < 0 {
+		return _err.NewInvalidTransactionErr(name + " is negative")
+	}
+
+	if v.BitLen() > 256 {
+		return _err.NewInvalidTransactionErr(name + " does not fit in 256 bits")
+	}
+
+	return nil
+}
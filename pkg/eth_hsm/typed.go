@@ -0,0 +1,191 @@
+package eth_hsm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/big"
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/hsm"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// eip712Domain is the type name of the domain in every EIP-712 document
+const eip712Domain = "EIP712Domain"
+
+// TypedData is an EIP-712 document as eth_signTypedData_v4 takes it: types,
+// primaryType, domain and message
+type TypedData = apitypes.TypedData
+
+// typedDataDocument is TypedData with a chainId that can also be a JSON
+// number, which wallets send but apitypes only takes as a string
+type typedDataDocument struct {
+	Types       apitypes.Types            `json:"types"`
+	PrimaryType string                    `json:"primaryType"`
+	Domain      typedDataDomain           `json:"domain"`
+	Message     apitypes.TypedDataMessage `json:"message"`
+}
+
+type typedDataDomain struct {
+	Name              string          `json:"name"`
+	Version           string          `json:"version"`
+	ChainId           json.RawMessage `json:"chainId"`
+	VerifyingContract string          `json:"verifyingContract"`
+	Salt              string          `json:"salt"`
+}
+
+// ParseTypedData decodes an EIP-712 JSON document and checks it can be
+// hashed. JSON numbers in the message have to be integers.
+func ParseTypedData(b []byte) (td TypedData, err error) {
+	var doc typedDataDocument
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	d.UseNumber()
+
+	if err := d.Decode(&doc); err != nil {
+		return td, _err.NewInvalidTypedDataErr(err.Error())
+	}
+
+	if err := parseNumbers(doc.Message); err != nil {
+		return td, err
+	}
+
+	td = TypedData{
+		Types:       doc.Types,
+		PrimaryType: doc.PrimaryType,
+		Message:     doc.Message,
+		Domain: apitypes.TypedDataDomain{
+			Name:              doc.Domain.Name,
+			Version:           doc.Domain.Version,
+			VerifyingContract: doc.Domain.VerifyingContract,
+			Salt:              doc.Domain.Salt,
+		},
+	}
+
+	if chainID := strings.Trim(string(doc.Domain.ChainId), `"`); chainID != "" && chainID != "null" {
+		td.Domain.ChainId = new(math.HexOrDecimal256)
+		if err := td.Domain.ChainId.UnmarshalText([]byte(chainID)); err != nil {
+			return td, _err.NewInvalidTypedDataErr("domain chainId " + err.Error())
+		}
+	}
+
+	if _, _, err := TypedDataHash(td); err != nil {
+		return td, err
+	}
+
+	return td, nil
+}
+
+// parseNumbers replaces the JSON numbers in v with the integers they hold,
+// decoding them as float64 would round integers above 2^53
+func parseNumbers(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			n, err := parseNumber(item)
+			if err != nil {
+				return err
+			}
+			v[k] = n
+		}
+	case []interface{}:
+		for i, item := range v {
+			n, err := parseNumber(item)
+			if err != nil {
+				return err
+			}
+			v[i] = n
+		}
+	}
+
+	return nil
+}
+
+func parseNumber(v interface{}) (interface{}, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v, parseNumbers(v)
+	}
+
+	i, ok := new(big.Int).SetString(n.String(), 10)
+	if !ok {
+		return nil, _err.NewInvalidTypedDataErr("number " + n.String() + " is not an integer")
+	}
+
+	return (*math.HexOrDecimal256)(i), nil
+}
+
+// TypedDataHash returns the EIP-712 digest of td,
+// keccak256("\x19\x01" || domainSeparator || hashStruct(message)), and the
+// domain separator
+func TypedDataHash(td TypedData) (hash, domainSeparator []byte, err error) {
+	if _, ok := td.Types[eip712Domain]; !ok {
+		return nil, nil, _err.NewInvalidTypedDataErr("types has no " + eip712Domain)
+	}
+
+	if td.PrimaryType == eip712Domain {
+		return nil, nil, _err.NewInvalidTypedDataErr("primaryType can not be " + eip712Domain)
+	}
+
+	if _, ok := td.Types[td.PrimaryType]; !ok {
+		return nil, nil, _err.NewInvalidTypedDataErr("primaryType " + td.PrimaryType + " is not in types")
+	}
+
+	domainSeparator, err = td.HashStruct(eip712Domain, td.Domain.Map())
+	if err != nil {
+		return nil, nil, _err.NewInvalidTypedDataErr("domain: " + err.Error())
+	}
+
+	structHash, err := td.HashStruct(td.PrimaryType, td.Message)
+	if err != nil {
+		return nil, nil, _err.NewInvalidTypedDataErr("message: " + err.Error())
+	}
+
+	return crypto.Keccak256([]byte{0x19, 0x01}, domainSeparator, structHash), domainSeparator, nil
+}
+
+// CheckTypedDataChain refuses documents whose domain is not bound to
+// chainID, a signature for another chain, or for any chain, could be
+// replayed there
+func CheckTypedDataChain(td TypedData, chainID *big.Int) error {
+	if chainID == nil {
+		return _err.NewInvalidTypedDataErr("chainId is required")
+	}
+
+	if td.Domain.ChainId == nil {
+		return _err.NewInvalidTypedDataErr("domain has no chainId")
+	}
+
+	if (*big.Int)(td.Domain.ChainId).Cmp(chainID) != 0 {
+		return _err.NewInvalidTypedDataErr("domain chainId " + (*big.Int)(td.Domain.ChainId).String() + " does not match chainId " + chainID.String())
+	}
+
+	return nil
+}
+
+// SignTypedData signs td with the key labeled label as eth_signTypedData_v4
+// does and returns the 65 byte [R || S || V] signature with V 27 or 28. The
+// domain has to be bound to chainID.
+func SignTypedData(ctx context.Context, h hsm.HSM, label string, td TypedData, chainID *big.Int) ([]byte, error) {
+	if err := CheckTypedDataChain(td, chainID); err != nil {
+		return nil, err
+	}
+
+	hash, _, err := TypedDataHash(td)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := signHash(ctx, h, label, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	sig[crypto.RecoveryIDOffset] += 27
+	return sig, nil
+}
@@ -0,0 +1,124 @@
+package eth_hsm
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"open_custodial/pkg/_err"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// mailTypedData is the example of the EIP-712 specification
+const mailTypedData = `{
+	"types": {
+		"EIP712Domain": [
+			{"name": "name", "type": "string"},
+			{"name": "version", "type": "string"},
+			{"name": "chainId", "type": "uint256"},
+			{"name": "verifyingContract", "type": "address"}
+		],
+		"Person": [
+			{"name": "name", "type": "string"},
+			{"name": "wallet", "type": "address"}
+		],
+		"Mail": [
+			{"name": "from", "type": "Person"},
+			{"name": "to", "type": "Person"},
+			{"name": "contents", "type": "string"}
+		]
+	},
+	"primaryType": "Mail",
+	"domain": {
+		"name": "Ether Mail",
+		"version": "1",
+		"chainId": 1,
+		"verifyingContract": "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+	},
+	"message": {
+		"from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+		"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+		"contents": "Hello, Bob!"
+	}
+}`
+
+func (s *MessageSuite) TestTypedDataHash() {
+	td, err := ParseTypedData([]byte(mailTypedData))
+	s.NoError(err)
+
+	hash, domainSeparator, err := TypedDataHash(td)
+	s.NoError(err)
+	s.Equal(common.HexToHash("0xf2cee375fa42b42143804025fc449deafd50cc031ca257e0b194a650a912090f").Bytes(), domainSeparator)
+	s.Equal(common.HexToHash("0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2").Bytes(), hash)
+}
+
+func (s *MessageSuite) TestSignTypedData() {
+	addr, err := CreateAddress(context.Background(), s.hsm, "test_sign_typed_data")
+	s.NoError(err)
+
+	td, err := ParseTypedData([]byte(mailTypedData))
+	s.NoError(err)
+
+	sig, err := SignTypedData(context.Background(), s.hsm, "test_sign_typed_data", td, big.NewInt(1))
+	s.NoError(err)
+	s.Contains([]byte{27, 28}, sig[64])
+
+	hash, _, err := TypedDataHash(td)
+	s.NoError(err)
+
+	recoverable := append([]byte{}, sig...)
+	recoverable[64] -= 27
+	pub, err := crypto.SigToPub(hash, recoverable)
+	s.NoError(err)
+	s.Equal(addr, crypto.PubkeyToAddress(*pub))
+
+	_, err = SignTypedData(context.Background(), s.hsm, "test_sign_typed_data", td, big.NewInt(5))
+	s.IsType(_err.InvalidTypedData{}, err)
+	s.Zero(s.hsm.(*hsm_mem.HSM).OpenSessions())
+}
+
+func (s *MessageSuite) TestParseTypedDataInvalid() {
+	for name, doc := range map[string]string{
+		"no domain type":  `{"types": {"Mail": [{"name": "contents", "type": "string"}]}, "primaryType": "Mail", "domain": {"chainId": 1}, "message": {"contents": "hi"}}`,
+		"unknown primary": `{"types": {"EIP712Domain": [{"name": "chainId", "type": "uint256"}]}, "primaryType": "Mail", "domain": {"chainId": 1}, "message": {}}`,
+		"undefined type":  `{"types": {"EIP712Domain": [{"name": "chainId", "type": "uint256"}], "Mail": [{"name": "from", "type": "Person"}]}, "primaryType": "Mail", "domain": {"chainId": 1}, "message": {"from": {}}}`,
+		"extra field":     `{"types": {"EIP712Domain": [{"name": "chainId", "type": "uint256"}], "Mail": [{"name": "contents", "type": "string"}]}, "primaryType": "Mail", "domain": {"chainId": 1}, "message": {"contents": "hi", "to": "bob"}}`,
+		"not json":        `{"types": `,
+	} {
+		_, err := ParseTypedData([]byte(doc))
+		s.IsType(_err.InvalidTypedData{}, err, name)
+	}
+
+	td, err := ParseTypedData([]byte(`{"types": {"EIP712Domain": [{"name": "name", "type": "string"}], "Mail": [{"name": "contents", "type": "string"}]}, "primaryType": "Mail", "domain": {"name": "no chain"}, "message": {"contents": "hi"}}`))
+	s.NoError(err)
+	s.IsType(_err.InvalidTypedData{}, CheckTypedDataChain(td, big.NewInt(1)))
+}
+
+func (s *MessageSuite) TestParseTypedDataLargeNumber() {
+	const permit = `{"types": {"EIP712Domain": [{"name": "chainId", "type": "uint256"}], "Permit": [{"name": "value", "type": "uint256"}]}, "primaryType": "Permit", "domain": {"chainId": 1}, "message": {"value": %s}}`
+
+	number, err := ParseTypedData([]byte(fmt.Sprintf(permit, "1234567890123456789")))
+	s.NoError(err)
+	str, err := ParseTypedData([]byte(fmt.Sprintf(permit, `"1234567890123456789"`)))
+	s.NoError(err)
+
+	// a number above 2^53 is hashed exactly as the same value sent as a string
+	numberHash, _, err := TypedDataHash(number)
+	s.NoError(err)
+	strHash, _, err := TypedDataHash(str)
+	s.NoError(err)
+	s.Equal(strHash, numberHash)
+
+	rounded, err := ParseTypedData([]byte(fmt.Sprintf(permit, `"1234567890123456768"`)))
+	s.NoError(err)
+	roundedHash, _, err := TypedDataHash(rounded)
+	s.NoError(err)
+	s.NotEqual(roundedHash, numberHash)
+
+	for _, value := range []string{"1.5", "1e3"} {
+		_, err := ParseTypedData([]byte(fmt.Sprintf(permit, value)))
+		s.IsType(_err.InvalidTypedData{}, err, value)
+	}
+}
@@ -0,0 +1,155 @@
+package eth_hsm
+
+import (
+	"context"
+	"errors"
+
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/hsm"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/miekg/pkcs11"
+)
+
+// ErrUnknownAddress is returned by FindAddress when no key of the HSM
+// controls the address
+var ErrUnknownAddress = errors.New("no key in the hsm controls the address")
+
+// RecoverSigner returns the address whose key produced the 65 byte
+// [R || S || V] signature of hash. V can be the recovery id, 0 or 1, or 27
+// and 28 as personal_sign and eth_signTypedData_v4 return it.
+func RecoverSigner(hash, signature []byte) (addr common.Address, err error) {
+	if len(signature) != crypto.SignatureLength {
+		return addr, _err.NewInvalidSignatureErr("expected 65 bytes [R || S || V]")
+	}
+
+	sig := append([]byte{}, signature...)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+
+	if sig[crypto.RecoveryIDOffset] > 1 {
+		return addr, _err.NewInvalidSignatureErr("v must be 0, 1, 27 or 28")
+	}
+
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return addr, _err.NewInvalidSignatureErr(err.Error())
+	}
+
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+// RecoverTransactionSender decodes a signed raw transaction, as
+// RawTransaction encodes it, and returns it with the address that signed
+// it. Legacy transactions without replay protection are accepted too.
+func RecoverTransactionSender(raw []byte) (*types.Transaction, common.Address, error) {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return nil, common.Address{}, _err.NewInvalidSignatureErr("unable to decode raw transaction: " + err.Error())
+	}
+
+	var signer types.Signer = types.HomesteadSigner{}
+	if tx.Protected() {
+		signer = types.LatestSignerForChainID(tx.ChainId())
+	}
+
+	sender, err := types.Sender(signer, tx)
+	if err != nil {
+		return nil, common.Address{}, _err.NewInvalidSignatureErr(err.Error())
+	}
+
+	return tx, sender, nil
+}
+
+// FindAddress returns the label of the secp256k1 key controlling addr and
+// whether it is retired. Every key of the HSM is read, one session per
+// token, so it is meant for addresses the key repository does not know.
+func FindAddress(ctx context.Context, h hsm.HSM, addr common.Address) (label string, retired bool, err error) {
+	labels, err := h.KeyLabels(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	keys := make(map[string][]hsm.KeyLocation)
+	var tokens []string
+	for _, label := range labels {
+		loc, err := h.LocateKey(ctx, label)
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+
+		if _, ok := keys[loc.Token]; !ok {
+			tokens = append(tokens, loc.Token)
+		}
+		keys[loc.Token] = append(keys[loc.Token], loc)
+	}
+
+	for _, token := range tokens {
+		label, retired, err := findTokenAddress(ctx, h, token, keys[token], addr)
+		if !errors.Is(err, ErrUnknownAddress) {
+			return label, retired, err
+		}
+	}
+
+	return "", false, ErrUnknownAddress
+}
+
+func findTokenAddress(ctx context.Context, h hsm.HSM, token string, keys []hsm.KeyLocation, addr common.Address) (string, bool, error) {
+	sess, err := h.NewReadOnlySlotSession(ctx, token)
+	if err != nil {
+		return "", false, err
+	}
+
+	defer h.EndSession(sess)
+
+	for _, loc := range keys {
+		found, err := controls(ctx, h, *sess, loc.Key, addr)
+		if err != nil {
+			return "", false, err
+		}
+
+		if !found {
+			continue
+		}
+
+		// the key of a single key token is labeled by the token
+		label := string(loc.Key)
+		if label == "" {
+			label = loc.Token
+		}
+
+		_, retired, err := h.KeyRetiredAt(ctx, *sess, loc.Key)
+		return label, retired, err
+	}
+
+	return "", false, ErrUnknownAddress
+}
+
+// controls reports whether key is a secp256k1 key for addr, keys on other
+// curves control no address
+func controls(ctx context.Context, h hsm.HSM, sess pkcs11.SessionHandle, key hsm.KeyID, addr common.Address) (bool, error) {
+	pubHandle, err := h.PublicKeyHandle(ctx, sess, key)
+	if err != nil {
+		return false, err
+	}
+
+	curve, err := h.KeyCurve(ctx, sess, pubHandle)
+	if err != nil {
+		return false, err
+	}
+
+	if curve != hsm.CurveSecp256k1 {
+		return false, nil
+	}
+
+	pub, err := getPublicKey(ctx, h, sess, pubHandle)
+	if err != nil {
+		return false, err
+	}
+
+	return crypto.PubkeyToAddress(pub) == addr, nil
+}
@@ -0,0 +1,111 @@
+package eth_hsm
+
+import (
+	"context"
+	"math/big"
+	"open_custodial/pkg/_err"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func (s *MessageSuite) TestRecoverSigner() {
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+
+	hash := PersonalMessageHash([]byte("recover"))
+	sig, err := crypto.Sign(hash, key)
+	s.NoError(err)
+
+	recovered, err := RecoverSigner(hash, sig)
+	s.NoError(err)
+	s.Equal(addr, recovered)
+
+	sig[64] += 27
+	recovered, err = RecoverSigner(hash, sig)
+	s.NoError(err)
+	s.Equal(addr, recovered)
+
+	sig[64] = 29
+	_, err = RecoverSigner(hash, sig)
+	s.IsType(_err.InvalidSignature{}, err)
+
+	_, err = RecoverSigner(hash, sig[:64])
+	s.IsType(_err.InvalidSignature{}, err)
+}
+
+func (s *MessageSuite) TestRecoverTransactionSender() {
+	addr, err := CreateAddress(context.Background(), s.hsm, "test_recover_sender")
+	s.NoError(err)
+
+	tx, err := NewTransaction(TxParams{
+		Type:      types.DynamicFeeTxType,
+		ChainID:   big.NewInt(3),
+		To:        common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"),
+		Gas:       21000,
+		GasTipCap: big.NewInt(2),
+		GasFeeCap: big.NewInt(100),
+	})
+	s.NoError(err)
+
+	signed, err := SignTransaction(context.Background(), s.hsm, tx, "test_recover_sender", big.NewInt(3))
+	s.NoError(err)
+
+	raw, err := RawTransaction(signed)
+	s.NoError(err)
+
+	decoded, sender, err := RecoverTransactionSender(raw)
+	s.NoError(err)
+	s.Equal(addr, sender)
+	s.Equal(signed.Hash(), decoded.Hash())
+
+	// legacy transactions signed before EIP-155 have no chain id
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+
+	unprotected, err := types.SignTx(types.NewTransaction(1, common.Address{}, big.NewInt(1), 21000, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+	s.NoError(err)
+
+	raw, err = RawTransaction(unprotected)
+	s.NoError(err)
+
+	_, sender, err = RecoverTransactionSender(raw)
+	s.NoError(err)
+	s.Equal(crypto.PubkeyToAddress(key.PublicKey), sender)
+
+	_, _, err = RecoverTransactionSender([]byte{0x02, 0x01})
+	s.IsType(_err.InvalidSignature{}, err)
+}
+
+func (s *MessageSuite) TestFindAddress() {
+	ctx := context.Background()
+
+	_, err := s.hsm.NewSlot(ctx, "test_find_token")
+	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(ctx, "test_find_token")
+	s.NoError(err)
+	_, _, err = s.hsm.GenerateKeyEdDSA_ed25519(ctx, *sess, "test_find_ed25519")
+	s.NoError(err)
+	s.NoError(s.hsm.EndSession(sess))
+
+	addr, err := CreateAddressInToken(ctx, s.hsm, "test_find_token", "test_find_address")
+	s.NoError(err)
+
+	label, retired, err := FindAddress(ctx, s.hsm, addr)
+	s.NoError(err)
+	s.Equal("test_find_address", label)
+	s.False(retired)
+
+	_, err = RetireAddress(ctx, s.hsm, "test_find_address")
+	s.NoError(err)
+
+	_, retired, err = FindAddress(ctx, s.hsm, addr)
+	s.NoError(err)
+	s.True(retired)
+
+	_, _, err = FindAddress(ctx, s.hsm, common.HexToAddress("0xE8B5fBaE723E5A4AAc991dDC54c549c1BaEEAb5e"))
+	s.ErrorIs(err, ErrUnknownAddress)
+}
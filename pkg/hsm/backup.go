@@ -0,0 +1,119 @@
+package hsm
+
+import (
+	"errors"
+
+	"github.com/miekg/pkcs11"
+)
+
+// BackupKEKLabel is the CKA_LABEL of the AES key encryption key that backup
+// mode provisions on every token it creates
+const BackupKEKLabel = "open_custodial_backup_kek"
+
+// Option configures optional behaviour of NewHSM
+type Option func(*hsm)
+
+// WithKeyBackup turns on backup mode. Every token created afterwards gets a
+// trusted copy of kek, and private keys are generated extractable, but only
+// under trusted wrapping keys, so WrapKeyECDSA_secp256k1 can export them.
+func WithKeyBackup(kek []byte) Option {
+	return func(h *hsm) {
+		h.backupKEK = append([]byte(nil), kek...)
+	}
+}
+
+// privateKeyPolicy returns the attributes that control whether private keys
+// can leave the token
+func (h *hsm) privateKeyPolicy() []*pkcs11.Attribute {
+	if len(h.backupKEK) == 0 {
+		return []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		}
+	}
+
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP_WITH_TRUSTED, true),
+	}
+}
+
+// provisionBackupKEK stores the backup key encryption key on a new token
+// as two objects with the same value, one that only wraps and one that only
+// unwraps. Keys generated in backup mode can only be wrapped under trusted
+// keys, and only the SO can mark a key as trusted. SO sessions can only
+// create public objects, so the wrapping half is public; it is sensitive,
+// can never be read back and wraps nothing without a logged in crypto user,
+// who alone sees the private keys. The unwrapping half, which restores keys
+// into the token, is private and created by the crypto user.
+func (h *hsm) provisionBackupKEK(soSession pkcs11.SessionHandle, slotID uint) error {
+	wrapping := append(backupKEKTemplate(h.backupKEK),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, false),
+		pkcs11.NewAttribute(pkcs11.CKA_TRUSTED, true),
+	)
+
+	if _, err := h.ctx.CreateObject(soSession, wrapping); err != nil {
+		return err
+	}
+
+	if err := h.ctx.Logout(soSession); err != nil {
+		return err
+	}
+
+	pin, err := h.buildPin(slotID)
+	if err != nil {
+		return err
+	}
+
+	if err := h.ctx.Login(soSession, pkcs11.CKU_USER, pin); err != nil {
+		return err
+	}
+
+	unwrapping := append(backupKEKTemplate(h.backupKEK),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, false),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+	)
+
+	_, err = h.ctx.CreateObject(soSession, unwrapping)
+	return err
+}
+
+func backupKEKTemplate(kek []byte) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, kek),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, BackupKEKLabel),
+	}
+}
+
+// wrapKeyECDSA_secp256k1 exports a private key with C_WrapKey and
+// CKM_AES_KEY_WRAP_PAD under the secret key labeled kek. Only keys created
+// in backup mode are extractable.
+func (h *hsm) wrapKeyECDSA_secp256k1(session pkcs11.SessionHandle, kek KeyID, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	if kek == "" {
+		return nil, errors.New("wrapping a key needs the label of a key encryption key")
+	}
+
+	kekHandle, err := h.findWithAttributes(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, string(kek)),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := h.ctx.WrapKey(session, WrapAESKeyWrapPad.mechanism(), kekHandle, privKey)
+	return wrapped, h.observe(session, err)
+}
@@ -0,0 +1,407 @@
+package hsm
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Operation groups the calls into the module that share a timeout
+type Operation string
+
+const (
+	// OpSession is opening and logging in sessions
+	OpSession Operation = "session"
+	// OpLookup is finding objects and reading their attributes
+	OpLookup Operation = "lookup"
+	OpSign   Operation = "sign"
+	// OpKey is generating, importing, wrapping, retiring and destroying keys
+	OpKey Operation = "key"
+	// OpToken is creating, discarding and scanning tokens
+	OpToken Operation = "token"
+)
+
+// Operations lists every operation a timeout can be set for
+var Operations = []Operation{OpSession, OpLookup, OpSign, OpKey, OpToken}
+
+// WithTimeout bounds every call of op to d, on top of the deadline of the
+// caller's context. Without it only the caller's context applies.
+func WithTimeout(op Operation, d time.Duration) Option {
+	return func(h *hsm) {
+		h.timeouts[op] = d
+	}
+}
+
+func (h *hsm) withTimeout(ctx context.Context, op Operation) (context.Context, context.CancelFunc) {
+	if d := h.timeouts[op]; d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// call runs fn, which calls into the module on session, until it returns or
+// ctx is done. PKCS#11 calls can not be interrupted, so a call that runs past
+// ctx is abandoned: it keeps running in the background and the session is
+// marked broken, it is closed once fn returns instead of going back to the
+// pool. Calls on the same session run one after the other. Results set by
+// fn must only be read when call returns nil.
+func (h *hsm) call(ctx context.Context, session pkcs11.SessionHandle, op Operation, fn func() error) error {
+	ctx, cancel := h.withTimeout(ctx, op)
+	defer cancel()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		h.pool.begin(session)
+		defer h.pool.end(session)
+
+		if err := ctx.Err(); err != nil {
+			// given up while waiting for the session
+			done <- err
+			return
+		}
+
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		h.pool.abandon(session)
+		fmt.Println("hsm: abandoned ", op, " call ", ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// NewSession opens a session that is not pooled, it must be closed with
+// EndSession
+func (h *hsm) NewSession(ctx context.Context, slotID uint) (pkcs11.SessionHandle, error) {
+	ctx, cancel := h.withTimeout(ctx, OpSession)
+	defer cancel()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	done := make(chan borrowed, 1)
+	go func() {
+		sess, err := h.openSession(slotID)
+		done <- borrowed{sess, err}
+	}()
+
+	select {
+	case b := <-done:
+		return b.sess, b.err
+	case <-ctx.Done():
+		go func() {
+			if b := <-done; b.err == nil {
+				h.ctx.CloseSession(b.sess)
+			}
+		}()
+
+		fmt.Println("hsm: abandoned session ", ctx.Err())
+		return 0, ctx.Err()
+	}
+}
+
+// GetSlotID, LocateKey and KeyLabels only read the index, they do not call the module
+
+func (h *hsm) GetSlotID(ctx context.Context, label string) (uint, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return h.getSlotID(label)
+}
+
+func (h *hsm) LocateKey(ctx context.Context, label string) (KeyLocation, error) {
+	if err := ctx.Err(); err != nil {
+		return KeyLocation{}, err
+	}
+
+	return h.locateKey(label)
+}
+
+// KeyLabels lists every label LocateKey resolves, in order
+func (h *hsm) KeyLabels(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return h.slotIndex.KeyLabels(), nil
+}
+
+// KeyDestroyed reports whether label belongs to a destroyed key, which can
+// never be used again
+func (h *hsm) KeyDestroyed(ctx context.Context, label string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	_, ok := h.slotIndex.GetDestroyed(label)
+	return ok, nil
+}
+
+func (h *hsm) GetPublicKey(ctx context.Context, session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ecdsa.PublicKey, error) {
+	var pub ecdsa.PublicKey
+	err := h.call(ctx, session, OpLookup, func() (err error) {
+		pub, err = h.getPublicKey(session, pubKeyHandle)
+		return err
+	})
+	if err != nil {
+		return ecdsa.PublicKey{}, err
+	}
+
+	return pub, nil
+}
+
+func (h *hsm) PublicKeyHandle(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, error) {
+	return h.objectCall(ctx, session, OpLookup, func() (pkcs11.ObjectHandle, error) {
+		return h.publicKeyHandle(session, key)
+	})
+}
+
+func (h *hsm) PrivateKeyHandle(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, error) {
+	return h.objectCall(ctx, session, OpLookup, func() (pkcs11.ObjectHandle, error) {
+		return h.privateKeyHandle(session, key)
+	})
+}
+
+func (h *hsm) ReleaseHandle(ctx context.Context, session pkcs11.SessionHandle) error {
+	return h.call(ctx, session, OpLookup, func() error {
+		return h.releaseHandle(session)
+	})
+}
+
+func (h *hsm) KeyCurve(ctx context.Context, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (Curve, error) {
+	var curve Curve
+	err := h.call(ctx, session, OpLookup, func() (err error) {
+		curve, err = h.keyCurve(session, obj)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return curve, nil
+}
+
+func (h *hsm) GenerateKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	return h.keyPairCall(ctx, session, func() (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+		return h.generateKeyECDSA_secp256k1(session, key)
+	})
+}
+
+func (h *hsm) SignECDSA_secp256k1(ctx context.Context, msg []byte, session pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	return h.bytesCall(ctx, session, OpSign, func() ([]byte, error) {
+		return h.signECDSA_secp256k1(msg, session, privKey)
+	})
+}
+
+func (h *hsm) GenerateKeyEdDSA_ed25519(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	return h.keyPairCall(ctx, session, func() (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+		return h.generateKeyEdDSA_ed25519(session, key)
+	})
+}
+
+func (h *hsm) GetPublicKeyEdDSA_ed25519(ctx context.Context, session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ed25519.PublicKey, error) {
+	return h.bytesCall(ctx, session, OpLookup, func() ([]byte, error) {
+		return h.getPublicKeyEdDSA_ed25519(session, pubKeyHandle)
+	})
+}
+
+func (h *hsm) SignEdDSA_ed25519(ctx context.Context, msg []byte, session pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	return h.bytesCall(ctx, session, OpSign, func() ([]byte, error) {
+		return h.signEdDSA_ed25519(msg, session, privKey)
+	})
+}
+
+func (h *hsm) GenerateKeyECDSA_P256(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	return h.keyPairCall(ctx, session, func() (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+		return h.generateKeyECDSA_P256(session, key)
+	})
+}
+
+func (h *hsm) SignECDSA_P256(ctx context.Context, msg []byte, session pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	return h.bytesCall(ctx, session, OpSign, func() ([]byte, error) {
+		return h.signECDSA_P256(msg, session, privKey)
+	})
+}
+
+func (h *hsm) SignDigestECDSA_P256(ctx context.Context, digest []byte, session pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	return h.bytesCall(ctx, session, OpSign, func() ([]byte, error) {
+		return h.signDigestECDSA_P256(digest, session, privKey)
+	})
+}
+
+func (h *hsm) WrappingPublicKey(ctx context.Context, session pkcs11.SessionHandle) (*rsa.PublicKey, error) {
+	var pub *rsa.PublicKey
+	err := h.call(ctx, session, OpKey, func() (err error) {
+		pub, err = h.wrappingPublicKey(session)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pub, nil
+}
+
+func (h *hsm) UnwrapKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, mech WrapMechanism, kek KeyID, wrapped []byte, key KeyID) (pkcs11.ObjectHandle, error) {
+	return h.objectCall(ctx, session, OpKey, func() (pkcs11.ObjectHandle, error) {
+		return h.unwrapKeyECDSA_secp256k1(session, mech, kek, wrapped, key)
+	})
+}
+
+func (h *hsm) CreatePublicKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, pub ecdsa.PublicKey, key KeyID) (pkcs11.ObjectHandle, error) {
+	return h.objectCall(ctx, session, OpKey, func() (pkcs11.ObjectHandle, error) {
+		return h.createPublicKeyECDSA_secp256k1(session, pub, key)
+	})
+}
+
+func (h *hsm) DestroyObject(ctx context.Context, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) error {
+	return h.call(ctx, session, OpKey, func() error {
+		return h.destroyObject(session, obj)
+	})
+}
+
+func (h *hsm) WrapKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, kek KeyID, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	return h.bytesCall(ctx, session, OpKey, func() ([]byte, error) {
+		return h.wrapKeyECDSA_secp256k1(session, kek, privKey)
+	})
+}
+
+func (h *hsm) RetireKey(ctx context.Context, session pkcs11.SessionHandle, key KeyID) error {
+	return h.call(ctx, session, OpKey, func() error {
+		return h.retireKey(session, key)
+	})
+}
+
+func (h *hsm) KeyRetiredAt(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (time.Time, bool, error) {
+	var (
+		at      time.Time
+		retired bool
+	)
+	err := h.call(ctx, session, OpLookup, func() (err error) {
+		at, retired, err = h.keyRetiredAt(session, key)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return at, retired, nil
+}
+
+func (h *hsm) DestroyKey(ctx context.Context, session pkcs11.SessionHandle, key KeyID) error {
+	return h.call(ctx, session, OpKey, func() error {
+		return h.destroyKey(session, key)
+	})
+}
+
+func (h *hsm) NewSlot(ctx context.Context, name string) (uint, error) {
+	var slotID uint
+	err := h.call(ctx, 0, OpToken, func() (err error) {
+		slotID, err = h.newSlot(name)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return slotID, nil
+}
+
+func (h *hsm) DiscardSlot(ctx context.Context, name string) error {
+	return h.call(ctx, 0, OpToken, func() error {
+		return h.discardSlot(name)
+	})
+}
+
+func (h *hsm) Orphans(ctx context.Context) ([]Orphan, error) {
+	var orphans []Orphan
+	err := h.call(ctx, 0, OpToken, func() (err error) {
+		orphans, err = h.orphans()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return orphans, nil
+}
+
+func (h *hsm) Refresh(ctx context.Context) (IndexReport, error) {
+	var report IndexReport
+	err := h.call(ctx, 0, OpToken, func() (err error) {
+		report, err = h.refresh()
+		return err
+	})
+	if err != nil {
+		return IndexReport{}, err
+	}
+
+	return report, nil
+}
+
+func (h *hsm) Info(ctx context.Context) (InfoReport, error) {
+	var report InfoReport
+	err := h.call(ctx, 0, OpToken, func() (err error) {
+		report, err = h.info()
+		return err
+	})
+	if err != nil {
+		return InfoReport{}, err
+	}
+
+	return report, nil
+}
+
+func (h *hsm) objectCall(ctx context.Context, session pkcs11.SessionHandle, op Operation, fn func() (pkcs11.ObjectHandle, error)) (pkcs11.ObjectHandle, error) {
+	var obj pkcs11.ObjectHandle
+	err := h.call(ctx, session, op, func() (err error) {
+		obj, err = fn()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return obj, nil
+}
+
+func (h *hsm) keyPairCall(ctx context.Context, session pkcs11.SessionHandle, fn func() (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	var pub, priv pkcs11.ObjectHandle
+	err := h.call(ctx, session, OpKey, func() (err error) {
+		pub, priv, err = fn()
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return pub, priv, nil
+}
+
+func (h *hsm) bytesCall(ctx context.Context, session pkcs11.SessionHandle, op Operation, fn func() ([]byte, error)) ([]byte, error) {
+	var out []byte
+	err := h.call(ctx, session, op, func() (err error) {
+		out, err = fn()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,109 @@
+package hsm
+
+import (
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS#11 v3.0 values for Edwards curve keys, miekg/pkcs11 predates them
+const (
+	CKK_EC_EDWARDS              = 0x00000040
+	CKM_EC_EDWARDS_KEY_PAIR_GEN = 0x00001055
+	CKM_EDDSA                   = 0x00001057
+)
+
+// Curve names the curve a key pair is generated on
+type Curve string
+
+const (
+	CurveSecp256k1 Curve = "secp256k1"
+	CurveEd25519   Curve = "ed25519"
+	// CurveP256 is NIST P-256, also known as secp256r1 and prime256v1
+	CurveP256 Curve = "p256"
+)
+
+// Curves lists every supported curve
+var Curves = []Curve{CurveSecp256k1, CurveEd25519, CurveP256}
+
+func (c Curve) Valid() bool {
+	for _, curve := range Curves {
+		if c == curve {
+			return true
+		}
+	}
+
+	return false
+}
+
+// oid returns the object identifier CKA_EC_PARAMS names the curve with
+func (c Curve) oid() asn1.ObjectIdentifier {
+	switch c {
+	case CurveSecp256k1:
+		// http://oid-info.com/get/1.3.132.0.10
+		return asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+	case CurveEd25519:
+		// id-Ed25519 from RFC 8410
+		return asn1.ObjectIdentifier{1, 3, 101, 112}
+	case CurveP256:
+		// http://oid-info.com/get/1.2.840.10045.3.1.7
+		return asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	}
+
+	return nil
+}
+
+// params returns the DER encoded CKA_EC_PARAMS of the curve
+func (c Curve) params() ([]byte, error) {
+	oid := c.oid()
+	if oid == nil {
+		return nil, fmt.Errorf("unknown curve %s", c)
+	}
+
+	return asn1.Marshal(oid)
+}
+
+// keyType returns the CKA_KEY_TYPE of keys on the curve
+func (c Curve) keyType() uint {
+	if c == CurveEd25519 {
+		return CKK_EC_EDWARDS
+	}
+
+	return pkcs11.CKK_ECDSA
+}
+
+func (c Curve) keyGenMechanism() uint {
+	if c == CurveEd25519 {
+		return CKM_EC_EDWARDS_KEY_PAIR_GEN
+	}
+
+	return pkcs11.CKM_ECDSA_KEY_PAIR_GEN
+}
+
+// curveFromParams reads a DER encoded CKA_EC_PARAMS. Besides an object
+// identifier, PKCS#11 v3.0 lets tokens name Edwards curves with a printable
+// string, which SoftHSM does.
+func curveFromParams(b []byte) (Curve, error) {
+	var oid asn1.ObjectIdentifier
+	if rest, err := asn1.Unmarshal(b, &oid); err == nil && len(rest) == 0 {
+		for _, c := range Curves {
+			if oid.Equal(c.oid()) {
+				return c, nil
+			}
+		}
+
+		return "", fmt.Errorf("unsupported curve %s", oid)
+	}
+
+	var name string
+	if rest, err := asn1.UnmarshalWithParams(b, &name, "printable"); err == nil && len(rest) == 0 {
+		if name == "edwards25519" {
+			return CurveEd25519, nil
+		}
+
+		return "", fmt.Errorf("unsupported curve %s", name)
+	}
+
+	return "", fmt.Errorf("unable to parse ec params")
+}
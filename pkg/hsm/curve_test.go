@@ -0,0 +1,83 @@
+package hsm
+
+import (
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CurveSuite struct {
+	suite.Suite
+}
+
+func TestCurveSuite(t *testing.T) {
+	suite.Run(t, new(CurveSuite))
+}
+
+func (s *CurveSuite) TestCurveFromParams() {
+	for _, c := range Curves {
+		params, err := c.params()
+		s.NoError(err)
+
+		curve, err := curveFromParams(params)
+		s.NoError(err)
+		s.Equal(c, curve)
+	}
+
+	name, err := asn1.MarshalWithParams("edwards25519", "printable")
+	s.NoError(err)
+
+	curve, err := curveFromParams(name)
+	s.NoError(err)
+	s.Equal(CurveEd25519, curve)
+
+	// secp384r1 is not supported
+	p384, err := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 34})
+	s.NoError(err)
+
+	_, err = curveFromParams(p384)
+	s.Error(err)
+
+	_, err = curveFromParams([]byte{0x06})
+	s.Error(err)
+}
+
+func (s *CurveSuite) TestUnmarshalEdwardsPoint() {
+	pub, _, err := ed25519.GenerateKey(nil)
+	s.NoError(err)
+
+	point, err := unmarshalEdwardsPoint(pub)
+	s.NoError(err)
+	s.Equal([]byte(pub), point)
+
+	der, err := asn1.Marshal([]byte(pub))
+	s.NoError(err)
+
+	point, err = unmarshalEdwardsPoint(der)
+	s.NoError(err)
+	s.Equal([]byte(pub), point)
+
+	short, err := asn1.Marshal([]byte(pub[:31]))
+	s.NoError(err)
+
+	_, err = unmarshalEdwardsPoint(short)
+	s.Error(err)
+}
+
+func (s *CurveSuite) TestUnmarshalEcParams() {
+	params, err := CurveP256.params()
+	s.NoError(err)
+
+	curve, err := unmarshalEcParams(params)
+	s.NoError(err)
+	s.Equal(elliptic.P256(), curve)
+
+	params, err = CurveEd25519.params()
+	s.NoError(err)
+
+	_, err = unmarshalEcParams(params)
+	s.Error(err)
+}
@@ -0,0 +1,65 @@
+package hsm
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// generateKeyEdDSA_ed25519 generates an Ed25519 key pair on the session's
+// token with CKM_EC_EDWARDS_KEY_PAIR_GEN. Keys are labeled the same way as
+// generateKeyECDSA_secp256k1 labels them.
+func (h *hsm) generateKeyEdDSA_ed25519(session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	return h.generateKeyPair(session, CurveEd25519, key)
+}
+
+// getPublicKeyEdDSA_ed25519 reads an Ed25519 public key
+func (h *hsm) getPublicKeyEdDSA_ed25519(session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ed25519.PublicKey, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	}
+
+	attributes, err := h.ctx.GetAttributeValue(session, pubKeyHandle, template)
+	if err != nil {
+		return nil, h.observe(session, err)
+	}
+
+	curve, err := curveFromParams(attributes[0].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	if curve != CurveEd25519 {
+		return nil, fmt.Errorf("key is on %s, not ed25519", curve)
+	}
+
+	point, err := unmarshalEdwardsPoint(attributes[1].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.PublicKey(point), nil
+}
+
+// signEdDSA_ed25519 signs msg with pure Ed25519 through CKM_EDDSA and
+// returns the 64 byte R || S signature. The message is not hashed first.
+func (h *hsm) signEdDSA_ed25519(msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(CKM_EDDSA, nil)}
+
+	if err := h.ctx.SignInit(sess, mech, privKey); err != nil {
+		return nil, h.observe(sess, err)
+	}
+
+	signature, err := h.ctx.Sign(sess, msg)
+	if err != nil {
+		return nil, h.observe(sess, err)
+	}
+
+	if len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("token returned a %d byte ed25519 signature", len(signature))
+	}
+
+	return signature, nil
+}
@@ -1,67 +1,161 @@
 package hsm
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
+
+	"open_custodial/pkg/config"
 
 	"github.com/miekg/pkcs11"
 )
 
+// HSM is a PKCS#11 module. Calls that reach the module give up when their
+// context is done, see WithTimeout. EndSession, Close and Status always run
+// to completion so cleanup is never skipped.
 type HSM interface {
-	NewSlotSession(name string) (*pkcs11.SessionHandle, error)
+	NewSlotSession(ctx context.Context, name string) (*pkcs11.SessionHandle, error)
+	NewReadOnlySlotSession(ctx context.Context, name string) (*pkcs11.SessionHandle, error)
 	EndSession(sess *pkcs11.SessionHandle) error
-	GetPublicKey(session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ecdsa.PublicKey, error)
-	PublicKeyHandle(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, error)
-	PrivateKeyHandle(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, error)
-	GenerateKeyECDSA_secp256k1(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
-	SignECDSA_secp256k1(msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error)
-	NewSlot(name string) (uint, error)
-	NewSession(slotID uint) (pkcs11.SessionHandle, error)
-	GetSlotID(label string) (uint, error)
-	ReleaseHandle(sess pkcs11.SessionHandle) error
+	GetPublicKey(ctx context.Context, session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ecdsa.PublicKey, error)
+	PublicKeyHandle(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, error)
+	PrivateKeyHandle(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, error)
+	GenerateKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+	SignECDSA_secp256k1(ctx context.Context, msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error)
+	NewSlot(ctx context.Context, name string) (uint, error)
+	NewSession(ctx context.Context, slotID uint) (pkcs11.SessionHandle, error)
+	GetSlotID(ctx context.Context, label string) (uint, error)
+	LocateKey(ctx context.Context, label string) (KeyLocation, error)
+	KeyLabels(ctx context.Context) ([]string, error)
+	KeyDestroyed(ctx context.Context, label string) (bool, error)
+	ReleaseHandle(ctx context.Context, sess pkcs11.SessionHandle) error
+	WrappingPublicKey(ctx context.Context, session pkcs11.SessionHandle) (*rsa.PublicKey, error)
+	UnwrapKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, mech WrapMechanism, kek KeyID, wrapped []byte, key KeyID) (pkcs11.ObjectHandle, error)
+	CreatePublicKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, pub ecdsa.PublicKey, key KeyID) (pkcs11.ObjectHandle, error)
+	DestroyObject(ctx context.Context, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) error
+	WrapKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, kek KeyID, privKey pkcs11.ObjectHandle) ([]byte, error)
+	KeyCurve(ctx context.Context, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (Curve, error)
+	GenerateKeyEdDSA_ed25519(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+	GetPublicKeyEdDSA_ed25519(ctx context.Context, session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ed25519.PublicKey, error)
+	SignEdDSA_ed25519(ctx context.Context, msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error)
+	GenerateKeyECDSA_P256(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+	SignECDSA_P256(ctx context.Context, msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error)
+	SignDigestECDSA_P256(ctx context.Context, digest []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error)
+	Refresh(ctx context.Context) (IndexReport, error)
+	Close() error
+	DiscardSlot(ctx context.Context, name string) error
+	Orphans(ctx context.Context) ([]Orphan, error)
+	RetireKey(ctx context.Context, session pkcs11.SessionHandle, key KeyID) error
+	KeyRetiredAt(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (time.Time, bool, error)
+	DestroyKey(ctx context.Context, session pkcs11.SessionHandle, key KeyID) error
+	Status() ConnectionStatus
+	Info(ctx context.Context) (InfoReport, error)
+	RotatePIN(ctx context.Context, role config.Role, next config.Credential) (PINRotation, error)
+	PINRotation() (PINRotation, bool)
 }
 
 type hsm struct {
-	ctx        *pkcs11.Ctx
-	cuUsername string
-	cuPassword string
-	soPassword string
-	slotIndex  *slotIndex
+	ctx       *pkcs11.Ctx
+	slotIndex *slotIndex
+	pool      *sessionPool
+	backupKEK []byte
+
+	// slotMu serializes token creation and removal
+	slotMu sync.Mutex
+
+	// wrapLocks serialize wrapping key generation per slot
+	wrapMu    sync.Mutex
+	wrapLocks map[uint]*sync.Mutex
+
+	refreshMu       sync.Mutex
+	refreshInterval time.Duration
+	stop            chan struct{}
+
+	supervisor     *supervisor
+	healthInterval time.Duration
+
+	timeouts map[Operation]time.Duration
+
+	// rotationMu guards the credentials, which a PIN rotation switches, and
+	// the tokens found on the legacy SO PIN
+	rotationMu sync.Mutex
+	creds      config.CredentialProvider
+	rotation   *rotation
+	legacySO   map[uint]bool
+
+	legacySOPin bool
+
+	// rotationState is the file an incomplete rotation is kept in, sealed
+	// with rotationPassphrase
+	rotationState      string
+	rotationPassphrase []byte
 }
 
-func NewHSM(libPath, cuUsername, cuPassword, soPassword string) (HSM, error) {
+// NewHSM loads the PKCS#11 module at libPath. Only a library that can not be
+// loaded is an error, when the module fails to initialize the HSM starts
+// disconnected and keeps reconnecting in the background, see Status.
+func NewHSM(libPath string, creds config.CredentialProvider, opts ...Option) (HSM, error) {
 	p := pkcs11.New(libPath)
 	if p == nil {
 		return nil, fmt.Errorf("unable to initialize pkcs11 module with path %s", libPath)
 	}
 
-	if err := p.Initialize(); err != nil {
-		return nil, err
+	slotIdx := newSlotIndex()
+	h := &hsm{
+		ctx:       p,
+		creds:     creds,
+		slotIndex: slotIdx,
+		stop:      make(chan struct{}),
+		timeouts:  make(map[Operation]time.Duration),
 	}
+	h.pool = newSessionPool(p, h.buildPin, defaultMaxIdleSessions)
+	h.pool.relogin = h.loginRotating
 
-	slotIdx := &slotIndex{labelSlotIdx: make(map[string]uint)}
-	h := &hsm{p, cuUsername, cuPassword, soPassword, slotIdx}
+	for _, opt := range opts {
+		opt(h)
+	}
 
-	if err := h.buildSlotIndex(); err != nil {
+	if err := h.loadRotation(); err != nil {
 		return nil, err
 	}
 
+	h.supervisor = newSupervisor(h.reconnect, h.probe, h.healthInterval, h.stop)
+	go h.supervisor.run()
+
+	if err := h.connect(); err != nil {
+		var missing *MissingMechanismsError
+		if errors.As(err, &missing) {
+			// retrying will not make the vendor support them
+			h.Close()
+			return nil, err
+		}
+
+		fmt.Println("hsm: unable to connect, retrying in the background ", err)
+		h.supervisor.fail(err)
+	}
+
+	if h.refreshInterval > 0 {
+		go h.refreshLoop(h.refreshInterval)
+	}
+
 	return h, nil
 }
 
-type slotIndex struct {
-	mu           sync.Mutex
-	labelSlotIdx map[string]uint
-}
+func (h *hsm) connect() error {
+	if err := h.ctx.Initialize(); err != nil {
+		return err
+	}
 
-func (s *slotIndex) Set(label string, slotID uint) {
-	s.mu.Lock()
-	s.labelSlotIdx[label] = slotID
-	s.mu.Unlock()
-}
+	report, err := h.refresh()
+	if err != nil {
+		return err
+	}
 
-func (s *slotIndex) Get(label string) (uint, bool) {
-	slotID, ok := s.labelSlotIdx[label]
-	return slotID, ok
+	report.log()
+	return h.checkCapabilities()
 }
@@ -1,9 +1,17 @@
 package hsm
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
 	"errors"
 	"open_custodial/pkg/config"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/pkcs11"
 	"github.com/stretchr/testify/suite"
@@ -20,6 +28,10 @@ func TestHSMSuite(t *testing.T) {
 
 func (s *HSMSuite) SetupSuite() {
 	c := config.NewConfig()
+	if c.HSMLibPath == "" {
+		s.T().Skip("HSM_LIB_PATH is not set")
+	}
+
 	p := pkcs11.New(c.HSMLibPath)
 	if p == nil {
 		s.NoError(errors.New("unable to init pkcs11"))
@@ -28,10 +40,476 @@ func (s *HSMSuite) SetupSuite() {
 	err := p.Initialize()
 	s.NoError(err)
 
-	s.hsm = &hsm{p, c.CU_USERNAME, c.CU_PASSWORD, c.SO_PASSWORD, nil}
+	creds, err := c.CredentialProvider("")
+	s.NoError(err)
+
+	s.hsm = &hsm{
+		ctx:       p,
+		creds:     creds,
+		slotIndex: newSlotIndex(),
+	}
+	s.hsm.pool = newSessionPool(p, s.hsm.buildPin, defaultMaxIdleSessions)
+	s.hsm.pool.relogin = s.hsm.loginRotating
 }
 
 func (s *HSMSuite) TestNewSlot() {
-	_, err := s.hsm.NewSlot("test_new_slot")
+	_, err := s.hsm.NewSlot(context.Background(), "test_new_slot")
+	s.NoError(err)
+}
+
+func (s *HSMSuite) TestEd25519() {
+	_, err := s.hsm.NewSlot(context.Background(), "test_ed25519")
+	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "test_ed25519")
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	pub, priv, err := s.hsm.GenerateKeyEdDSA_ed25519(context.Background(), *sess, "test_ed25519")
+	s.NoError(err)
+
+	key, err := s.hsm.GetPublicKeyEdDSA_ed25519(context.Background(), *sess, pub)
+	s.NoError(err)
+
+	msg := []byte("test_ed25519")
+	sig, err := s.hsm.SignEdDSA_ed25519(context.Background(), msg, *sess, priv)
+	s.NoError(err)
+	s.True(ed25519.Verify(key, msg, sig))
+}
+
+func (s *HSMSuite) TestP256() {
+	_, err := s.hsm.NewSlot(context.Background(), "test_p256")
+	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "test_p256")
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	pub, priv, err := s.hsm.GenerateKeyECDSA_P256(context.Background(), *sess, "test_p256")
+	s.NoError(err)
+
+	key, err := s.hsm.GetPublicKey(context.Background(), *sess, pub)
+	s.NoError(err)
+
+	msg := []byte("test_p256")
+	sig, err := s.hsm.SignECDSA_P256(context.Background(), msg, *sess, priv)
+	s.NoError(err)
+
+	digest := sha256.Sum256(msg)
+	s.True(ecdsa.VerifyASN1(&key, digest[:], sig))
+}
+
+func (s *HSMSuite) TestRefresh() {
+	_, err := s.hsm.NewSlot(context.Background(), "test_refresh")
+	s.NoError(err)
+
+	report, err := s.hsm.Refresh(context.Background())
+	s.NoError(err)
+	s.NotContains(report.Removed, "test_refresh")
+
+	_, err = s.hsm.GetSlotID(context.Background(), "test_refresh")
+	s.NoError(err)
+}
+
+func (s *HSMSuite) TestInfo() {
+	report, err := s.hsm.Info(context.Background())
+	s.NoError(err)
+	s.NotEmpty(report.Tokens)
+	s.NotEmpty(report.Mechanisms)
+}
+
+func (s *HSMSuite) TestRotatePIN() {
+	_, err := s.hsm.NewSlot(context.Background(), "test_rotate_pin")
+	s.NoError(err)
+
+	current, err := s.hsm.credential(config.RoleCU, 0)
+	s.NoError(err)
+
+	next := config.Credential{Username: current.Username, Password: current.Password + "_rotated"}
+	report, err := s.hsm.RotatePIN(context.Background(), config.RoleCU, next)
+	s.NoError(err)
+	s.Equal(RotationComplete, report.State)
+	s.Contains(report.Rotated, "test_rotate_pin")
+
+	// sessions log in with the new PIN
+	sess, err := s.hsm.NewSlotSession(context.Background(), "test_rotate_pin")
+	s.NoError(err)
+	s.NoError(s.hsm.EndSession(sess))
+
+	report, err = s.hsm.RotatePIN(context.Background(), config.RoleCU, current)
+	s.NoError(err)
+	s.Equal(RotationComplete, report.State)
+}
+
+func (s *HSMSuite) TestConcurrentNewSlot() {
+	labels := []string{"test_concurrent_0", "test_concurrent_1", "test_concurrent_2", "test_concurrent_3"}
+
+	slots := make([]uint, len(labels))
+	errs := make([]error, len(labels))
+	var wg sync.WaitGroup
+	for i, label := range labels {
+		wg.Add(1)
+		go func(i int, label string) {
+			defer wg.Done()
+			slots[i], errs[i] = s.hsm.NewSlot(context.Background(), label)
+		}(i, label)
+	}
+	wg.Wait()
+
+	seen := make(map[uint]bool)
+	for i := range labels {
+		s.NoError(errs[i])
+		s.False(seen[slots[i]], "slot %d handed out twice", slots[i])
+		seen[slots[i]] = true
+	}
+
+	// the same label is only created once
+	var created int32
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.hsm.NewSlot(context.Background(), "test_concurrent_same"); err == nil {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	s.Equal(int32(1), created)
+}
+
+func (s *HSMSuite) TestReuseFailedSlot() {
+	slotID, err := s.hsm.NewSlot(context.Background(), "test_reuse_failed")
+	s.NoError(err)
+
+	s.NoError(s.hsm.DiscardSlot(context.Background(), "test_reuse_failed"))
+
+	info, err := s.hsm.ctx.GetTokenInfo(slotID)
+	s.NoError(err)
+	s.Equal(failedLabel(slotID), info.Label)
+
+	_, err = s.hsm.GetSlotID(context.Background(), "test_reuse_failed")
+	s.Error(err)
+
+	// without an uninitialized token the failed one is picked, failed
+	// tokens other tests left behind are left out
+	slots, err := s.hsm.ctx.GetSlotList(true)
+	s.NoError(err)
+
+	var initialized []uint
+	for _, slot := range slots {
+		info, err := s.hsm.ctx.GetTokenInfo(slot)
+		s.NoError(err)
+		if info.Flags&pkcs11.CKF_TOKEN_INITIALIZED != 0 && (slot == slotID || !isFailedLabel(info.Label)) {
+			initialized = append(initialized, slot)
+		}
+	}
+
+	s.hsm.slotMu.Lock()
+	free, err := s.hsm.freeSlot(initialized)
+	s.NoError(err)
+	s.Equal(slotID, free)
+
+	// a failed token is initialized with the SO PIN, so it can be set up again
+	soPin, err := s.hsm.buildSOPin(slotID)
+	s.NoError(err)
+	s.NoError(s.hsm.ctx.InitToken(slotID, soPin, "test_reuse_failed"))
+	s.NoError(s.hsm.setupToken(slotID))
+	s.hsm.slotIndex.Set("test_reuse_failed", slotID)
+	s.hsm.slotMu.Unlock()
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "test_reuse_failed")
+	s.NoError(err)
+	s.NoError(s.hsm.EndSession(sess))
+}
+
+func (s *HSMSuite) TestOrphans() {
+	_, err := s.hsm.NewSlot(context.Background(), "test_orphan_empty")
+	s.NoError(err)
+
+	failedSlot, err := s.hsm.NewSlot(context.Background(), "test_orphan_failed")
+	s.NoError(err)
+	s.NoError(s.hsm.DiscardSlot(context.Background(), "test_orphan_failed"))
+
+	_, err = s.hsm.NewSlot(context.Background(), "test_orphan_key")
 	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "test_orphan_key")
+	s.NoError(err)
+	_, _, err = s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, "test_orphan_key")
+	s.NoError(err)
+	s.NoError(s.hsm.EndSession(sess))
+
+	// a token whose user PIN was never set, as when setup stopped half way
+	s.hsm.slotMu.Lock()
+	slots, err := s.hsm.ctx.GetSlotList(true)
+	s.NoError(err)
+	pinSlot, err := s.hsm.freeSlot(slots)
+	s.NoError(err)
+	soPin, err := s.hsm.buildSOPin(pinSlot)
+	s.NoError(err)
+	s.NoError(s.hsm.ctx.InitToken(pinSlot, soPin, "test_orphan_pin"))
+	s.hsm.slotMu.Unlock()
+
+	orphans, err := s.hsm.Orphans(context.Background())
+	s.NoError(err)
+
+	reasons := make(map[string]OrphanReason)
+	for _, orphan := range orphans {
+		reasons[orphan.Label] = orphan.Reason
+	}
+
+	s.Equal(OrphanEmpty, reasons["test_orphan_empty"])
+	s.Equal(OrphanFailed, reasons[failedLabel(failedSlot)])
+	s.Equal(OrphanPINNotInitialized, reasons["test_orphan_pin"])
+	s.NotContains(reasons, "test_orphan_key")
+}
+
+func (s *HSMSuite) newKey(label string) (*pkcs11.SessionHandle, pkcs11.ObjectHandle) {
+	_, err := s.hsm.NewSlot(context.Background(), label)
+	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), label)
+	s.NoError(err)
+
+	_, priv, err := s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, KeyID(label))
+	s.NoError(err)
+
+	return sess, priv
+}
+
+func (s *HSMSuite) TestRetireKey() {
+	sess, priv := s.newKey("test_retire")
+	defer s.hsm.EndSession(sess)
+
+	// a public record, which any session can create, does not retire the key
+	forged, err := s.hsm.ctx.CreateObject(*sess, append(recordTemplate(RetiredKeyApplication, "test_retire"),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte(time.Now().Add(-time.Hour*24*365).UTC().Format(time.RFC3339Nano))),
+	))
+	s.NoError(err)
+	_, retired, err := s.hsm.KeyRetiredAt(context.Background(), *sess, "test_retire")
+	s.NoError(err)
+	s.False(retired)
+	s.NoError(s.hsm.ctx.DestroyObject(*sess, forged))
+
+	s.NoError(s.hsm.RetireKey(context.Background(), *sess, "test_retire"))
+
+	attributes, err := s.hsm.ctx.GetAttributeValue(*sess, priv, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN_RECOVER, nil),
+	})
+	s.NoError(err)
+	s.Equal([]byte{0}, attributes[0].Value)
+	s.Equal([]byte{0}, attributes[1].Value)
+
+	_, err = s.hsm.findWithAttributes(*sess, retiredTemplate("test_retire"))
+	s.NoError(err)
+
+	at, retired, err := s.hsm.KeyRetiredAt(context.Background(), *sess, "test_retire")
+	s.NoError(err)
+	s.True(retired)
+	s.False(at.IsZero())
+
+	_, err = s.hsm.SignECDSA_secp256k1(context.Background(), make([]byte, 32), *sess, priv)
+	s.Error(err)
+
+	// retiring again keeps the first record
+	s.NoError(s.hsm.RetireKey(context.Background(), *sess, "test_retire"))
+	again, _, err := s.hsm.KeyRetiredAt(context.Background(), *sess, "test_retire")
+	s.NoError(err)
+	s.Equal(at, again)
+}
+
+func (s *HSMSuite) TestDestroyKey() {
+	sess, _ := s.newKey("test_destroy")
+	defer s.hsm.EndSession(sess)
+
+	s.ErrorIs(s.hsm.DestroyKey(context.Background(), *sess, "test_destroy"), ErrKeyNotRetired)
+
+	s.NoError(s.hsm.RetireKey(context.Background(), *sess, "test_destroy"))
+	s.NoError(s.hsm.DestroyKey(context.Background(), *sess, "test_destroy"))
+
+	_, err := s.hsm.privateKeyHandle(*sess, "test_destroy")
+	s.Error(err)
+	_, err = s.hsm.publicKeyHandle(*sess, "test_destroy")
+	s.Error(err)
+
+	// the retirement record goes, the destruction record stays
+	_, err = s.hsm.findWithAttributes(*sess, recordTemplate(RetiredKeyApplication, "test_destroy"))
+	s.Error(err)
+	_, err = s.hsm.findWithAttributes(*sess, recordTemplate(DestroyedKeyApplication, "test_destroy"))
+	s.NoError(err)
+
+	_, err = s.hsm.LocateKey(context.Background(), "test_destroy")
+	s.Error(err)
+
+	// the label stays reserved once the index is rebuilt from the tokens
+	_, err = s.hsm.Refresh(context.Background())
+	s.NoError(err)
+
+	token, ok := s.hsm.slotIndex.GetDestroyed("test_destroy")
+	s.True(ok)
+	s.Equal("test_destroy", token)
+
+	_, _, err = s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, "test_destroy")
+	s.Error(err)
+}
+
+func (s *HSMSuite) TestDestroyKeyInterrupted() {
+	sess, priv := s.newKey("test_destroy_interrupted")
+	defer s.hsm.EndSession(sess)
+
+	s.NoError(s.hsm.RetireKey(context.Background(), *sess, "test_destroy_interrupted"))
+
+	// a destruction that stopped after the record and the private key, the
+	// record is written before any C_DestroyObject
+	s.NoError(s.hsm.createRecord(*sess, DestroyedKeyApplication, "test_destroy_interrupted", time.Now()))
+	s.NoError(s.hsm.destroyObject(*sess, priv))
+
+	_, err := s.hsm.Refresh(context.Background())
+	s.NoError(err)
+
+	_, ok := s.hsm.slotIndex.GetDestroyed("test_destroy_interrupted")
+	s.True(ok)
+
+	// destroying again finishes the job
+	s.NoError(s.hsm.DestroyKey(context.Background(), *sess, "test_destroy_interrupted"))
+	_, err = s.hsm.publicKeyHandle(*sess, "test_destroy_interrupted")
+	s.Error(err)
+}
+
+func (s *HSMSuite) TestLegacySOPin() {
+	// a token initialized before the SO had its own credential
+	s.hsm.slotMu.Lock()
+	slots, err := s.hsm.ctx.GetSlotList(true)
+	s.NoError(err)
+	slotID, err := s.hsm.freeSlot(slots)
+	s.NoError(err)
+	legacy, err := s.hsm.legacySOPinOf(slotID)
+	s.NoError(err)
+	s.NoError(s.hsm.ctx.InitToken(slotID, legacy, "test_legacy_so_pin"))
+
+	// without the opt in the crypto user PIN is no SO PIN
+	s.Error(s.hsm.setupToken(slotID))
+
+	s.hsm.legacySOPin = true
+	defer func() { s.hsm.legacySOPin = false }()
+
+	s.NoError(s.hsm.setupToken(slotID))
+	s.hsm.slotIndex.Set("test_legacy_so_pin", slotID)
+	s.hsm.slotMu.Unlock()
+
+	s.True(s.legacyReported(slotID))
+
+	// rotating the SO PIN moves it to the SO credential
+	so, err := s.hsm.credential(config.RoleSO, slotID)
+	s.NoError(err)
+	report, err := s.hsm.RotatePIN(context.Background(), config.RoleSO, so)
+	s.NoError(err)
+	s.Equal(RotationComplete, report.State)
+	s.Contains(report.Rotated, "test_legacy_so_pin")
+	s.False(s.legacyReported(slotID))
+
+	sess, err := newSession(s.hsm.ctx, slotID)
+	s.NoError(err)
+	defer s.hsm.ctx.CloseSession(sess)
+	s.NoError(s.hsm.ctx.Login(sess, pkcs11.CKU_SO, so.PIN()))
+}
+
+func (s *HSMSuite) legacyReported(slotID uint) bool {
+	info, err := s.hsm.Info(context.Background())
+	s.NoError(err)
+
+	for _, token := range info.Tokens {
+		if token.SlotID == slotID {
+			return token.LegacySOPin
+		}
+	}
+
+	return false
+}
+
+func (s *HSMSuite) TestConcurrentWrappingKey() {
+	_, err := s.hsm.NewSlot(context.Background(), "test_wrapping_key")
+	s.NoError(err)
+
+	keys := make([]*rsa.PublicKey, 4)
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			sess, err := s.hsm.NewSlotSession(context.Background(), "test_wrapping_key")
+			s.NoError(err)
+			defer s.hsm.EndSession(sess)
+
+			keys[i], err = s.hsm.wrappingPublicKey(*sess)
+			s.NoError(err)
+		}(i)
+	}
+	wg.Wait()
+
+	// one key pair is generated, and its private half is the one found
+	for _, key := range keys[1:] {
+		s.Equal(keys[0], key)
+	}
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "test_wrapping_key")
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	priv, err := s.hsm.rsaUnwrappingKey(*sess)
+	s.NoError(err)
+	pub, err := s.hsm.findWithAttributes(*sess, wrappingKeyTemplate(pkcs11.CKO_PUBLIC_KEY))
+	s.NoError(err)
+
+	ids := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, nil)}
+	privID, err := s.hsm.ctx.GetAttributeValue(*sess, priv, ids)
+	s.NoError(err)
+	pubID, err := s.hsm.ctx.GetAttributeValue(*sess, pub, ids)
+	s.NoError(err)
+	s.NotEmpty(pubID[0].Value)
+	s.Equal(pubID[0].Value, privID[0].Value)
+}
+
+func (s *HSMSuite) TestBackupKEKRoles() {
+	s.hsm.backupKEK = make([]byte, 32)
+	_, err := s.hsm.NewSlot(context.Background(), "test_backup_kek")
+	s.hsm.backupKEK = nil
+	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "test_backup_kek")
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	roles := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_TRUSTED, nil),
+	}
+
+	// the trusted half only wraps, the private half only unwraps
+	for _, tc := range []struct {
+		role     uint
+		expected []byte
+	}{
+		{pkcs11.CKA_WRAP, []byte{0, 1, 0, 1}},
+		{pkcs11.CKA_UNWRAP, []byte{1, 0, 1, 0}},
+	} {
+		obj, err := s.hsm.findWithAttributes(*sess, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, BackupKEKLabel),
+			pkcs11.NewAttribute(tc.role, true),
+		})
+		s.NoError(err)
+
+		attributes, err := s.hsm.ctx.GetAttributeValue(*sess, obj, roles)
+		s.NoError(err)
+		for i, a := range attributes {
+			s.Equal(tc.expected[i] == 1, attributeTrue(a), "attribute %d of the %d half", i, tc.role)
+		}
+	}
 }
@@ -0,0 +1,485 @@
+package hsm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// WithIndexRefresh rescans the tokens every interval, so tokens created or
+// removed outside the process, by softhsm2-util or another replica, show up
+// without a restart. See Refresh.
+func WithIndexRefresh(interval time.Duration) Option {
+	return func(h *hsm) {
+		h.refreshInterval = interval
+	}
+}
+
+// slotIndex maps token labels to slot IDs and key labels to the label of the
+// token holding them
+type slotIndex struct {
+	mu           sync.RWMutex
+	labelSlotIdx map[string]uint
+	keyTokenIdx  map[string]string
+	// destroyedIdx maps labels of destroyed keys to the token that held them
+	destroyedIdx map[string]string
+	// singleKeyIdx holds the labels of tokens whose only key is unlabeled,
+	// the token label addresses that key
+	singleKeyIdx map[string]bool
+	// ambiguousIdx holds key labels found on more than one token, they are
+	// not resolved to any of them
+	ambiguousIdx map[string]bool
+
+	// entries set while a refresh is scanning the tokens, they are applied
+	// on top of the scan so they are not lost
+	scanning         bool
+	pendingSlots     map[string]uint
+	pendingKeys      map[string]string
+	pendingDestroyed map[string]string
+	// tokens that got a labeled key or lost their key during the scan
+	pendingShared map[string]bool
+}
+
+func newSlotIndex() *slotIndex {
+	return &slotIndex{
+		labelSlotIdx: make(map[string]uint),
+		keyTokenIdx:  make(map[string]string),
+		destroyedIdx: make(map[string]string),
+		singleKeyIdx: make(map[string]bool),
+		ambiguousIdx: make(map[string]bool),
+	}
+}
+
+func (s *slotIndex) Set(label string, slotID uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.labelSlotIdx[label] = slotID
+	if s.scanning {
+		s.pendingSlots[label] = slotID
+	}
+}
+
+// Delete forgets the token labeled label and every key it holds
+func (s *slotIndex) Delete(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.labelSlotIdx, label)
+	delete(s.pendingSlots, label)
+	delete(s.singleKeyIdx, label)
+	for key, token := range s.keyTokenIdx {
+		if token == label {
+			delete(s.keyTokenIdx, key)
+			delete(s.pendingKeys, key)
+		}
+	}
+}
+
+func (s *slotIndex) Get(label string) (uint, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	slotID, ok := s.labelSlotIdx[label]
+	return slotID, ok
+}
+
+// Slots returns a copy of the token labels and their slot IDs
+func (s *slotIndex) Slots() map[string]uint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	slots := make(map[string]uint, len(s.labelSlotIdx))
+	for label, slotID := range s.labelSlotIdx {
+		slots[label] = slotID
+	}
+
+	return slots
+}
+
+// SetKey records the label of the token holding the key with the given label
+func (s *slotIndex) SetKey(label, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keyTokenIdx[label] = token
+	s.unsetSingleKey(token)
+	if s.scanning {
+		s.pendingKeys[label] = token
+	}
+}
+
+func (s *slotIndex) GetKey(label string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token, ok := s.keyTokenIdx[label]
+	return token, ok
+}
+
+// SetDestroyed reserves the label of a destroyed key for good
+func (s *slotIndex) SetDestroyed(label, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keyTokenIdx, label)
+	delete(s.pendingKeys, label)
+
+	s.destroyedIdx[label] = token
+	s.unsetSingleKey(token)
+	if s.scanning {
+		s.pendingDestroyed[label] = token
+	}
+}
+
+func (s *slotIndex) GetDestroyed(label string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token, ok := s.destroyedIdx[label]
+	return token, ok
+}
+
+// KeyLabels returns the labels of the indexed keys and of the tokens holding
+// a single unlabeled key, sorted
+func (s *slotIndex) KeyLabels() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	labels := make([]string, 0, len(s.keyTokenIdx)+len(s.singleKeyIdx))
+	for label := range s.keyTokenIdx {
+		labels = append(labels, label)
+	}
+
+	for token := range s.singleKeyIdx {
+		if _, ok := s.keyTokenIdx[token]; !ok {
+			labels = append(labels, token)
+		}
+	}
+
+	sort.Strings(labels)
+	return labels
+}
+
+// IsAmbiguous reports whether the key label was found on more than one token
+func (s *slotIndex) IsAmbiguous(label string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.ambiguousIdx[label]
+}
+
+// IsSingleKey reports whether the token labeled label holds exactly one key,
+// and that key is unlabeled
+func (s *slotIndex) IsSingleKey(label string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.singleKeyIdx[label]
+}
+
+func (s *slotIndex) unsetSingleKey(token string) {
+	delete(s.singleKeyIdx, token)
+	if s.scanning {
+		s.pendingShared[token] = true
+	}
+}
+
+func (s *slotIndex) beginScan() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scanning = true
+	s.pendingSlots = make(map[string]uint)
+	s.pendingKeys = make(map[string]string)
+	s.pendingDestroyed = make(map[string]string)
+	s.pendingShared = make(map[string]bool)
+}
+
+// abortScan drops the entries recorded for a scan that failed, they are
+// already in the live maps
+func (s *slotIndex) abortScan() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scanning = false
+	s.pendingSlots = nil
+	s.pendingKeys = nil
+	s.pendingDestroyed = nil
+	s.pendingShared = nil
+}
+
+// scan is what a refresh found on the tokens
+type scan struct {
+	slots      map[string]uint
+	keys       map[string]string
+	destroyed  map[string]string
+	singleKey  map[string]bool
+	ambiguous  map[string]bool
+	duplicates map[string][]uint
+}
+
+// replace swaps in the result of a scan and reports how the tokens changed
+func (s *slotIndex) replace(sc scan) IndexReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for label, slotID := range s.pendingSlots {
+		sc.slots[label] = slotID
+	}
+
+	for label, token := range s.pendingKeys {
+		sc.keys[label] = token
+	}
+
+	for label, token := range s.pendingDestroyed {
+		sc.destroyed[label] = token
+		delete(sc.keys, label)
+	}
+
+	for token := range s.pendingShared {
+		delete(sc.singleKey, token)
+	}
+
+	report := diffSlots(s.labelSlotIdx, sc.slots)
+	report.Duplicates = sc.duplicates
+
+	s.labelSlotIdx = sc.slots
+	s.keyTokenIdx = sc.keys
+	s.destroyedIdx = sc.destroyed
+	s.singleKeyIdx = sc.singleKey
+	s.ambiguousIdx = sc.ambiguous
+	s.scanning = false
+	s.pendingSlots = nil
+	s.pendingKeys = nil
+	s.pendingDestroyed = nil
+	s.pendingShared = nil
+
+	return report
+}
+
+// IndexReport describes how the tokens changed between two refreshes
+type IndexReport struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Renamed maps the old label of a slot to its new label
+	Renamed map[string]string `json:"renamed"`
+	// Duplicates lists the slots of token labels and of key labels found
+	// more than once. Only the lowest slot ID of a token label is indexed,
+	// the others can not be reached by label. A duplicate key label is not
+	// resolved at all.
+	Duplicates map[string][]uint `json:"duplicates"`
+	// RemovedSlots are the slot IDs that no longer hold the token they did
+	RemovedSlots []uint `json:"removedSlots"`
+}
+
+// Changed reports whether any token was added, removed or renamed
+func (r IndexReport) Changed() bool {
+	return len(r.Added) > 0 || len(r.Removed) > 0 || len(r.Renamed) > 0
+}
+
+func (r IndexReport) log() {
+	for label, slots := range r.Duplicates {
+		fmt.Println("slot_index: duplicate label ", label, " on slots ", slots)
+	}
+
+	if r.Changed() {
+		fmt.Println("slot_index: added ", r.Added, " removed ", r.Removed, " renamed ", r.Renamed)
+	}
+}
+
+func diffSlots(old, current map[string]uint) IndexReport {
+	report := IndexReport{
+		Renamed:    make(map[string]string),
+		Duplicates: make(map[string][]uint),
+	}
+
+	bySlot := make(map[uint]string, len(current))
+	for label, slotID := range current {
+		bySlot[slotID] = label
+	}
+
+	for label, slotID := range old {
+		if id, ok := current[label]; ok && id == slotID {
+			continue
+		}
+
+		report.RemovedSlots = append(report.RemovedSlots, slotID)
+
+		if renamed, ok := bySlot[slotID]; ok {
+			if _, existed := old[renamed]; !existed {
+				report.Renamed[label] = renamed
+				continue
+			}
+		}
+
+		if _, ok := current[label]; !ok {
+			report.Removed = append(report.Removed, label)
+		}
+	}
+
+	renamedTo := make(map[string]bool, len(report.Renamed))
+	for _, label := range report.Renamed {
+		renamedTo[label] = true
+	}
+
+	for label := range current {
+		if _, ok := old[label]; !ok && !renamedTo[label] {
+			report.Added = append(report.Added, label)
+		}
+	}
+
+	sort.Strings(report.Added)
+	sort.Strings(report.Removed)
+
+	return report
+}
+
+// refresh rescans every token and key label and swaps the result in. Sessions
+// pooled for slots whose token was removed or renamed are closed. Token
+// labels found on more than one slot are reported in Duplicates.
+func (h *hsm) refresh() (IndexReport, error) {
+	h.refreshMu.Lock()
+	defer h.refreshMu.Unlock()
+
+	h.slotIndex.beginScan()
+
+	sc, err := h.scanSlots()
+	if err != nil {
+		h.slotIndex.abortScan()
+		return IndexReport{}, h.checkFatal(err)
+	}
+
+	report := h.slotIndex.replace(sc)
+
+	for _, slotID := range report.RemovedSlots {
+		h.pool.evictSlot(slotID)
+	}
+
+	return report, nil
+}
+
+// scanSlots lists every initialized token, the labels of its keys and of
+// the keys destroyed on it
+func (h *hsm) scanSlots() (sc scan, err error) {
+	slotList, err := h.ctx.GetSlotList(true)
+	if err != nil {
+		return sc, err
+	}
+
+	// lowest slot ID first, so the same token wins every time
+	sort.Slice(slotList, func(i, j int) bool { return slotList[i] < slotList[j] })
+
+	sc = scan{
+		slots:      make(map[string]uint),
+		keys:       make(map[string]string),
+		destroyed:  make(map[string]string),
+		singleKey:  make(map[string]bool),
+		ambiguous:  make(map[string]bool),
+		duplicates: make(map[string][]uint),
+	}
+
+	for _, s := range slotList {
+		info, err := h.ctx.GetTokenInfo(s)
+		if err != nil {
+			return sc, err
+		}
+
+		if info.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 || isFailedLabel(info.Label) {
+			continue
+		}
+
+		if first, ok := sc.slots[info.Label]; ok {
+			if len(sc.duplicates[info.Label]) == 0 {
+				sc.duplicates[info.Label] = []uint{first}
+			}
+			sc.duplicates[info.Label] = append(sc.duplicates[info.Label], s)
+			continue
+		}
+
+		sc.slots[info.Label] = s
+
+		labels, err := h.keyLabels(s)
+		if err != nil {
+			return sc, err
+		}
+
+		for _, key := range labels {
+			if key == "" {
+				continue
+			}
+
+			first, ok := sc.keys[key]
+			if !ok {
+				sc.keys[key] = info.Label
+				continue
+			}
+
+			// the label stays indexed so it can not be taken again, but it
+			// is not resolved to either token
+			if !sc.ambiguous[key] {
+				sc.ambiguous[key] = true
+				sc.duplicates[key] = append(sc.duplicates[key], sc.slots[first])
+			}
+			sc.duplicates[key] = append(sc.duplicates[key], s)
+		}
+
+		if len(labels) == 1 && labels[0] == "" {
+			sc.singleKey[info.Label] = true
+		}
+
+		destroyed, err := h.destroyedLabels(s)
+		if err != nil {
+			return sc, err
+		}
+
+		for _, key := range destroyed {
+			sc.destroyed[destroyedLabel(key, info.Label)] = info.Label
+		}
+	}
+
+	return sc, nil
+}
+
+func (h *hsm) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			report, err := h.refresh()
+			if err != nil {
+				fmt.Println("slot_index: refresh failed ", err)
+				continue
+			}
+
+			report.log()
+		}
+	}
+}
+
+// Close stops the background refresh, closes pooled sessions and finalizes
+// the PKCS#11 module
+func (h *hsm) Close() error {
+	select {
+	case <-h.stop:
+		return nil
+	default:
+		close(h.stop)
+	}
+
+	h.pool.close()
+
+	if err := h.ctx.Finalize(); err != nil && !isPKCS11Error(err, pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED) {
+		return err
+	}
+
+	h.ctx.Destroy()
+	return nil
+}
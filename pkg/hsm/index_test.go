@@ -0,0 +1,157 @@
+package hsm
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type IndexSuite struct {
+	suite.Suite
+}
+
+func TestIndexSuite(t *testing.T) {
+	suite.Run(t, new(IndexSuite))
+}
+
+func (s *IndexSuite) TestDiffSlots() {
+	old := map[string]uint{"kept": 1, "removed": 2, "old_name": 3, "moved": 4}
+	current := map[string]uint{"kept": 1, "new_name": 3, "moved": 5, "added": 6}
+
+	report := diffSlots(old, current)
+	s.Equal([]string{"added"}, report.Added)
+	s.Equal([]string{"removed"}, report.Removed)
+	s.Equal(map[string]string{"old_name": "new_name"}, report.Renamed)
+	s.ElementsMatch([]uint{2, 3, 4}, report.RemovedSlots)
+	s.True(report.Changed())
+
+	s.False(diffSlots(current, current).Changed())
+}
+
+func (s *IndexSuite) TestReplaceKeepsEntriesSetDuringScan() {
+	idx := newSlotIndex()
+	idx.Set("before", 1)
+	idx.SetKey("key_before", "before")
+
+	idx.beginScan()
+	idx.Set("during", 2)
+	idx.SetKey("key_during", "during")
+
+	report := idx.replace(newScan(map[string]uint{"scanned": 3}))
+	s.Equal([]string{"scanned"}, report.Added)
+	s.Equal([]string{"before"}, report.Removed)
+
+	_, ok := idx.Get("before")
+	s.False(ok)
+
+	slotID, ok := idx.Get("during")
+	s.True(ok)
+	s.Equal(uint(2), slotID)
+
+	token, ok := idx.GetKey("key_during")
+	s.True(ok)
+	s.Equal("during", token)
+
+	_, ok = idx.GetKey("key_before")
+	s.False(ok)
+}
+
+func (s *IndexSuite) TestConcurrentAccess() {
+	idx := newSlotIndex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			idx.Set("token", uint(i))
+			idx.SetKey("key", "token")
+		}(i)
+		go func() {
+			defer wg.Done()
+			idx.Get("token")
+			idx.GetKey("key")
+			idx.beginScan()
+			idx.replace(newScan(map[string]uint{}))
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *IndexSuite) TestDestroyedSurvivesScan() {
+	idx := newSlotIndex()
+	idx.SetKey("key", "token")
+
+	idx.beginScan()
+	idx.SetDestroyed("key", "token")
+
+	sc := newScan(map[string]uint{"token": 1})
+	sc.keys["key"] = "token"
+	idx.replace(sc)
+
+	_, ok := idx.GetKey("key")
+	s.False(ok)
+
+	token, ok := idx.GetDestroyed("key")
+	s.True(ok)
+	s.Equal("token", token)
+}
+
+func newScan(slots map[string]uint) scan {
+	return scan{
+		slots:     slots,
+		keys:      make(map[string]string),
+		destroyed: make(map[string]string),
+		singleKey: make(map[string]bool),
+		ambiguous: make(map[string]bool),
+	}
+}
+
+func (s *IndexSuite) TestSingleKeyDroppedByLabeledKey() {
+	idx := newSlotIndex()
+
+	sc := newScan(map[string]uint{"legacy": 1, "shared": 2})
+	sc.singleKey["legacy"] = true
+	sc.singleKey["shared"] = true
+
+	idx.beginScan()
+	idx.SetKey("alice", "shared")
+	idx.replace(sc)
+
+	s.True(idx.IsSingleKey("legacy"))
+	s.False(idx.IsSingleKey("shared"))
+
+	idx.SetDestroyed("legacy", "legacy")
+	s.False(idx.IsSingleKey("legacy"))
+}
+
+func (s *IndexSuite) TestAmbiguousKeyLabelIsNotResolved() {
+	h := &hsm{slotIndex: newSlotIndex()}
+
+	sc := newScan(map[string]uint{"first": 1, "second": 2})
+	sc.keys["alice"] = "first"
+	sc.keys["bob"] = "second"
+	sc.ambiguous["alice"] = true
+	sc.duplicates = map[string][]uint{"alice": {1, 2}}
+
+	report := h.slotIndex.replace(sc)
+	s.Equal(map[string][]uint{"alice": {1, 2}}, report.Duplicates)
+
+	_, err := h.locateKey("alice")
+	s.Error(err)
+	s.Error(h.checkKeyLabel("alice"))
+
+	loc, err := h.locateKey("bob")
+	s.NoError(err)
+	s.Equal(KeyLocation{Token: "second", Key: "bob"}, loc)
+
+	// a scan without the duplicate resolves the label again
+	sc = newScan(map[string]uint{"first": 1})
+	sc.keys["alice"] = "first"
+	h.slotIndex.replace(sc)
+
+	loc, err = h.locateKey("alice")
+	s.NoError(err)
+	s.Equal("first", loc.Token)
+}
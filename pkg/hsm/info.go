@@ -0,0 +1,362 @@
+package hsm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// InfoReport describes the PKCS#11 module, what it can do and how full its
+// tokens are
+type InfoReport struct {
+	Library LibraryInfo `json:"library"`
+	// Mechanisms are the mechanisms of the first token, tokens of a module
+	// share them
+	Mechanisms []MechanismReport `json:"mechanisms"`
+	Features   []FeatureReport   `json:"features"`
+	Tokens     []TokenReport     `json:"tokens"`
+	// Backends holds the report of every module of a multi backend HSM
+	Backends map[string]InfoReport `json:"backends,omitempty"`
+}
+
+type LibraryInfo struct {
+	Manufacturer    string `json:"manufacturer"`
+	Description     string `json:"description"`
+	Version         string `json:"version"`
+	CryptokiVersion string `json:"cryptokiVersion"`
+}
+
+type MechanismReport struct {
+	Name       string   `json:"name"`
+	Type       uint     `json:"type"`
+	MinKeySize uint     `json:"minKeySize"`
+	MaxKeySize uint     `json:"maxKeySize"`
+	Flags      []string `json:"flags"`
+
+	flags uint
+}
+
+// FeatureReport tells whether the mechanisms a feature needs are there
+type FeatureReport struct {
+	Name      Feature  `json:"name"`
+	Supported bool     `json:"supported"`
+	Required  bool     `json:"required"`
+	Missing   []string `json:"missing,omitempty"`
+}
+
+// TokenReport is the C_GetTokenInfo of a slot. Counts the token does not
+// report are null, a MaxSessions of 0 means there is no limit.
+type TokenReport struct {
+	SlotID       uint     `json:"slotID"`
+	Label        string   `json:"label"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SerialNumber string   `json:"serialNumber"`
+	Flags        []string `json:"flags"`
+
+	Sessions      *uint `json:"sessions"`
+	MaxSessions   *uint `json:"maxSessions"`
+	RWSessions    *uint `json:"rwSessions"`
+	MaxRWSessions *uint `json:"maxRWSessions"`
+
+	FreePublicMemory   *uint `json:"freePublicMemory"`
+	TotalPublicMemory  *uint `json:"totalPublicMemory"`
+	FreePrivateMemory  *uint `json:"freePrivateMemory"`
+	TotalPrivateMemory *uint `json:"totalPrivateMemory"`
+
+	// LegacySOPin is set for tokens the SO logged into with the crypto user
+	// PIN, their SO PIN has to be rotated
+	LegacySOPin bool `json:"legacySOPin,omitempty"`
+}
+
+// Feature is a group of operations that needs a set of mechanisms
+type Feature string
+
+const (
+	// FeatureECDSA is secp256k1 and P-256 key generation and signing
+	FeatureECDSA Feature = "ecdsa"
+	// FeatureEdDSA is Ed25519 key generation and signing
+	FeatureEdDSA Feature = "eddsa"
+	// FeatureKeyImport is unwrapping keys wrapped to an RSA wrapping key or
+	// an AES key encryption key
+	FeatureKeyImport Feature = "key-import"
+	// FeatureKeyBackup is wrapping keys under the backup key encryption key
+	FeatureKeyBackup Feature = "key-backup"
+)
+
+// requirement is a mechanism a feature uses and the flag it has to have
+type requirement struct {
+	mechanism uint
+	flag      uint
+}
+
+var features = []struct {
+	name Feature
+	reqs []requirement
+}{
+	{FeatureECDSA, []requirement{
+		{pkcs11.CKM_ECDSA_KEY_PAIR_GEN, pkcs11.CKF_GENERATE_KEY_PAIR},
+		{pkcs11.CKM_ECDSA, pkcs11.CKF_SIGN},
+	}},
+	{FeatureEdDSA, []requirement{
+		{CKM_EC_EDWARDS_KEY_PAIR_GEN, pkcs11.CKF_GENERATE_KEY_PAIR},
+		{CKM_EDDSA, pkcs11.CKF_SIGN},
+	}},
+	{FeatureKeyImport, []requirement{
+		{pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, pkcs11.CKF_GENERATE_KEY_PAIR},
+		{pkcs11.CKM_RSA_PKCS_OAEP, pkcs11.CKF_UNWRAP},
+		{pkcs11.CKM_AES_KEY_WRAP_PAD, pkcs11.CKF_UNWRAP},
+	}},
+	{FeatureKeyBackup, []requirement{
+		{pkcs11.CKM_AES_KEY_WRAP_PAD, pkcs11.CKF_WRAP},
+		{pkcs11.CKM_AES_KEY_WRAP_PAD, pkcs11.CKF_UNWRAP},
+	}},
+}
+
+var mechanismNames = map[uint]string{
+	pkcs11.CKM_ECDSA_KEY_PAIR_GEN:    "CKM_EC_KEY_PAIR_GEN",
+	pkcs11.CKM_ECDSA:                 "CKM_ECDSA",
+	CKM_EC_EDWARDS_KEY_PAIR_GEN:      "CKM_EC_EDWARDS_KEY_PAIR_GEN",
+	CKM_EDDSA:                        "CKM_EDDSA",
+	pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN: "CKM_RSA_PKCS_KEY_PAIR_GEN",
+	pkcs11.CKM_RSA_PKCS_OAEP:         "CKM_RSA_PKCS_OAEP",
+	pkcs11.CKM_AES_KEY_WRAP_PAD:      "CKM_AES_KEY_WRAP_PAD",
+	pkcs11.CKM_AES_KEY_GEN:           "CKM_AES_KEY_GEN",
+	pkcs11.CKM_SHA256:                "CKM_SHA256",
+}
+
+// MechanismName returns the CKM_ name of the mechanisms this package uses,
+// and the hex value of any other
+func MechanismName(mechanism uint) string {
+	if name, ok := mechanismNames[mechanism]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%08x", mechanism)
+}
+
+var mechanismFlags = []struct {
+	flag uint
+	name string
+}{
+	{pkcs11.CKF_HW, "hw"},
+	{pkcs11.CKF_ENCRYPT, "encrypt"},
+	{pkcs11.CKF_DECRYPT, "decrypt"},
+	{pkcs11.CKF_DIGEST, "digest"},
+	{pkcs11.CKF_SIGN, "sign"},
+	{pkcs11.CKF_VERIFY, "verify"},
+	{pkcs11.CKF_GENERATE, "generate"},
+	{pkcs11.CKF_GENERATE_KEY_PAIR, "generate_key_pair"},
+	{pkcs11.CKF_WRAP, "wrap"},
+	{pkcs11.CKF_UNWRAP, "unwrap"},
+	{pkcs11.CKF_DERIVE, "derive"},
+}
+
+var tokenFlags = []struct {
+	flag uint
+	name string
+}{
+	{pkcs11.CKF_RNG, "rng"},
+	{pkcs11.CKF_WRITE_PROTECTED, "write_protected"},
+	{pkcs11.CKF_LOGIN_REQUIRED, "login_required"},
+	{pkcs11.CKF_USER_PIN_INITIALIZED, "user_pin_initialized"},
+	{pkcs11.CKF_TOKEN_INITIALIZED, "token_initialized"},
+	{pkcs11.CKF_USER_PIN_COUNT_LOW, "user_pin_count_low"},
+	{pkcs11.CKF_USER_PIN_FINAL_TRY, "user_pin_final_try"},
+	{pkcs11.CKF_USER_PIN_LOCKED, "user_pin_locked"},
+	{pkcs11.CKF_SO_PIN_LOCKED, "so_pin_locked"},
+}
+
+func flagNames(flags uint, names []struct {
+	flag uint
+	name string
+}) []string {
+	set := []string{}
+	for _, f := range names {
+		if flags&f.flag != 0 {
+			set = append(set, f.name)
+		}
+	}
+
+	return set
+}
+
+// MissingMechanismsError is returned when the module lacks mechanisms of a
+// required feature
+type MissingMechanismsError struct {
+	Missing []string
+}
+
+func (e *MissingMechanismsError) Error() string {
+	return fmt.Sprintf("pkcs11 module does not support required mechanisms: %s", strings.Join(e.Missing, ", "))
+}
+
+// NewMechanismReport describes a mechanism from its C_GetMechanismInfo
+func NewMechanismReport(mechanism uint, info pkcs11.MechanismInfo) MechanismReport {
+	return MechanismReport{
+		Name:       MechanismName(mechanism),
+		Type:       mechanism,
+		MinKeySize: info.MinKeySize,
+		MaxKeySize: info.MaxKeySize,
+		Flags:      flagNames(info.Flags, mechanismFlags),
+		flags:      info.Flags,
+	}
+}
+
+// NewTokenReport describes the token in slotID from its C_GetTokenInfo
+func NewTokenReport(slotID uint, info pkcs11.TokenInfo) TokenReport {
+	return TokenReport{
+		SlotID:             slotID,
+		Label:              info.Label,
+		Manufacturer:       info.ManufacturerID,
+		Model:              info.Model,
+		SerialNumber:       info.SerialNumber,
+		Flags:              flagNames(info.Flags, tokenFlags),
+		Sessions:           available(info.SessionCount),
+		MaxSessions:        available(info.MaxSessionCount),
+		RWSessions:         available(info.RwSessionCount),
+		MaxRWSessions:      available(info.MaxRwSessionCount),
+		FreePublicMemory:   available(info.FreePublicMemory),
+		TotalPublicMemory:  available(info.TotalPublicMemory),
+		FreePrivateMemory:  available(info.FreePrivateMemory),
+		TotalPrivateMemory: available(info.TotalPrivateMemory),
+	}
+}
+
+// available returns nil for CK_UNAVAILABLE_INFORMATION
+func available(v uint) *uint {
+	if v == ^uint(0) {
+		return nil
+	}
+
+	return &v
+}
+
+// CheckFeatures fills in r.Features from r.Mechanisms, marking required as
+// required, and returns a MissingMechanismsError when a required feature is
+// not supported. Reports without mechanisms, from modules without any token,
+// are not checked.
+func (r *InfoReport) CheckFeatures(required ...Feature) error {
+	supported := make(map[uint]uint, len(r.Mechanisms))
+	for _, m := range r.Mechanisms {
+		supported[m.Type] |= m.flags
+	}
+
+	var missing []string
+	r.Features = nil
+	for _, f := range features {
+		report := FeatureReport{Name: f.name}
+		for _, req := range required {
+			report.Required = report.Required || req == f.name
+		}
+
+		for _, req := range f.reqs {
+			if supported[req.mechanism]&req.flag == 0 {
+				report.Missing = append(report.Missing, fmt.Sprintf("%s (%s)", MechanismName(req.mechanism), flagNames(req.flag, mechanismFlags)[0]))
+			}
+		}
+
+		report.Supported = len(report.Missing) == 0
+		if report.Required && !report.Supported {
+			missing = append(missing, report.Missing...)
+		}
+
+		r.Features = append(r.Features, report)
+	}
+
+	if len(missing) > 0 && len(r.Mechanisms) > 0 {
+		return &MissingMechanismsError{Missing: missing}
+	}
+
+	return nil
+}
+
+func (r InfoReport) log() {
+	for _, f := range r.Features {
+		if !f.Supported {
+			fmt.Println("hsm_info: feature ", f.Name, " not supported, missing ", f.Missing)
+		}
+	}
+
+	for _, t := range r.Tokens {
+		if t.FreePrivateMemory != nil && t.TotalPrivateMemory != nil && *t.TotalPrivateMemory > 0 && *t.FreePrivateMemory*10 < *t.TotalPrivateMemory {
+			fmt.Println("hsm_info: token ", t.Label, " on slot ", t.SlotID, " has less than 10% private memory left")
+		}
+	}
+}
+
+// requiredFeatures lists the features the configuration depends on
+func (h *hsm) requiredFeatures() []Feature {
+	required := []Feature{FeatureECDSA}
+	if len(h.backupKEK) > 0 {
+		required = append(required, FeatureKeyBackup)
+	}
+
+	return required
+}
+
+// info queries C_GetInfo, C_GetTokenInfo of every slot with a token and the
+// mechanisms of the first one. The error is a MissingMechanismsError when a
+// required feature is not supported, the report is complete regardless.
+func (h *hsm) info() (r InfoReport, err error) {
+	lib, err := h.ctx.GetInfo()
+	if err != nil {
+		return r, h.checkFatal(err)
+	}
+
+	r.Library = LibraryInfo{
+		Manufacturer:    lib.ManufacturerID,
+		Description:     lib.LibraryDescription,
+		Version:         fmt.Sprintf("%d.%d", lib.LibraryVersion.Major, lib.LibraryVersion.Minor),
+		CryptokiVersion: fmt.Sprintf("%d.%d", lib.CryptokiVersion.Major, lib.CryptokiVersion.Minor),
+	}
+
+	slots, err := h.ctx.GetSlotList(true)
+	if err != nil {
+		return r, h.checkFatal(err)
+	}
+
+	r.Tokens = []TokenReport{}
+	for _, slotID := range slots {
+		info, err := h.ctx.GetTokenInfo(slotID)
+		if err != nil {
+			return r, h.checkFatal(err)
+		}
+
+		token := NewTokenReport(slotID, info)
+		token.LegacySOPin = h.isLegacySO(slotID)
+		r.Tokens = append(r.Tokens, token)
+	}
+
+	r.Mechanisms = []MechanismReport{}
+	if len(slots) > 0 {
+		mechanisms, err := h.ctx.GetMechanismList(slots[0])
+		if err != nil {
+			return r, h.checkFatal(err)
+		}
+
+		for _, m := range mechanisms {
+			info, err := h.ctx.GetMechanismInfo(slots[0], []*pkcs11.Mechanism{m})
+			if err != nil {
+				return r, h.checkFatal(err)
+			}
+
+			r.Mechanisms = append(r.Mechanisms, NewMechanismReport(m.Mechanism, info))
+		}
+	}
+
+	return r, r.CheckFeatures(h.requiredFeatures()...)
+}
+
+// checkCapabilities runs Info and logs its findings, it fails when required
+// mechanisms are missing
+func (h *hsm) checkCapabilities() error {
+	report, err := h.info()
+	if err != nil {
+		return err
+	}
+
+	report.log()
+	return nil
+}
@@ -0,0 +1,96 @@
+package hsm
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/suite"
+)
+
+type InfoSuite struct {
+	suite.Suite
+}
+
+func TestInfoSuite(t *testing.T) {
+	suite.Run(t, new(InfoSuite))
+}
+
+func (s *InfoSuite) report(mechanisms map[uint]uint) InfoReport {
+	var r InfoReport
+	for mechanism, flags := range mechanisms {
+		r.Mechanisms = append(r.Mechanisms, NewMechanismReport(mechanism, pkcs11.MechanismInfo{Flags: flags}))
+	}
+
+	return r
+}
+
+func (s *InfoSuite) feature(r InfoReport, name Feature) FeatureReport {
+	for _, f := range r.Features {
+		if f.Name == name {
+			return f
+		}
+	}
+
+	s.FailNow("feature not reported", name)
+	return FeatureReport{}
+}
+
+func (s *InfoSuite) TestCheckFeatures() {
+	r := s.report(map[uint]uint{
+		pkcs11.CKM_ECDSA_KEY_PAIR_GEN: pkcs11.CKF_GENERATE_KEY_PAIR,
+		pkcs11.CKM_ECDSA:              pkcs11.CKF_SIGN | pkcs11.CKF_VERIFY,
+		pkcs11.CKM_AES_KEY_WRAP_PAD:   pkcs11.CKF_UNWRAP,
+	})
+
+	s.NoError(r.CheckFeatures(FeatureECDSA))
+	s.True(s.feature(r, FeatureECDSA).Supported)
+	s.True(s.feature(r, FeatureECDSA).Required)
+	s.False(s.feature(r, FeatureEdDSA).Supported)
+	s.False(s.feature(r, FeatureEdDSA).Required)
+
+	// unwrap alone is not enough for backups
+	err := r.CheckFeatures(FeatureECDSA, FeatureKeyBackup)
+	s.IsType(&MissingMechanismsError{}, err)
+	s.Equal([]string{"CKM_AES_KEY_WRAP_PAD (wrap)"}, err.(*MissingMechanismsError).Missing)
+}
+
+func (s *InfoSuite) TestCheckFeaturesMissingFlag() {
+	// a vendor listing the mechanism without the flag does not support it
+	r := s.report(map[uint]uint{
+		pkcs11.CKM_ECDSA_KEY_PAIR_GEN: pkcs11.CKF_GENERATE_KEY_PAIR,
+		pkcs11.CKM_ECDSA:              pkcs11.CKF_VERIFY,
+	})
+
+	err := r.CheckFeatures(FeatureECDSA)
+	s.EqualError(err, "pkcs11 module does not support required mechanisms: CKM_ECDSA (sign)")
+}
+
+func (s *InfoSuite) TestCheckFeaturesWithoutTokens() {
+	var r InfoReport
+	s.NoError(r.CheckFeatures(FeatureECDSA))
+	s.False(s.feature(r, FeatureECDSA).Supported)
+}
+
+func (s *InfoSuite) TestNewTokenReport() {
+	t := NewTokenReport(3, pkcs11.TokenInfo{
+		Label:              "token",
+		Flags:              pkcs11.CKF_TOKEN_INITIALIZED | pkcs11.CKF_USER_PIN_INITIALIZED,
+		MaxSessionCount:    0,
+		FreePrivateMemory:  1024,
+		TotalPrivateMemory: 4096,
+		FreePublicMemory:   ^uint(0),
+		TotalPublicMemory:  ^uint(0),
+	})
+
+	s.Equal(uint(3), t.SlotID)
+	s.Equal([]string{"user_pin_initialized", "token_initialized"}, t.Flags)
+	s.Equal(uint(0), *t.MaxSessions)
+	s.Equal(uint(1024), *t.FreePrivateMemory)
+	s.Nil(t.FreePublicMemory)
+	s.Nil(t.TotalPublicMemory)
+}
+
+func (s *InfoSuite) TestMechanismName() {
+	s.Equal("CKM_EDDSA", MechanismName(CKM_EDDSA))
+	s.Equal("0x00001234", MechanismName(0x1234))
+}
@@ -4,11 +4,58 @@ import (
 	"crypto/ecdsa"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/miekg/pkcs11"
 )
 
-func (h *hsm) GetSlotID(label string) (uint, error) {
+// maxTokenLabelLen is the size of CK_TOKEN_INFO.label
+const maxTokenLabelLen = 32
+
+// KeyID identifies a key pair inside a token through its CKA_LABEL and
+// CKA_ID. The empty KeyID matches the first key pair on the token, which is
+// how tokens holding a single unlabeled key are addressed.
+type KeyID string
+
+func (k KeyID) template() []*pkcs11.Attribute {
+	if k == "" {
+		return nil
+	}
+
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, string(k)),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(k)),
+	}
+}
+
+// KeyLocation points at a key pair: the token holding it and the key
+// inside that token.
+type KeyLocation struct {
+	Token string
+	Key   KeyID
+}
+
+// locateKey finds the key pair with the given label. Keys labeled with
+// CKA_LABEL are found in any token, otherwise the label is taken as the
+// label of a token holding a single unlabeled key. Shared tokens and empty
+// tokens do not stand for a key.
+func (h *hsm) locateKey(label string) (loc KeyLocation, err error) {
+	if h.slotIndex.IsAmbiguous(label) {
+		return loc, fmt.Errorf("key with label %s is on more than one token", label)
+	}
+
+	if token, ok := h.slotIndex.GetKey(label); ok {
+		return KeyLocation{Token: token, Key: KeyID(label)}, nil
+	}
+
+	if !h.slotIndex.IsSingleKey(label) {
+		return loc, fmt.Errorf("unable to find key with label %s", label)
+	}
+
+	return KeyLocation{Token: label}, nil
+}
+
+func (h *hsm) getSlotID(label string) (uint, error) {
 	slotID, ok := h.slotIndex.Get(label)
 	if !ok {
 		return 0, errors.New("unable to find slot with label")
@@ -17,7 +64,22 @@ func (h *hsm) GetSlotID(label string) (uint, error) {
 	return slotID, nil
 }
 
-func (h *hsm) NewSlot(name string) (uint, error) {
+// newSlot initializes a free token labeled name and sets up its user PIN.
+// Token creation is serialized, so concurrent calls never pick the same
+// token. When setting up the token fails it is marked as failed, see
+// discardSlot, instead of being left half initialized.
+func (h *hsm) newSlot(name string) (uint, error) {
+	if len(name) > maxTokenLabelLen {
+		return 0, fmt.Errorf("token label %s is longer than %d bytes", name, maxTokenLabelLen)
+	}
+
+	if strings.HasPrefix(name, FailedTokenPrefix) {
+		return 0, fmt.Errorf("token labels can not start with %s", FailedTokenPrefix)
+	}
+
+	h.slotMu.Lock()
+	defer h.slotMu.Unlock()
+
 	slots, err := h.ctx.GetSlotList(true)
 	if err != nil {
 		return 0, err
@@ -28,34 +90,65 @@ func (h *hsm) NewSlot(name string) (uint, error) {
 		return 0, errors.New("slots already exists")
 	}
 
-	slotID := uint(len(slots)) - 1
+	slotID, err := h.freeSlot(slots)
+	if err != nil {
+		return 0, err
+	}
 
-	if err := h.ctx.InitToken(slotID, h.buildSOPin(), name); err != nil {
+	// a token created while PINs are rotated starts out with the new ones
+	h.adoptToken(slotID)
+
+	if err := h.initToken(slotID, name); err != nil {
 		fmt.Println("new_slot: failed to init token ", err)
 		return 0, err
 	}
 
+	if err := h.setupToken(slotID); err != nil {
+		if markErr := h.markFailed(slotID); markErr != nil {
+			fmt.Println("new_slot: failed to mark token as failed ", markErr)
+		}
+
+		return 0, err
+	}
+
+	h.slotIndex.Set(name, slotID)
+
+	return slotID, nil
+}
+
+// setupToken sets the user PIN of a freshly initialized token
+func (h *hsm) setupToken(slotID uint) error {
 	sess, err := newSession(h.ctx, slotID)
 	if err != nil {
 		fmt.Println("new_slot: failed to open session ", err)
-		return 0, err
+		return err
 	}
 
 	defer h.EndSession(&sess)
 
-	if err := h.ctx.Login(sess, pkcs11.CKU_SO, h.buildSOPin()); err != nil {
+	if _, err := h.loginSO(sess, slotID); err != nil {
 		fmt.Println("new_slot: failed to login ", err)
-		return 0, err
+		return err
 	}
 
-	if err := h.ctx.InitPIN(sess, h.buildPin()); err != nil {
+	pin, err := h.buildPin(slotID)
+	if err != nil {
+		return err
+	}
+
+	if err := h.ctx.InitPIN(sess, pin); err != nil {
 		fmt.Println("new_slot: failed to init pin ", err)
-		return 0, err
+		return err
 	}
 
-	h.slotIndex.Set(name, slotID)
+	if len(h.backupKEK) > 0 {
+		if err := h.provisionBackupKEK(sess, slotID); err != nil {
+			fmt.Println("new_slot: failed to provision backup key ", err)
+			return err
+		}
+	}
 
-	return slotID, nil
+	return nil
 }
 
 func (h *hsm) SlotExists(name string) (bool, error) {
@@ -68,45 +161,51 @@ func (h *hsm) SlotExists(name string) (bool, error) {
 	return err == nil, err
 }
 
-func (h *hsm) PublicKeyHandle(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, error) {
-
-	attr := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
-	}
-
-	return h.findWithAttributes(session, attr)
+// publicKeyHandle finds the public key labeled key on any curve, see
+// keyCurve. The empty KeyID only matches secp256k1 keys, which is all
+// single key tokens hold.
+func (h *hsm) publicKeyHandle(session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, error) {
+	return h.findWithAttributes(session, keyHandleTemplate(pkcs11.CKO_PUBLIC_KEY, key))
 }
 
-func (h *hsm) PrivateKeyHandle(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, error) {
+func (h *hsm) privateKeyHandle(session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, error) {
+	return h.findWithAttributes(session, keyHandleTemplate(pkcs11.CKO_PRIVATE_KEY, key))
+}
 
-	attr := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+func keyHandleTemplate(class uint, key KeyID) []*pkcs11.Attribute {
+	attr := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if key == "" {
+		return append(attr, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA))
 	}
 
-	return h.findWithAttributes(session, attr)
+	return append(attr, key.template()...)
 }
 
+// errObjectNotFound is returned by findWithAttributes when no object matches
+var errObjectNotFound = errors.New("no objects found")
+
 func (h *hsm) findWithAttributes(session pkcs11.SessionHandle, attr []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
 	err := h.ctx.FindObjectsInit(session, attr)
 	if err != nil {
-		return pkcs11.ObjectHandle(1), err
+		return pkcs11.ObjectHandle(1), h.observe(session, err)
 	}
 
+	// finalize right away, sessions go back to the pool with no search active
+	defer h.ctx.FindObjectsFinal(session)
+
 	obj, _, err := h.ctx.FindObjects(session, 1)
 	if err != nil {
-		return pkcs11.ObjectHandle(1), err
+		return pkcs11.ObjectHandle(1), h.observe(session, err)
 	}
 
 	if len(obj) == 0 {
-		return pkcs11.ObjectHandle(1), errors.New("no objects found")
+		return pkcs11.ObjectHandle(1), errObjectNotFound
 	}
 
 	return obj[0], nil
 }
 
-func (h *hsm) GetPublicKey(session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ecdsa.PublicKey, error) {
+func (h *hsm) getPublicKey(session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ecdsa.PublicKey, error) {
 	var pub ecdsa.PublicKey
 
 	// define which attributes we want to get
@@ -119,7 +218,7 @@ func (h *hsm) GetPublicKey(session pkcs11.SessionHandle, pubKeyHandle pkcs11.Obj
 	// gets attributes based on template array
 	attributes, err := h.ctx.GetAttributeValue(session, pubKeyHandle, template)
 	if err != nil {
-		return pub, err
+		return pub, h.observe(session, err)
 	}
 
 	// pub curve could be hard coded, but using this function for extra safety
@@ -137,34 +236,87 @@ func (h *hsm) GetPublicKey(session pkcs11.SessionHandle, pubKeyHandle pkcs11.Obj
 	return pub, nil
 }
 
+// generateKeyECDSA_secp256k1 generates a key pair on the session's token.
+// A non empty key is set as CKA_LABEL and CKA_ID of both keys so the token
+// can hold many key pairs.
 // TODO - the key generated here will not be verified correctly. This makes testing pretty tricky.
-func (h *hsm) GenerateKeyECDSA_secp256k1(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+func (h *hsm) generateKeyECDSA_secp256k1(session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	return h.generateKeyPair(session, CurveSecp256k1, key)
+}
 
-	oid, err := secp256k1OID()
+// generateKeyPair generates a key pair on the given curve
+func (h *hsm) generateKeyPair(session pkcs11.SessionHandle, curve Curve, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+
+	params, err := curve.params()
 	if err != nil {
-		return 0, 0, errors.New("unable to get secp256 OID")
+		return 0, 0, err
+	}
+
+	if err := h.checkKeyLabel(key); err != nil {
+		return 0, 0, err
 	}
 
 	pubTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, curve.keyType()),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		// public keys stay readable without login so keys can be indexed
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
 		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
-		pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, oid),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
 	}
 
 	privTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
-		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
-		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
-		pkcs11.NewAttribute(pkcs11.CKA_SIGN_RECOVER, true),
 	}
 
+	if curve == CurveSecp256k1 {
+		privTemplate = append(privTemplate, pkcs11.NewAttribute(pkcs11.CKA_SIGN_RECOVER, true))
+	}
+
+	pubTemplate = append(pubTemplate, key.template()...)
+	privTemplate = append(privTemplate, h.privateKeyPolicy()...)
+	privTemplate = append(privTemplate, key.template()...)
+
 	// important to have the right mechanism
-	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA_KEY_PAIR_GEN, nil)}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(curve.keyGenMechanism(), nil)}
 
-	return h.ctx.GenerateKeyPair(session, mech, pubTemplate, privTemplate)
+	pub, priv, err := h.ctx.GenerateKeyPair(session, mech, pubTemplate, privTemplate)
+	if err != nil {
+		return pub, priv, h.observe(session, err)
+	}
+
+	if key != "" {
+		if err := h.indexKey(session, key); err != nil {
+			return pub, priv, err
+		}
+	}
+
+	return pub, priv, nil
+}
+
+// keyCurve reads the curve of a public or private key
+func (h *hsm) keyCurve(session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (Curve, error) {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil)}
+
+	attributes, err := h.ctx.GetAttributeValue(session, obj, template)
+	if err != nil {
+		return "", h.observe(session, err)
+	}
+
+	return curveFromParams(attributes[0].Value)
+}
+
+// indexKey records which token the session's key was created on
+func (h *hsm) indexKey(session pkcs11.SessionHandle, key KeyID) error {
+	token, err := h.sessionToken(session)
+	if err != nil {
+		return err
+	}
+
+	h.slotIndex.SetKey(string(key), token)
+	return nil
 }
 
 func findSlotByName(ctx *pkcs11.Ctx, slots []uint, name string) (uint, error) {
@@ -184,21 +336,92 @@ func findSlotByName(ctx *pkcs11.Ctx, slots []uint, name string) (uint, error) {
 	return 0, fmt.Errorf("unable to find slots with name %s", name)
 }
 
-func (h *hsm) buildSlotIndex() error {
+// keyLabels lists the CKA_LABEL of every ECDSA and EdDSA public key on the
+// token, unlabeled keys as the empty label. Public keys are not private
+// objects, so no login is needed.
+func (h *hsm) keyLabels(slotID uint) ([]string, error) {
+	var labels []string
+	for _, keyType := range []uint{pkcs11.CKK_ECDSA, CKK_EC_EDWARDS} {
+		found, err := h.findLabels(slotID, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		labels = append(labels, found...)
+	}
+
+	return labels, nil
+}
+
+// destroyedLabels lists the labels of the keys destroyed on the token, the
+// empty label stands for the key of a single key token. The records are
+// private, they are read logged in as the crypto user.
+func (h *hsm) destroyedLabels(slotID uint) ([]string, error) {
+	sess, ok, err := h.openUserSession(slotID)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	defer h.ctx.CloseSession(sess)
 
-	slots, err := h.ctx.GetSlotList(true)
+	return h.sessionLabels(sess, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, DestroyedKeyApplication),
+	})
+}
+
+// findLabels lists the CKA_LABEL of every public object matching attr
+func (h *hsm) findLabels(slotID uint, attr []*pkcs11.Attribute) ([]string, error) {
+	sess, err := h.ctx.OpenSession(slotID, pkcs11.CKF_SERIAL_SESSION)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, s := range slots {
-		info, err := h.ctx.GetTokenInfo(s)
+	defer h.ctx.CloseSession(sess)
+
+	return h.sessionLabels(sess, attr)
+}
+
+// sessionLabels lists the CKA_LABEL of every object matching attr that sess
+// can see
+func (h *hsm) sessionLabels(sess pkcs11.SessionHandle, attr []*pkcs11.Attribute) ([]string, error) {
+	if err := h.ctx.FindObjectsInit(sess, attr); err != nil {
+		return nil, err
+	}
+
+	var objects []pkcs11.ObjectHandle
+	for {
+		obj, _, err := h.ctx.FindObjects(sess, 100)
 		if err != nil {
-			return err
+			h.ctx.FindObjectsFinal(sess)
+			return nil, err
 		}
 
-		h.slotIndex.Set(info.Label, s)
+		if len(obj) == 0 {
+			break
+		}
+
+		objects = append(objects, obj...)
 	}
 
-	return nil
+	if err := h.ctx.FindObjectsFinal(sess); err != nil {
+		return nil, err
+	}
+
+	var labels []string
+	for _, obj := range objects {
+		template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil)}
+
+		attributes, err := h.ctx.GetAttributeValue(sess, obj, template)
+		if err != nil {
+			return nil, err
+		}
+
+		labels = append(labels, string(attributes[0].Value))
+	}
+
+	return labels, nil
 }
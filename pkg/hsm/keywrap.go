@@ -0,0 +1,104 @@
+package hsm
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// alternative initial value from RFC 5649 section 3
+var keyWrapPadAIV = []byte{0xa6, 0x59, 0x59, 0xa6}
+
+// AESKeyWrapPad wraps key under kek the way CKM_AES_KEY_WRAP_PAD does
+// (RFC 5649). Callers use it to prepare keys for import without an HSM.
+func AESKeyWrapPad(kek, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) == 0 {
+		return nil, errors.New("nothing to wrap")
+	}
+
+	n := (len(key) + 7) / 8
+	padded := make([]byte, 8+8*n)
+	copy(padded, keyWrapPadAIV)
+	binary.BigEndian.PutUint32(padded[4:8], uint32(len(key)))
+	copy(padded[8:], key)
+
+	if n == 1 {
+		block.Encrypt(padded, padded)
+		return padded, nil
+	}
+
+	// RFC 3394 wrapping process with the alternative initial value
+	a := padded[:8]
+	b := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, a)
+			copy(b[8:], padded[8*i:8*i+8])
+			block.Encrypt(b, b)
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^t)
+			copy(padded[8*i:8*i+8], b[8:])
+		}
+	}
+
+	return padded, nil
+}
+
+// AESKeyUnwrapPad reverses AESKeyWrapPad and checks the integrity of the
+// wrapped key.
+func AESKeyUnwrapPad(kek, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < 16 || len(wrapped)%8 != 0 {
+		return nil, errors.New("wrapped key has an invalid length")
+	}
+
+	n := len(wrapped)/8 - 1
+	out := make([]byte, len(wrapped))
+	copy(out, wrapped)
+
+	if n == 1 {
+		block.Decrypt(out, out)
+	} else {
+		a := out[:8]
+		b := make([]byte, 16)
+		for j := 5; j >= 0; j-- {
+			for i := n; i >= 1; i-- {
+				t := uint64(n*j + i)
+				binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(a)^t)
+				copy(b[8:], out[8*i:8*i+8])
+				block.Decrypt(b, b)
+
+				copy(a, b[:8])
+				copy(out[8*i:8*i+8], b[8:])
+			}
+		}
+	}
+
+	if subtle.ConstantTimeCompare(out[:4], keyWrapPadAIV) != 1 {
+		return nil, errors.New("wrapped key failed the integrity check")
+	}
+
+	length := int(binary.BigEndian.Uint32(out[4:8]))
+	if length <= 8*(n-1) || length > 8*n {
+		return nil, errors.New("wrapped key failed the integrity check")
+	}
+
+	for _, p := range out[8+length:] {
+		if p != 0 {
+			return nil, errors.New("wrapped key failed the integrity check")
+		}
+	}
+
+	return out[8 : 8+length], nil
+}
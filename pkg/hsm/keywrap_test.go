@@ -0,0 +1,53 @@
+package hsm
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type KeyWrapSuite struct {
+	suite.Suite
+}
+
+func TestKeyWrapSuite(t *testing.T) {
+	suite.Run(t, new(KeyWrapSuite))
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// test vectors from RFC 5649 section 6
+func (s *KeyWrapSuite) TestVectors() {
+	kek := unhex("5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+
+	for key, wrapped := range map[string]string{
+		"c37b7e6492584340bed12207808941155068f738": "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a",
+		"466f7250617369":                           "afbeb0f07dfbf5419200f2ccb50bb24f",
+	} {
+		out, err := AESKeyWrapPad(kek, unhex(key))
+		s.NoError(err)
+		s.Equal(wrapped, hex.EncodeToString(out))
+
+		in, err := AESKeyUnwrapPad(kek, unhex(wrapped))
+		s.NoError(err)
+		s.Equal(key, hex.EncodeToString(in))
+	}
+}
+
+func (s *KeyWrapSuite) TestUnwrapTampered() {
+	kek := unhex("5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+
+	wrapped, err := AESKeyWrapPad(kek, []byte("a secp256k1 private key"))
+	s.NoError(err)
+
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = AESKeyUnwrapPad(kek, wrapped)
+	s.Error(err)
+}
@@ -0,0 +1,107 @@
+package hsm_mem
+
+import (
+	"context"
+	"open_custodial/pkg/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// EnableKeyBackup turns on backup mode, like hsm.WithKeyBackup
+func (m *HSM) EnableKeyBackup(kek []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.backupKEK = append([]byte(nil), kek...)
+}
+
+func (m *HSM) privateKeyPolicy() []*pkcs11.Attribute {
+	if len(m.backupKEK) == 0 {
+		return []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		}
+	}
+
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP_WITH_TRUSTED, true),
+	}
+}
+
+// newBackupKEK returns the two halves of the backup key encryption key, a
+// public trusted one that only wraps and a private one that only unwraps
+func newBackupKEK(kek []byte) []*object {
+	wrapping := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, false),
+		pkcs11.NewAttribute(pkcs11.CKA_TRUSTED, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, hsm.BackupKEKLabel),
+	)
+	wrapping.secret = append([]byte(nil), kek...)
+
+	unwrapping := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, false),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, hsm.BackupKEKLabel),
+	)
+	unwrapping.secret = append([]byte(nil), kek...)
+
+	return []*object{wrapping, unwrapping}
+}
+
+func (m *HSM) WrapKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, kek hsm.KeyID, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	if err := m.wait(ctx, OpWrapKey); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fail(OpWrapKey); err != nil {
+		return nil, err
+	}
+
+	obj, s, err := m.object(session, privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.priv == nil || !obj.bool(pkcs11.CKA_EXTRACTABLE) {
+		return nil, ckr(pkcs11.CKR_KEY_UNEXTRACTABLE)
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, string(kek)),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+	}
+
+	for _, wrapping := range m.token(s).objects {
+		if wrapping.secret == nil || !wrapping.matches(template) {
+			continue
+		}
+
+		if obj.bool(pkcs11.CKA_WRAP_WITH_TRUSTED) && !wrapping.bool(pkcs11.CKA_TRUSTED) {
+			return nil, ckr(pkcs11.CKR_KEY_NOT_WRAPPABLE)
+		}
+
+		der, err := hsm.MarshalPKCS8Secp256k1(obj.priv)
+		if err != nil {
+			return nil, ckr(pkcs11.CKR_FUNCTION_FAILED)
+		}
+
+		return hsm.AESKeyWrapPad(wrapping.secret, der)
+	}
+
+	return nil, ckr(pkcs11.CKR_WRAPPING_KEY_HANDLE_INVALID)
+}
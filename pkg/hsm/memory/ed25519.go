@@ -0,0 +1,158 @@
+package hsm_mem
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/asn1"
+
+	"open_custodial/pkg/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// http://oid-info.com/get/1.3.101.112
+var ed25519OID = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+func (m *HSM) GenerateKeyEdDSA_ed25519(ctx context.Context, session pkcs11.SessionHandle, key hsm.KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if err := m.wait(ctx, OpGenerateKeyPair); err != nil {
+		return 0, 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.generateSession(session, key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return 0, 0, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	oid, err := asn1.Marshal(ed25519OID)
+	if err != nil {
+		return 0, 0, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	// SoftHSM returns the point as a DER octet string
+	point, err := asn1.Marshal([]byte(pub))
+	if err != nil {
+		return 0, 0, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	pubObj := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, hsm.CKK_EC_EDWARDS),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oid),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+	)
+	pubObj.set(keyTemplate(key)...)
+	pubObj.edPub = pub
+
+	privObj := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, hsm.CKK_EC_EDWARDS),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oid),
+	)
+	privObj.set(m.privateKeyPolicy()...)
+	privObj.set(keyTemplate(key)...)
+	privObj.edPriv = priv
+
+	t := m.token(s)
+	return m.store(t, pubObj), m.store(t, privObj), nil
+}
+
+func (m *HSM) GetPublicKeyEdDSA_ed25519(ctx context.Context, session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ed25519.PublicKey, error) {
+	if err := m.wait(ctx, OpGetAttributeValue); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fail(OpGetAttributeValue); err != nil {
+		return nil, err
+	}
+
+	obj, _, err := m.object(session, pubKeyHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.edPub == nil {
+		return nil, ckr(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+	}
+
+	return append(ed25519.PublicKey(nil), obj.edPub...), nil
+}
+
+func (m *HSM) SignEdDSA_ed25519(ctx context.Context, msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	if err := m.wait(ctx, OpSign); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fail(OpSign); err != nil {
+		return nil, err
+	}
+
+	obj, s, err := m.object(sess, privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.edPriv == nil || !obj.bool(pkcs11.CKA_SIGN) {
+		return nil, ckr(pkcs11.CKR_KEY_TYPE_INCONSISTENT)
+	}
+
+	if !s.loggedIn {
+		return nil, ckr(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+
+	return ed25519.Sign(obj.edPriv, msg), nil
+}
+
+func (m *HSM) KeyCurve(ctx context.Context, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (hsm.Curve, error) {
+	if err := m.wait(ctx, OpGetAttributeValue); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fail(OpGetAttributeValue); err != nil {
+		return "", err
+	}
+
+	o, _, err := m.object(session, obj)
+	if err != nil {
+		return "", err
+	}
+
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(o.attrs[pkcs11.CKA_EC_PARAMS], &oid); err != nil {
+		return "", ckr(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+	}
+
+	switch {
+	case oid.Equal(secp256k1OID):
+		return hsm.CurveSecp256k1, nil
+	case oid.Equal(ed25519OID):
+		return hsm.CurveEd25519, nil
+	case oid.Equal(p256OID):
+		return hsm.CurveP256, nil
+	}
+
+	return "", ckr(pkcs11.CKR_CURVE_NOT_SUPPORTED)
+}
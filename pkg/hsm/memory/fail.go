@@ -0,0 +1,136 @@
+package hsm_mem
+
+import (
+	"context"
+	"time"
+)
+
+// Op names the PKCS#11 call a failure is injected into
+type Op string
+
+const (
+	OpInitToken         Op = "C_InitToken"
+	OpInitPIN           Op = "C_InitPIN"
+	OpSetPIN            Op = "C_SetPIN"
+	OpOpenSession       Op = "C_OpenSession"
+	OpLogin             Op = "C_Login"
+	OpFindObjects       Op = "C_FindObjects"
+	OpGetAttributeValue Op = "C_GetAttributeValue"
+	OpSetAttributeValue Op = "C_SetAttributeValue"
+	OpGenerateKeyPair   Op = "C_GenerateKeyPair"
+	OpSign              Op = "C_Sign"
+	OpWrapKey           Op = "C_WrapKey"
+	OpUnwrapKey         Op = "C_UnwrapKey"
+	OpCreateObject      Op = "C_CreateObject"
+	OpDestroyObject     Op = "C_DestroyObject"
+)
+
+type failure struct {
+	err   error
+	times int
+}
+
+// Fail makes the next times calls to op return err, usually a pkcs11.Error.
+// A times value of zero or less fails every call until ClearFailures.
+func (m *HSM) Fail(op Op, err error, times int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.failures[op] = &failure{err: err, times: times}
+}
+
+// ClearFailures removes every injected failure and stall
+func (m *HSM) ClearFailures() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.failures = make(map[Op]*failure)
+	m.stalls = make(map[Op]time.Duration)
+}
+
+// fail returns the injected error for op, if any. Callers hold m.mu.
+func (m *HSM) fail(op Op) error {
+	f, ok := m.failures[op]
+	if !ok {
+		return nil
+	}
+
+	if f.times > 0 {
+		f.times--
+		if f.times == 0 {
+			delete(m.failures, op)
+		}
+	}
+
+	return f.err
+}
+
+// Stall makes calls to op block for d, or until their context is done, to
+// simulate a module that stops answering
+func (m *HSM) Stall(op Op, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stalls[op] = d
+}
+
+// wait blocks for the stalls of ops and returns the error of ctx, if any.
+// Unlike a real module a call given up here never happens.
+func (m *HSM) wait(ctx context.Context, ops ...Op) error {
+	m.mu.Lock()
+	var stall time.Duration
+	for _, op := range ops {
+		stall += m.stalls[op]
+	}
+	m.mu.Unlock()
+
+	if stall > 0 {
+		timer := time.NewTimer(stall)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	return ctx.Err()
+}
+
+// SignatureMode controls the s value the token produces before
+// SignECDSA_secp256k1 normalizes it. Tokens start out with low s values, so
+// tests are deterministic unless they ask for another mode.
+type SignatureMode int
+
+const (
+	SignatureAlwaysLowS SignatureMode = iota
+	SignatureAlwaysHighS
+	// SignatureRandomS returns low and high s values at random, like most HSMs
+	SignatureRandomS
+)
+
+// SetSignatureMode chooses which s values signatures are returned with
+func (m *HSM) SetSignatureMode(mode SignatureMode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sigMode = mode
+}
+
+// SignatureEncoding controls the format C_Sign output is returned in
+type SignatureEncoding int
+
+const (
+	// SignatureRaw returns the 64 byte r || s value from PKCS#11 v2.40
+	SignatureRaw SignatureEncoding = iota
+	// SignatureDER returns a DER encoded ECDSA-Sig-Value
+	SignatureDER
+)
+
+// SetSignatureEncoding chooses the format the token returns signatures in
+func (m *HSM) SetSignatureEncoding(enc SignatureEncoding) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sigEncoding = enc
+}
@@ -0,0 +1,87 @@
+package hsm_mem
+
+import (
+	"context"
+	"open_custodial/pkg/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// mechanisms are the mechanisms the in memory HSM implements
+var mechanisms = []struct {
+	mechanism uint
+	info      pkcs11.MechanismInfo
+}{
+	{pkcs11.CKM_ECDSA_KEY_PAIR_GEN, pkcs11.MechanismInfo{MinKeySize: 256, MaxKeySize: 256, Flags: pkcs11.CKF_GENERATE_KEY_PAIR}},
+	{pkcs11.CKM_ECDSA, pkcs11.MechanismInfo{MinKeySize: 256, MaxKeySize: 256, Flags: pkcs11.CKF_SIGN | pkcs11.CKF_VERIFY}},
+	{hsm.CKM_EC_EDWARDS_KEY_PAIR_GEN, pkcs11.MechanismInfo{MinKeySize: 255, MaxKeySize: 255, Flags: pkcs11.CKF_GENERATE_KEY_PAIR}},
+	{hsm.CKM_EDDSA, pkcs11.MechanismInfo{MinKeySize: 255, MaxKeySize: 255, Flags: pkcs11.CKF_SIGN | pkcs11.CKF_VERIFY}},
+	{pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, pkcs11.MechanismInfo{MinKeySize: 2048, MaxKeySize: 4096, Flags: pkcs11.CKF_GENERATE_KEY_PAIR}},
+	{pkcs11.CKM_RSA_PKCS_OAEP, pkcs11.MechanismInfo{MinKeySize: 2048, MaxKeySize: 4096, Flags: pkcs11.CKF_UNWRAP}},
+	{pkcs11.CKM_AES_KEY_WRAP_PAD, pkcs11.MechanismInfo{MinKeySize: 16, MaxKeySize: 32, Flags: pkcs11.CKF_WRAP | pkcs11.CKF_UNWRAP}},
+}
+
+func (m *HSM) Info(ctx context.Context) (hsm.InfoReport, error) {
+	if err := m.wait(ctx); err != nil {
+		return hsm.InfoReport{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := hsm.InfoReport{
+		Library: hsm.LibraryInfo{
+			Manufacturer:    "open_custodial",
+			Description:     "in memory hsm",
+			Version:         "1.0",
+			CryptokiVersion: "2.40",
+		},
+		Tokens:     []hsm.TokenReport{},
+		Mechanisms: []hsm.MechanismReport{},
+	}
+
+	for _, mech := range mechanisms {
+		r.Mechanisms = append(r.Mechanisms, hsm.NewMechanismReport(mech.mechanism, mech.info))
+	}
+
+	sessions := make(map[uint]uint)
+	rwSessions := make(map[uint]uint)
+	for _, s := range m.sessions {
+		sessions[s.slotID]++
+		if !s.readOnly {
+			rwSessions[s.slotID]++
+		}
+	}
+
+	for i, t := range m.slots {
+		info := pkcs11.TokenInfo{
+			Label:              t.label,
+			ManufacturerID:     "open_custodial",
+			Model:              "memory",
+			Flags:              pkcs11.CKF_RNG | pkcs11.CKF_LOGIN_REQUIRED,
+			SessionCount:       sessions[uint(i)],
+			RwSessionCount:     rwSessions[uint(i)],
+			FreePublicMemory:   ^uint(0),
+			TotalPublicMemory:  ^uint(0),
+			FreePrivateMemory:  ^uint(0),
+			TotalPrivateMemory: ^uint(0),
+		}
+
+		if t.initialized {
+			info.Flags |= pkcs11.CKF_TOKEN_INITIALIZED
+		}
+
+		if t.pinInitialized {
+			info.Flags |= pkcs11.CKF_USER_PIN_INITIALIZED
+		}
+
+		r.Tokens = append(r.Tokens, hsm.NewTokenReport(uint(i), info))
+	}
+
+	required := []hsm.Feature{hsm.FeatureECDSA}
+	if len(m.backupKEK) > 0 {
+		required = append(required, hsm.FeatureKeyBackup)
+	}
+
+	return r, r.CheckFeatures(required...)
+}
@@ -0,0 +1,495 @@
+package hsm_mem
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"open_custodial/pkg/hsm"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/miekg/pkcs11"
+)
+
+func (m *HSM) LocateKey(ctx context.Context, label string) (loc hsm.KeyLocation, err error) {
+	if err := m.wait(ctx); err != nil {
+		return hsm.KeyLocation{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	template := keyTemplate(hsm.KeyID(label))
+	var tokens []string
+	for _, t := range m.slots {
+		for _, obj := range t.objects {
+			if (obj.pub != nil || obj.edPub != nil) && obj.matches(template) {
+				tokens = append(tokens, t.label)
+				break
+			}
+		}
+	}
+
+	switch len(tokens) {
+	case 0:
+	case 1:
+		return hsm.KeyLocation{Token: tokens[0], Key: hsm.KeyID(label)}, nil
+	default:
+		return loc, fmt.Errorf("key with label %s is on more than one token", label)
+	}
+
+	slotID, ok := m.findSlot(label)
+	if !ok || !m.slots[slotID].singleKey() {
+		return loc, fmt.Errorf("unable to find key with label %s", label)
+	}
+
+	return hsm.KeyLocation{Token: label}, nil
+}
+
+func (m *HSM) KeyDestroyed(ctx context.Context, label string) (bool, error) {
+	if err := m.wait(ctx); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.isDestroyed(hsm.KeyID(label)) {
+		return true, nil
+	}
+
+	// the key of a single key token is destroyed under the token label
+	slotID, ok := m.findSlot(label)
+	if !ok {
+		return false, nil
+	}
+
+	template := recordTemplate(hsm.DestroyedKeyApplication, "")
+	for _, obj := range m.slots[slotID].objects {
+		if obj.matches(template) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *HSM) KeyLabels(ctx context.Context) ([]string, error) {
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var labels []string
+	for _, t := range m.slots {
+		if !t.initialized {
+			continue
+		}
+
+		if t.singleKey() {
+			labels = append(labels, t.label)
+			continue
+		}
+
+		for _, obj := range t.objects {
+			if obj.pub == nil && obj.edPub == nil {
+				continue
+			}
+
+			if label := string(obj.attrs[pkcs11.CKA_LABEL]); label != "" {
+				labels = append(labels, label)
+			}
+		}
+	}
+
+	sort.Strings(labels)
+	return labels, nil
+}
+
+// singleKey reports whether the token holds exactly one key, and that key
+// is unlabeled
+func (t *token) singleKey() bool {
+	var labels []string
+	for _, obj := range t.objects {
+		if obj.pub != nil || obj.edPub != nil {
+			labels = append(labels, string(obj.attrs[pkcs11.CKA_LABEL]))
+		}
+	}
+
+	return len(labels) == 1 && labels[0] == ""
+}
+
+func (m *HSM) PublicKeyHandle(ctx context.Context, session pkcs11.SessionHandle, key hsm.KeyID) (pkcs11.ObjectHandle, error) {
+	if err := m.wait(ctx, OpFindObjects); err != nil {
+		return 0, err
+	}
+
+	return m.findWithAttributes(session, keyHandleTemplate(pkcs11.CKO_PUBLIC_KEY, key))
+}
+
+func (m *HSM) PrivateKeyHandle(ctx context.Context, session pkcs11.SessionHandle, key hsm.KeyID) (pkcs11.ObjectHandle, error) {
+	if err := m.wait(ctx, OpFindObjects); err != nil {
+		return 0, err
+	}
+
+	return m.findWithAttributes(session, keyHandleTemplate(pkcs11.CKO_PRIVATE_KEY, key))
+}
+
+// keyHandleTemplate matches labeled keys on any curve and unlabeled keys
+// on secp256k1 only, like the PKCS#11 implementation
+func keyHandleTemplate(class uint, key hsm.KeyID) []*pkcs11.Attribute {
+	attr := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if key == "" {
+		return append(attr, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA))
+	}
+
+	return append(attr, keyTemplate(key)...)
+}
+
+func keyTemplate(key hsm.KeyID) []*pkcs11.Attribute {
+	if key == "" {
+		return nil
+	}
+
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, string(key)),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(key)),
+	}
+}
+
+func (m *HSM) findWithAttributes(sess pkcs11.SessionHandle, attr []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fail(OpFindObjects); err != nil {
+		return 0, err
+	}
+
+	s, err := m.session(sess)
+	if err != nil {
+		return 0, err
+	}
+
+	// handles are handed out in increasing order, return the oldest match
+	// the same way a token lists objects in creation order
+	var found pkcs11.ObjectHandle
+	for handle, obj := range m.token(s).objects {
+		if !s.loggedIn && obj.isPrivate() {
+			continue
+		}
+
+		if obj.matches(attr) && (found == 0 || handle < found) {
+			found = handle
+		}
+	}
+
+	if found == 0 {
+		return 0, errors.New("no objects found")
+	}
+
+	return found, nil
+}
+
+func (m *HSM) GetPublicKey(ctx context.Context, session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (pub ecdsa.PublicKey, err error) {
+	if err := m.wait(ctx, OpGetAttributeValue); err != nil {
+		return ecdsa.PublicKey{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fail(OpGetAttributeValue); err != nil {
+		return pub, err
+	}
+
+	obj, _, err := m.object(session, pubKeyHandle)
+	if err != nil {
+		return pub, err
+	}
+
+	if obj.pub == nil {
+		return pub, ckr(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+	}
+
+	return *obj.pub, nil
+}
+
+func (m *HSM) GenerateKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, key hsm.KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if err := m.wait(ctx, OpGenerateKeyPair); err != nil {
+		return 0, 0, err
+	}
+
+	return m.generateECDSA(session, key, crypto.S256(), secp256k1OID)
+}
+
+func (m *HSM) generateECDSA(session pkcs11.SessionHandle, key hsm.KeyID, curve elliptic.Curve, curveOID asn1.ObjectIdentifier) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.generateSession(session, key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return 0, 0, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	oid, err := asn1.Marshal(curveOID)
+	if err != nil {
+		return 0, 0, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	point, err := asn1.Marshal(elliptic.Marshal(curve, priv.X, priv.Y))
+	if err != nil {
+		return 0, 0, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	pubObj := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, oid),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+	)
+	pubObj.set(keyTemplate(key)...)
+	pubObj.pub = &priv.PublicKey
+
+	privObj := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, oid),
+	)
+	privObj.set(m.privateKeyPolicy()...)
+	privObj.set(keyTemplate(key)...)
+	privObj.priv = priv
+
+	t := m.token(s)
+	pubHandle := m.store(t, pubObj)
+	privHandle := m.store(t, privObj)
+
+	return pubHandle, privHandle, nil
+}
+
+// generateSession checks a key pair labeled key can be generated in session
+func (m *HSM) generateSession(session pkcs11.SessionHandle, key hsm.KeyID) (*session, error) {
+	if err := m.fail(OpGenerateKeyPair); err != nil {
+		return nil, err
+	}
+
+	s, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.readOnly {
+		return nil, ckr(pkcs11.CKR_SESSION_READ_ONLY)
+	}
+
+	if !s.loggedIn {
+		return nil, ckr(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+
+	if key != "" && m.hasKey(key) {
+		return nil, fmt.Errorf("key with label %s already exists", key)
+	}
+
+	if key != "" && m.isDestroyed(key) {
+		return nil, fmt.Errorf("key with label %s was destroyed and can not be reused", key)
+	}
+
+	return s, nil
+}
+
+// SignECDSA_secp256k1 signs a 32 byte digest and returns r || s with the
+// low s value, canonicalized and normalized the way the PKCS#11
+// implementation does.
+func (m *HSM) SignECDSA_secp256k1(ctx context.Context, msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	if err := m.wait(ctx, OpSign); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	raw, err := m.sign(msg, sess, privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := hsm.CanonicalSignature(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, _, err = hsm.NormalizeS(signature)
+	return signature, err
+}
+
+// sign behaves like C_Sign with CKM_ECDSA. Like a real token it does not
+// care about the size of s and the output encoding depends on the provider,
+// see SetSignatureMode and SetSignatureEncoding.
+func (m *HSM) sign(msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	if err := m.fail(OpSign); err != nil {
+		return nil, err
+	}
+
+	obj, s, err := m.object(sess, privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.priv == nil || !obj.bool(pkcs11.CKA_SIGN) {
+		return nil, ckr(pkcs11.CKR_KEY_FUNCTION_NOT_PERMITTED)
+	}
+
+	if !s.loggedIn {
+		return nil, ckr(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+
+	if len(msg) != 32 {
+		return nil, ckr(pkcs11.CKR_DATA_LEN_RANGE)
+	}
+
+	if obj.priv.Curve != crypto.S256() {
+		r, s, err := ecdsa.Sign(rand.Reader, obj.priv, msg)
+		if err != nil {
+			return nil, ckr(pkcs11.CKR_FUNCTION_FAILED)
+		}
+
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return m.encode(sig)
+	}
+
+	// crypto.Sign always returns the low s value, mirror it according to
+	// the signature mode to behave like an HSM that does not normalize
+	sig, err := crypto.Sign(msg, obj.priv)
+	if err != nil {
+		return nil, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	if m.flipS() {
+		n := crypto.S256().Params().N
+		s := new(big.Int).Sub(n, new(big.Int).SetBytes(sig[32:64]))
+		s.FillBytes(sig[32:64])
+	}
+
+	return m.encode(sig[:64])
+}
+
+func (m *HSM) encode(sig []byte) ([]byte, error) {
+	if m.sigEncoding == SignatureDER {
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	}
+
+	return sig, nil
+}
+
+func (m *HSM) flipS() bool {
+	switch m.sigMode {
+	case SignatureAlwaysLowS:
+		return false
+	case SignatureAlwaysHighS:
+		return true
+	}
+
+	b := make([]byte, 1)
+	rand.Read(b)
+	return b[0]&1 == 1
+}
+
+func (m *HSM) hasKey(key hsm.KeyID) bool {
+	template := keyTemplate(key)
+	for _, t := range m.slots {
+		for _, obj := range t.objects {
+			if obj.matches(template) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// object looks up handle on the token sess belongs to
+func (m *HSM) object(sess pkcs11.SessionHandle, handle pkcs11.ObjectHandle) (*object, *session, error) {
+	s, err := m.session(sess)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj, ok := m.token(s).objects[handle]
+	if !ok || (!s.loggedIn && obj.isPrivate()) {
+		return nil, nil, ckr(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+
+	return obj, s, nil
+}
+
+func (m *HSM) store(t *token, obj *object) pkcs11.ObjectHandle {
+	handle := m.nextObject
+	m.nextObject++
+	t.objects[handle] = obj
+	return handle
+}
+
+func newObject(attrs ...*pkcs11.Attribute) *object {
+	obj := &object{attrs: make(map[uint][]byte)}
+	obj.set(attrs...)
+	return obj
+}
+
+func (o *object) set(attrs ...*pkcs11.Attribute) {
+	for _, a := range attrs {
+		o.attrs[a.Type] = a.Value
+	}
+}
+
+func (o *object) matches(template []*pkcs11.Attribute) bool {
+	for _, a := range template {
+		v, ok := o.attrs[a.Type]
+		if !ok || !bytes.Equal(v, a.Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (o *object) bool(typ uint) bool {
+	v := o.attrs[typ]
+	return len(v) == 1 && v[0] == 1
+}
+
+func (o *object) isPrivate() bool {
+	return o.bool(pkcs11.CKA_PRIVATE)
+}
+
+// http://oid-info.com/get/1.3.132.0.10
+var secp256k1OID = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+
+// http://oid-info.com/get/1.2.840.10045.3.1.7
+var p256OID = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+
+func asn1Secp256k1() ([]byte, error) {
+	return asn1.Marshal(secp256k1OID)
+}
@@ -0,0 +1,491 @@
+package hsm_mem
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"open_custodial/pkg/config"
+	"open_custodial/pkg/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+// HSM is a pure Go, in memory implementation of hsm.HSM. It keeps slots,
+// tokens, sessions and objects the way a PKCS#11 token would and reports
+// failures as pkcs11.Error values, so code written against hsm.HSM can be
+// tested without a PKCS#11 library.
+type HSM struct {
+	mu          sync.Mutex
+	slots       []*token
+	sessions    map[pkcs11.SessionHandle]*session
+	nextSession pkcs11.SessionHandle
+	nextObject  pkcs11.ObjectHandle
+	failures    map[Op]*failure
+	stalls      map[Op]time.Duration
+	sigMode     SignatureMode
+	sigEncoding SignatureEncoding
+	backupKEK   []byte
+	status      hsm.ConnectionStatus
+	rotation    *rotation
+
+	// slotMu serializes token creation and removal
+	slotMu sync.Mutex
+}
+
+var _ hsm.HSM = (*HSM)(nil)
+
+type token struct {
+	label          string
+	initialized    bool
+	pinInitialized bool
+	objects        map[pkcs11.ObjectHandle]*object
+	// pins holds the credentials a PIN rotation set, tokens start out with
+	// the configured ones
+	pins map[config.Role]config.Credential
+}
+
+type session struct {
+	slotID   uint
+	readOnly bool
+	loggedIn bool
+}
+
+type object struct {
+	attrs  map[uint][]byte
+	pub    *ecdsa.PublicKey
+	priv   *ecdsa.PrivateKey
+	edPub  ed25519.PublicKey
+	edPriv ed25519.PrivateKey
+	rsa    *rsa.PrivateKey
+	secret []byte
+}
+
+// New returns an empty HSM with a single uninitialized slot, the way
+// SoftHSM presents itself before any token is created.
+func New() *HSM {
+	return &HSM{
+		slots:       []*token{newToken()},
+		sessions:    make(map[pkcs11.SessionHandle]*session),
+		nextSession: 1,
+		nextObject:  1,
+		failures:    make(map[Op]*failure),
+		stalls:      make(map[Op]time.Duration),
+		status:      hsm.ConnectionStatus{State: hsm.StateConnected, Since: time.Now()},
+	}
+}
+
+func newToken() *token {
+	return &token{
+		objects: make(map[pkcs11.ObjectHandle]*object),
+		pins:    make(map[config.Role]config.Credential),
+	}
+}
+
+func ckr(code uint) error {
+	return pkcs11.Error(code)
+}
+
+func (m *HSM) GetSlotID(ctx context.Context, label string) (uint, error) {
+	if err := m.wait(ctx); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slotID, ok := m.findSlot(label)
+	if !ok {
+		return 0, errors.New("unable to find slot with label")
+	}
+
+	return slotID, nil
+}
+
+type createdSlot struct {
+	slotID uint
+	err    error
+}
+
+// NewSlot keeps creating the token after ctx is done, the way a PKCS#11
+// module finishes a C_InitToken call the caller gave up on
+func (m *HSM) NewSlot(ctx context.Context, name string) (uint, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	done := make(chan createdSlot, 1)
+	go func() {
+		m.slotMu.Lock()
+		defer m.slotMu.Unlock()
+
+		m.wait(context.Background(), OpInitToken)
+		slotID, err := m.newSlot(name)
+		done <- createdSlot{slotID, err}
+	}()
+
+	select {
+	case c := <-done:
+		return c.slotID, c.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (m *HSM) newSlot(name string) (uint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(name) > 32 {
+		return 0, fmt.Errorf("token label %s is longer than 32 bytes", name)
+	}
+
+	if strings.HasPrefix(name, hsm.FailedTokenPrefix) {
+		return 0, fmt.Errorf("token labels can not start with %s", hsm.FailedTokenPrefix)
+	}
+
+	if _, ok := m.findSlot(name); ok {
+		return 0, errors.New("slots already exists")
+	}
+
+	slotID := m.freeSlot()
+
+	if err := m.fail(OpInitToken); err != nil {
+		return 0, err
+	}
+
+	t := m.slots[slotID]
+	t.label = name
+	t.initialized = true
+	t.pinInitialized = false
+	t.objects = make(map[pkcs11.ObjectHandle]*object)
+	t.pins = make(map[config.Role]config.Credential)
+
+	// a token created during or after a PIN rotation has the new PIN
+	if r := m.rotation; r != nil {
+		t.pins[r.role] = r.next
+	}
+
+	// like SoftHSM, keep one uninitialized slot around for the next token
+	if slotID == uint(len(m.slots))-1 {
+		m.slots = append(m.slots, newToken())
+	}
+
+	if err := m.fail(OpInitPIN); err != nil {
+		m.markFailed(slotID)
+		return 0, err
+	}
+
+	t.pinInitialized = true
+
+	if len(m.backupKEK) > 0 {
+		for _, obj := range newBackupKEK(m.backupKEK) {
+			m.store(t, obj)
+		}
+	}
+
+	return slotID, nil
+}
+
+// freeSlot returns the first uninitialized slot, or the first failed token
+// when there is none
+func (m *HSM) freeSlot() uint {
+	failed := -1
+	for i, t := range m.slots {
+		if !t.initialized {
+			return uint(i)
+		}
+
+		if failed < 0 && strings.HasPrefix(t.label, hsm.FailedTokenPrefix) {
+			failed = i
+		}
+	}
+
+	if failed >= 0 {
+		return uint(failed)
+	}
+
+	m.slots = append(m.slots, newToken())
+	return uint(len(m.slots)) - 1
+}
+
+// markFailed wipes the token and relabels it the way the PKCS#11
+// implementation does
+func (m *HSM) markFailed(slotID uint) {
+	t := m.slots[slotID]
+	t.label = fmt.Sprintf("%s%d", hsm.FailedTokenPrefix, slotID)
+	t.pinInitialized = false
+	t.objects = make(map[pkcs11.ObjectHandle]*object)
+
+	for handle, s := range m.sessions {
+		if s.slotID == slotID {
+			delete(m.sessions, handle)
+		}
+	}
+}
+
+func (m *HSM) DiscardSlot(ctx context.Context, name string) error {
+	m.slotMu.Lock()
+	defer m.slotMu.Unlock()
+
+	if err := m.wait(ctx, OpInitToken); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slotID, ok := m.findSlot(name)
+	if !ok {
+		return fmt.Errorf("unable to find slots with name %s", name)
+	}
+
+	if err := m.fail(OpInitToken); err != nil {
+		return err
+	}
+
+	m.markFailed(slotID)
+	return nil
+}
+
+func (m *HSM) Orphans(ctx context.Context) ([]hsm.Orphan, error) {
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var orphans []hsm.Orphan
+	for i, t := range m.slots {
+		if !t.initialized {
+			continue
+		}
+
+		orphan := hsm.Orphan{SlotID: uint(i), Label: t.label}
+		switch {
+		case strings.HasPrefix(t.label, hsm.FailedTokenPrefix):
+			orphan.Reason = hsm.OrphanFailed
+		case !t.pinInitialized:
+			orphan.Reason = hsm.OrphanPINNotInitialized
+		case !t.hasPublicKey() && !t.hasDestroyedKey():
+			orphan.Reason = hsm.OrphanEmpty
+		default:
+			continue
+		}
+
+		orphans = append(orphans, orphan)
+	}
+
+	return orphans, nil
+}
+
+func (t *token) hasPublicKey() bool {
+	return t.has([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY)})
+}
+
+// hasDestroyedKey reports whether a key of the token was destroyed, such a
+// token keeps its label reserved and is never an orphan
+func (t *token) hasDestroyedKey() bool {
+	return t.has([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, hsm.DestroyedKeyApplication),
+	})
+}
+
+func (t *token) has(template []*pkcs11.Attribute) bool {
+	for _, obj := range t.objects {
+		if obj.matches(template) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *HSM) findSlot(label string) (uint, bool) {
+	for i, t := range m.slots {
+		if t.initialized && t.label == label {
+			return uint(i), true
+		}
+	}
+
+	return 0, false
+}
+
+func (m *HSM) NewSession(ctx context.Context, slotID uint) (pkcs11.SessionHandle, error) {
+	if err := m.wait(ctx, OpOpenSession); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.openSession(slotID, false)
+}
+
+func (m *HSM) NewSlotSession(ctx context.Context, name string) (*pkcs11.SessionHandle, error) {
+	if err := m.wait(ctx, OpOpenSession); err != nil {
+		return nil, err
+	}
+
+	return m.newLoggedInSession(name, false)
+}
+
+func (m *HSM) NewReadOnlySlotSession(ctx context.Context, name string) (*pkcs11.SessionHandle, error) {
+	if err := m.wait(ctx, OpOpenSession); err != nil {
+		return nil, err
+	}
+
+	return m.newLoggedInSession(name, true)
+}
+
+func (m *HSM) newLoggedInSession(name string, readOnly bool) (*pkcs11.SessionHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.status.State != hsm.StateConnected {
+		return nil, hsm.ErrNotConnected
+	}
+
+	slotID, ok := m.findSlot(name)
+	if !ok {
+		return nil, errors.New("unable to find slot with label")
+	}
+
+	sess, err := m.openSession(slotID, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.fail(OpLogin); err != nil {
+		delete(m.sessions, sess)
+		return nil, err
+	}
+
+	m.sessions[sess].loggedIn = true
+
+	return &sess, nil
+}
+
+func (m *HSM) openSession(slotID uint, readOnly bool) (pkcs11.SessionHandle, error) {
+	if err := m.fail(OpOpenSession); err != nil {
+		return 0, err
+	}
+
+	if slotID >= uint(len(m.slots)) {
+		return 0, ckr(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+
+	if !m.slots[slotID].initialized {
+		return 0, ckr(pkcs11.CKR_TOKEN_NOT_RECOGNIZED)
+	}
+
+	sess := m.nextSession
+	m.nextSession++
+	m.sessions[sess] = &session{slotID: slotID, readOnly: readOnly}
+
+	return sess, nil
+}
+
+func (m *HSM) EndSession(sess *pkcs11.SessionHandle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[*sess]; !ok {
+		return ckr(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+
+	delete(m.sessions, *sess)
+	return nil
+}
+
+func (m *HSM) ReleaseHandle(ctx context.Context, sess pkcs11.SessionHandle) error {
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.session(sess)
+	return err
+}
+
+// session looks up an open session
+func (m *HSM) session(sess pkcs11.SessionHandle) (*session, error) {
+	s, ok := m.sessions[sess]
+	if !ok {
+		return nil, ckr(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+
+	return s, nil
+}
+
+func (m *HSM) token(s *session) *token {
+	return m.slots[s.slotID]
+}
+
+// OpenSessions returns the number of sessions that have not been ended yet
+func (m *HSM) OpenSessions() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.sessions)
+}
+
+// Refresh has nothing to rescan, tokens are looked up directly
+func (m *HSM) Refresh(ctx context.Context) (hsm.IndexReport, error) {
+	if err := m.wait(ctx); err != nil {
+		return hsm.IndexReport{}, err
+	}
+
+	return hsm.IndexReport{}, nil
+}
+
+// Close ends every open session
+func (m *HSM) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions = make(map[pkcs11.SessionHandle]*session)
+	return nil
+}
+
+func (m *HSM) Status() hsm.ConnectionStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.status
+}
+
+// Disconnect simulates the module dropping with err, every open session is
+// lost and new ones are refused until Reconnect
+func (m *HSM) Disconnect(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions = make(map[pkcs11.SessionHandle]*session)
+	m.status = hsm.ConnectionStatus{
+		State:      hsm.StateDisconnected,
+		Since:      time.Now(),
+		LastError:  err.Error(),
+		Reconnects: m.status.Reconnects,
+	}
+}
+
+// Reconnect ends a simulated disconnect
+func (m *HSM) Reconnect() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status.State = hsm.StateConnected
+	m.status.Since = time.Now()
+	m.status.Reconnects++
+}
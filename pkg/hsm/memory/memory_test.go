@@ -0,0 +1,236 @@
+package hsm_mem
+
+import (
+	"context"
+	"crypto/ed25519"
+	"math/big"
+	"testing"
+
+	"open_custodial/pkg/hsm"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/suite"
+)
+
+type MemorySuite struct {
+	suite.Suite
+	hsm *HSM
+}
+
+func TestMemorySuite(t *testing.T) {
+	suite.Run(t, new(MemorySuite))
+}
+
+func (s *MemorySuite) SetupTest() {
+	s.hsm = New()
+}
+
+func (s *MemorySuite) TestNewSlot() {
+	first, err := s.hsm.NewSlot(context.Background(), "first")
+	s.NoError(err)
+
+	second, err := s.hsm.NewSlot(context.Background(), "second")
+	s.NoError(err)
+	s.NotEqual(first, second)
+
+	_, err = s.hsm.NewSlot(context.Background(), "first")
+	s.Error(err)
+
+	slotID, err := s.hsm.GetSlotID(context.Background(), "second")
+	s.NoError(err)
+	s.Equal(second, slotID)
+}
+
+func (s *MemorySuite) TestReadOnlySessionCannotGenerate() {
+	_, err := s.hsm.NewSlot(context.Background(), "read_only")
+	s.NoError(err)
+
+	sess, err := s.hsm.NewReadOnlySlotSession(context.Background(), "read_only")
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	_, _, err = s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, "")
+	s.Equal(pkcs11.Error(pkcs11.CKR_SESSION_READ_ONLY), err)
+}
+
+func (s *MemorySuite) TestPrivateKeyHiddenWithoutLogin() {
+	slotID, err := s.hsm.NewSlot(context.Background(), "hidden")
+	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "hidden")
+	s.NoError(err)
+	_, _, err = s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, "")
+	s.NoError(err)
+	s.NoError(s.hsm.EndSession(sess))
+
+	public, err := s.hsm.NewSession(context.Background(), slotID)
+	s.NoError(err)
+	defer s.hsm.EndSession(&public)
+
+	_, err = s.hsm.PublicKeyHandle(context.Background(), public, "")
+	s.NoError(err)
+
+	_, err = s.hsm.PrivateKeyHandle(context.Background(), public, "")
+	s.Error(err)
+}
+
+func (s *MemorySuite) TestFail() {
+	_, err := s.hsm.NewSlot(context.Background(), "fail")
+	s.NoError(err)
+
+	removed := pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED)
+	s.hsm.Fail(OpOpenSession, removed, 1)
+
+	_, err = s.hsm.NewSlotSession(context.Background(), "fail")
+	s.Equal(removed, err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "fail")
+	s.NoError(err)
+	s.NoError(s.hsm.EndSession(sess))
+
+	s.hsm.Fail(OpSign, removed, 0)
+	sess, err = s.hsm.NewSlotSession(context.Background(), "fail")
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	_, priv, err := s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, "")
+	s.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		_, err = s.hsm.SignECDSA_secp256k1(context.Background(), make([]byte, 32), *sess, priv)
+		s.Equal(removed, err)
+	}
+
+	s.hsm.ClearFailures()
+	sig, err := s.hsm.SignECDSA_secp256k1(context.Background(), make([]byte, 32), *sess, priv)
+	s.NoError(err)
+	s.Len(sig, 64)
+}
+
+func (s *MemorySuite) TestSignNormalizesHighS() {
+	_, err := s.hsm.NewSlot(context.Background(), "high_s")
+	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "high_s")
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	_, priv, err := s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, "")
+	s.NoError(err)
+
+	halfN := new(big.Int).Rsh(crypto.S256().Params().N, 1)
+	for _, mode := range []SignatureMode{SignatureAlwaysLowS, SignatureAlwaysHighS} {
+		s.hsm.SetSignatureMode(mode)
+
+		sig, err := s.hsm.SignECDSA_secp256k1(context.Background(), crypto.Keccak256([]byte("high_s")), *sess, priv)
+		s.NoError(err)
+		s.True(new(big.Int).SetBytes(sig[32:64]).Cmp(halfN) <= 0)
+	}
+}
+
+func (s *MemorySuite) TestSignCanonicalizesEncoding() {
+	_, err := s.hsm.NewSlot(context.Background(), "encoding")
+	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "encoding")
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	pub, priv, err := s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, "")
+	s.NoError(err)
+
+	key, err := s.hsm.GetPublicKey(context.Background(), *sess, pub)
+	s.NoError(err)
+
+	digest := crypto.Keccak256([]byte("encoding"))
+	for _, enc := range []SignatureEncoding{SignatureRaw, SignatureDER} {
+		s.hsm.SetSignatureEncoding(enc)
+
+		sig, err := s.hsm.SignECDSA_secp256k1(context.Background(), digest, *sess, priv)
+		s.NoError(err)
+		s.Len(sig, 64)
+		s.True(crypto.VerifySignature(crypto.FromECDSAPub(&key), digest, sig))
+	}
+}
+
+func (s *MemorySuite) TestEd25519() {
+	_, err := s.hsm.NewSlot(context.Background(), "ed25519")
+	s.NoError(err)
+
+	sess, err := s.hsm.NewSlotSession(context.Background(), "ed25519")
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	_, _, err = s.hsm.GenerateKeyEdDSA_ed25519(context.Background(), *sess, "ed_key")
+	s.NoError(err)
+
+	loc, err := s.hsm.LocateKey(context.Background(), "ed_key")
+	s.NoError(err)
+	s.Equal("ed25519", loc.Token)
+
+	pub, err := s.hsm.PublicKeyHandle(context.Background(), *sess, "ed_key")
+	s.NoError(err)
+
+	priv, err := s.hsm.PrivateKeyHandle(context.Background(), *sess, "ed_key")
+	s.NoError(err)
+
+	curve, err := s.hsm.KeyCurve(context.Background(), *sess, priv)
+	s.NoError(err)
+	s.Equal(hsm.CurveEd25519, curve)
+
+	key, err := s.hsm.GetPublicKeyEdDSA_ed25519(context.Background(), *sess, pub)
+	s.NoError(err)
+
+	msg := []byte("ed25519")
+	sig, err := s.hsm.SignEdDSA_ed25519(context.Background(), msg, *sess, priv)
+	s.NoError(err)
+	s.True(ed25519.Verify(key, msg, sig))
+
+	_, err = s.hsm.GetPublicKey(context.Background(), *sess, pub)
+	s.Error(err)
+
+	_, err = s.hsm.SignECDSA_secp256k1(context.Background(), crypto.Keccak256(msg), *sess, priv)
+	s.Error(err)
+
+	_, _, err = s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, "ed_key")
+	s.Error(err)
+}
+
+func (s *MemorySuite) TestLocateKeyByTokenLabel() {
+	ctx := context.Background()
+
+	_, err := s.hsm.NewSlot(ctx, "empty")
+	s.NoError(err)
+
+	_, err = s.hsm.LocateKey(ctx, "empty")
+	s.Error(err)
+
+	_, err = s.hsm.NewSlot(ctx, "single")
+	s.NoError(err)
+	s.generate("single", "")
+
+	loc, err := s.hsm.LocateKey(ctx, "single")
+	s.NoError(err)
+	s.Equal(hsm.KeyLocation{Token: "single"}, loc)
+
+	_, err = s.hsm.NewSlot(ctx, "shared")
+	s.NoError(err)
+	s.generate("shared", "alice")
+
+	_, err = s.hsm.LocateKey(ctx, "shared")
+	s.Error(err)
+
+	loc, err = s.hsm.LocateKey(ctx, "alice")
+	s.NoError(err)
+	s.Equal(hsm.KeyLocation{Token: "shared", Key: "alice"}, loc)
+}
+
+func (s *MemorySuite) generate(token string, key hsm.KeyID) {
+	sess, err := s.hsm.NewSlotSession(context.Background(), token)
+	s.NoError(err)
+	defer s.hsm.EndSession(sess)
+
+	_, _, err = s.hsm.GenerateKeyECDSA_secp256k1(context.Background(), *sess, key)
+	s.NoError(err)
+}
@@ -0,0 +1,65 @@
+package hsm_mem
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+
+	"open_custodial/pkg/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+func (m *HSM) GenerateKeyECDSA_P256(ctx context.Context, session pkcs11.SessionHandle, key hsm.KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if err := m.wait(ctx, OpGenerateKeyPair); err != nil {
+		return 0, 0, err
+	}
+
+	return m.generateECDSA(session, key, elliptic.P256(), p256OID)
+}
+
+// SignECDSA_P256 hashes msg with SHA-256 and returns a DER encoded
+// signature, like the PKCS#11 implementation
+func (m *HSM) SignECDSA_P256(ctx context.Context, msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	if err := m.wait(ctx, OpSign); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	digest := sha256.Sum256(msg)
+	return m.signDigestP256(digest[:], sess, privKey)
+}
+
+// SignDigestECDSA_P256 signs a digest the caller computed and returns a DER
+// encoded signature
+func (m *HSM) SignDigestECDSA_P256(ctx context.Context, digest []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	if err := m.wait(ctx, OpSign); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.signDigestP256(digest, sess, privKey)
+}
+
+func (m *HSM) signDigestP256(digest []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	raw, err := m.sign(digest, sess, privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := hsm.CanonicalSignature(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(sig[:32]),
+		new(big.Int).SetBytes(sig[32:]),
+	})
+}
@@ -0,0 +1,178 @@
+package hsm_mem
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"open_custodial/pkg/hsm"
+
+	"github.com/miekg/pkcs11"
+)
+
+func (m *HSM) RetireKey(ctx context.Context, session pkcs11.SessionHandle, key hsm.KeyID) error {
+	if err := m.wait(ctx, OpSetAttributeValue); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.writableSession(session)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := m.findObject(s, retiredTemplate(key)); ok {
+		return nil
+	}
+
+	if err := m.fail(OpSetAttributeValue); err != nil {
+		return err
+	}
+
+	handle, ok := m.findObject(s, keyHandleTemplate(pkcs11.CKO_PRIVATE_KEY, key))
+	if !ok {
+		return fmt.Errorf("unable to find key with label %s", key)
+	}
+
+	m.token(s).objects[handle].set(
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN_RECOVER, false),
+	)
+	return m.createRecord(s, hsm.RetiredKeyApplication, key, time.Now())
+}
+
+func (m *HSM) KeyRetiredAt(ctx context.Context, session pkcs11.SessionHandle, key hsm.KeyID) (time.Time, bool, error) {
+	if err := m.wait(ctx, OpFindObjects); err != nil {
+		return time.Time{}, false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.session(session)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	handle, ok := m.findObject(s, retiredTemplate(key))
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, string(m.token(s).objects[handle].attrs[pkcs11.CKA_VALUE]))
+	return at, err == nil, err
+}
+
+func (m *HSM) DestroyKey(ctx context.Context, session pkcs11.SessionHandle, key hsm.KeyID) error {
+	if err := m.wait(ctx, OpDestroyObject); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.writableSession(session)
+	if err != nil {
+		return err
+	}
+
+	retired, ok := m.findObject(s, retiredTemplate(key))
+	if !ok {
+		return hsm.ErrKeyNotRetired
+	}
+
+	if err := m.fail(OpDestroyObject); err != nil {
+		return err
+	}
+
+	if err := m.createRecord(s, hsm.DestroyedKeyApplication, key, time.Now()); err != nil {
+		return err
+	}
+
+	t := m.token(s)
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		if handle, ok := m.findObject(s, keyHandleTemplate(class, key)); ok {
+			delete(t.objects, handle)
+		}
+	}
+
+	delete(t.objects, retired)
+	return nil
+}
+
+func (m *HSM) writableSession(session pkcs11.SessionHandle) (*session, error) {
+	s, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.readOnly {
+		return nil, ckr(pkcs11.CKR_SESSION_READ_ONLY)
+	}
+
+	if !s.loggedIn {
+		return nil, ckr(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+
+	return s, nil
+}
+
+func (m *HSM) createRecord(s *session, application string, key hsm.KeyID, at time.Time) error {
+	if err := m.fail(OpCreateObject); err != nil {
+		return err
+	}
+
+	obj := newObject(recordTemplate(application, key)...)
+	obj.set(
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte(at.UTC().Format(time.RFC3339Nano))),
+	)
+	m.store(m.token(s), obj)
+
+	return nil
+}
+
+// findObject returns the oldest object on the session's token matching attr
+func (m *HSM) findObject(s *session, attr []*pkcs11.Attribute) (pkcs11.ObjectHandle, bool) {
+	var found pkcs11.ObjectHandle
+	for handle, obj := range m.token(s).objects {
+		if !s.loggedIn && obj.isPrivate() {
+			continue
+		}
+
+		if obj.matches(attr) && (found == 0 || handle < found) {
+			found = handle
+		}
+	}
+
+	return found, found != 0
+}
+
+// isDestroyed reports whether a key labeled key was destroyed on any token
+func (m *HSM) isDestroyed(key hsm.KeyID) bool {
+	template := recordTemplate(hsm.DestroyedKeyApplication, key)
+	for _, t := range m.slots {
+		for _, obj := range t.objects {
+			if obj.matches(template) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func retiredTemplate(key hsm.KeyID) []*pkcs11.Attribute {
+	return append(recordTemplate(hsm.RetiredKeyApplication, key), pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true))
+}
+
+func recordTemplate(application string, key hsm.KeyID) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, application),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, string(key)),
+	}
+}
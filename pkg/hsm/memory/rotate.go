@@ -0,0 +1,180 @@
+package hsm_mem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"open_custodial/pkg/config"
+	"open_custodial/pkg/hsm"
+)
+
+type rotation struct {
+	role      config.Role
+	next      config.Credential
+	running   bool
+	done      bool
+	failed    map[string]string
+	startedAt time.Time
+	updatedAt time.Time
+}
+
+// RotatePIN follows the rules of the PKCS#11 implementation: tokens that
+// already have the new PIN are skipped, failures injected into OpSetPIN
+// leave a token on the old PIN and the rotation incomplete.
+func (m *HSM) RotatePIN(ctx context.Context, role config.Role, next config.Credential) (hsm.PINRotation, error) {
+	if role != config.RoleCU && role != config.RoleSO {
+		return hsm.PINRotation{}, fmt.Errorf("unknown role %s", role)
+	}
+
+	if next.Password == "" {
+		return hsm.PINRotation{}, errors.New("new pin is empty")
+	}
+
+	r, labels, err := m.beginRotation(role, next)
+	if err != nil {
+		return hsm.PINRotation{}, err
+	}
+
+	for _, label := range labels {
+		if err := m.wait(ctx, OpSetPIN); err != nil {
+			break
+		}
+
+		m.rotateToken(r, label)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r.running = false
+	r.updatedAt = time.Now()
+
+	report := m.rotationReport(r)
+	if len(report.Pending) == 0 && len(report.Failed) == 0 {
+		r.done = true
+		report.State = hsm.RotationComplete
+	}
+
+	return report, nil
+}
+
+func (m *HSM) PINRotation() (hsm.PINRotation, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.rotation == nil {
+		return hsm.PINRotation{}, false
+	}
+
+	return m.rotationReport(m.rotation), true
+}
+
+// beginRotation resumes or starts a rotation and returns the labels of the
+// tokens to rotate
+func (m *HSM) beginRotation(role config.Role, next config.Credential) (*rotation, []string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.status.State != hsm.StateConnected {
+		return nil, nil, hsm.ErrNotConnected
+	}
+
+	r := m.rotation
+	switch {
+	case r != nil && r.running:
+		return nil, nil, fmt.Errorf("%w: the %s pin is being rotated", hsm.ErrRotationConflict, r.role)
+	case r != nil && !r.done && r.role != role:
+		return nil, nil, fmt.Errorf("%w: the rotation of the %s pin is incomplete, resume it first", hsm.ErrRotationConflict, r.role)
+	case r != nil && !r.done && r.next != next:
+		return nil, nil, fmt.Errorf("%w: the incomplete rotation of the %s pin is to another credential, resume it with the same one", hsm.ErrRotationConflict, r.role)
+	case r == nil || r.done:
+		r = &rotation{role: role, next: next, failed: make(map[string]string), startedAt: time.Now()}
+		m.rotation = r
+	}
+
+	r.running = true
+	r.updatedAt = time.Now()
+
+	var labels []string
+	for _, t := range m.rotatable() {
+		labels = append(labels, t.label)
+	}
+	sort.Strings(labels)
+
+	return r, labels, nil
+}
+
+func (m *HSM) rotateToken(r *rotation, label string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slotID, ok := m.findSlot(label)
+	if !ok {
+		return
+	}
+
+	t := m.slots[slotID]
+	if t.pins[r.role] == r.next {
+		return
+	}
+
+	r.updatedAt = time.Now()
+	if err := m.fail(OpSetPIN); err != nil {
+		r.failed[label] = err.Error()
+		return
+	}
+
+	t.pins[r.role] = r.next
+	delete(r.failed, label)
+}
+
+// rotatable lists the tokens that have PINs. Callers hold m.mu.
+func (m *HSM) rotatable() []*token {
+	var tokens []*token
+	for _, t := range m.slots {
+		if t.initialized && t.pinInitialized && !strings.HasPrefix(t.label, hsm.FailedTokenPrefix) {
+			tokens = append(tokens, t)
+		}
+	}
+
+	return tokens
+}
+
+// rotationReport lists the tokens by progress. Callers hold m.mu.
+func (m *HSM) rotationReport(r *rotation) hsm.PINRotation {
+	report := hsm.PINRotation{
+		Role:      r.role,
+		State:     hsm.RotationIncomplete,
+		Rotated:   []string{},
+		Pending:   []string{},
+		Failed:    make(map[string]string),
+		StartedAt: r.startedAt,
+		UpdatedAt: r.updatedAt,
+	}
+
+	switch {
+	case r.running:
+		report.State = hsm.RotationRunning
+	case r.done:
+		report.State = hsm.RotationComplete
+	}
+
+	for _, t := range m.rotatable() {
+		switch reason, failed := r.failed[t.label]; {
+		case t.pins[r.role] == r.next:
+			report.Rotated = append(report.Rotated, t.label)
+		case failed:
+			report.Failed[t.label] = reason
+		default:
+			report.Pending = append(report.Pending, t.label)
+		}
+	}
+
+	sort.Strings(report.Rotated)
+	sort.Strings(report.Pending)
+	return report
+}
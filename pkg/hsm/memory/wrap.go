@@ -0,0 +1,279 @@
+package hsm_mem
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+
+	"open_custodial/pkg/hsm"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/miekg/pkcs11"
+)
+
+// wrappingKeyBits is smaller than what the PKCS#11 implementation generates
+// to keep tests fast
+const wrappingKeyBits = 2048
+
+func (m *HSM) WrappingPublicKey(ctx context.Context, session pkcs11.SessionHandle) (*rsa.PublicKey, error) {
+	if err := m.wait(ctx, OpFindObjects); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj := m.wrappingKey(s); obj != nil {
+		return &obj.rsa.PublicKey, nil
+	}
+
+	if s.readOnly {
+		return nil, ckr(pkcs11.CKR_SESSION_READ_ONLY)
+	}
+
+	if err := m.fail(OpGenerateKeyPair); err != nil {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, wrappingKeyBits)
+	if err != nil {
+		return nil, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	priv := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, hsm.WrappingKeyLabel),
+	)
+	priv.rsa = key
+	m.store(m.token(s), priv)
+
+	return &key.PublicKey, nil
+}
+
+func (m *HSM) wrappingKey(s *session) *object {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, hsm.WrappingKeyLabel),
+	}
+
+	for _, obj := range m.token(s).objects {
+		if obj.rsa != nil && obj.matches(template) {
+			return obj
+		}
+	}
+
+	return nil
+}
+
+// CreateKEK stores an AES key encryption key labeled kek on the token, the
+// way operators provision one before importing keys with AES key wrap.
+func (m *HSM) CreateKEK(token string, kek hsm.KeyID, key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	slotID, ok := m.findSlot(token)
+	if !ok {
+		return fmt.Errorf("unable to find slot with label %s", token)
+	}
+
+	obj := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, string(kek)),
+	)
+	obj.secret = append([]byte(nil), key...)
+	m.store(m.slots[slotID], obj)
+
+	return nil
+}
+
+func (m *HSM) UnwrapKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, mech hsm.WrapMechanism, kek hsm.KeyID, wrapped []byte, key hsm.KeyID) (pkcs11.ObjectHandle, error) {
+	if err := m.wait(ctx, OpUnwrapKey); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fail(OpUnwrapKey); err != nil {
+		return 0, err
+	}
+
+	s, err := m.session(session)
+	if err != nil {
+		return 0, err
+	}
+
+	if s.readOnly {
+		return 0, ckr(pkcs11.CKR_SESSION_READ_ONLY)
+	}
+
+	if !s.loggedIn {
+		return 0, ckr(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+
+	if key != "" && m.hasKey(key) {
+		return 0, fmt.Errorf("key with label %s already exists", key)
+	}
+
+	if key != "" && m.isDestroyed(key) {
+		return 0, fmt.Errorf("key with label %s was destroyed and can not be reused", key)
+	}
+
+	der, err := m.unwrap(s, mech, kek, wrapped)
+	if err != nil {
+		return 0, err
+	}
+
+	priv, err := hsm.ParsePKCS8Secp256k1(der)
+	if err != nil {
+		return 0, ckr(pkcs11.CKR_WRAPPED_KEY_INVALID)
+	}
+
+	oid, err := asn1Secp256k1()
+	if err != nil {
+		return 0, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	obj := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, oid),
+	)
+	obj.set(m.privateKeyPolicy()...)
+	obj.set(keyTemplate(key)...)
+	obj.priv = priv
+
+	return m.store(m.token(s), obj), nil
+}
+
+func (m *HSM) unwrap(s *session, mech hsm.WrapMechanism, kek hsm.KeyID, wrapped []byte) ([]byte, error) {
+	switch mech {
+	case hsm.WrapRSAOAEP:
+		obj := m.wrappingKey(s)
+		if obj == nil {
+			return nil, ckr(pkcs11.CKR_UNWRAPPING_KEY_HANDLE_INVALID)
+		}
+
+		der, err := rsa.DecryptOAEP(sha256.New(), nil, obj.rsa, wrapped, nil)
+		if err != nil {
+			return nil, ckr(pkcs11.CKR_WRAPPED_KEY_INVALID)
+		}
+
+		return der, nil
+	case hsm.WrapAESKeyWrapPad:
+		template := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, string(kek)),
+			pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		}
+
+		for _, obj := range m.token(s).objects {
+			if obj.secret == nil || !obj.matches(template) {
+				continue
+			}
+
+			der, err := hsm.AESKeyUnwrapPad(obj.secret, wrapped)
+			if err != nil {
+				return nil, ckr(pkcs11.CKR_WRAPPED_KEY_INVALID)
+			}
+
+			return der, nil
+		}
+
+		return nil, ckr(pkcs11.CKR_UNWRAPPING_KEY_HANDLE_INVALID)
+	}
+
+	return nil, ckr(pkcs11.CKR_MECHANISM_INVALID)
+}
+
+func (m *HSM) CreatePublicKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, pub ecdsa.PublicKey, key hsm.KeyID) (pkcs11.ObjectHandle, error) {
+	if err := m.wait(ctx, OpCreateObject); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fail(OpCreateObject); err != nil {
+		return 0, err
+	}
+
+	s, err := m.session(session)
+	if err != nil {
+		return 0, err
+	}
+
+	if s.readOnly {
+		return 0, ckr(pkcs11.CKR_SESSION_READ_ONLY)
+	}
+
+	oid, err := asn1Secp256k1()
+	if err != nil {
+		return 0, ckr(pkcs11.CKR_FUNCTION_FAILED)
+	}
+
+	point, err := asn1.Marshal(crypto.FromECDSAPub(&pub))
+	if err != nil {
+		return 0, ckr(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID)
+	}
+
+	obj := newObject(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, oid),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+	)
+	obj.set(keyTemplate(key)...)
+	obj.pub = &pub
+
+	return m.store(m.token(s), obj), nil
+}
+
+func (m *HSM) DestroyObject(ctx context.Context, session pkcs11.SessionHandle, handle pkcs11.ObjectHandle) error {
+	if err := m.wait(ctx, OpDestroyObject); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fail(OpDestroyObject); err != nil {
+		return err
+	}
+
+	_, s, err := m.object(session, handle)
+	if err != nil {
+		return err
+	}
+
+	if s.readOnly {
+		return ckr(pkcs11.CKR_SESSION_READ_ONLY)
+	}
+
+	delete(m.token(s).objects, handle)
+	return nil
+}
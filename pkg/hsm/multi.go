@@ -0,0 +1,857 @@
+package hsm
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"open_custodial/pkg/config"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Backend is a named PKCS#11 module of a multi backend HSM
+type Backend struct {
+	Name string
+	HSM  HSM
+	// LabelPrefixes routes new tokens whose label starts with one of the
+	// prefixes to this backend, keys are created on the backend of their token
+	LabelPrefixes []string
+	// ReplicaOf names the backend whose keys this one holds copies of. Read
+	// operations fail over to replicas, new labels never go to one.
+	ReplicaOf string
+}
+
+// backendShift moves the backend index above the 32 bit slot IDs of the
+// modules, so slot IDs of the first backend are passed through unchanged
+const backendShift = 32
+
+// virtual slot IDs need a 64 bit uint, this fails to compile where uint has
+// 32 bits instead of silently folding backends onto each other
+const _ uint = 1 << (backendShift + 31)
+
+// backendSession keeps the handle the backend gave out, EndSession has to
+// get the same pointer back
+type backendSession struct {
+	backend int
+	sess    *pkcs11.SessionHandle
+}
+
+// multi is an HSM over several PKCS#11 modules. Labels go to the backend
+// that holds them, sessions are handed out under handles of its own that
+// remember the backend they were opened on.
+type multi struct {
+	backends []Backend
+
+	mu          sync.Mutex
+	sessions    map[pkcs11.SessionHandle]backendSession
+	nextSession pkcs11.SessionHandle
+}
+
+// NewMultiHSM routes every label to one of backends. Existing labels are
+// found on the backend holding them, new labels go to the backend with a
+// matching label prefix or else to the first backend that is no replica.
+func NewMultiHSM(backends ...Backend) (HSM, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("at least one hsm backend is required")
+	}
+
+	names := make(map[string]bool, len(backends))
+	primary := false
+	for _, b := range backends {
+		if b.Name == "" || names[b.Name] {
+			return nil, fmt.Errorf("hsm backend name %q is empty or not unique", b.Name)
+		}
+		names[b.Name] = true
+		primary = primary || b.ReplicaOf == ""
+	}
+
+	if !primary {
+		return nil, errors.New("at least one hsm backend must not be a replica")
+	}
+
+	for _, b := range backends {
+		if b.ReplicaOf != "" && (!names[b.ReplicaOf] || b.ReplicaOf == b.Name) {
+			return nil, fmt.Errorf("hsm backend %s is a replica of unknown backend %s", b.Name, b.ReplicaOf)
+		}
+	}
+
+	return &multi{
+		backends:    backends,
+		sessions:    make(map[pkcs11.SessionHandle]backendSession),
+		nextSession: 1,
+	}, nil
+}
+
+func (m *multi) virtualSlot(backend int, slotID uint) uint {
+	return uint(backend)<<backendShift | slotID
+}
+
+func (m *multi) splitSlot(slotID uint) (int, uint, error) {
+	backend := int(slotID >> backendShift)
+	if backend >= len(m.backends) {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+
+	return backend, slotID & (1<<backendShift - 1), nil
+}
+
+// owner returns the backend holding label, or the backend new labels like it
+// are routed to
+func (m *multi) owner(ctx context.Context, label string) int {
+	for i, b := range m.backends {
+		if b.ReplicaOf != "" {
+			continue
+		}
+
+		if _, err := b.HSM.LocateKey(ctx, label); err == nil {
+			return i
+		}
+	}
+
+	return m.route(label)
+}
+
+// route picks the backend for a new label
+func (m *multi) route(label string) int {
+	first := -1
+	for i, b := range m.backends {
+		if b.ReplicaOf != "" {
+			continue
+		}
+
+		for _, prefix := range b.LabelPrefixes {
+			if strings.HasPrefix(label, prefix) {
+				return i
+			}
+		}
+
+		if first < 0 {
+			first = i
+		}
+	}
+
+	return first
+}
+
+// checkDestroyed refuses a new label that belongs to a key destroyed on any
+// backend, routing it to another backend must not bring it back
+func (m *multi) checkDestroyed(ctx context.Context, label KeyID) error {
+	if label == "" {
+		return nil
+	}
+
+	destroyed, err := m.KeyDestroyed(ctx, string(label))
+	if err != nil {
+		return err
+	}
+
+	if destroyed {
+		return fmt.Errorf("key with label %s was destroyed and can not be reused", label)
+	}
+
+	return nil
+}
+
+// readers lists the backend holding label followed by its replicas
+func (m *multi) readers(ctx context.Context, label string) []int {
+	owner := m.owner(ctx, label)
+	readers := []int{owner}
+	for i, b := range m.backends {
+		if b.ReplicaOf == m.backends[owner].Name {
+			readers = append(readers, i)
+		}
+	}
+
+	return readers
+}
+
+// read runs fn against the backend holding label, and against its replicas
+// while the backends before them are not connected
+func (m *multi) read(ctx context.Context, label string, fn func(i int, h HSM) error) error {
+	var err error
+	for _, i := range m.readers(ctx, label) {
+		h := m.backends[i].HSM
+		if h.Status().State != StateConnected {
+			err = fmt.Errorf("hsm backend %s: %w", m.backends[i].Name, ErrNotConnected)
+			continue
+		}
+
+		if err = fn(i, h); err == nil || (!errors.Is(err, ErrNotConnected) && !isModuleFatal(err)) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (m *multi) open(backend int, sess *pkcs11.SessionHandle) pkcs11.SessionHandle {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	handle := m.nextSession
+	m.nextSession++
+	m.sessions[handle] = backendSession{backend, sess}
+
+	return handle
+}
+
+func (m *multi) session(sess pkcs11.SessionHandle) (HSM, pkcs11.SessionHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[sess]
+	if !ok {
+		return nil, 0, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+
+	return m.backends[s.backend].HSM, *s.sess, nil
+}
+
+func (m *multi) NewSlotSession(ctx context.Context, name string) (*pkcs11.SessionHandle, error) {
+	i := m.owner(ctx, name)
+	sess, err := m.backends[i].HSM.NewSlotSession(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := m.open(i, sess)
+	return &handle, nil
+}
+
+// NewReadOnlySlotSession fails over to replicas of the backend holding name
+func (m *multi) NewReadOnlySlotSession(ctx context.Context, name string) (*pkcs11.SessionHandle, error) {
+	var handle pkcs11.SessionHandle
+	err := m.read(ctx, name, func(i int, h HSM) error {
+		sess, err := h.NewReadOnlySlotSession(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		handle = m.open(i, sess)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &handle, nil
+}
+
+func (m *multi) EndSession(sess *pkcs11.SessionHandle) error {
+	m.mu.Lock()
+	s, ok := m.sessions[*sess]
+	delete(m.sessions, *sess)
+	m.mu.Unlock()
+
+	if !ok {
+		return pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+
+	return m.backends[s.backend].HSM.EndSession(s.sess)
+}
+
+func (m *multi) NewSession(ctx context.Context, slotID uint) (pkcs11.SessionHandle, error) {
+	i, slot, err := m.splitSlot(slotID)
+	if err != nil {
+		return 0, err
+	}
+
+	sess, err := m.backends[i].HSM.NewSession(ctx, slot)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.open(i, &sess), nil
+}
+
+// GetSlotID fails over to replicas of the backend holding label
+func (m *multi) GetSlotID(ctx context.Context, label string) (slotID uint, err error) {
+	err = m.read(ctx, label, func(i int, h HSM) error {
+		slot, err := h.GetSlotID(ctx, label)
+		slotID = m.virtualSlot(i, slot)
+		return err
+	})
+
+	return slotID, err
+}
+
+// LocateKey fails over to replicas of the backend holding label
+func (m *multi) LocateKey(ctx context.Context, label string) (loc KeyLocation, err error) {
+	err = m.read(ctx, label, func(i int, h HSM) error {
+		loc, err = h.LocateKey(ctx, label)
+		return err
+	})
+
+	return loc, err
+}
+
+// KeyLabels lists the keys of every backend, replicas hold the same keys as
+// their primary and are skipped
+func (m *multi) KeyLabels(ctx context.Context) ([]string, error) {
+	var labels []string
+	for _, b := range m.backends {
+		if b.ReplicaOf != "" {
+			continue
+		}
+
+		found, err := b.HSM.KeyLabels(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("hsm backend %s: %w", b.Name, err)
+		}
+
+		labels = append(labels, found...)
+	}
+
+	sort.Strings(labels)
+	return labels, nil
+}
+
+// KeyDestroyed checks every backend, replicas included
+func (m *multi) KeyDestroyed(ctx context.Context, label string) (bool, error) {
+	for _, b := range m.backends {
+		destroyed, err := b.HSM.KeyDestroyed(ctx, label)
+		if err != nil {
+			return false, fmt.Errorf("hsm backend %s: %w", b.Name, err)
+		}
+
+		if destroyed {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *multi) NewSlot(ctx context.Context, name string) (uint, error) {
+	for _, b := range m.backends {
+		if b.ReplicaOf != "" {
+			continue
+		}
+
+		if _, err := b.HSM.GetSlotID(ctx, name); err == nil {
+			return 0, fmt.Errorf("token with label %s already exists on hsm backend %s", name, b.Name)
+		}
+	}
+
+	if err := m.checkDestroyed(ctx, KeyID(name)); err != nil {
+		return 0, err
+	}
+
+	i := m.route(name)
+	slotID, err := m.backends[i].HSM.NewSlot(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.virtualSlot(i, slotID), nil
+}
+
+func (m *multi) DiscardSlot(ctx context.Context, name string) error {
+	return m.backends[m.owner(ctx, name)].HSM.DiscardSlot(ctx, name)
+}
+
+func (m *multi) Orphans(ctx context.Context) ([]Orphan, error) {
+	var orphans []Orphan
+	for i, b := range m.backends {
+		found, err := b.HSM.Orphans(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("hsm backend %s: %w", b.Name, err)
+		}
+
+		for _, orphan := range found {
+			orphan.SlotID = m.virtualSlot(i, orphan.SlotID)
+			orphans = append(orphans, orphan)
+		}
+	}
+
+	return orphans, nil
+}
+
+// Refresh refreshes every backend. A failing backend does not stop the
+// others, its error is returned once all of them ran.
+func (m *multi) Refresh(ctx context.Context) (IndexReport, error) {
+	merged := IndexReport{
+		Renamed:    make(map[string]string),
+		Duplicates: make(map[string][]uint),
+	}
+
+	var errs []string
+	for i, b := range m.backends {
+		report, err := b.HSM.Refresh(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("hsm backend %s: %v", b.Name, err))
+			continue
+		}
+
+		merged.Added = append(merged.Added, report.Added...)
+		merged.Removed = append(merged.Removed, report.Removed...)
+		for old, label := range report.Renamed {
+			merged.Renamed[old] = label
+		}
+
+		for label, slots := range report.Duplicates {
+			for _, slot := range slots {
+				merged.Duplicates[label] = append(merged.Duplicates[label], m.virtualSlot(i, slot))
+			}
+		}
+
+		for _, slot := range report.RemovedSlots {
+			merged.RemovedSlots = append(merged.RemovedSlots, m.virtualSlot(i, slot))
+		}
+	}
+
+	if len(errs) > 0 {
+		return merged, errors.New(strings.Join(errs, "; "))
+	}
+
+	return merged, nil
+}
+
+func (m *multi) Close() error {
+	var errs []string
+	for _, b := range m.backends {
+		if err := b.HSM.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("hsm backend %s: %v", b.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Status is the worst state of the backends that are no replica, a replica
+// that is down only shows in Backends
+func (m *multi) Status() ConnectionStatus {
+	rank := map[ConnectionState]int{StateConnected: 0, StateReconnecting: 1, StateDisconnected: 2}
+
+	var status ConnectionStatus
+	backends := make(map[string]ConnectionStatus, len(m.backends))
+	reconnects := 0
+	for _, b := range m.backends {
+		s := b.HSM.Status()
+		backends[b.Name] = s
+		reconnects += s.Reconnects
+
+		if b.ReplicaOf != "" {
+			continue
+		}
+
+		if status.State == "" || rank[s.State] > rank[status.State] {
+			status = s
+			if s.LastError != "" {
+				status.LastError = fmt.Sprintf("%s: %s", b.Name, s.LastError)
+			}
+		}
+	}
+
+	status.Backends = backends
+	status.Reconnects = reconnects
+	return status
+}
+
+func (m *multi) GetPublicKey(ctx context.Context, session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ecdsa.PublicKey, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return ecdsa.PublicKey{}, err
+	}
+
+	return h.GetPublicKey(ctx, sess, pubKeyHandle)
+}
+
+func (m *multi) PublicKeyHandle(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.PublicKeyHandle(ctx, sess, key)
+}
+
+func (m *multi) PrivateKeyHandle(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.PrivateKeyHandle(ctx, sess, key)
+}
+
+func (m *multi) GenerateKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := m.checkDestroyed(ctx, key); err != nil {
+		return 0, 0, err
+	}
+
+	return h.GenerateKeyECDSA_secp256k1(ctx, sess, key)
+}
+
+func (m *multi) SignECDSA_secp256k1(ctx context.Context, msg []byte, session pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.SignECDSA_secp256k1(ctx, msg, sess, privKey)
+}
+
+func (m *multi) ReleaseHandle(ctx context.Context, session pkcs11.SessionHandle) error {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return err
+	}
+
+	return h.ReleaseHandle(ctx, sess)
+}
+
+func (m *multi) WrappingPublicKey(ctx context.Context, session pkcs11.SessionHandle) (*rsa.PublicKey, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.WrappingPublicKey(ctx, sess)
+}
+
+func (m *multi) UnwrapKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, mech WrapMechanism, kek KeyID, wrapped []byte, key KeyID) (pkcs11.ObjectHandle, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := m.checkDestroyed(ctx, key); err != nil {
+		return 0, err
+	}
+
+	return h.UnwrapKeyECDSA_secp256k1(ctx, sess, mech, kek, wrapped, key)
+}
+
+func (m *multi) CreatePublicKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, pub ecdsa.PublicKey, key KeyID) (pkcs11.ObjectHandle, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := m.checkDestroyed(ctx, key); err != nil {
+		return 0, err
+	}
+
+	return h.CreatePublicKeyECDSA_secp256k1(ctx, sess, pub, key)
+}
+
+func (m *multi) DestroyObject(ctx context.Context, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) error {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return err
+	}
+
+	return h.DestroyObject(ctx, sess, obj)
+}
+
+func (m *multi) WrapKeyECDSA_secp256k1(ctx context.Context, session pkcs11.SessionHandle, kek KeyID, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.WrapKeyECDSA_secp256k1(ctx, sess, kek, privKey)
+}
+
+func (m *multi) KeyCurve(ctx context.Context, session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) (Curve, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return "", err
+	}
+
+	return h.KeyCurve(ctx, sess, obj)
+}
+
+func (m *multi) GenerateKeyEdDSA_ed25519(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := m.checkDestroyed(ctx, key); err != nil {
+		return 0, 0, err
+	}
+
+	return h.GenerateKeyEdDSA_ed25519(ctx, sess, key)
+}
+
+func (m *multi) GetPublicKeyEdDSA_ed25519(ctx context.Context, session pkcs11.SessionHandle, pubKeyHandle pkcs11.ObjectHandle) (ed25519.PublicKey, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.GetPublicKeyEdDSA_ed25519(ctx, sess, pubKeyHandle)
+}
+
+func (m *multi) SignEdDSA_ed25519(ctx context.Context, msg []byte, session pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.SignEdDSA_ed25519(ctx, msg, sess, privKey)
+}
+
+func (m *multi) GenerateKeyECDSA_P256(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := m.checkDestroyed(ctx, key); err != nil {
+		return 0, 0, err
+	}
+
+	return h.GenerateKeyECDSA_P256(ctx, sess, key)
+}
+
+func (m *multi) SignECDSA_P256(ctx context.Context, msg []byte, session pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.SignECDSA_P256(ctx, msg, sess, privKey)
+}
+
+func (m *multi) SignDigestECDSA_P256(ctx context.Context, digest []byte, session pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.SignDigestECDSA_P256(ctx, digest, sess, privKey)
+}
+
+func (m *multi) RetireKey(ctx context.Context, session pkcs11.SessionHandle, key KeyID) error {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return err
+	}
+
+	return h.RetireKey(ctx, sess, key)
+}
+
+func (m *multi) KeyRetiredAt(ctx context.Context, session pkcs11.SessionHandle, key KeyID) (time.Time, bool, error) {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	return h.KeyRetiredAt(ctx, sess, key)
+}
+
+func (m *multi) DestroyKey(ctx context.Context, session pkcs11.SessionHandle, key KeyID) error {
+	h, sess, err := m.session(session)
+	if err != nil {
+		return err
+	}
+
+	return h.DestroyKey(ctx, sess, key)
+}
+
+// withRotationState adds WithRotationState for backend to opts when c keeps
+// PIN rotations on disk
+func withRotationState(c config.Config, backend string, opts []Option) ([]Option, error) {
+	path := c.RotationStatePath(backend)
+	if path == "" {
+		return opts, nil
+	}
+
+	passphrase, err := c.Passphrase()
+	if err != nil {
+		return nil, fmt.Errorf("rotation state: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	return append(append([]Option(nil), opts...), WithRotationState(path, passphrase)), nil
+}
+
+// NewHSMFromConfig loads the module at c.HSMLibPath, or every module of
+// c.Backends behind a multi backend HSM. opts apply to every module.
+func NewHSMFromConfig(c config.Config, opts ...Option) (HSM, error) {
+	if len(c.Backends) == 0 {
+		creds, err := c.CredentialProvider("")
+		if err != nil {
+			return nil, err
+		}
+
+		opts, err = withRotationState(c, "", opts)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewHSM(c.HSMLibPath, creds, opts...)
+	}
+
+	backends := make([]Backend, 0, len(c.Backends))
+	for _, b := range c.Backends {
+		creds, err := c.CredentialProvider(b.Name)
+		if err != nil {
+			closeBackends(backends)
+			return nil, fmt.Errorf("hsm backend %s: %w", b.Name, err)
+		}
+
+		backendOpts, err := withRotationState(c, b.Name, opts)
+		if err != nil {
+			closeBackends(backends)
+			return nil, fmt.Errorf("hsm backend %s: %w", b.Name, err)
+		}
+
+		h, err := NewHSM(b.HSMLibPath, creds, backendOpts...)
+		if err != nil {
+			closeBackends(backends)
+			return nil, fmt.Errorf("hsm backend %s: %w", b.Name, err)
+		}
+
+		backends = append(backends, Backend{
+			Name:          b.Name,
+			HSM:           h,
+			LabelPrefixes: b.LabelPrefixes,
+			ReplicaOf:     b.ReplicaOf,
+		})
+	}
+
+	h, err := NewMultiHSM(backends...)
+	if err != nil {
+		closeBackends(backends)
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// closeBackends closes the backends built before setting up another one
+// failed, so their modules are finalized and their background work stops
+func closeBackends(backends []Backend) {
+	for _, b := range backends {
+		if err := b.HSM.Close(); err != nil {
+			fmt.Println("hsm: failed to close backend ", b.Name, " ", err)
+		}
+	}
+}
+
+// Info reports every backend under Backends and lists the tokens of all of
+// them with slot IDs of the multi backend HSM. The first backend missing
+// required mechanisms fails it.
+func (m *multi) Info(ctx context.Context) (InfoReport, error) {
+	report := InfoReport{
+		Tokens:   []TokenReport{},
+		Backends: make(map[string]InfoReport, len(m.backends)),
+	}
+
+	var missing error
+	for i, b := range m.backends {
+		r, err := b.HSM.Info(ctx)
+		var missingErr *MissingMechanismsError
+		if err != nil && !errors.As(err, &missingErr) {
+			return report, fmt.Errorf("hsm backend %s: %w", b.Name, err)
+		}
+
+		if err != nil && missing == nil {
+			missing = fmt.Errorf("hsm backend %s: %w", b.Name, err)
+		}
+
+		report.Backends[b.Name] = r
+		for _, t := range r.Tokens {
+			t.SlotID = m.virtualSlot(i, t.SlotID)
+			report.Tokens = append(report.Tokens, t)
+		}
+	}
+
+	return report, missing
+}
+
+// RotatePIN rotates the PIN of role to next on every backend, replicas
+// included, one backend after the other. A backend that can not start does
+// not stop the others, its error is returned once all of them ran.
+func (m *multi) RotatePIN(ctx context.Context, role config.Role, next config.Credential) (PINRotation, error) {
+	var (
+		errs     []string
+		conflict bool
+	)
+	for _, b := range m.backends {
+		if _, err := b.HSM.RotatePIN(ctx, role, next); err != nil {
+			errs = append(errs, fmt.Sprintf("hsm backend %s: %v", b.Name, err))
+			conflict = conflict || errors.Is(err, ErrRotationConflict)
+		}
+	}
+
+	report, _ := m.PINRotation()
+	switch {
+	case conflict:
+		return report, fmt.Errorf("%w: %s", ErrRotationConflict, strings.Join(errs, "; "))
+	case len(errs) > 0:
+		return report, errors.New(strings.Join(errs, "; "))
+	}
+
+	return report, nil
+}
+
+// PINRotation merges the last rotation of every backend and reports each
+// under Backends. The merged state is the least advanced one.
+func (m *multi) PINRotation() (PINRotation, bool) {
+	rank := map[RotationState]int{RotationComplete: 0, RotationIncomplete: 1, RotationRunning: 2}
+
+	merged := PINRotation{
+		Rotated:  []string{},
+		Pending:  []string{},
+		Failed:   make(map[string]string),
+		Backends: make(map[string]PINRotation, len(m.backends)),
+	}
+
+	found := false
+	for _, b := range m.backends {
+		r, ok := b.HSM.PINRotation()
+		if !ok {
+			continue
+		}
+
+		if !found || rank[r.State] > rank[merged.State] {
+			merged.Role = r.Role
+			merged.State = r.State
+		}
+
+		if !found || r.StartedAt.Before(merged.StartedAt) {
+			merged.StartedAt = r.StartedAt
+		}
+
+		if r.UpdatedAt.After(merged.UpdatedAt) {
+			merged.UpdatedAt = r.UpdatedAt
+		}
+
+		found = true
+		merged.Backends[b.Name] = r
+		merged.Rotated = append(merged.Rotated, r.Rotated...)
+		merged.Pending = append(merged.Pending, r.Pending...)
+		for label, reason := range r.Failed {
+			merged.Failed[label] = reason
+		}
+	}
+
+	return merged, found
+}
@@ -0,0 +1,49 @@
+package hsm
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// generateKeyECDSA_P256 generates a NIST P-256 key pair on the session's
+// token. GetPublicKey returns its public key like for secp256k1 keys.
+func (h *hsm) generateKeyECDSA_P256(session pkcs11.SessionHandle, key KeyID) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	return h.generateKeyPair(session, CurveP256, key)
+}
+
+// signECDSA_P256 hashes msg with SHA-256 and signs the digest, which is what
+// ES256, TLS and X.509 expect. Hashing happens here and the token only sees
+// CKM_ECDSA, as not every token implements CKM_ECDSA_SHA256. The signature
+// is returned as a DER encoded ECDSA-Sig-Value.
+func (h *hsm) signECDSA_P256(msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	return h.signDigestECDSA_P256(digest[:], sess, privKey)
+}
+
+// signDigestECDSA_P256 signs a digest the caller computed, for callers that
+// hash on their own like crypto.Signer consumers
+func (h *hsm) signDigestECDSA_P256(digest []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	raw, err := h.Sign(sess, privKey, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalDERSignature(raw)
+}
+
+// marshalDERSignature turns whatever format C_Sign returned into a DER
+// encoded ECDSA-Sig-Value
+func marshalDERSignature(raw []byte) ([]byte, error) {
+	sig, err := CanonicalSignature(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ecdsaSignature{
+		R: new(big.Int).SetBytes(sig[:signatureComponentLen]),
+		S: new(big.Int).SetBytes(sig[signatureComponentLen:]),
+	})
+}
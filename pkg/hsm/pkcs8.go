@@ -0,0 +1,94 @@
+package hsm
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// http://oid-info.com/get/1.2.840.10045.2.1
+var oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+
+// pkcs8 is the PrivateKeyInfo structure from RFC 5208
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// ecPrivateKey is the ECPrivateKey structure from RFC 5915
+type ecPrivateKey struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+// MarshalPKCS8Secp256k1 encodes a secp256k1 private key as PKCS#8, which is
+// the format C_UnwrapKey expects wrapped private keys in. x509 does not
+// support secp256k1, hence the hand rolled encoding.
+func MarshalPKCS8Secp256k1(priv *ecdsa.PrivateKey) ([]byte, error) {
+	oid, err := secp256k1OID()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := asn1.Marshal(ecPrivateKey{
+		Version:    1,
+		PrivateKey: crypto.FromECDSA(priv),
+		PublicKey: asn1.BitString{
+			Bytes:     crypto.FromECDSAPub(&priv.PublicKey),
+			BitLength: 8 * len(crypto.FromECDSAPub(&priv.PublicKey)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pkcs8{
+		Algo: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPublicKeyECDSA,
+			Parameters: asn1.RawValue{FullBytes: oid},
+		},
+		PrivateKey: key,
+	})
+}
+
+// ParsePKCS8Secp256k1 decodes a PKCS#8 encoded secp256k1 private key
+func ParsePKCS8Secp256k1(der []byte) (*ecdsa.PrivateKey, error) {
+	var info pkcs8
+	rest, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) > 0 {
+		return nil, errors.New("unexpected data found after PKCS#8 private key")
+	}
+
+	if !info.Algo.Algorithm.Equal(oidPublicKeyECDSA) {
+		return nil, errors.New("PKCS#8 private key is not an elliptic curve key")
+	}
+
+	if _, err := unmarshalEcParams(info.Algo.Parameters.FullBytes); err != nil {
+		return nil, err
+	}
+
+	var key ecPrivateKey
+	if _, err := asn1.Unmarshal(info.PrivateKey, &key); err != nil {
+		return nil, err
+	}
+
+	if len(key.PrivateKey) > 32 {
+		return nil, errors.New("secp256k1 private key is longer than 32 bytes")
+	}
+
+	d := make([]byte, 32)
+	new(big.Int).SetBytes(key.PrivateKey).FillBytes(d)
+
+	return crypto.ToECDSA(d)
+}
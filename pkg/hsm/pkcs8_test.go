@@ -0,0 +1,31 @@
+package hsm
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/suite"
+)
+
+type PKCS8Suite struct {
+	suite.Suite
+}
+
+func TestPKCS8Suite(t *testing.T) {
+	suite.Run(t, new(PKCS8Suite))
+}
+
+func (s *PKCS8Suite) TestRoundTrip() {
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+
+	der, err := MarshalPKCS8Secp256k1(key)
+	s.NoError(err)
+
+	parsed, err := ParsePKCS8Secp256k1(der)
+	s.NoError(err)
+	s.Equal(crypto.FromECDSA(key), crypto.FromECDSA(parsed))
+
+	_, err = ParsePKCS8Secp256k1(append(der, 0))
+	s.Error(err)
+}
@@ -0,0 +1,432 @@
+package hsm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// defaultMaxIdleSessions is the number of sessions kept warm per slot and mode
+const defaultMaxIdleSessions = 8
+
+// sessionModule is the part of the PKCS#11 module the pool uses
+type sessionModule interface {
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(sh pkcs11.SessionHandle) error
+	Login(sh pkcs11.SessionHandle, userType uint, pin string) error
+}
+
+type poolKey struct {
+	slotID   uint
+	readOnly bool
+}
+
+// sessionPool keeps logged in sessions open per slot so requests can borrow
+// them instead of paying for C_OpenSession and C_Login every time.
+type sessionPool struct {
+	ctx     sessionModule
+	pin     func(slotID uint) (string, error)
+	maxIdle int
+	// relogin, when set, gets a session whose token refused the PIN
+	relogin func(sess pkcs11.SessionHandle, slotID uint, refused string) error
+
+	mu     sync.Mutex
+	idle   map[poolKey][]pkcs11.SessionHandle
+	inUse  map[pkcs11.SessionHandle]poolKey
+	broken map[pkcs11.SessionHandle]bool
+	// holders maps the handle every borrower was given to the generation it
+	// was borrowed in. reset starts a new generation, the new connection
+	// may hand the same handle numbers to other borrowers, so holders of
+	// older generations must not release them.
+	holders map[*pkcs11.SessionHandle]uint64
+	gen     uint64
+	// running holds the sessions a call runs on, including abandoned calls.
+	// Sessions must not be used from two threads at once, so calls on the
+	// same session wait for each other on callDone.
+	running  map[pkcs11.SessionHandle]bool
+	callDone *sync.Cond
+	// closing holds sessions given back while a call still runs on them,
+	// they are closed when the call returns
+	closing map[pkcs11.SessionHandle]bool
+	// paused holds slots that hand out no sessions, borrowers wait on
+	// callDone until the slot is resumed. opening counts the sessions being
+	// opened per slot, they are not borrowed yet.
+	paused  map[uint]bool
+	opening map[uint]int
+}
+
+func newSessionPool(ctx sessionModule, pin func(slotID uint) (string, error), maxIdle int) *sessionPool {
+	p := &sessionPool{
+		ctx:     ctx,
+		pin:     pin,
+		maxIdle: maxIdle,
+		idle:    make(map[poolKey][]pkcs11.SessionHandle),
+		inUse:   make(map[pkcs11.SessionHandle]poolKey),
+		broken:  make(map[pkcs11.SessionHandle]bool),
+		holders: make(map[*pkcs11.SessionHandle]uint64),
+		running: make(map[pkcs11.SessionHandle]bool),
+		closing: make(map[pkcs11.SessionHandle]bool),
+		paused:  make(map[uint]bool),
+		opening: make(map[uint]int),
+	}
+	p.callDone = sync.NewCond(&p.mu)
+
+	return p
+}
+
+// borrow hands out an idle logged in session for the slot, opening a new one
+// when none is available. Borrowed sessions must be given back with release,
+// passing the pointer borrow returned.
+func (p *sessionPool) borrow(slotID uint, readOnly bool) (*pkcs11.SessionHandle, error) {
+	key := poolKey{slotID, readOnly}
+
+	p.mu.Lock()
+	for p.paused[slotID] {
+		p.callDone.Wait()
+	}
+
+	if idle := p.idle[key]; len(idle) > 0 {
+		sess := idle[len(idle)-1]
+		p.idle[key] = idle[:len(idle)-1]
+		p.inUse[sess] = key
+		holder := p.hold(sess)
+		p.mu.Unlock()
+		return holder, nil
+	}
+	p.opening[slotID]++
+	p.mu.Unlock()
+
+	sess, err := p.open(key)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.opening[slotID]--
+	if err != nil {
+		return nil, err
+	}
+
+	p.inUse[sess] = key
+
+	return p.hold(sess), nil
+}
+
+// hold records a borrower of sess in the current generation. Callers hold
+// p.mu.
+func (p *sessionPool) hold(sess pkcs11.SessionHandle) *pkcs11.SessionHandle {
+	holder := new(pkcs11.SessionHandle)
+	*holder = sess
+	p.holders[holder] = p.gen
+
+	return holder
+}
+
+func (p *sessionPool) open(key poolKey) (pkcs11.SessionHandle, error) {
+	flags := uint(pkcs11.CKF_SERIAL_SESSION)
+	if !key.readOnly {
+		flags |= pkcs11.CKF_RW_SESSION
+	}
+
+	sess, err := p.ctx.OpenSession(key.slotID, flags)
+	if err != nil {
+		return 0, err
+	}
+
+	// login state is shared by every session the application has open on a
+	// token, so any session after the first one is already logged in
+	pin, err := p.pin(key.slotID)
+	if err != nil {
+		p.ctx.CloseSession(sess)
+		return 0, err
+	}
+
+	err = p.ctx.Login(sess, pkcs11.CKU_USER, pin)
+	if isPKCS11Error(err, pkcs11.CKR_PIN_INCORRECT) && p.relogin != nil {
+		err = p.relogin(sess, key.slotID, pin)
+	}
+
+	if err != nil && !isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		p.ctx.CloseSession(sess)
+		return 0, err
+	}
+
+	return sess, nil
+}
+
+// owns reports whether holder was handed out by borrow and not released yet
+func (p *sessionPool) owns(holder *pkcs11.SessionHandle) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.holders[holder]
+	return ok
+}
+
+// release gives a borrowed session back. Broken sessions, and sessions that
+// would grow the pool past maxIdle, are closed instead of kept. Sessions
+// borrowed before reset are forgotten, their handle may belong to another
+// borrower by now.
+func (p *sessionPool) release(holder *pkcs11.SessionHandle) error {
+	p.mu.Lock()
+	gen, held := p.holders[holder]
+	delete(p.holders, holder)
+	if held && gen != p.gen {
+		p.mu.Unlock()
+		return nil
+	}
+
+	sess := *holder
+	key, ok := p.inUse[sess]
+	broken := p.broken[sess]
+	delete(p.inUse, sess)
+	delete(p.broken, sess)
+
+	if ok && !broken && !p.paused[key.slotID] && len(p.idle[key]) < p.maxIdle {
+		p.idle[key] = append(p.idle[key], sess)
+		p.mu.Unlock()
+		return nil
+	}
+
+	if p.running[sess] {
+		p.closing[sess] = true
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	err := p.ctx.CloseSession(sess)
+	if broken {
+		// the handle is already gone on the module side
+		return nil
+	}
+
+	return err
+}
+
+// observe evicts sessions when err shows they can no longer be used. Errors
+// that invalidate the whole token evict every idle session of the slot too.
+func (p *sessionPool) observe(sess pkcs11.SessionHandle, err error) {
+	if !isSessionFatal(err) {
+		return
+	}
+
+	p.mu.Lock()
+	key, ok := p.inUse[sess]
+	if ok {
+		p.broken[sess] = true
+	}
+	p.mu.Unlock()
+
+	if ok && isTokenFatal(err) {
+		p.evictSlot(key.slotID)
+	}
+}
+
+// begin waits until no other call runs on sess and records that one does
+func (p *sessionPool) begin(sess pkcs11.SessionHandle) {
+	if sess == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	for p.running[sess] {
+		p.callDone.Wait()
+	}
+	p.running[sess] = true
+	p.mu.Unlock()
+}
+
+// end records that the call on sess returned, and closes sess when it was
+// given back while the call was running
+func (p *sessionPool) end(sess pkcs11.SessionHandle) {
+	if sess == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	if !p.running[sess] {
+		// forgotten by reset, the handle belongs to the old connection
+		p.mu.Unlock()
+		return
+	}
+
+	delete(p.running, sess)
+	closing := p.closing[sess]
+	delete(p.closing, sess)
+	p.callDone.Broadcast()
+	p.mu.Unlock()
+
+	if closing {
+		p.ctx.CloseSession(sess)
+	}
+}
+
+// abandon marks sess broken because a call on it was given up while still
+// running. The module is busy with the session until the call returns, so
+// it must not be handed out again.
+func (p *sessionPool) abandon(sess pkcs11.SessionHandle) {
+	p.mu.Lock()
+	if _, ok := p.inUse[sess]; ok {
+		p.broken[sess] = true
+	}
+	p.mu.Unlock()
+}
+
+// closeWhenIdle defers closing a session that is not pooled until the calls
+// running on it return. It reports false when nothing runs on sess and the
+// caller has to close it.
+func (p *sessionPool) closeWhenIdle(sess pkcs11.SessionHandle) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.running[sess] {
+		return false
+	}
+
+	p.closing[sess] = true
+	return true
+}
+
+// evictSlot closes every idle session of the slot and marks borrowed ones as
+// broken so they are closed when they are released.
+func (p *sessionPool) evictSlot(slotID uint) {
+	p.mu.Lock()
+	for sess, key := range p.inUse {
+		if key.slotID == slotID {
+			p.broken[sess] = true
+		}
+	}
+	p.mu.Unlock()
+
+	p.closeIdle(slotID)
+}
+
+// closeIdle closes every idle session of the slot
+func (p *sessionPool) closeIdle(slotID uint) {
+	var stale []pkcs11.SessionHandle
+
+	p.mu.Lock()
+	for key, idle := range p.idle {
+		if key.slotID != slotID {
+			continue
+		}
+		stale = append(stale, idle...)
+		delete(p.idle, key)
+	}
+	p.mu.Unlock()
+
+	for _, sess := range stale {
+		p.ctx.CloseSession(sess)
+	}
+}
+
+// pause stops handing out sessions of the slot and closes them, so the
+// application is logged out of the token and can log in as another user.
+// Borrowed sessions are closed when they are released. It waits up to
+// timeout for them and reports false, resuming the slot, when they are not
+// released in time.
+func (p *sessionPool) pause(slotID uint, timeout time.Duration) bool {
+	p.mu.Lock()
+	p.paused[slotID] = true
+	p.mu.Unlock()
+
+	p.closeIdle(slotID)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		p.mu.Lock()
+		busy := p.opening[slotID] > 0
+		for _, key := range p.inUse {
+			busy = busy || key.slotID == slotID
+		}
+		p.mu.Unlock()
+
+		if !busy {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			p.resume(slotID)
+			return false
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// resume hands out sessions of a paused slot again
+func (p *sessionPool) resume(slotID uint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.paused, slotID)
+	p.callDone.Broadcast()
+}
+
+// close closes every idle session. Borrowed sessions are closed on release.
+func (p *sessionPool) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[poolKey][]pkcs11.SessionHandle)
+	for sess := range p.inUse {
+		p.broken[sess] = true
+	}
+	p.mu.Unlock()
+
+	for _, sessions := range idle {
+		for _, sess := range sessions {
+			p.ctx.CloseSession(sess)
+		}
+	}
+}
+
+// drain waits until every borrowed session is released, or timeout passes
+func (p *sessionPool) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		busy := len(p.inUse)
+		p.mu.Unlock()
+
+		if busy == 0 {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// reset forgets every session after the module was finalized. Nothing is
+// closed, the handles are already gone and may be handed out again by the
+// new connection.
+func (p *sessionPool) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.gen++
+	p.idle = make(map[poolKey][]pkcs11.SessionHandle)
+	p.inUse = make(map[pkcs11.SessionHandle]poolKey)
+	p.broken = make(map[pkcs11.SessionHandle]bool)
+	p.running = make(map[pkcs11.SessionHandle]bool)
+	p.closing = make(map[pkcs11.SessionHandle]bool)
+	p.callDone.Broadcast()
+}
+
+// isSessionFatal reports whether err leaves the session unusable
+func isSessionFatal(err error) bool {
+	return isPKCS11Error(err,
+		pkcs11.CKR_SESSION_HANDLE_INVALID,
+		pkcs11.CKR_SESSION_CLOSED,
+	) || isTokenFatal(err) || isModuleFatal(err)
+}
+
+// isTokenFatal reports whether err invalidates every session open on the token
+func isTokenFatal(err error) bool {
+	return isPKCS11Error(err,
+		pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_DEVICE_ERROR,
+		pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_USER_NOT_LOGGED_IN,
+	)
+}
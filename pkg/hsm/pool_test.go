@@ -0,0 +1,243 @@
+package hsm
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeModule opens sessions with increasing handles and records which ones
+// are open, and the flags they were opened with
+type fakeModule struct {
+	mu     sync.Mutex
+	next   pkcs11.SessionHandle
+	open   map[pkcs11.SessionHandle]uint
+	logins int
+	// refuse is a PIN Login fails with CKR_PIN_INCORRECT
+	refuse string
+}
+
+func newFakeModule() *fakeModule {
+	return &fakeModule{open: make(map[pkcs11.SessionHandle]uint)}
+}
+
+func (m *fakeModule) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.next++
+	m.open[m.next] = flags
+	return m.next, nil
+}
+
+func (m *fakeModule) CloseSession(sh pkcs11.SessionHandle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.open[sh]; !ok {
+		return pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	delete(m.open, sh)
+	return nil
+}
+
+func (m *fakeModule) Login(sh pkcs11.SessionHandle, userType uint, pin string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pin == m.refuse {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+
+	m.logins++
+	if m.logins > 1 {
+		return pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)
+	}
+	return nil
+}
+
+func (m *fakeModule) isOpen(sh pkcs11.SessionHandle) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.open[sh]
+	return ok
+}
+
+func (m *fakeModule) openCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.open)
+}
+
+type PoolSuite struct {
+	suite.Suite
+	module *fakeModule
+	pool   *sessionPool
+}
+
+func TestPoolSuite(t *testing.T) {
+	suite.Run(t, new(PoolSuite))
+}
+
+func (s *PoolSuite) SetupTest() {
+	s.module = newFakeModule()
+	s.pool = newSessionPool(s.module, func(uint) (string, error) { return "1234", nil }, 2)
+}
+
+func (s *PoolSuite) TestBorrowReusesReleasedSession() {
+	sess, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	s.True(s.pool.owns(sess))
+
+	s.NoError(s.pool.release(sess))
+	s.False(s.pool.owns(sess))
+	s.True(s.module.isOpen(*sess))
+
+	again, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	s.Equal(*sess, *again)
+	s.Equal(1, s.module.openCount())
+
+	// only the pointer borrow handed out is owned
+	handle := *again
+	s.False(s.pool.owns(&handle))
+}
+
+func (s *PoolSuite) TestReleaseClosesPastMaxIdle() {
+	var borrowed []*pkcs11.SessionHandle
+	for i := 0; i < 3; i++ {
+		sess, err := s.pool.borrow(1, false)
+		s.NoError(err)
+		borrowed = append(borrowed, sess)
+	}
+
+	for _, sess := range borrowed {
+		s.NoError(s.pool.release(sess))
+	}
+
+	s.Equal(2, s.module.openCount())
+	s.False(s.module.isOpen(*borrowed[2]))
+}
+
+func (s *PoolSuite) TestReadOnlyAndReadWriteAreKeptApart() {
+	ro, err := s.pool.borrow(1, true)
+	s.NoError(err)
+	s.NoError(s.pool.release(ro))
+
+	rw, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	s.NotEqual(*ro, *rw)
+	s.NotZero(s.module.open[*rw] & pkcs11.CKF_RW_SESSION)
+	s.Zero(s.module.open[*ro] & pkcs11.CKF_RW_SESSION)
+
+	again, err := s.pool.borrow(1, true)
+	s.NoError(err)
+	s.Equal(*ro, *again)
+}
+
+func (s *PoolSuite) TestInvalidHandleEvictsSession() {
+	sess, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	other, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	s.NoError(s.pool.release(other))
+
+	s.pool.observe(*sess, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID))
+	s.NoError(s.pool.release(sess))
+
+	// only the broken session is dropped
+	s.False(s.module.isOpen(*sess))
+	s.True(s.module.isOpen(*other))
+
+	again, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	s.Equal(*other, *again)
+}
+
+func (s *PoolSuite) TestDeviceRemovedEvictsSlot() {
+	sess, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	idle, err := s.pool.borrow(1, true)
+	s.NoError(err)
+	s.NoError(s.pool.release(idle))
+	otherSlot, err := s.pool.borrow(2, false)
+	s.NoError(err)
+	s.NoError(s.pool.release(otherSlot))
+
+	s.pool.observe(*sess, pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED))
+	s.False(s.module.isOpen(*idle))
+	s.True(s.module.isOpen(*sess))
+
+	s.NoError(s.pool.release(sess))
+	s.False(s.module.isOpen(*sess))
+	s.True(s.module.isOpen(*otherSlot))
+
+	fresh, err := s.pool.borrow(1, true)
+	s.NoError(err)
+	s.NotEqual(*idle, *fresh)
+}
+
+func (s *PoolSuite) TestUnrelatedErrorKeepsSession() {
+	sess, err := s.pool.borrow(1, false)
+	s.NoError(err)
+
+	s.pool.observe(*sess, pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID))
+	s.NoError(s.pool.release(sess))
+	s.True(s.module.isOpen(*sess))
+}
+
+func (s *PoolSuite) TestIncorrectPINFallsBackToRelogin() {
+	s.module.refuse = "1234"
+
+	var refused []string
+	s.pool.relogin = func(sess pkcs11.SessionHandle, slotID uint, pin string) error {
+		refused = append(refused, pin)
+		return s.module.Login(sess, pkcs11.CKU_USER, "5678")
+	}
+
+	sess, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	s.Equal([]string{"1234"}, refused)
+	s.True(s.module.isOpen(*sess))
+}
+
+func (s *PoolSuite) TestFailedReloginClosesSession() {
+	s.module.refuse = "1234"
+	s.pool.relogin = func(pkcs11.SessionHandle, uint, string) error {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+
+	_, err := s.pool.borrow(1, false)
+	s.True(isPKCS11Error(err, pkcs11.CKR_PIN_INCORRECT))
+	s.Equal(0, s.module.openCount())
+}
+
+func (s *PoolSuite) TestStaleHolderDoesNotReleaseReusedHandle() {
+	old, err := s.pool.borrow(1, false)
+	s.NoError(err)
+
+	// the module is initialized again and hands out the same handle number
+	s.pool.reset()
+	s.module = newFakeModule()
+	s.pool.ctx = s.module
+
+	current, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	s.Equal(*old, *current)
+
+	s.True(s.pool.owns(old))
+	s.NoError(s.pool.release(old))
+	s.True(s.pool.owns(current))
+	s.True(s.module.isOpen(*current))
+
+	s.NoError(s.pool.release(current))
+	s.True(s.module.isOpen(*current))
+
+	again, err := s.pool.borrow(1, false)
+	s.NoError(err)
+	s.Equal(*current, *again)
+}
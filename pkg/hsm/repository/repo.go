@@ -1,7 +1,322 @@
 package hsm_repo
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/hsm"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotFound is returned for labels and addresses the repository does not
+// know
+var ErrNotFound = errors.New("key not found in repository")
+
+// ErrDuplicateAddress is returned when creating a key whose address is
+// already recorded under another label
+var ErrDuplicateAddress = errors.New("address already recorded under another label")
+
+// State is where a key is in its lifecycle
+type State string
+
+const (
+	StateActive State = "active"
+	// StateRetired keys no longer sign, see eth_hsm.RetireAddress
+	StateRetired State = "retired"
+	// StateDestroyed keys are gone from the HSM, their label stays reserved
+	StateDestroyed State = "destroyed"
+)
+
+// Key is the metadata of a key. The key material stays in the HSM, which
+// remains the source of truth for it.
+type Key struct {
+	Label string `json:"label"`
+	// Address is the checksummed Ethereum address of secp256k1 keys
+	Address string    `json:"address,omitempty"`
+	Token   string    `json:"token"`
+	SlotID  uint      `json:"slotID"`
+	KeyID   hsm.KeyID `json:"keyID"`
+	Curve   hsm.Curve `json:"curve"`
+	// Creator is whoever asked for the key, empty for keys found in the HSM
+	// that were created before the repository
+	Creator   string    `json:"creator,omitempty"`
+	Tags      []string  `json:"tags"`
+	State     State     `json:"state"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// HasTag reports whether the key is tagged with tag
+func (k Key) HasTag(tag string) bool {
+	for _, t := range k.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter selects keys in List, zero fields match every key
+type Filter struct {
+	State State
+	Curve hsm.Curve
+	Tag   string
+}
+
+func (f Filter) matches(k Key) bool {
+	return (f.State == "" || k.State == f.State) &&
+		(f.Curve == "" || k.Curve == f.Curve) &&
+		(f.Tag == "" || k.HasTag(f.Tag))
+}
+
+// HSMRepo stores key metadata so lookups and listings are answered without
+// calling into the HSM
 type HSMRepo interface {
+	// Create records a new key, a label that is already recorded is a
+	// DuplicateLabel error
+	Create(k Key) error
+	Get(label string) (Key, error)
+	GetByAddress(address string) (Key, error)
+	// List returns the keys f matches ordered by label
+	List(f Filter) ([]Key, error)
+	SetState(label string, state State) error
+	SetTags(label string, tags []string) error
+	// Delete forgets a key, for creations that were rolled back
+	Delete(label string) error
+	Close() error
 }
 
+var (
+	keysBucket      = []byte("keys")
+	addressesBucket = []byte("addresses")
+)
+
 type repo struct {
+	db *bolt.DB
+}
+
+// NewBoltRepo opens, or creates, the bbolt database at path. Only one
+// process can have it open at a time.
+func NewBoltRepo(path string) (HSMRepo, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open key repository %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{keysBucket, addressesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &repo{db}, nil
+}
+
+// addressKey indexes addresses case insensitively
+func addressKey(address string) []byte {
+	return []byte(strings.ToLower(address))
+}
+
+func (r *repo) Create(k Key) error {
+	now := time.Now().UTC()
+	if k.CreatedAt.IsZero() {
+		k.CreatedAt = now
+	}
+	k.UpdatedAt = now
+
+	if k.State == "" {
+		k.State = StateActive
+	}
+
+	if k.Tags == nil {
+		k.Tags = []string{}
+	}
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(keysBucket)
+		if keys.Get([]byte(k.Label)) != nil {
+			return _err.NewDuplicateLabelErr(k.Label)
+		}
+
+		addresses := tx.Bucket(addressesBucket)
+		if k.Address != "" {
+			if label := addresses.Get(addressKey(k.Address)); label != nil {
+				return fmt.Errorf("%w: %s is recorded as %s", ErrDuplicateAddress, k.Address, label)
+			}
+		}
+
+		if err := put(keys, k); err != nil {
+			return err
+		}
+
+		if k.Address == "" {
+			return nil
+		}
+
+		return addresses.Put(addressKey(k.Address), []byte(k.Label))
+	})
+}
+
+func (r *repo) Get(label string) (k Key, err error) {
+	err = r.db.View(func(tx *bolt.Tx) error {
+		k, err = get(tx.Bucket(keysBucket), label)
+		return err
+	})
+
+	return k, err
+}
+
+func (r *repo) GetByAddress(address string) (k Key, err error) {
+	err = r.db.View(func(tx *bolt.Tx) error {
+		label := tx.Bucket(addressesBucket).Get(addressKey(address))
+		if label == nil {
+			return ErrNotFound
+		}
+
+		k, err = get(tx.Bucket(keysBucket), string(label))
+		return err
+	})
+
+	return k, err
+}
+
+func (r *repo) List(f Filter) ([]Key, error) {
+	keys := []Key{}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		// bbolt iterates in key order, which is label order
+		return tx.Bucket(keysBucket).ForEach(func(_, v []byte) error {
+			var k Key
+			if err := json.Unmarshal(v, &k); err != nil {
+				return err
+			}
+
+			if f.matches(k) {
+				keys = append(keys, k)
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (r *repo) SetState(label string, state State) error {
+	return r.update(label, func(k *Key) {
+		k.State = state
+	})
+}
+
+func (r *repo) SetTags(label string, tags []string) error {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+
+	return r.update(label, func(k *Key) {
+		k.Tags = sorted
+	})
+}
+
+func (r *repo) update(label string, fn func(k *Key)) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(keysBucket)
+		k, err := get(keys, label)
+		if err != nil {
+			return err
+		}
+
+		fn(&k)
+		k.UpdatedAt = time.Now().UTC()
+		return put(keys, k)
+	})
+}
+
+func (r *repo) Delete(label string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(keysBucket)
+		k, err := get(keys, label)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		addresses := tx.Bucket(addressesBucket)
+		if k.Address != "" && string(addresses.Get(addressKey(k.Address))) == label {
+			if err := addresses.Delete(addressKey(k.Address)); err != nil {
+				return err
+			}
+		}
+
+		return keys.Delete([]byte(label))
+	})
+}
+
+func (r *repo) Close() error {
+	return r.db.Close()
+}
+
+func get(keys *bolt.Bucket, label string) (k Key, err error) {
+	v := keys.Get([]byte(label))
+	if v == nil {
+		return k, ErrNotFound
+	}
+
+	err = json.Unmarshal(v, &k)
+	return k, err
+}
+
+func put(keys *bolt.Bucket, k Key) error {
+	v, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	return keys.Put([]byte(k.Label), v)
+}
+
+// Locate returns the metadata the HSM knows of the key labeled label, the
+// token, slot and key identifier it is stored under. Keys addressed by the
+// label of their token have no key identifier and are not recorded.
+func Locate(ctx context.Context, h hsm.HSM, label string) (k Key, err error) {
+	loc, err := h.LocateKey(ctx, label)
+	if err != nil {
+		return k, err
+	}
+
+	if loc.Key == "" {
+		return k, fmt.Errorf("key %s is addressed by its token label, it has no key identifier", label)
+	}
+
+	slotID, err := h.GetSlotID(ctx, loc.Token)
+	if err != nil {
+		return k, err
+	}
+
+	return Key{
+		Label:  label,
+		Token:  loc.Token,
+		SlotID: slotID,
+		KeyID:  loc.Key,
+		State:  StateActive,
+	}, nil
 }
@@ -0,0 +1,149 @@
+package hsm_repo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/hsm"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RepoSuite struct {
+	suite.Suite
+	dir  string
+	repo HSMRepo
+}
+
+func TestRepoSuite(t *testing.T) {
+	suite.Run(t, new(RepoSuite))
+}
+
+func (s *RepoSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "hsm_repo")
+	s.NoError(err)
+	s.dir = dir
+
+	s.repo, err = NewBoltRepo(filepath.Join(dir, "keys.db"))
+	s.NoError(err)
+}
+
+func (s *RepoSuite) TearDownTest() {
+	s.repo.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *RepoSuite) TestCreateAndGet() {
+	err := s.repo.Create(Key{
+		Label:   "repo_key",
+		Address: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		Token:   "repo_key",
+		SlotID:  3,
+		KeyID:   hsm.KeyID("01"),
+		Curve:   hsm.CurveSecp256k1,
+		Creator: "alice",
+	})
+	s.NoError(err)
+
+	k, err := s.repo.Get("repo_key")
+	s.NoError(err)
+	s.Equal(uint(3), k.SlotID)
+	s.Equal(StateActive, k.State)
+	s.Equal("alice", k.Creator)
+	s.Equal([]string{}, k.Tags)
+	s.False(k.CreatedAt.IsZero())
+
+	err = s.repo.Create(Key{Label: "repo_key"})
+	s.IsType(_err.DuplicateLabel{}, err)
+
+	_, err = s.repo.Get("unknown")
+	s.ErrorIs(err, ErrNotFound)
+}
+
+func (s *RepoSuite) TestGetByAddress() {
+	s.NoError(s.repo.Create(Key{Label: "repo_address", Address: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"}))
+
+	k, err := s.repo.GetByAddress("0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed")
+	s.NoError(err)
+	s.Equal("repo_address", k.Label)
+
+	s.NoError(s.repo.Delete("repo_address"))
+	_, err = s.repo.GetByAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+	s.ErrorIs(err, ErrNotFound)
+	s.NoError(s.repo.Delete("repo_address"))
+}
+
+func (s *RepoSuite) TestCreateRefusesRecordedAddress() {
+	s.NoError(s.repo.Create(Key{Label: "first", Address: "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"}))
+
+	err := s.repo.Create(Key{Label: "second", Address: "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"})
+	s.ErrorIs(err, ErrDuplicateAddress)
+
+	_, err = s.repo.Get("second")
+	s.ErrorIs(err, ErrNotFound)
+
+	k, err := s.repo.GetByAddress("0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+	s.NoError(err)
+	s.Equal("first", k.Label)
+}
+
+func (s *RepoSuite) TestListFilters() {
+	s.NoError(s.repo.Create(Key{Label: "b", Curve: hsm.CurveSecp256k1, Tags: []string{"hot"}}))
+	s.NoError(s.repo.Create(Key{Label: "a", Curve: hsm.CurveSecp256k1}))
+	s.NoError(s.repo.Create(Key{Label: "c", Curve: hsm.CurveP256, State: StateRetired}))
+
+	keys, err := s.repo.List(Filter{})
+	s.NoError(err)
+	s.Equal([]string{"a", "b", "c"}, labels(keys))
+
+	keys, err = s.repo.List(Filter{Curve: hsm.CurveSecp256k1})
+	s.NoError(err)
+	s.Equal([]string{"a", "b"}, labels(keys))
+
+	keys, err = s.repo.List(Filter{Tag: "hot"})
+	s.NoError(err)
+	s.Equal([]string{"b"}, labels(keys))
+
+	keys, err = s.repo.List(Filter{State: StateRetired})
+	s.NoError(err)
+	s.Equal([]string{"c"}, labels(keys))
+}
+
+func (s *RepoSuite) TestSetStateAndTags() {
+	s.NoError(s.repo.Create(Key{Label: "repo_state"}))
+
+	s.NoError(s.repo.SetState("repo_state", StateRetired))
+	s.NoError(s.repo.SetTags("repo_state", []string{"cold", "audit"}))
+
+	k, err := s.repo.Get("repo_state")
+	s.NoError(err)
+	s.Equal(StateRetired, k.State)
+	s.Equal([]string{"audit", "cold"}, k.Tags)
+	s.True(k.UpdatedAt.After(k.CreatedAt) || k.UpdatedAt.Equal(k.CreatedAt))
+
+	s.ErrorIs(s.repo.SetState("unknown", StateRetired), ErrNotFound)
+}
+
+func (s *RepoSuite) TestPersists() {
+	s.NoError(s.repo.Create(Key{Label: "repo_persist"}))
+	s.NoError(s.repo.Close())
+
+	var err error
+	s.repo, err = NewBoltRepo(filepath.Join(s.dir, "keys.db"))
+	s.NoError(err)
+
+	_, err = s.repo.Get("repo_persist")
+	s.NoError(err)
+}
+
+func labels(keys []Key) []string {
+	l := make([]string, 0, len(keys))
+	for _, k := range keys {
+		l = append(l, k.Label)
+	}
+
+	return l
+}
@@ -0,0 +1,209 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// CKA_APPLICATION values of the data objects that track the life cycle of a
+// key. The objects are labeled like the key and private, so only the crypto
+// user can create them or move the start of the destroy waiting period.
+const (
+	RetiredKeyApplication   = "open_custodial_retired_key"
+	DestroyedKeyApplication = "open_custodial_destroyed_key"
+)
+
+// ErrKeyNotRetired is returned when destroying a key that was not retired
+var ErrKeyNotRetired = errors.New("key must be retired before it is destroyed")
+
+// retireKey stops the key from signing by clearing CKA_SIGN and
+// CKA_SIGN_RECOVER on its private half and records when it was retired, see
+// KeyRetiredAt. Retired keys can still be looked up, and destroyed with
+// DestroyKey.
+func (h *hsm) retireKey(session pkcs11.SessionHandle, key KeyID) error {
+	if _, retired, err := h.keyRetiredAt(session, key); err != nil || retired {
+		return err
+	}
+
+	privHandle, err := h.privateKeyHandle(session, key)
+	if err != nil {
+		return err
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN_RECOVER, false),
+	}
+	if err := h.ctx.SetAttributeValue(session, privHandle, template); err != nil {
+		return h.observe(session, err)
+	}
+
+	// some tokens accept the template without applying it
+	attributes, err := h.ctx.GetAttributeValue(session, privHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN_RECOVER, nil),
+	})
+	if err != nil {
+		return h.observe(session, err)
+	}
+
+	for _, a := range attributes {
+		if attributeTrue(a) {
+			return fmt.Errorf("token did not stop key %s from signing", key)
+		}
+	}
+
+	return h.createRecord(session, RetiredKeyApplication, key, time.Now())
+}
+
+// keyRetiredAt returns when the key was retired, and false if it was not
+func (h *hsm) keyRetiredAt(session pkcs11.SessionHandle, key KeyID) (time.Time, bool, error) {
+	record, err := h.findWithAttributes(session, retiredTemplate(key))
+	if err != nil {
+		var ckErr pkcs11.Error
+		if errors.As(err, &ckErr) {
+			return time.Time{}, false, err
+		}
+
+		// no record, the key was never retired
+		return time.Time{}, false, nil
+	}
+
+	attributes, err := h.ctx.GetAttributeValue(session, record, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+	if err != nil {
+		return time.Time{}, false, h.observe(session, err)
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, string(attributes[0].Value))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("unable to read retirement of key %s: %w", key, err)
+	}
+
+	return at, true, nil
+}
+
+// destroyKey destroys both halves of a retired key with C_DestroyObject and
+// leaves a record behind, so the label can not be used for another key.
+func (h *hsm) destroyKey(session pkcs11.SessionHandle, key KeyID) error {
+	_, retired, err := h.keyRetiredAt(session, key)
+	if err != nil {
+		return err
+	}
+
+	if !retired {
+		return ErrKeyNotRetired
+	}
+
+	token, err := h.sessionToken(session)
+	if err != nil {
+		return err
+	}
+
+	// write the record first, a failure half way must never free the label
+	if err := h.createRecord(session, DestroyedKeyApplication, key, time.Now()); err != nil {
+		return err
+	}
+
+	for _, find := range []func(pkcs11.SessionHandle, KeyID) (pkcs11.ObjectHandle, error){h.privateKeyHandle, h.publicKeyHandle} {
+		obj, err := find(session, key)
+		if err != nil {
+			// already destroyed by an earlier attempt
+			continue
+		}
+
+		if err := h.destroyObject(session, obj); err != nil {
+			return err
+		}
+	}
+
+	if record, err := h.findWithAttributes(session, retiredTemplate(key)); err == nil {
+		if err := h.destroyObject(session, record); err != nil {
+			return err
+		}
+	}
+
+	h.slotIndex.SetDestroyed(destroyedLabel(string(key), token), token)
+	return nil
+}
+
+func (h *hsm) createRecord(session pkcs11.SessionHandle, application string, key KeyID, at time.Time) error {
+	template := append(recordTemplate(application, key),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODIFIABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte(at.UTC().Format(time.RFC3339Nano))),
+	)
+
+	_, err := h.ctx.CreateObject(session, template)
+	return h.observe(session, err)
+}
+
+// retiredTemplate matches the retirement record of key. Public records
+// predate private ones and anyone could have created them, they are ignored.
+func retiredTemplate(key KeyID) []*pkcs11.Attribute {
+	return append(recordTemplate(RetiredKeyApplication, key), pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true))
+}
+
+// attributeTrue reports whether the CK_BBOOL attribute a is set
+func attributeTrue(a *pkcs11.Attribute) bool {
+	for _, b := range a.Value {
+		if b != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func recordTemplate(application string, key KeyID) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_APPLICATION, application),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, string(key)),
+	}
+}
+
+// destroyedLabel is the label a destroyed key is reserved under. The key of
+// a single key token is addressed by the token label.
+func destroyedLabel(key, token string) string {
+	if key == "" {
+		return token
+	}
+
+	return key
+}
+
+// sessionToken returns the label of the token the session is open on
+func (h *hsm) sessionToken(session pkcs11.SessionHandle) (string, error) {
+	info, err := h.ctx.GetSessionInfo(session)
+	if err != nil {
+		return "", h.observe(session, err)
+	}
+
+	token, err := h.ctx.GetTokenInfo(info.SlotID)
+	if err != nil {
+		return "", err
+	}
+
+	return token.Label, nil
+}
+
+// checkKeyLabel refuses labels of keys that exist or were destroyed
+func (h *hsm) checkKeyLabel(key KeyID) error {
+	if key == "" {
+		return nil
+	}
+
+	if _, ok := h.slotIndex.GetKey(string(key)); ok {
+		return fmt.Errorf("key with label %s already exists", key)
+	}
+
+	if _, ok := h.slotIndex.GetDestroyed(string(key)); ok {
+		return fmt.Errorf("key with label %s was destroyed and can not be reused", key)
+	}
+
+	return nil
+}
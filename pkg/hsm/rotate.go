@@ -0,0 +1,509 @@
+package hsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"open_custodial/pkg/config"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrRotationConflict is returned for rotations that can not start because
+// another one is running or incomplete
+var ErrRotationConflict = errors.New("pin rotation conflict")
+
+// rotationDrainTimeout is how long rotating a token waits for its borrowed
+// sessions to be released
+const rotationDrainTimeout = 5 * time.Second
+
+// RotationState tells how far a PIN rotation got
+type RotationState string
+
+const (
+	RotationRunning RotationState = "running"
+	// RotationIncomplete rotations stopped with tokens left on the old PIN,
+	// rotating to the same credential again resumes them
+	RotationIncomplete RotationState = "incomplete"
+	// RotationComplete rotations changed the PIN of every token, the new
+	// credential is the live one
+	RotationComplete RotationState = "complete"
+)
+
+// PINRotation reports the progress of a PIN rotation by token label. It
+// never holds credentials.
+type PINRotation struct {
+	Role    config.Role   `json:"role"`
+	State   RotationState `json:"state"`
+	Rotated []string      `json:"rotated"`
+	Pending []string      `json:"pending"`
+	// Failed maps the labels of tokens whose last attempt failed to the error
+	Failed    map[string]string `json:"failed,omitempty"`
+	StartedAt time.Time         `json:"startedAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	// Backends holds the rotation of every module of a multi backend HSM
+	Backends map[string]PINRotation `json:"backends,omitempty"`
+}
+
+// rotation is the state of the last PIN rotation, guarded by rotationMu
+type rotation struct {
+	role config.Role
+	// previous is the credential of role when the rotation started
+	previous config.Credential
+	next     config.Credential
+	running  bool
+	done     bool
+	// rotated holds the slots whose token already has the new PIN
+	rotated   map[uint]bool
+	failed    map[string]string
+	startedAt time.Time
+	updatedAt time.Time
+}
+
+// rotatedProvider hands out the credential a rotation switched role to and
+// asks base for the other role
+type rotatedProvider struct {
+	base config.CredentialProvider
+	role config.Role
+	cred config.Credential
+}
+
+func (p rotatedProvider) Credential(role config.Role) (config.Credential, error) {
+	if role == p.role {
+		return p.cred, nil
+	}
+
+	return p.base.Credential(role)
+}
+
+// RotatePIN changes the PIN of role to next with C_SetPIN on every token in
+// the index, one token at a time. The sessions of a token are paused while
+// its PIN changes, requests for it wait instead of failing. Tokens that fail
+// keep the old PIN and are reported, running RotatePIN again with the same
+// credential resumes the rotation. Tokens rotated before a restart are
+// recognized by the new PIN, and with WithRotationState the rotation itself
+// outlives the restart. Once every token is rotated next is the live
+// credential of role, the credential source has to be updated to it before
+// the next restart.
+func (h *hsm) RotatePIN(ctx context.Context, role config.Role, next config.Credential) (PINRotation, error) {
+	if role != config.RoleCU && role != config.RoleSO {
+		return PINRotation{}, fmt.Errorf("unknown role %s", role)
+	}
+
+	if next.Password == "" {
+		return PINRotation{}, errors.New("new pin is empty")
+	}
+
+	if !h.supervisor.connected() {
+		return PINRotation{}, ErrNotConnected
+	}
+
+	r, err := h.beginRotation(role, next)
+	if err != nil {
+		return PINRotation{}, err
+	}
+
+	slots := h.slotIndex.Slots()
+	labels := make([]string, 0, len(slots))
+	for label := range slots {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		slotID := slots[label]
+		if h.isRotated(r, slotID) {
+			continue
+		}
+
+		err := h.call(ctx, 0, OpToken, func() error {
+			return h.rotateToken(r, label, slotID)
+		})
+		if ctx.Err() != nil {
+			// an abandoned token records its outcome once it returns
+			fmt.Println("hsm: pin rotation stopped ", ctx.Err())
+			break
+		}
+
+		if err != nil {
+			fmt.Println("hsm: unable to rotate pin of token ", label, " ", err)
+		}
+	}
+
+	return h.endRotation(r), nil
+}
+
+// PINRotation reports the last PIN rotation, false when there was none
+func (h *hsm) PINRotation() (PINRotation, bool) {
+	h.rotationMu.Lock()
+	defer h.rotationMu.Unlock()
+
+	if h.rotation == nil {
+		return PINRotation{}, false
+	}
+
+	return h.rotationReport(h.rotation), true
+}
+
+// beginRotation resumes the incomplete rotation to next, or starts a new one
+// when the last rotation is complete
+func (h *hsm) beginRotation(role config.Role, next config.Credential) (*rotation, error) {
+	h.rotationMu.Lock()
+	defer h.rotationMu.Unlock()
+
+	r := h.rotation
+	switch {
+	case r != nil && r.running:
+		return nil, fmt.Errorf("%w: the %s pin is being rotated", ErrRotationConflict, r.role)
+	case r != nil && !r.done && r.role != role:
+		return nil, fmt.Errorf("%w: the rotation of the %s pin is incomplete, resume it first", ErrRotationConflict, r.role)
+	case r != nil && !r.done && r.next != next:
+		return nil, fmt.Errorf("%w: the incomplete rotation of the %s pin is to another credential, resume it with the same one", ErrRotationConflict, r.role)
+	case r == nil || r.done:
+		previous, err := h.creds.Credential(role)
+		if err != nil {
+			return nil, err
+		}
+
+		r = &rotation{
+			role:      role,
+			previous:  previous,
+			next:      next,
+			rotated:   make(map[uint]bool),
+			failed:    make(map[string]string),
+			startedAt: time.Now(),
+		}
+
+		// no token may change its PIN before the rotation outlives a restart
+		if err := h.saveRotation(r); err != nil {
+			return nil, fmt.Errorf("unable to keep the pin rotation: %w", err)
+		}
+		h.rotation = r
+	}
+
+	r.running = true
+	r.updatedAt = time.Now()
+	return r, nil
+}
+
+// endRotation switches the live credential when no token is left on the old
+// PIN
+func (h *hsm) endRotation(r *rotation) PINRotation {
+	h.rotationMu.Lock()
+	defer h.rotationMu.Unlock()
+
+	r.running = false
+	r.updatedAt = time.Now()
+
+	report := h.rotationReport(r)
+	if len(report.Pending) > 0 || len(report.Failed) > 0 {
+		fmt.Println("hsm: pin rotation incomplete, tokens left ", len(report.Pending)+len(report.Failed))
+		return report
+	}
+
+	r.done = true
+	h.creds = rotatedProvider{h.creds, r.role, r.next}
+	h.removeRotation()
+	fmt.Println("hsm: rotated pin of tokens ", len(report.Rotated))
+
+	report.State = RotationComplete
+	return report
+}
+
+// rotationReport lists the tokens of the index by progress. Callers hold
+// rotationMu.
+func (h *hsm) rotationReport(r *rotation) PINRotation {
+	report := PINRotation{
+		Role:      r.role,
+		State:     RotationIncomplete,
+		Rotated:   []string{},
+		Pending:   []string{},
+		Failed:    make(map[string]string),
+		StartedAt: r.startedAt,
+		UpdatedAt: r.updatedAt,
+	}
+
+	switch {
+	case r.running:
+		report.State = RotationRunning
+	case r.done:
+		report.State = RotationComplete
+	}
+
+	for label, slotID := range h.slotIndex.Slots() {
+		switch reason, failed := r.failed[label]; {
+		case r.rotated[slotID]:
+			report.Rotated = append(report.Rotated, label)
+		case failed:
+			report.Failed[label] = reason
+		default:
+			report.Pending = append(report.Pending, label)
+		}
+	}
+
+	sort.Strings(report.Rotated)
+	sort.Strings(report.Pending)
+	return report
+}
+
+func (h *hsm) isRotated(r *rotation, slotID uint) bool {
+	h.rotationMu.Lock()
+	defer h.rotationMu.Unlock()
+
+	return r.rotated[slotID]
+}
+
+// credential returns the credential of role for the token in slotID, the new
+// one once a rotation that is not complete yet changed its PIN
+func (h *hsm) credential(role config.Role, slotID uint) (config.Credential, error) {
+	h.rotationMu.Lock()
+	creds, r := h.creds, h.rotation
+	if r != nil && !r.done && r.role == role && r.rotated[slotID] {
+		h.rotationMu.Unlock()
+		return r.next, nil
+	}
+	h.rotationMu.Unlock()
+
+	return creds.Credential(role)
+}
+
+// adoptToken marks a token created during or after a rotation as rotated,
+// it is initialized with the new PIN. Callers hold slotMu.
+func (h *hsm) adoptToken(slotID uint) {
+	h.rotationMu.Lock()
+	defer h.rotationMu.Unlock()
+
+	if r := h.rotation; r != nil {
+		r.rotated[slotID] = true
+	}
+}
+
+// rotateToken changes the PIN of the token and records the outcome
+func (h *hsm) rotateToken(r *rotation, label string, slotID uint) error {
+	err := h.changePIN(r, slotID)
+
+	h.rotationMu.Lock()
+	defer h.rotationMu.Unlock()
+
+	r.updatedAt = time.Now()
+	if err != nil {
+		r.failed[label] = err.Error()
+		return err
+	}
+
+	delete(r.failed, label)
+	return nil
+}
+
+// changePIN logs into the token in slotID as r.role with the current PIN
+// and sets the new one. A token that refuses the current PIN but takes the
+// new one was rotated before. The token is marked rotated before its
+// sessions are resumed, so they log in with the new PIN.
+func (h *hsm) changePIN(r *rotation, slotID uint) error {
+	h.slotMu.Lock()
+	defer h.slotMu.Unlock()
+
+	if !h.pool.pause(slotID, rotationDrainTimeout) {
+		return errors.New("sessions of the token are still in use")
+	}
+
+	defer h.pool.resume(slotID)
+
+	current, err := h.credential(r.role, slotID)
+	if err != nil {
+		return err
+	}
+
+	userType := uint(pkcs11.CKU_USER)
+	if r.role == config.RoleSO {
+		userType = pkcs11.CKU_SO
+	}
+
+	sess, err := newSession(h.ctx, slotID)
+	if err != nil {
+		return h.checkFatal(err)
+	}
+
+	// closing the last session of the token logs the application out
+	defer h.ctx.CloseSession(sess)
+
+	currentPIN := current.PIN()
+	if r.role == config.RoleSO {
+		currentPIN, err = h.loginSO(sess, slotID)
+	} else {
+		err = h.ctx.Login(sess, userType, currentPIN)
+	}
+
+	if isPKCS11Error(err, pkcs11.CKR_PIN_INCORRECT) {
+		if h.ctx.Login(sess, userType, r.next.PIN()) == nil {
+			h.markRotated(r, slotID)
+			return nil
+		}
+
+		// the credential source may already hand out the new credential
+		if r.previous.PIN() == currentPIN {
+			return fmt.Errorf("token accepts neither the current nor the new %s pin: %w", r.role, err)
+		}
+
+		currentPIN = r.previous.PIN()
+		if err = h.ctx.Login(sess, userType, currentPIN); err != nil {
+			return fmt.Errorf("token accepts neither the current nor the new %s pin: %w", r.role, h.checkFatal(err))
+		}
+	}
+
+	if err != nil && !isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		return h.checkFatal(err)
+	}
+
+	if err := h.ctx.SetPIN(sess, currentPIN, r.next.PIN()); err != nil {
+		return h.checkFatal(err)
+	}
+
+	h.markRotated(r, slotID)
+	return nil
+}
+
+func (h *hsm) markRotated(r *rotation, slotID uint) {
+	h.rotationMu.Lock()
+	defer h.rotationMu.Unlock()
+
+	r.rotated[slotID] = true
+	if r.role == config.RoleSO {
+		delete(h.legacySO, slotID)
+	}
+}
+
+// loginRotating logs sess into the token in slotID as the crypto user after
+// it refused the PIN of the credential source. While a rotation of the
+// crypto user PIN is incomplete the token may be on the other PIN of the
+// rotation, for instance after a restart half way through it. A token found
+// on the new PIN is marked rotated.
+func (h *hsm) loginRotating(sess pkcs11.SessionHandle, slotID uint, refused string) error {
+	h.rotationMu.Lock()
+	r := h.rotation
+	incomplete := r != nil && !r.done && r.role == config.RoleCU
+	h.rotationMu.Unlock()
+
+	if !incomplete {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+
+	for _, cred := range []config.Credential{r.next, r.previous} {
+		if cred.PIN() == refused {
+			continue
+		}
+
+		err := h.ctx.Login(sess, pkcs11.CKU_USER, cred.PIN())
+		if err != nil && !isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			continue
+		}
+
+		if cred == r.next {
+			h.markRotated(r, slotID)
+		}
+		return nil
+	}
+
+	return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+}
+
+// WithRotationState keeps the credentials of an incomplete PIN rotation in
+// the file at path, sealed with passphrase like sealed credential files. A
+// restart half way through a rotation resumes it, tokens on either PIN can
+// be used and RotatePIN with the same credential completes it.
+func WithRotationState(path string, passphrase []byte) Option {
+	return func(h *hsm) {
+		h.rotationState = path
+		h.rotationPassphrase = append([]byte(nil), passphrase...)
+	}
+}
+
+// rotationStateKey is the key of a credential of the rotation of role in the
+// sealed state file
+func rotationStateKey(role config.Role, which string) string {
+	return fmt.Sprintf("%s/%s", role, which)
+}
+
+// saveRotation writes the credentials of r to the rotation state file.
+// Callers hold rotationMu.
+func (h *hsm) saveRotation(r *rotation) error {
+	if h.rotationState == "" {
+		return nil
+	}
+
+	sealed, err := config.SealCredentials(map[string]config.Credential{
+		rotationStateKey(r.role, "previous"): r.previous,
+		rotationStateKey(r.role, "next"):     r.next,
+	}, h.rotationPassphrase)
+	if err != nil {
+		return err
+	}
+
+	// written aside and renamed so a crash never leaves half a file
+	tmp := h.rotationState + ".tmp"
+	if err := ioutil.WriteFile(tmp, sealed, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, h.rotationState)
+}
+
+// removeRotation deletes the state file of a complete rotation. Callers
+// hold rotationMu.
+func (h *hsm) removeRotation() {
+	if h.rotationState == "" {
+		return
+	}
+
+	if err := os.Remove(h.rotationState); err != nil && !os.IsNotExist(err) {
+		fmt.Println("hsm: unable to remove the pin rotation state ", err)
+	}
+}
+
+// loadRotation restores the incomplete rotation of the state file, which
+// RotatePIN resumes when given the same credential
+func (h *hsm) loadRotation() error {
+	if h.rotationState == "" {
+		return nil
+	}
+
+	sealed, err := ioutil.ReadFile(h.rotationState)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	creds, err := config.UnsealCredentials(sealed, h.rotationPassphrase)
+	if err != nil {
+		return fmt.Errorf("unable to read the pin rotation state: %w", err)
+	}
+
+	for _, role := range []config.Role{config.RoleCU, config.RoleSO} {
+		previous, okPrevious := creds[rotationStateKey(role, "previous")]
+		next, okNext := creds[rotationStateKey(role, "next")]
+		if !okPrevious || !okNext {
+			continue
+		}
+
+		fmt.Println("hsm: resuming the incomplete rotation of the pin of ", role)
+		h.rotation = &rotation{
+			role:      role,
+			previous:  previous,
+			next:      next,
+			rotated:   make(map[uint]bool),
+			failed:    make(map[string]string),
+			startedAt: time.Now(),
+		}
+		return nil
+	}
+
+	return errors.New("the pin rotation state holds no rotation")
+}
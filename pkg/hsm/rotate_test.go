@@ -0,0 +1,102 @@
+package hsm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"open_custodial/pkg/config"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/suite"
+)
+
+type RotationSuite struct {
+	suite.Suite
+	path    string
+	current config.Credential
+	next    config.Credential
+}
+
+func TestRotationSuite(t *testing.T) {
+	suite.Run(t, new(RotationSuite))
+}
+
+func (s *RotationSuite) SetupTest() {
+	s.path = filepath.Join(s.T().TempDir(), "rotation.sealed")
+	s.current = config.Credential{Username: "cu", Password: "current"}
+	s.next = config.Credential{Username: "cu", Password: "next"}
+}
+
+func (s *RotationSuite) newHSM() *hsm {
+	h := &hsm{
+		creds:     config.NewStaticProvider(s.current, config.Credential{Username: "so", Password: "so"}),
+		slotIndex: newSlotIndex(),
+	}
+	WithRotationState(s.path, []byte("passphrase"))(h)
+	return h
+}
+
+func (s *RotationSuite) TestIncompleteRotationOutlivesRestart() {
+	h := s.newHSM()
+	r, err := h.beginRotation(config.RoleCU, s.next)
+	s.NoError(err)
+	s.Equal(s.current, r.previous)
+
+	info, err := os.Stat(s.path)
+	s.NoError(err)
+	s.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	// the process stops before endRotation
+	restarted := s.newHSM()
+	s.NoError(restarted.loadRotation())
+	s.Require().NotNil(restarted.rotation)
+	s.Equal(config.RoleCU, restarted.rotation.role)
+	s.Equal(s.current, restarted.rotation.previous)
+	s.Equal(s.next, restarted.rotation.next)
+	s.False(restarted.rotation.running)
+
+	report, ok := restarted.PINRotation()
+	s.True(ok)
+	s.Equal(RotationIncomplete, report.State)
+
+	// only the same credential resumes it
+	_, err = restarted.beginRotation(config.RoleCU, config.Credential{Username: "cu", Password: "other"})
+	s.True(errors.Is(err, ErrRotationConflict))
+
+	r, err = restarted.beginRotation(config.RoleCU, s.next)
+	s.NoError(err)
+
+	report = restarted.endRotation(r)
+	s.Equal(RotationComplete, report.State)
+
+	_, err = os.Stat(s.path)
+	s.True(os.IsNotExist(err))
+
+	cred, err := restarted.credential(config.RoleCU, 0)
+	s.NoError(err)
+	s.Equal(s.next, cred)
+}
+
+func (s *RotationSuite) TestWrongPassphraseRefusesState() {
+	h := s.newHSM()
+	_, err := h.beginRotation(config.RoleCU, s.next)
+	s.NoError(err)
+
+	restarted := s.newHSM()
+	WithRotationState(s.path, []byte("wrong"))(restarted)
+	s.Error(restarted.loadRotation())
+}
+
+func (s *RotationSuite) TestNoStateFile() {
+	h := s.newHSM()
+	s.NoError(h.loadRotation())
+	s.Nil(h.rotation)
+}
+
+func (s *RotationSuite) TestLoginRotatingWithoutRotation() {
+	h := s.newHSM()
+	err := h.loginRotating(1, 0, s.current.PIN())
+	s.True(isPKCS11Error(err, pkcs11.CKR_PIN_INCORRECT))
+}
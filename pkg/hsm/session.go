@@ -1,42 +1,100 @@
 package hsm
 
 import (
+	"context"
 	"fmt"
+	"open_custodial/pkg/config"
 
 	"github.com/miekg/pkcs11"
 )
 
-func (h *hsm) NewSession(slotID uint) (pkcs11.SessionHandle, error) {
+func (h *hsm) openSession(slotID uint) (pkcs11.SessionHandle, error) {
 	return newSession(h.ctx, slotID)
 }
 
 func newSession(ctx *pkcs11.Ctx, slotID uint) (pkcs11.SessionHandle, error) {
-	// TODO should session params come from function args?
 	return ctx.OpenSession(slotID, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
 }
 
-func (h *hsm) NewSlotSession(name string) (*pkcs11.SessionHandle, error) {
-	slot, err := h.GetSlotID(name)
-	if err != nil {
-		return nil, err
+// NewSlotSession borrows a logged in read/write session from the pool.
+// The session must be handed back with EndSession.
+func (h *hsm) NewSlotSession(ctx context.Context, name string) (*pkcs11.SessionHandle, error) {
+	return h.borrowSlotSession(ctx, name, false)
+}
+
+// NewReadOnlySlotSession borrows a logged in read-only session from the pool,
+// which is all that lookups like fetching a public key need.
+func (h *hsm) NewReadOnlySlotSession(ctx context.Context, name string) (*pkcs11.SessionHandle, error) {
+	return h.borrowSlotSession(ctx, name, true)
+}
+
+type borrowed struct {
+	sess pkcs11.SessionHandle
+	err  error
+}
+
+type borrowedHolder struct {
+	sess *pkcs11.SessionHandle
+	err  error
+}
+
+func (h *hsm) borrowSlotSession(ctx context.Context, name string, readOnly bool) (*pkcs11.SessionHandle, error) {
+	if !h.supervisor.connected() {
+		return nil, ErrNotConnected
 	}
 
-	sess, err := newSession(h.ctx, slot)
+	slot, err := h.getSlotID(name)
 	if err != nil {
 		return nil, err
 	}
 
-	err = h.ctx.Login(sess, pkcs11.CKU_USER, h.buildPin())
-	if err != nil {
+	ctx, cancel := h.withTimeout(ctx, OpSession)
+	defer cancel()
+
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	return &sess, nil
+	done := make(chan borrowedHolder, 1)
+	go func() {
+		sess, err := h.pool.borrow(slot, readOnly)
+		done <- borrowedHolder{sess, err}
+	}()
+
+	select {
+	case b := <-done:
+		if b.err != nil {
+			return nil, h.checkFatal(b.err)
+		}
+
+		return b.sess, nil
+	case <-ctx.Done():
+		// nobody waits for the session anymore, give it back once the
+		// login finishes
+		go func() {
+			if b := <-done; b.err == nil {
+				h.pool.release(b.sess)
+			}
+		}()
+
+		fmt.Println("hsm: abandoned session ", ctx.Err())
+		return nil, ctx.Err()
+	}
 }
 
+// EndSession returns pooled sessions to the pool, sess has to be the
+// pointer NewSlotSession returned. Any other session is closed. Other
+// sessions are never logged out: login state is shared by every session of
+// the application on the token, C_Logout would log out the pooled sessions
+// of the slot too. A session that a timed out call still runs on is closed
+// when the call returns.
 func (h *hsm) EndSession(sess *pkcs11.SessionHandle) error {
-	if err := h.ctx.Logout(*sess); err != nil {
-		return err
+	if h.pool.owns(sess) {
+		return h.pool.release(sess)
+	}
+
+	if h.pool.closeWhenIdle(*sess) {
+		return nil
 	}
 
 	if err := h.ctx.CloseSession(*sess); err != nil {
@@ -46,14 +104,158 @@ func (h *hsm) EndSession(sess *pkcs11.SessionHandle) error {
 	return nil
 }
 
-func (h *hsm) ReleaseHandle(sess pkcs11.SessionHandle) error {
-	return h.ctx.FindObjectsFinal(sess)
+func (h *hsm) releaseHandle(sess pkcs11.SessionHandle) error {
+	err := h.ctx.FindObjectsFinal(sess)
+	if isPKCS11Error(err, pkcs11.CKR_OPERATION_NOT_INITIALIZED) {
+		// lookups already finalize their search
+		return nil
+	}
+
+	return h.observe(sess, err)
+}
+
+// observe lets the pool evict sess when err shows it is broken, and returns
+// err so callers can use it inline.
+func (h *hsm) observe(sess pkcs11.SessionHandle, err error) error {
+	if err != nil {
+		h.pool.observe(sess, err)
+	}
+
+	return h.checkFatal(err)
+}
+
+// openUserSession opens a read-only session on the token in slotID logged in
+// as the crypto user, to read private objects outside the pool. ok is false
+// for tokens whose user PIN was never set, they hold no private objects.
+func (h *hsm) openUserSession(slotID uint) (sess pkcs11.SessionHandle, ok bool, err error) {
+	sess, err = h.ctx.OpenSession(slotID, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return 0, false, err
+	}
+
+	pin, err := h.buildPin(slotID)
+	if err == nil {
+		err = h.ctx.Login(sess, pkcs11.CKU_USER, pin)
+	}
+
+	if isPKCS11Error(err, pkcs11.CKR_PIN_INCORRECT) {
+		err = h.loginRotating(sess, slotID, pin)
+	}
+
+	switch {
+	case err == nil, isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN):
+		return sess, true, nil
+	case isPKCS11Error(err, pkcs11.CKR_USER_PIN_NOT_INITIALIZED):
+		err = nil
+	}
+
+	h.ctx.CloseSession(sess)
+	return 0, false, err
+}
+
+// buildSOPin returns the PIN of the security officer of the token in slotID,
+// who initializes it and sets its user PIN. It is never used to log in as
+// the crypto user.
+func (h *hsm) buildSOPin(slotID uint) (string, error) {
+	return h.pin(config.RoleSO, slotID)
 }
 
-func (h *hsm) buildSOPin() string {
-	return fmt.Sprintf("%s:%s", h.cuUsername, h.cuPassword)
+// buildPin returns the PIN of the crypto user the keys of the token in
+// slotID belong to
+func (h *hsm) buildPin(slotID uint) (string, error) {
+	return h.pin(config.RoleCU, slotID)
 }
 
-func (h *hsm) buildPin() string {
-	return fmt.Sprintf("%s:%s", h.cuUsername, h.cuPassword)
+// WithLegacySOPin lets SO logins fall back to the crypto user PIN. Tokens
+// created before the SO had a credential of its own were initialized with
+// it as their SO PIN, this keeps them usable until their SO PIN is rotated.
+// Anyone with the crypto user credential is SO of those tokens meanwhile, so
+// it is meant to be on only for the rotation.
+func WithLegacySOPin() Option {
+	return func(h *hsm) {
+		h.legacySOPin = true
+	}
+}
+
+// legacySOPinOf returns the SO PIN of tokens initialized before the SO had
+// a credential of its own, they were initialized with the crypto user PIN
+func (h *hsm) legacySOPinOf(slotID uint) (string, error) {
+	return h.pin(config.RoleCU, slotID)
+}
+
+// initToken initializes the token in slotID with the SO PIN
+func (h *hsm) initToken(slotID uint, label string) error {
+	soPin, err := h.buildSOPin(slotID)
+	if err != nil {
+		return err
+	}
+
+	if err := h.ctx.InitToken(slotID, soPin, label); err != nil {
+		return err
+	}
+
+	h.setLegacySO(slotID, false)
+	return nil
+}
+
+// loginSO logs into sess as the SO of the token in slotID and returns the
+// PIN the token took. With WithLegacySOPin a refused SO PIN is retried with
+// the legacy one, and the token is reported by Info until its SO PIN is
+// rotated.
+func (h *hsm) loginSO(sess pkcs11.SessionHandle, slotID uint) (string, error) {
+	soPin, err := h.buildSOPin(slotID)
+	if err != nil {
+		return "", err
+	}
+
+	err = h.ctx.Login(sess, pkcs11.CKU_SO, soPin)
+	if !h.legacySOPin || !isPKCS11Error(err, pkcs11.CKR_PIN_INCORRECT) {
+		return soPin, err
+	}
+
+	legacy, legacyErr := h.legacySOPinOf(slotID)
+	if legacyErr != nil || legacy == soPin {
+		return "", err
+	}
+
+	if err := h.ctx.Login(sess, pkcs11.CKU_SO, legacy); err != nil {
+		return "", err
+	}
+
+	fmt.Println("login: token still has the legacy so pin, rotate the so pin of slot ", slotID)
+	h.setLegacySO(slotID, true)
+	return legacy, nil
+}
+
+// setLegacySO records whether the token in slotID was found on the legacy
+// SO PIN
+func (h *hsm) setLegacySO(slotID uint, legacy bool) {
+	h.rotationMu.Lock()
+	defer h.rotationMu.Unlock()
+
+	if !legacy {
+		delete(h.legacySO, slotID)
+		return
+	}
+
+	if h.legacySO == nil {
+		h.legacySO = make(map[uint]bool)
+	}
+	h.legacySO[slotID] = true
+}
+
+func (h *hsm) isLegacySO(slotID uint) bool {
+	h.rotationMu.Lock()
+	defer h.rotationMu.Unlock()
+
+	return h.legacySO[slotID]
+}
+
+func (h *hsm) pin(role config.Role, slotID uint) (string, error) {
+	cred, err := h.credential(role, slotID)
+	if err != nil {
+		return "", err
+	}
+
+	return cred.PIN(), nil
 }
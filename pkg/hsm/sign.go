@@ -1,38 +1,50 @@
 package hsm
 
 import (
-	"errors"
-	"math/big"
+	"expvar"
 
-	"github.com/ethereum/go-ethereum/crypto/secp256k1"
 	"github.com/miekg/pkcs11"
 )
 
-func (h *hsm) SignECDSA_secp256k1(msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+var (
+	// served on /debug/vars to see how often tokens return high s values
+	signatureCount  = expvar.NewInt("hsm_ecdsa_signatures")
+	normalizedCount = expvar.NewInt("hsm_ecdsa_signatures_normalized")
+)
 
-	curve := secp256k1.S256()
-	halfN := new(big.Int).Div(curve.N, big.NewInt(2))
+// SignatureStats returns the number of ECDSA signatures created and how
+// many of them had to be normalized to a low s value.
+func SignatureStats() (total, normalized int64) {
+	return signatureCount.Value(), normalizedCount.Value()
+}
 
-	// TODO - flip S value instead of retrying till it works
-	for i := 0; i < 20; i++ {
+// signECDSA_secp256k1 signs msg and returns a 64 byte r || s with s in the
+// lower half of the curve order, as Ethereum requires. Whatever format the
+// token returns is canonicalized first, and high s values are replaced by
+// N - s instead of signing again.
+func (h *hsm) signECDSA_secp256k1(msg []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
 
-		signature, err := h.Sign(sess, privKey, msg)
-		if err != nil {
-			return nil, err
-		}
+	raw, err := h.Sign(sess, privKey, msg)
+	if err != nil {
+		return nil, err
+	}
 
-		// s value is the last 32 bytes of an ECDSA signature
-		// the first 32 bytes represent r value
-		s := new(big.Int).SetBytes(signature[32:64])
+	signature, err := CanonicalSignature(raw)
+	if err != nil {
+		return nil, err
+	}
 
-		// check if s value is less than half of N
-		if s.Cmp(halfN) == -1 {
-			return signature, nil
-		}
+	signature, normalized, err := NormalizeS(signature)
+	if err != nil {
+		return nil, err
+	}
 
+	signatureCount.Add(1)
+	if normalized {
+		normalizedCount.Add(1)
 	}
 
-	return nil, errors.New("unable to calculate signature within 20 attempts")
+	return signature, nil
 }
 
 func (h *hsm) Sign(sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle, message []byte) ([]byte, error) {
@@ -40,14 +52,14 @@ func (h *hsm) Sign(sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle, messa
 	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
 
 	if err := h.ctx.SignInit(sess, mech, privKey); err != nil {
-		return nil, err
+		return nil, h.observe(sess, err)
 	}
 
 	defer h.ctx.SignFinal(sess)
 
 	b, err := h.ctx.Sign(sess, message)
 	if err != nil {
-		return nil, err
+		return nil, h.observe(sess, err)
 	}
 
 	return b, nil
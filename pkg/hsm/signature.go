@@ -0,0 +1,107 @@
+package hsm
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+)
+
+// signatureComponentLen is the size of r and s for the 256 bit curves in use
+const signatureComponentLen = 32
+
+var (
+	secp256k1N     = secp256k1.S256().N
+	secp256k1HalfN = new(big.Int).Rsh(secp256k1N, 1)
+)
+
+// SignatureFormatError is returned for signatures that can not be turned
+// into a 64 byte r || s value.
+type SignatureFormatError struct {
+	Length int
+	Reason string
+}
+
+func (e SignatureFormatError) Error() string {
+	return fmt.Sprintf("malformed signature of %d bytes: %s", e.Length, e.Reason)
+}
+
+// ecdsaSignature is the ASN.1 ECDSA-Sig-Value structure from RFC 3279
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// CanonicalSignature turns what a PKCS#11 provider returned from C_Sign into
+// a 64 byte r || s value. Besides raw r || s it accepts DER encoded
+// ECDSA-Sig-Value structures. Raw values of any other length are refused,
+// with leading zeros stripped from r or s there is no telling where r ends.
+func CanonicalSignature(raw []byte) ([]byte, error) {
+	if r, s, ok := parseDERSignature(raw); ok {
+		return joinSignature(raw, r, s)
+	}
+
+	if len(raw) == 2*signatureComponentLen {
+		r := new(big.Int).SetBytes(raw[:signatureComponentLen])
+		s := new(big.Int).SetBytes(raw[signatureComponentLen:])
+		return joinSignature(raw, r, s)
+	}
+
+	return nil, SignatureFormatError{len(raw), "expected 64 byte r || s or a DER encoded ECDSA-Sig-Value"}
+}
+
+// parseDERSignature decodes raw as a DER ECDSA-Sig-Value. Anything that is
+// not exactly one such structure is rejected so raw r || s values are never
+// mistaken for DER.
+func parseDERSignature(raw []byte) (*big.Int, *big.Int, bool) {
+	if len(raw) < 8 || raw[0] != 0x30 {
+		return nil, nil, false
+	}
+
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(raw, &sig)
+	if err != nil || len(rest) > 0 {
+		return nil, nil, false
+	}
+
+	return sig.R, sig.S, true
+}
+
+func joinSignature(raw []byte, r, s *big.Int) ([]byte, error) {
+	if r.Sign() <= 0 || s.Sign() <= 0 {
+		return nil, SignatureFormatError{len(raw), "r and s must be positive"}
+	}
+
+	if r.BitLen() > 8*signatureComponentLen || s.BitLen() > 8*signatureComponentLen {
+		return nil, SignatureFormatError{len(raw), "r or s is longer than 32 bytes"}
+	}
+
+	sig := make([]byte, 2*signatureComponentLen)
+	r.FillBytes(sig[:signatureComponentLen])
+	s.FillBytes(sig[signatureComponentLen:])
+
+	return sig, nil
+}
+
+// NormalizeS returns a copy of the 64 byte r || s signature with s replaced
+// by N - s when s is above N/2, and reports whether it was replaced. Both
+// values are valid signatures, but replacing s flips the parity of the
+// recovery id, so it has to be worked out after normalizing.
+func NormalizeS(signature []byte) ([]byte, bool, error) {
+	if len(signature) != 2*signatureComponentLen {
+		return nil, false, SignatureFormatError{len(signature), "expected 64 byte r || s"}
+	}
+
+	sig := make([]byte, len(signature))
+	copy(sig, signature)
+
+	s := new(big.Int).SetBytes(sig[32:64])
+	if s.Cmp(secp256k1HalfN) <= 0 {
+		return sig, false, nil
+	}
+
+	s.Sub(secp256k1N, s)
+	s.FillBytes(sig[32:64])
+
+	return sig, true, nil
+}
@@ -0,0 +1,141 @@
+package hsm
+
+import (
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/suite"
+)
+
+type SignatureSuite struct {
+	suite.Suite
+}
+
+func TestSignatureSuite(t *testing.T) {
+	suite.Run(t, new(SignatureSuite))
+}
+
+func withS(s *big.Int) []byte {
+	sig := make([]byte, 64)
+	big.NewInt(1).FillBytes(sig[:32])
+	s.FillBytes(sig[32:64])
+	return sig
+}
+
+func (s *SignatureSuite) TestNormalizeLowS() {
+	for _, v := range []*big.Int{big.NewInt(1), new(big.Int).Sub(secp256k1HalfN, big.NewInt(1)), secp256k1HalfN} {
+		sig := withS(v)
+
+		normalized, flipped, err := NormalizeS(sig)
+		s.NoError(err)
+		s.False(flipped)
+		s.Equal(sig, normalized)
+	}
+}
+
+func (s *SignatureSuite) TestNormalizeHighS() {
+	for _, v := range []*big.Int{new(big.Int).Add(secp256k1HalfN, big.NewInt(1)), new(big.Int).Sub(secp256k1N, big.NewInt(1))} {
+		sig := withS(v)
+
+		normalized, flipped, err := NormalizeS(sig)
+		s.NoError(err)
+		s.True(flipped)
+		s.Equal(sig[:32], normalized[:32])
+
+		expected := new(big.Int).Sub(secp256k1N, v)
+		s.Equal(0, expected.Cmp(new(big.Int).SetBytes(normalized[32:64])))
+		s.True(new(big.Int).SetBytes(normalized[32:64]).Cmp(secp256k1HalfN) <= 0)
+
+		// the input is left untouched
+		s.Equal(0, v.Cmp(new(big.Int).SetBytes(sig[32:64])))
+	}
+}
+
+func (s *SignatureSuite) TestNormalizeFlipsRecoveryID() {
+	key, err := crypto.GenerateKey()
+	s.NoError(err)
+
+	digest := crypto.Keccak256([]byte("normalize"))
+	sig, err := crypto.Sign(digest, key)
+	s.NoError(err)
+
+	// mirror the low s signature into its high s twin, which recovers the
+	// same key with the other recovery id
+	high := make([]byte, 64)
+	copy(high, sig[:64])
+	new(big.Int).Sub(secp256k1N, new(big.Int).SetBytes(sig[32:64])).FillBytes(high[32:64])
+
+	normalized, flipped, err := NormalizeS(high)
+	s.NoError(err)
+	s.True(flipped)
+	s.Equal(sig[:64], normalized)
+
+	pub, err := crypto.Ecrecover(digest, append(normalized, sig[64]))
+	s.NoError(err)
+	s.Equal(crypto.FromECDSAPub(&key.PublicKey), pub)
+}
+
+func (s *SignatureSuite) TestNormalizeRejectsLength() {
+	_, _, err := NormalizeS(make([]byte, 63))
+	s.IsType(SignatureFormatError{}, err)
+}
+
+func (s *SignatureSuite) TestCanonicalSignature() {
+	r := new(big.Int).SetBytes([]byte{0x00, 0x00, 0x81, 0x02})
+	sInt := new(big.Int).Sub(secp256k1N, big.NewInt(7))
+
+	expected := make([]byte, 64)
+	r.FillBytes(expected[:32])
+	sInt.FillBytes(expected[32:])
+
+	der, err := asn1.Marshal(ecdsaSignature{r, sInt})
+	s.NoError(err)
+
+	for name, raw := range map[string][]byte{
+		"raw": expected,
+		"der": der,
+	} {
+		sig, err := CanonicalSignature(raw)
+		s.NoError(err, name)
+		s.Equal(expected, sig, name)
+	}
+}
+
+func (s *SignatureSuite) TestCanonicalSignatureStripped() {
+	r := make([]byte, 32)
+	r[2] = 0x01
+	sig := make([]byte, 32)
+	sig[0] = 0x80
+
+	// r lost two leading zeros and s none, splitting 62 bytes in half would
+	// move a byte of s into r
+	unequal := append(append([]byte{}, r[2:]...), sig...)
+	_, err := CanonicalSignature(unequal)
+	s.IsType(SignatureFormatError{}, err)
+
+	_, err = CanonicalSignature([]byte{0x01, 0x02})
+	s.IsType(SignatureFormatError{}, err)
+}
+
+func (s *SignatureSuite) TestCanonicalSignatureMalformed() {
+	tooLong, err := asn1.Marshal(ecdsaSignature{new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1)})
+	s.NoError(err)
+
+	negative, err := asn1.Marshal(ecdsaSignature{big.NewInt(-1), big.NewInt(1)})
+	s.NoError(err)
+
+	for name, raw := range map[string][]byte{
+		"empty":     {},
+		"odd":       make([]byte, 63),
+		"too long":  make([]byte, 65),
+		"zero r":    make([]byte, 64),
+		"der 257":   tooLong,
+		"der sign":  negative,
+		"der extra": append(append([]byte{}, negative...), 0),
+	} {
+		_, err := CanonicalSignature(raw)
+		s.IsType(SignatureFormatError{}, err, name)
+	}
+}
@@ -0,0 +1,153 @@
+package hsm
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Signer is a crypto.Signer for the key labeled label, so the standard
+// library, TLS client auth, x509.CreateCertificateRequest and JWS libraries
+// among others, can use HSM keys. Every Sign borrows a session of its own,
+// a Signer can be shared between goroutines.
+type Signer struct {
+	h     HSM
+	label string
+	curve Curve
+	pub   crypto.PublicKey
+}
+
+var _ crypto.Signer = (*Signer)(nil)
+
+// NewSigner reads the curve and public key of the key labeled label
+func NewSigner(ctx context.Context, h HSM, label string) (*Signer, error) {
+	loc, err := h.LocateKey(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := h.NewReadOnlySlotSession(ctx, loc.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer h.EndSession(sess)
+
+	pubHandle, err := h.PublicKeyHandle(ctx, *sess, loc.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	curve, err := h.KeyCurve(ctx, *sess, pubHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Signer{h: h, label: label, curve: curve}
+	if curve == CurveEd25519 {
+		s.pub, err = h.GetPublicKeyEdDSA_ed25519(ctx, *sess, pubHandle)
+		if err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	}
+
+	pub, err := h.GetPublicKey(ctx, *sess, pubHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pub = &pub
+	return s, nil
+}
+
+// Public returns an *ecdsa.PublicKey or an ed25519.PublicKey
+func (s *Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *Signer) Curve() Curve {
+	return s.curve
+}
+
+// Sign is SignContext without a deadline, the timeouts of the HSM still
+// apply. rand is not used, the token brings its own randomness.
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.SignContext(context.Background(), digest, opts)
+}
+
+// SignContext signs digest with an ECDSA key and returns an ASN.1 encoded
+// signature, or signs the message itself with an Ed25519 key, which is what
+// ecdsa.PrivateKey and ed25519.PrivateKey do. secp256k1 signatures have a
+// low s value.
+func (s *Signer) SignContext(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := crypto.Hash(0)
+	if opts != nil {
+		hash = opts.HashFunc()
+	}
+
+	switch {
+	case s.curve == CurveEd25519 && hash != 0:
+		return nil, errors.New("ed25519 keys sign the message itself, Ed25519ph is not supported")
+	case s.curve != CurveEd25519 && hash != 0 && len(digest) != hash.Size():
+		return nil, fmt.Errorf("digest is %d bytes, %s digests are %d", len(digest), hash, hash.Size())
+	case s.curve != CurveEd25519 && len(digest) == 0:
+		return nil, errors.New("digest is empty")
+	}
+
+	if s.curve != CurveEd25519 {
+		digest = truncateDigest(digest)
+	}
+
+	loc, err := s.h.LocateKey(ctx, s.label)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := s.h.NewSlotSession(ctx, loc.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.h.EndSession(sess)
+
+	privHandle, err := s.h.PrivateKeyHandle(ctx, *sess, loc.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.sign(ctx, digest, *sess, privHandle)
+}
+
+func (s *Signer) sign(ctx context.Context, digest []byte, sess pkcs11.SessionHandle, privKey pkcs11.ObjectHandle) ([]byte, error) {
+	switch s.curve {
+	case CurveEd25519:
+		return s.h.SignEdDSA_ed25519(ctx, digest, sess, privKey)
+	case CurveP256:
+		return s.h.SignDigestECDSA_P256(ctx, digest, sess, privKey)
+	case CurveSecp256k1:
+		sig, err := s.h.SignECDSA_secp256k1(ctx, digest, sess, privKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return marshalDERSignature(sig)
+	}
+
+	return nil, fmt.Errorf("unknown curve %s", s.curve)
+}
+
+// truncateDigest keeps the leftmost 256 bits of digests longer than the
+// curve order, as ECDSA does. Tokens are not consistent about doing it.
+func truncateDigest(digest []byte) []byte {
+	if len(digest) > signatureComponentLen {
+		return digest[:signatureComponentLen]
+	}
+
+	return digest
+}
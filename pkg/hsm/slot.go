@@ -0,0 +1,189 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// FailedTokenPrefix starts the label of tokens whose creation failed. PKCS#11
+// can not return a token to the uninitialized state, so failed tokens are
+// wiped and relabeled instead, and NewSlot reuses them.
+const FailedTokenPrefix = "failed_token_"
+
+// OrphanReason tells why a token is considered an orphan
+type OrphanReason string
+
+const (
+	// OrphanFailed tokens were marked as failed and are waiting to be reused
+	OrphanFailed OrphanReason = "failed"
+	// OrphanPINNotInitialized tokens were initialized but never got a user PIN
+	OrphanPINNotInitialized OrphanReason = "pin-not-initialized"
+	// OrphanEmpty tokens have a user PIN but hold no keys
+	OrphanEmpty OrphanReason = "empty"
+)
+
+// Orphan is a token left behind by a token creation that did not complete
+type Orphan struct {
+	SlotID uint         `json:"slotID"`
+	Label  string       `json:"label"`
+	Reason OrphanReason `json:"reason"`
+}
+
+func failedLabel(slotID uint) string {
+	return fmt.Sprintf("%s%d", FailedTokenPrefix, slotID)
+}
+
+func isFailedLabel(label string) bool {
+	return strings.HasPrefix(label, FailedTokenPrefix)
+}
+
+// freeSlot finds a token NewSlot can initialize. Uninitialized tokens come
+// first, then tokens marked as failed. Callers hold slotMu.
+func (h *hsm) freeSlot(slots []uint) (uint, error) {
+	sorted := append([]uint(nil), slots...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var failed []uint
+	for _, s := range sorted {
+		info, err := h.ctx.GetTokenInfo(s)
+		if err != nil {
+			return 0, err
+		}
+
+		if info.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 {
+			return s, nil
+		}
+
+		if isFailedLabel(info.Label) {
+			failed = append(failed, s)
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed[0], nil
+	}
+
+	return 0, errors.New("no uninitialized token available")
+}
+
+// markFailed wipes the token and relabels it as failed. Callers hold slotMu
+// and must have closed every session on the slot.
+func (h *hsm) markFailed(slotID uint) error {
+	return h.initToken(slotID, failedLabel(slotID))
+}
+
+// discardSlot wipes the token labeled name and marks it as failed, so it can
+// be reused by NewSlot. It rolls back token creation when a later step, such
+// as generating the key, fails.
+func (h *hsm) discardSlot(name string) error {
+	h.slotMu.Lock()
+	defer h.slotMu.Unlock()
+
+	slots, err := h.ctx.GetSlotList(true)
+	if err != nil {
+		return err
+	}
+
+	slotID, err := findSlotByName(h.ctx, slots, name)
+	if err != nil {
+		return err
+	}
+
+	h.pool.evictSlot(slotID)
+
+	if err := h.markFailed(slotID); err != nil {
+		return err
+	}
+
+	h.slotIndex.Delete(name)
+	return nil
+}
+
+// orphans lists tokens left behind by token creations that did not complete.
+// Tokens that are being created right now show up as empty, so only act on
+// the list while no keys are being created.
+func (h *hsm) orphans() ([]Orphan, error) {
+	slots, err := h.ctx.GetSlotList(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	for _, s := range slots {
+		info, err := h.ctx.GetTokenInfo(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 {
+			continue
+		}
+
+		orphan := Orphan{SlotID: s, Label: info.Label}
+		switch {
+		case isFailedLabel(info.Label):
+			orphan.Reason = OrphanFailed
+		case info.Flags&pkcs11.CKF_USER_PIN_INITIALIZED == 0:
+			orphan.Reason = OrphanPINNotInitialized
+		default:
+			empty, err := h.isEmptyToken(s)
+			if err != nil {
+				return nil, err
+			}
+
+			if !empty {
+				continue
+			}
+
+			orphan.Reason = OrphanEmpty
+		}
+
+		orphans = append(orphans, orphan)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].SlotID < orphans[j].SlotID })
+	return orphans, nil
+}
+
+// isEmptyToken reports whether the token holds no public keys. Every key
+// pair, imported key and wrapping key has one. Tokens whose key was destroyed
+// are not empty, they keep the label of the key reserved.
+func (h *hsm) isEmptyToken(slotID uint) (bool, error) {
+	sess, err := h.ctx.OpenSession(slotID, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return false, err
+	}
+
+	defer h.ctx.CloseSession(sess)
+
+	found, err := h.hasObject(sess, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY)})
+	if err != nil || found {
+		return false, err
+	}
+
+	destroyed, err := h.destroyedLabels(slotID)
+	if err != nil {
+		return false, err
+	}
+
+	return len(destroyed) == 0, nil
+}
+
+func (h *hsm) hasObject(sess pkcs11.SessionHandle, attr []*pkcs11.Attribute) (bool, error) {
+	if err := h.ctx.FindObjectsInit(sess, attr); err != nil {
+		return false, err
+	}
+
+	defer h.ctx.FindObjectsFinal(sess)
+
+	obj, _, err := h.ctx.FindObjects(sess, 1)
+	if err != nil {
+		return false, err
+	}
+
+	return len(obj) > 0, nil
+}
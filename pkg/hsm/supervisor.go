@@ -0,0 +1,252 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ConnectionState is the state of the connection to the PKCS#11 module
+type ConnectionState string
+
+const (
+	StateConnected ConnectionState = "connected"
+	// StateReconnecting means the module is being finalized and initialized
+	// again after a fatal error
+	StateReconnecting ConnectionState = "reconnecting"
+	// StateDisconnected means the last reconnect failed, another one is
+	// attempted after a backoff
+	StateDisconnected ConnectionState = "disconnected"
+)
+
+type ConnectionStatus struct {
+	State ConnectionState `json:"state"`
+	// Since is when the connection entered State
+	Since     time.Time `json:"since"`
+	LastError string    `json:"lastError,omitempty"`
+	// Reconnects counts the successful reconnects since startup
+	Reconnects int `json:"reconnects"`
+	// Backends holds the status of every module of a multi backend HSM
+	Backends map[string]ConnectionStatus `json:"backends,omitempty"`
+}
+
+// ErrNotConnected is returned for sessions requested while the PKCS#11
+// module is being reconnected
+var ErrNotConnected = errors.New("hsm is not connected")
+
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 30 * time.Second
+	// sessionDrainTimeout is how long a reconnect waits for borrowed sessions
+	// to be released before finalizing the module under them
+	sessionDrainTimeout = 5 * time.Second
+)
+
+// WithHealthCheck probes the module every interval and reconnects when the
+// probe fails, so a dropped HSM is noticed before the next request hits it
+func WithHealthCheck(interval time.Duration) Option {
+	return func(h *hsm) {
+		h.healthInterval = interval
+	}
+}
+
+// supervisor tracks the connection state and reconnects the module after
+// fatal errors, retrying with an exponential backoff until it succeeds
+type supervisor struct {
+	reconnect func() error
+	probe     func() error
+	interval  time.Duration
+	stop      <-chan struct{}
+	trigger   chan struct{}
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu     sync.Mutex
+	status ConnectionStatus
+}
+
+func newSupervisor(reconnect, probe func() error, interval time.Duration, stop <-chan struct{}) *supervisor {
+	return &supervisor{
+		reconnect:  reconnect,
+		probe:      probe,
+		interval:   interval,
+		stop:       stop,
+		trigger:    make(chan struct{}, 1),
+		minBackoff: minReconnectBackoff,
+		maxBackoff: maxReconnectBackoff,
+		status:     ConnectionStatus{State: StateConnected, Since: time.Now()},
+	}
+}
+
+// Status returns the current connection status
+func (s *supervisor) Status() ConnectionStatus {
+	if s == nil {
+		return ConnectionStatus{State: StateConnected}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status
+}
+
+func (s *supervisor) connected() bool {
+	return s.Status().State == StateConnected
+}
+
+// fail starts a reconnect because of err. Errors seen while a reconnect is
+// already under way are ignored, they come from the old connection.
+func (s *supervisor) fail(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.status.State != StateConnected {
+		s.mu.Unlock()
+		return
+	}
+	s.setState(StateReconnecting, err)
+	s.mu.Unlock()
+
+	fmt.Println("hsm_supervisor: fatal error, reconnecting ", err)
+
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// setState must be called with mu held
+func (s *supervisor) setState(state ConnectionState, err error) {
+	if s.status.State != state {
+		s.status.Since = time.Now()
+	}
+
+	s.status.State = state
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+}
+
+func (s *supervisor) run() {
+	var probe <-chan time.Time
+	if s.interval > 0 {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		probe = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-probe:
+			if !s.connected() {
+				continue
+			}
+
+			if err := s.probe(); err != nil {
+				s.fail(err)
+			}
+		case <-s.trigger:
+			s.recover()
+		}
+	}
+}
+
+// recover reconnects until it succeeds or the supervisor is stopped
+func (s *supervisor) recover() {
+	backoff := s.minBackoff
+	for {
+		s.mu.Lock()
+		s.setState(StateReconnecting, nil)
+		s.mu.Unlock()
+
+		err := s.reconnect()
+		if err == nil {
+			s.mu.Lock()
+			s.setState(StateConnected, nil)
+			s.status.Reconnects++
+			s.mu.Unlock()
+
+			fmt.Println("hsm_supervisor: reconnected")
+			return
+		}
+
+		s.mu.Lock()
+		s.setState(StateDisconnected, err)
+		s.mu.Unlock()
+
+		fmt.Println("hsm_supervisor: reconnect failed, retrying in ", backoff, err)
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+// isModuleFatal reports whether err means the module has to be finalized and
+// initialized again before it can be used
+func isModuleFatal(err error) bool {
+	return isPKCS11Error(err,
+		pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+		pkcs11.CKR_DEVICE_REMOVED,
+	)
+}
+
+// checkFatal hands err to the supervisor when it is fatal for the module, and
+// returns err so callers can use it inline
+func (h *hsm) checkFatal(err error) error {
+	if isModuleFatal(err) {
+		h.supervisor.fail(err)
+	}
+
+	return err
+}
+
+// Status returns the state of the connection to the PKCS#11 module
+func (h *hsm) Status() ConnectionStatus {
+	return h.supervisor.Status()
+}
+
+// reconnect finalizes and initializes the module again, drops every session
+// of the old connection and rebuilds the index
+func (h *hsm) reconnect() error {
+	h.pool.drain(sessionDrainTimeout)
+
+	// the module may already consider itself finalized
+	h.ctx.Finalize()
+
+	if err := h.ctx.Initialize(); err != nil && !isPKCS11Error(err, pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return err
+	}
+
+	h.pool.reset()
+
+	report, err := h.refresh()
+	if err != nil {
+		return err
+	}
+
+	report.log()
+	return h.checkCapabilities()
+}
+
+// probe is the health check, listing the slots with a token touches the
+// module without needing a session
+func (h *hsm) probe() error {
+	_, err := h.ctx.GetSlotList(true)
+	return err
+}
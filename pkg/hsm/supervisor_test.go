@@ -0,0 +1,102 @@
+package hsm
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/suite"
+)
+
+type SupervisorSuite struct {
+	suite.Suite
+	stop chan struct{}
+}
+
+func TestSupervisorSuite(t *testing.T) {
+	suite.Run(t, new(SupervisorSuite))
+}
+
+func (s *SupervisorSuite) SetupTest() {
+	s.stop = make(chan struct{})
+}
+
+func (s *SupervisorSuite) TearDownTest() {
+	close(s.stop)
+}
+
+func (s *SupervisorSuite) newSupervisor(reconnect, probe func() error, interval time.Duration) *supervisor {
+	sup := newSupervisor(reconnect, probe, interval, s.stop)
+	sup.minBackoff = time.Millisecond
+	sup.maxBackoff = 4 * time.Millisecond
+	go sup.run()
+	return sup
+}
+
+func (s *SupervisorSuite) waitFor(sup *supervisor, state ConnectionState) ConnectionStatus {
+	s.Eventually(func() bool { return sup.Status().State == state }, time.Second, time.Millisecond)
+	return sup.Status()
+}
+
+func (s *SupervisorSuite) TestReconnectsAfterFatalError() {
+	var attempts int32
+	sup := s.newSupervisor(func() error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return errors.New("module unavailable")
+		}
+		return nil
+	}, nil, 0)
+
+	sup.fail(pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED))
+	s.False(sup.connected())
+
+	status := s.waitFor(sup, StateConnected)
+	s.Equal(int32(3), atomic.LoadInt32(&attempts))
+	s.Equal(1, status.Reconnects)
+	s.Equal("module unavailable", status.LastError)
+}
+
+func (s *SupervisorSuite) TestIgnoresErrorsWhileReconnecting() {
+	var attempts int32
+	release := make(chan struct{})
+	sup := s.newSupervisor(func() error {
+		atomic.AddInt32(&attempts, 1)
+		<-release
+		return nil
+	}, nil, 0)
+
+	sup.fail(pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED))
+	sup.fail(pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED))
+	close(release)
+
+	status := s.waitFor(sup, StateConnected)
+	s.Equal(int32(1), atomic.LoadInt32(&attempts))
+	s.Equal(1, status.Reconnects)
+}
+
+func (s *SupervisorSuite) TestHealthCheck() {
+	var healthy atomic.Value
+	healthy.Store(false)
+
+	sup := s.newSupervisor(func() error {
+		healthy.Store(true)
+		return nil
+	}, func() error {
+		if !healthy.Load().(bool) {
+			return errors.New("probe failed")
+		}
+		return nil
+	}, time.Millisecond)
+
+	s.Eventually(func() bool { return sup.Status().Reconnects == 1 }, time.Second, time.Millisecond)
+	s.Equal(StateConnected, sup.Status().State)
+}
+
+func (s *SupervisorSuite) TestIsModuleFatal() {
+	s.True(isModuleFatal(pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)))
+	s.True(isModuleFatal(pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED)))
+	s.False(isModuleFatal(pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)))
+	s.False(isModuleFatal(errors.New("device removed")))
+}
@@ -1,19 +1,21 @@
 package hsm
 
 import (
-	"bytes"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"encoding/asn1"
 	"errors"
+	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+	"github.com/miekg/pkcs11"
 )
 
 // asn1 object identiefier based on
 // http://oid-info.com/get/1.3.132.0.10
 func secp256k1OID() ([]byte, error) {
-	return asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 10})
+	return CurveSecp256k1.params()
 }
 
 func unmarshalEcPoint(b []byte, c elliptic.Curve) (*big.Int, *big.Int, error) {
@@ -34,15 +36,63 @@ func unmarshalEcPoint(b []byte, c elliptic.Curve) (*big.Int, *big.Int, error) {
 	return x, y, nil
 }
 
+func marshalEcPoint(c elliptic.Curve, x, y *big.Int) ([]byte, error) {
+	if x == nil || y == nil || !c.IsOnCurve(x, y) {
+		return nil, errors.New("elliptic curve point is not on the curve")
+	}
+
+	return asn1.Marshal(elliptic.Marshal(c, x, y))
+}
+
 func unmarshalEcParams(b []byte) (elliptic.Curve, error) {
-	oid, err := secp256k1OID()
+	curve, err := curveFromParams(b)
 	if err != nil {
 		return nil, err
 	}
 
-	if bytes.Equal(b, oid) {
+	switch curve {
+	case CurveSecp256k1:
 		return secp256k1.S256(), nil
+	case CurveP256:
+		return elliptic.P256(), nil
+	}
+
+	return nil, fmt.Errorf("ec params name %s, not an ECDSA curve", curve)
+}
+
+// unmarshalEdwardsPoint reads the CKA_EC_POINT of an Edwards curve key.
+// PKCS#11 v3.0 asks for a DER octet string, some tokens return the raw
+// 32 byte encoding.
+func unmarshalEdwardsPoint(b []byte) ([]byte, error) {
+	if len(b) == ed25519.PublicKeySize {
+		return b, nil
+	}
+
+	var point []byte
+	rest, err := asn1.Unmarshal(b, &point)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) > 0 || len(point) != ed25519.PublicKeySize {
+		return nil, errors.New("failed to parse edwards curve point")
+	}
+
+	return point, nil
+}
+
+// isPKCS11Error reports whether err is one of the given CKR_ return values
+func isPKCS11Error(err error, codes ...uint) bool {
+	var e pkcs11.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	for _, code := range codes {
+		if uint(e) == code {
+			return true
+		}
 	}
 
-	return nil, errors.New("ec params do not match secp256k1")
+	return false
 }
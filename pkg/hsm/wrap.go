@@ -0,0 +1,269 @@
+package hsm
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// WrappingKeyLabel is the CKA_LABEL of the RSA key pair each token uses to
+// receive wrapped keys
+const WrappingKeyLabel = "open_custodial_wrapping_key"
+
+// wrappingKeyBits is the modulus size of generated wrapping keys
+const wrappingKeyBits = 3072
+
+// WrapMechanism names how an imported private key was wrapped
+type WrapMechanism string
+
+const (
+	// WrapRSAOAEP is CKM_RSA_PKCS_OAEP with SHA-256 and MGF1-SHA256 under the
+	// token's wrapping key, see WrappingPublicKey
+	WrapRSAOAEP WrapMechanism = "rsa-oaep"
+	// WrapAESKeyWrapPad is CKM_AES_KEY_WRAP_PAD (RFC 5649) under an AES key
+	// encryption key provisioned on the token
+	WrapAESKeyWrapPad WrapMechanism = "aes-key-wrap-pad"
+)
+
+func (m WrapMechanism) Valid() bool {
+	return m == WrapRSAOAEP || m == WrapAESKeyWrapPad
+}
+
+func (m WrapMechanism) mechanism() []*pkcs11.Mechanism {
+	if m == WrapAESKeyWrapPad {
+		return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)}
+	}
+
+	params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, nil)
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}
+}
+
+// wrappingPublicKey returns the public half of the token's wrapping key,
+// generating the key pair on first use. Callers encrypt PKCS#8 encoded
+// private keys to it with RSA-OAEP to import them.
+func (h *hsm) wrappingPublicKey(session pkcs11.SessionHandle) (*rsa.PublicKey, error) {
+	pubHandle, err := h.findWithAttributes(session, wrappingKeyTemplate(pkcs11.CKO_PUBLIC_KEY))
+	if errors.Is(err, errObjectNotFound) {
+		pubHandle, err = h.ensureWrappingKey(session)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	}
+
+	attributes, err := h.ctx.GetAttributeValue(session, pubHandle, template)
+	if err != nil {
+		return nil, h.observe(session, err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attributes[0].Value),
+		E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+	}, nil
+}
+
+func wrappingKeyTemplate(class uint) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, WrappingKeyLabel),
+	}
+}
+
+// ensureWrappingKey generates the wrapping key of the session's token
+// unless a concurrent request generated it first
+func (h *hsm) ensureWrappingKey(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, error) {
+	info, err := h.ctx.GetSessionInfo(session)
+	if err != nil {
+		return 0, h.observe(session, err)
+	}
+
+	mu := h.wrapLock(info.SlotID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	pubHandle, err := h.findWithAttributes(session, wrappingKeyTemplate(pkcs11.CKO_PUBLIC_KEY))
+	if !errors.Is(err, errObjectNotFound) {
+		return pubHandle, err
+	}
+
+	return h.generateWrappingKey(session)
+}
+
+func (h *hsm) wrapLock(slotID uint) *sync.Mutex {
+	h.wrapMu.Lock()
+	defer h.wrapMu.Unlock()
+
+	if h.wrapLocks == nil {
+		h.wrapLocks = make(map[uint]*sync.Mutex)
+	}
+
+	mu, ok := h.wrapLocks[slotID]
+	if !ok {
+		mu = new(sync.Mutex)
+		h.wrapLocks[slotID] = mu
+	}
+
+	return mu
+}
+
+// generateWrappingKey generates the wrapping key pair, both halves share a
+// random CKA_ID so the private key matching the public one can be found
+func (h *hsm) generateWrappingKey(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return 0, err
+	}
+
+	pubTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, wrappingKeyBits),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, WrappingKeyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+
+	privTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, WrappingKeyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}
+
+	pub, _, err := h.ctx.GenerateKeyPair(session, mech, pubTemplate, privTemplate)
+	return pub, h.observe(session, err)
+}
+
+// rsaUnwrappingKey returns the private half of the wrapping key
+// wrappingPublicKey hands out, matched by CKA_ID. Pairs generated before
+// they carried one are matched by label only.
+func (h *hsm) rsaUnwrappingKey(session pkcs11.SessionHandle) (pkcs11.ObjectHandle, error) {
+	pubHandle, err := h.findWithAttributes(session, wrappingKeyTemplate(pkcs11.CKO_PUBLIC_KEY))
+	if err != nil {
+		return 0, err
+	}
+
+	attributes, err := h.ctx.GetAttributeValue(session, pubHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return 0, h.observe(session, err)
+	}
+
+	template := wrappingKeyTemplate(pkcs11.CKO_PRIVATE_KEY)
+	if id := attributes[0].Value; len(id) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+
+	return h.findWithAttributes(session, template)
+}
+
+// unwrapKeyECDSA_secp256k1 unwraps a PKCS#8 encoded secp256k1 private key
+// straight into the session's token as a sensitive key labeled key, which is
+// non extractable unless backup mode is on. RSA-OAEP uses the token's
+// wrapping key, AES key wrap uses the secret key labeled kek.
+func (h *hsm) unwrapKeyECDSA_secp256k1(session pkcs11.SessionHandle, mech WrapMechanism, kek KeyID, wrapped []byte, key KeyID) (pkcs11.ObjectHandle, error) {
+	if err := h.checkKeyLabel(key); err != nil {
+		return 0, err
+	}
+
+	unwrapping, err := h.unwrappingKey(session, mech, kek)
+	if err != nil {
+		return 0, err
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+	}
+
+	template = append(template, h.privateKeyPolicy()...)
+	priv, err := h.ctx.UnwrapKey(session, mech.mechanism(), unwrapping, wrapped, append(template, key.template()...))
+	return priv, h.observe(session, err)
+}
+
+func (h *hsm) unwrappingKey(session pkcs11.SessionHandle, mech WrapMechanism, kek KeyID) (pkcs11.ObjectHandle, error) {
+	switch mech {
+	case WrapRSAOAEP:
+		return h.rsaUnwrappingKey(session)
+	case WrapAESKeyWrapPad:
+		if kek == "" {
+			return 0, errors.New("aes key wrap needs the label of a key encryption key")
+		}
+
+		return h.findWithAttributes(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, string(kek)),
+			pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		})
+	}
+
+	return 0, fmt.Errorf("unknown wrap mechanism %s", mech)
+}
+
+// createPublicKeyECDSA_secp256k1 stores the public half of an imported key
+// next to it, so the key can be looked up like a generated one.
+func (h *hsm) createPublicKeyECDSA_secp256k1(session pkcs11.SessionHandle, pub ecdsa.PublicKey, key KeyID) (pkcs11.ObjectHandle, error) {
+	oid, err := secp256k1OID()
+	if err != nil {
+		return 0, err
+	}
+
+	point, err := marshalEcPoint(pub.Curve, pub.X, pub.Y)
+	if err != nil {
+		return 0, err
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, oid),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+	}
+
+	obj, err := h.ctx.CreateObject(session, append(template, key.template()...))
+	if err != nil {
+		return 0, h.observe(session, err)
+	}
+
+	if key != "" {
+		if err := h.indexKey(session, key); err != nil {
+			return obj, err
+		}
+	}
+
+	return obj, nil
+}
+
+func (h *hsm) destroyObject(session pkcs11.SessionHandle, obj pkcs11.ObjectHandle) error {
+	return h.observe(session, h.ctx.DestroyObject(session, obj))
+}
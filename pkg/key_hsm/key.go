@@ -0,0 +1,201 @@
+package key_hsm
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"open_custodial/pkg/_err"
+	"open_custodial/pkg/hsm"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/miekg/pkcs11"
+)
+
+// CreateKey creates a key pair on curve labeled label in a token of its own
+// and returns its public key, an *ecdsa.PublicKey or an ed25519.PublicKey.
+func CreateKey(ctx context.Context, h hsm.HSM, label string, curve hsm.Curve) (pub crypto.PublicKey, err error) {
+	if !curve.Valid() {
+		return nil, fmt.Errorf("unknown curve %s", curve)
+	}
+
+	if _, err := h.LocateKey(ctx, label); err == nil {
+		return nil, _err.NewDuplicateLabelErr(label)
+	}
+
+	if _, err := h.NewSlot(ctx, label); err != nil {
+		// the module keeps creating a token the call gave up on, do not let
+		// it hold the label
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			if discardErr := h.DiscardSlot(context.Background(), label); discardErr != nil {
+				fmt.Println("create_key: failed to discard abandoned token ", discardErr)
+			}
+		}
+
+		return nil, err
+	}
+
+	pub, err = generateKey(ctx, h, label, curve)
+	if err != nil {
+		// do not leave an empty token behind under the label, even when ctx
+		// is what failed
+		if discardErr := h.DiscardSlot(context.Background(), label); discardErr != nil {
+			fmt.Println("create_key: failed to discard token ", discardErr)
+		}
+
+		return nil, err
+	}
+
+	return pub, nil
+}
+
+func generateKey(ctx context.Context, h hsm.HSM, label string, curve hsm.Curve) (crypto.PublicKey, error) {
+	sess, err := h.NewSlotSession(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+
+	defer h.EndSession(sess)
+
+	var pubHandle pkcs11.ObjectHandle
+	switch curve {
+	case hsm.CurveSecp256k1:
+		pubHandle, _, err = h.GenerateKeyECDSA_secp256k1(ctx, *sess, hsm.KeyID(label))
+	case hsm.CurveEd25519:
+		pubHandle, _, err = h.GenerateKeyEdDSA_ed25519(ctx, *sess, hsm.KeyID(label))
+	case hsm.CurveP256:
+		pubHandle, _, err = h.GenerateKeyECDSA_P256(ctx, *sess, hsm.KeyID(label))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return publicKey(ctx, h, *sess, curve, pubHandle)
+}
+
+// GetPublicKey returns the curve and public key of the key labeled label
+func GetPublicKey(ctx context.Context, h hsm.HSM, label string) (curve hsm.Curve, pub crypto.PublicKey, err error) {
+	loc, err := h.LocateKey(ctx, label)
+	if err != nil {
+		return curve, nil, err
+	}
+
+	sess, err := h.NewReadOnlySlotSession(ctx, loc.Token)
+	if err != nil {
+		return curve, nil, err
+	}
+
+	defer h.EndSession(sess)
+
+	pubHandle, err := h.PublicKeyHandle(ctx, *sess, loc.Key)
+	if err != nil {
+		return curve, nil, err
+	}
+
+	curve, err = h.KeyCurve(ctx, *sess, pubHandle)
+	if err != nil {
+		return curve, nil, err
+	}
+
+	pub, err = publicKey(ctx, h, *sess, curve, pubHandle)
+	return curve, pub, err
+}
+
+// Sign signs msg with the key labeled label. P-256 keys hash msg with
+// SHA-256 and return an ASN.1 signature, Ed25519 keys sign msg itself.
+// secp256k1 keys sign through eth_hsm, which applies Ethereum's rules.
+func Sign(ctx context.Context, h hsm.HSM, label string, msg []byte) ([]byte, error) {
+	loc, err := h.LocateKey(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := h.NewSlotSession(ctx, loc.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer h.EndSession(sess)
+
+	privHandle, err := h.PrivateKeyHandle(ctx, *sess, loc.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	curve, err := h.KeyCurve(ctx, *sess, privHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	switch curve {
+	case hsm.CurveP256:
+		return h.SignECDSA_P256(ctx, msg, *sess, privHandle)
+	case hsm.CurveEd25519:
+		return h.SignEdDSA_ed25519(ctx, msg, *sess, privHandle)
+	}
+
+	return nil, fmt.Errorf("%s keys can not sign arbitrary messages", curve)
+}
+
+func publicKey(ctx context.Context, h hsm.HSM, sess pkcs11.SessionHandle, curve hsm.Curve, pubHandle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	if curve == hsm.CurveEd25519 {
+		return h.GetPublicKeyEdDSA_ed25519(ctx, sess, pubHandle)
+	}
+
+	pub, err := h.GetPublicKey(ctx, sess, pubHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pub, nil
+}
+
+// MarshalPublicKeyPEM encodes pub as a PEM SubjectPublicKeyInfo. x509 does
+// not know secp256k1, so those keys are encoded by hand.
+func MarshalPublicKeyPEM(pub crypto.PublicKey) (string, error) {
+	der, err := marshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// subjectPublicKeyInfo is the structure from RFC 5280
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+var (
+	// http://oid-info.com/get/1.2.840.10045.2.1
+	oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	// http://oid-info.com/get/1.3.132.0.10
+	oidSecp256k1 = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+)
+
+func marshalPKIXPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok || key.Curve.Params().P.Cmp(ethcrypto.S256().Params().P) != 0 {
+		return x509.MarshalPKIXPublicKey(pub)
+	}
+
+	params, err := asn1.Marshal(oidSecp256k1)
+	if err != nil {
+		return nil, err
+	}
+
+	point := ethcrypto.FromECDSAPub(key)
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPublicKeyECDSA,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+}
@@ -0,0 +1,180 @@
+package key_hsm
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"open_custodial/pkg/_err"
+	eth "open_custodial/pkg/eth_hsm"
+	"open_custodial/pkg/hsm"
+	hsm_mem "open_custodial/pkg/hsm/memory"
+
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/suite"
+)
+
+type KeySuite struct {
+	suite.Suite
+	hsm *hsm_mem.HSM
+}
+
+func TestKeySuite(t *testing.T) {
+	suite.Run(t, new(KeySuite))
+}
+
+func (s *KeySuite) SetupTest() {
+	s.hsm = hsm_mem.New()
+}
+
+func (s *KeySuite) TestP256() {
+	created, err := CreateKey(context.Background(), s.hsm, "test_p256", hsm.CurveP256)
+	s.NoError(err)
+
+	curve, pub, err := GetPublicKey(context.Background(), s.hsm, "test_p256")
+	s.NoError(err)
+	s.Equal(hsm.CurveP256, curve)
+	s.Equal(created, pub)
+
+	key, ok := pub.(*ecdsa.PublicKey)
+	s.True(ok)
+	s.Equal(elliptic.P256(), key.Curve)
+
+	msg := []byte("test_p256")
+	sig, err := Sign(context.Background(), s.hsm, "test_p256", msg)
+	s.NoError(err)
+
+	digest := sha256.Sum256(msg)
+	s.True(ecdsa.VerifyASN1(key, digest[:], sig))
+
+	// P-256 keys never turn into Ethereum addresses
+	_, err = eth.GetAddress(context.Background(), s.hsm, "test_p256")
+	s.Error(err)
+	s.Zero(s.hsm.OpenSessions())
+}
+
+func (s *KeySuite) TestEd25519() {
+	_, err := CreateKey(context.Background(), s.hsm, "test_ed25519", hsm.CurveEd25519)
+	s.NoError(err)
+
+	curve, pub, err := GetPublicKey(context.Background(), s.hsm, "test_ed25519")
+	s.NoError(err)
+	s.Equal(hsm.CurveEd25519, curve)
+
+	msg := []byte("test_ed25519")
+	sig, err := Sign(context.Background(), s.hsm, "test_ed25519", msg)
+	s.NoError(err)
+	s.True(ed25519.Verify(pub.(ed25519.PublicKey), msg, sig))
+}
+
+func (s *KeySuite) TestSecp256k1() {
+	_, err := CreateKey(context.Background(), s.hsm, "test_secp256k1", hsm.CurveSecp256k1)
+	s.NoError(err)
+
+	_, err = eth.GetAddress(context.Background(), s.hsm, "test_secp256k1")
+	s.NoError(err)
+
+	_, err = Sign(context.Background(), s.hsm, "test_secp256k1", []byte("test_secp256k1"))
+	s.Error(err)
+
+	_, err = CreateKey(context.Background(), s.hsm, "test_secp256k1", hsm.CurveP256)
+	s.IsType(_err.DuplicateLabel{}, err)
+
+	_, err = CreateKey(context.Background(), s.hsm, "test_unknown", hsm.Curve("secp384r1"))
+	s.Error(err)
+}
+
+func (s *KeySuite) TestMarshalPublicKeyPEM() {
+	for _, curve := range hsm.Curves {
+		pub, err := CreateKey(context.Background(), s.hsm, "test_pem_"+string(curve), curve)
+		s.NoError(err)
+
+		encoded, err := MarshalPublicKeyPEM(pub)
+		s.NoError(err)
+
+		block, _ := pem.Decode([]byte(encoded))
+		s.NotNil(block)
+		s.Equal("PUBLIC KEY", block.Type)
+
+		if curve == hsm.CurveSecp256k1 {
+			continue
+		}
+
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		s.NoError(err)
+		s.Equal(pub, parsed)
+	}
+}
+
+func (s *KeySuite) TestSignerCSR() {
+	_, err := CreateKey(context.Background(), s.hsm, "test_signer_p256", hsm.CurveP256)
+	s.NoError(err)
+
+	signer, err := hsm.NewSigner(context.Background(), s.hsm, "test_signer_p256")
+	s.NoError(err)
+	s.Equal(hsm.CurveP256, signer.Curve())
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "test_signer_p256"},
+	}, signer)
+	s.NoError(err)
+
+	csr, err := x509.ParseCertificateRequest(der)
+	s.NoError(err)
+	s.NoError(csr.CheckSignature())
+	s.Equal(signer.Public(), csr.PublicKey)
+
+	_, err = signer.Sign(rand.Reader, []byte("short"), crypto.SHA256)
+	s.Error(err)
+	s.Zero(s.hsm.OpenSessions())
+}
+
+func (s *KeySuite) TestSignerEd25519() {
+	_, err := CreateKey(context.Background(), s.hsm, "test_signer_ed25519", hsm.CurveEd25519)
+	s.NoError(err)
+
+	signer, err := hsm.NewSigner(context.Background(), s.hsm, "test_signer_ed25519")
+	s.NoError(err)
+
+	msg := []byte("test_signer_ed25519")
+	sig, err := signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	s.NoError(err)
+	s.True(ed25519.Verify(signer.Public().(ed25519.PublicKey), msg, sig))
+
+	_, err = signer.Sign(rand.Reader, msg, crypto.SHA512)
+	s.Error(err)
+}
+
+func (s *KeySuite) TestSignerSecp256k1() {
+	_, err := CreateKey(context.Background(), s.hsm, "test_signer_secp256k1", hsm.CurveSecp256k1)
+	s.NoError(err)
+
+	signer, err := hsm.NewSigner(context.Background(), s.hsm, "test_signer_secp256k1")
+	s.NoError(err)
+
+	digest := sha256.Sum256([]byte("test_signer_secp256k1"))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	s.NoError(err)
+
+	var rs struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(sig, &rs)
+	s.NoError(err)
+
+	raw := make([]byte, 64)
+	rs.R.FillBytes(raw[:32])
+	rs.S.FillBytes(raw[32:])
+
+	pub := signer.Public().(*ecdsa.PublicKey)
+	s.True(ethcrypto.VerifySignature(ethcrypto.FromECDSAPub(pub), digest[:], raw))
+	s.Zero(s.hsm.OpenSessions())
+}